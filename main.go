@@ -4,20 +4,30 @@ import (
 	"archive/zip"
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"image"
-	_ "image/gif"
-	_ "image/jpeg"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
 	"image/png"
 	"io"
 	"log"
+	"math"
 	"mime/multipart"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
+	"reflect"
 	"regexp"
 	"sort"
 	"strconv"
@@ -25,6 +35,7 @@ import (
 	"sync"
 	"sync/atomic"
 	"time"
+	"unicode/utf8"
 
 	_ "golang.org/x/image/bmp"
 	_ "golang.org/x/image/tiff"
@@ -36,6 +47,7 @@ import (
 
 	"business2api/src/adminauth"
 	"business2api/src/adminlogs"
+	"business2api/src/audit"
 	"business2api/src/flow"
 	"business2api/src/logger"
 	"business2api/src/pool"
@@ -62,8 +74,25 @@ type PoolConfig struct {
 	BrowserRefreshHeadless bool     `json:"browser_refresh_headless"`  // 浏览器刷新无头模式
 	BrowserRefreshMaxRetry int      `json:"browser_refresh_max_retry"` // 浏览器刷新最大重试次数(0=禁用)
 	AutoDelete401          bool     `json:"auto_delete_401"`           // 401时自动删除账号
+	AutoDeleteMinFailures  int      `json:"auto_delete_min_failures"`  // 401自动删除前需连续失败次数(0=默认3)
+	AutoDeleteGraceMinutes int      `json:"auto_delete_grace_minutes"` // 401自动删除前需持续失败分钟数(0=默认10, <0=不要求)
 	ExternalRefreshMode    bool     `json:"external_refresh_mode"`     // 启用外部续期模式
 	RegistrarBaseURL       string   `json:"registrar_base_url"`        // Python registrar 地址
+	JWTRefreshMarginSec    int      `json:"jwt_refresh_margin_sec"`    // JWT到期前主动刷新余量(秒, <0=禁用)
+	JWTTTLSec              int      `json:"jwt_ttl_sec"`               // JWT有效期(秒, 0=默认270)
+	MaxConcurrentGen       int      `json:"max_concurrent_gen"`        // 最大并发生成数(0=按就绪账号数自动, <0=不限制)
+	GenQueueTimeoutSec     int      `json:"gen_queue_timeout_sec"`     // 并发已满时排队等待时间(秒, <0=直接拒绝)
+	MaxImageN              int      `json:"max_image_n"`               // /v1/images/generations 单次最多生成张数
+	BulkRefreshThreads     int      `json:"bulk_refresh_threads"`      // 批量浏览器刷新并发数
+	HeartbeatIntervalSec   int      `json:"heartbeat_interval_sec"`    // 等待上游期间心跳间隔(秒, <0=禁用)
+	MaxMediaBytes          int64    `json:"max_media_bytes"`           // 单个图片/视频最大字节数(0=默认20MB, <0=不限制)
+	IPStatsRetentionDays   int      `json:"ip_stats_retention_days"`   // IP 统计持久化保留天数
+	IPStatsMaxEntries      int      `json:"ip_stats_max_entries"`      // IP 统计最多保留的 IP 数
+	MediaFetchTimeoutSec   int      `json:"media_fetch_timeout_sec"`   // 单次媒体下载超时(秒, <0=不单独限制)
+	ImageConvertPolicy     string   `json:"image_convert_policy"`      // 非 PNG/JPEG 图片转换策略: to_png / keep_original / to_jpeg_quality:N
+	StorageBackend         string   `json:"storage_backend"`           // 账号存储后端: file (默认)
+	MaxRequestBytes        int64    `json:"max_request_bytes"`         // API 请求体最大字节数(0=默认50MB, <0=不限制)
+	HealthCheckThreads     int      `json:"health_check_threads"`      // 批量账号健康检查并发数
 }
 
 // FlowConfig Flow 服务配置
@@ -74,30 +103,210 @@ type FlowConfigSection struct {
 	Timeout         int      `json:"timeout"`           // 超时时间
 	PollInterval    int      `json:"poll_interval"`     // 轮询间隔
 	MaxPollAttempts int      `json:"max_poll_attempts"` // 最大轮询次数
+	AuthRetry       int      `json:"auth_retry"`        // 认证失败切换 Token 重试次数 (0=默认2, <0=不重试)
+	DisableWebhook  string   `json:"disable_webhook"`   // Token 被禁用时通知的 Webhook 地址
 }
 
 // ProxyConfig 代理配置
 type ProxyConfig struct {
-	Proxy          string   `json:"proxy"`            // 单个代理 (http/socks5)
-	Subscribes     []string `json:"subscribes"`       // 订阅链接列表
-	Files          []string `json:"files"`            // 代理文件列表
-	HealthCheck    bool     `json:"health_check"`     // 是否启用健康检查
-	CheckOnStartup bool     `json:"check_on_startup"` // 启动时检查
+	Proxy           string   `json:"proxy"`                // 单个代理 (http/socks5)
+	Subscribes      []string `json:"subscribes"`           // 订阅链接列表
+	Files           []string `json:"files"`                // 代理文件列表
+	HealthCheck     bool     `json:"health_check"`         // 是否启用健康检查
+	CheckOnStartup  bool     `json:"check_on_startup"`     // 启动时检查
+	Sticky          bool     `json:"sticky"`               // 账号粘性代理：刷新时优先使用上次成功的节点
+	BlacklistRate   float64  `json:"blacklist_rate"`       // 真实请求失败率达到该值时拉黑节点(0=默认0.8, <0=禁用)
+	BlacklistMin    int      `json:"blacklist_min"`        // 判定失败率所需的最少请求数(0=默认5)
+	MinHealthy      int      `json:"min_healthy_proxies"`  // 代理池就绪所需的最少健康节点数(0=默认1)
+	ReadyTimeout    int      `json:"ready_timeout_sec"`    // 注册/续期等待代理就绪的超时(秒, 0=默认30)，超时后使用静态代理
+	FailureCooldown int      `json:"failure_cooldown_sec"` // 真实请求失败后节点降权时长(秒, 0=默认300, <0=禁用)
+}
+
+// CircuitBreakerConfig 熔断配置（大面积失败时暂停转发，避免重试放大负载）
+type CircuitBreakerConfig struct {
+	FailureRate float64 `json:"failure_rate"` // 触发熔断的失败率(0-1, <0=禁用)
+	WindowSec   int     `json:"window_sec"`   // 失败率统计窗口(秒)
+	MinRequests int     `json:"min_requests"` // 窗口内最少请求数，低于此值不触发
+	CooldownSec int     `json:"cooldown_sec"` // 熔断持续时间(秒)
+}
+
+// RateLimitConfig 按客户端 IP 的请求频率限制
+type RateLimitConfig struct {
+	PerIPRPM  int      `json:"per_ip_rpm"` // 单 IP 每分钟最多请求数 (0=不限制)
+	Whitelist []string `json:"whitelist"`  // 不受限制的 IP / CIDR
+}
+
+// 上游默认地址
+const (
+	defaultUpstreamAPIBaseURL = "https://biz-discoveryengine.googleapis.com"
+	defaultUpstreamOrigin     = "https://business.gemini.google"
+	defaultUpstreamUserAgent  = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/140.0.0.0 Safari/537.36"
+)
+
+// x-original-authorization 透传策略
+const (
+	origAuthPassthroughAuto   = "auto"   // 跳过 fallback-csesidx 占位值（默认）
+	origAuthPassthroughAlways = "always" // 有值就透传
+	origAuthPassthroughNever  = "never"  // 从不透传
+)
+
+// DefaultModelsConfig 各 API 路径未指定 model 时使用的默认模型，留空时使用 default_model
+type DefaultModelsConfig struct {
+	OpenAI string `json:"openai"` // /v1/chat/completions
+	Claude string `json:"claude"` // /v1/messages
+	Gemini string `json:"gemini"` // /v1beta/models/*action
+}
+
+// UpstreamConfig 上游地址配置（区域端点或镜像）
+// 地址修改后需重启；透传策略与请求头覆盖支持热重载
+type UpstreamConfig struct {
+	APIBaseURL          string `json:"api_base_url"`          // Discovery Engine API 地址
+	Origin              string `json:"origin"`                // 业务站点 Origin/Referer
+	OrigAuthPassthrough string `json:"orig_auth_passthrough"` // x-original-authorization 透传: auto / always / never
+	Referer             string `json:"referer"`               // 覆盖 referer 请求头，为空使用 origin + "/"
+	UserAgent           string `json:"user_agent"`            // 覆盖 user-agent 请求头
+}
+
+// validateUpstreamConfig 校验并规范化上游地址（去掉末尾斜杠，空值使用默认值）
+func validateUpstreamConfig(cfg *UpstreamConfig) error {
+	fields := []struct {
+		name  string
+		value *string
+		def   string
+	}{
+		{"upstream.api_base_url", &cfg.APIBaseURL, defaultUpstreamAPIBaseURL},
+		{"upstream.origin", &cfg.Origin, defaultUpstreamOrigin},
+	}
+	for _, f := range fields {
+		v := strings.TrimRight(strings.TrimSpace(*f.value), "/")
+		if v == "" {
+			v = f.def
+		}
+		u, err := url.Parse(v)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.RawQuery != "" || u.Fragment != "" {
+			return fmt.Errorf("%s 无效: %q（需为 http/https 地址，不含查询参数）", f.name, *f.value)
+		}
+		*f.value = v
+	}
+
+	switch policy := strings.ToLower(strings.TrimSpace(cfg.OrigAuthPassthrough)); policy {
+	case "":
+		cfg.OrigAuthPassthrough = origAuthPassthroughAuto
+	case origAuthPassthroughAuto, origAuthPassthroughAlways, origAuthPassthroughNever:
+		cfg.OrigAuthPassthrough = policy
+	default:
+		return fmt.Errorf("upstream.orig_auth_passthrough 无效: %q（支持 auto/always/never）", cfg.OrigAuthPassthrough)
+	}
+	cfg.Referer = strings.TrimSpace(cfg.Referer)
+	if cfg.Referer != "" {
+		u, err := url.Parse(cfg.Referer)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("upstream.referer 无效: %q（需为 http/https 地址）", cfg.Referer)
+		}
+	}
+	cfg.UserAgent = strings.TrimSpace(cfg.UserAgent)
+	return nil
+}
+
+// upstreamAPIURL 拼接上游 API 地址
+func upstreamAPIURL(path string) string {
+	configMu.RLock()
+	base := appConfig.Upstream.APIBaseURL
+	configMu.RUnlock()
+	if base == "" {
+		base = defaultUpstreamAPIBaseURL
+	}
+	return base + path
+}
+
+// upstreamOrigin 获取上游业务站点 Origin
+func upstreamOrigin() string {
+	configMu.RLock()
+	origin := appConfig.Upstream.Origin
+	configMu.RUnlock()
+	if origin == "" {
+		return defaultUpstreamOrigin
+	}
+	return origin
+}
+
+// upstreamHeaderSettings 获取透传策略与 referer/user-agent 请求头（未配置时使用默认值）
+func upstreamHeaderSettings() (passthrough, referer, userAgent string) {
+	configMu.RLock()
+	cfg := appConfig.Upstream
+	configMu.RUnlock()
+	passthrough = cfg.OrigAuthPassthrough
+	if passthrough == "" {
+		passthrough = origAuthPassthroughAuto
+	}
+	referer = cfg.Referer
+	if referer == "" {
+		origin := cfg.Origin
+		if origin == "" {
+			origin = defaultUpstreamOrigin
+		}
+		referer = origin + "/"
+	}
+	userAgent = cfg.UserAgent
+	if userAgent == "" {
+		userAgent = defaultUpstreamUserAgent
+	}
+	return passthrough, referer, userAgent
+}
+
+// shouldPassOrigAuth 按透传策略决定是否携带 x-original-authorization
+func shouldPassOrigAuth(policy, origAuth string) bool {
+	if origAuth == "" {
+		return false
+	}
+	switch policy {
+	case origAuthPassthroughAlways:
+		return true
+	case origAuthPassthroughNever:
+		return false
+	default:
+		return !strings.HasPrefix(strings.ToLower(origAuth), "bearer fallback-csesidx-")
+	}
+}
+
+// AuditConfig 请求审计日志（写入 data/audit/，默认关闭）
+type AuditConfig struct {
+	Enable     bool    `json:"enable"`      // 是否启用审计日志
+	SampleRate float64 `json:"sample_rate"` // 采样率(0-1, 0=全部记录)
 }
 
 type AppConfig struct {
-	APIKeys        []string              `json:"api_keys"`        // API 密钥列表
-	ListenAddr     string                `json:"listen_addr"`     // 监听地址
-	DataDir        string                `json:"data_dir"`        // 数据目录
-	Pool           PoolConfig            `json:"pool"`            // 号池配置
-	Proxy          string                `json:"proxy"`           // 代理 (兼容旧配置)
-	ProxySubscribe string                `json:"proxy_subscribe"` // 代理订阅链接 (兼容旧配置)
-	ProxyPool      ProxyConfig           `json:"proxy_pool"`      // 代理池配置
-	DefaultConfig  string                `json:"default_config"`  // 默认 configId
-	PoolServer     pool.PoolServerConfig `json:"pool_server"`     // 号池服务器配置
-	Debug          bool                  `json:"debug"`           // 调试模式
-	Flow           FlowConfigSection     `json:"flow"`            // Flow 配置
-	Note           []string              `json:"note"`            // 备注信息（支持多行）
+	APIKeys            []string              `json:"api_keys"`              // API 密钥列表
+	ListenAddr         string                `json:"listen_addr"`           // 监听地址
+	DataDir            string                `json:"data_dir"`              // 数据目录
+	Pool               PoolConfig            `json:"pool"`                  // 号池配置
+	Proxy              string                `json:"proxy"`                 // 代理 (兼容旧配置)
+	ProxySubscribe     string                `json:"proxy_subscribe"`       // 代理订阅链接 (兼容旧配置)
+	ProxyPool          ProxyConfig           `json:"proxy_pool"`            // 代理池配置
+	DefaultConfig      string                `json:"default_config"`        // 默认 configId
+	ConfigIDs          []string              `json:"config_ids"`            // 额外 configId（账号未配置 configId 时与 default_config 一起使用）
+	ConfigIDPolicy     string                `json:"config_id_policy"`      // configId 选择策略: bound（默认，固定账号 configId）/ round_robin（轮换）
+	PoolServer         pool.PoolServerConfig `json:"pool_server"`           // 号池服务器配置
+	Debug              bool                  `json:"debug"`                 // 调试模式
+	LogLevel           string                `json:"log_level"`             // 最低日志级别 error/warn/info/debug（debug=true 时为 debug）
+	Flow               FlowConfigSection     `json:"flow"`                  // Flow 配置
+	CircuitBreaker     CircuitBreakerConfig  `json:"circuit_breaker"`       // 熔断配置
+	RateLimit          RateLimitConfig       `json:"rate_limit"`            // 单 IP 限流配置
+	Audit              AuditConfig           `json:"audit"`                 // 请求审计日志配置
+	Upstream           UpstreamConfig        `json:"upstream"`              // 上游地址配置
+	TrustedProxies     []string              `json:"trusted_proxies"`       // 可信反代 IP / CIDR
+	ClientIPHeader     string                `json:"client_ip_header"`      // 真实客户端 IP 请求头 (如 CF-Connecting-IP)
+	RawStdout          bool                  `json:"raw_stdout"`            // 关闭 stdout 过滤管道，直接输出（也可用环境变量 RAW_STDOUT=1）
+	ModelTags          map[string]string     `json:"model_tags"`            // 模型 → 账号标签路由（键为模型名或 text/image/video）
+	ConfigBackups      int                   `json:"config_backups"`        // data/config-backups 中保留的配置备份数（0=默认10，<0=不写磁盘）
+	ReasoningOutput    string                `json:"reasoning_output"`      // 思考内容输出: separate（默认）/ none / think
+	GlobalSystemPrefix string                `json:"global_system_prefix"`  // 全局系统提示词前缀（置于请求系统提示词之前）
+	GlobalSystemSuffix string                `json:"global_system_suffix"`  // 全局系统提示词后缀（置于请求系统提示词之后）
+	DefaultModel       string                `json:"default_model"`         // 请求未指定 model 时的默认模型（空=gemini-2.5-flash）
+	DefaultModels      DefaultModelsConfig   `json:"default_models"`        // 按 API 路径覆盖默认模型
+	ModelFallbacks     map[string][]string   `json:"model_fallbacks"`       // 模型 → 回退模型列表（请求模型重试耗尽后依次尝试）
+	ModelFallbackNote  bool                  `json:"model_fallback_notice"` // 使用回退模型时在响应中注明（响应头 X-Model-Fallback / 流式提示）
+	Note               []string              `json:"note"`                  // 备注信息（支持多行）
 }
 
 // PoolMode 号池模式
@@ -118,6 +327,7 @@ var (
 	panelAuthStore   *adminauth.Store
 	panelSessions    *adminauth.SessionManager
 	logStreamHandler gin.HandlerFunc
+	logWSHandler     gin.HandlerFunc
 	panelAuthMu      sync.Mutex
 	panelAuthDataDir string
 )
@@ -140,6 +350,8 @@ type APIStats struct {
 	outputTokens    int64                  // 输出 tokens
 	imageGenerated  int64                  // 生成的图片数
 	videoGenerated  int64                  // 生成的视频数
+	fallbackUsed    int64                  // 切换到回退模型的请求数
+	fallbackSuccess int64                  // 回退模型成功完成的请求数
 	requestTimes    []time.Time            // 最近请求时间（用于计算 RPM）
 	modelStats      map[string]*ModelStats // 每个模型的统计
 	hourlyStats     [24]HourlyStats        // 24小时统计
@@ -175,6 +387,78 @@ var apiStats = &APIStats{
 type IPStats struct {
 	mu         sync.RWMutex
 	ipRequests map[string]*IPRequestInfo
+	evicted    ipEvictedStats // 已淘汰 IP 的累计统计
+}
+
+// ipEvictedStats 被淘汰 IP 的累计统计，保证总量不因淘汰而丢失
+type ipEvictedStats struct {
+	IPs          int64 `json:"ips"`
+	TotalCount   int64 `json:"total_count"`
+	SuccessCount int64 `json:"success_count"`
+	FailedCount  int64 `json:"failed_count"`
+	InputTokens  int64 `json:"input_tokens"`
+	OutputTokens int64 `json:"output_tokens"`
+	ImagesCount  int64 `json:"images_count"`
+	VideosCount  int64 `json:"videos_count"`
+}
+
+// add 将单个 IP 的统计并入淘汰桶
+func (e *ipEvictedStats) add(info *IPRequestInfo) {
+	e.IPs++
+	e.TotalCount += info.TotalCount
+	e.SuccessCount += info.SuccessCount
+	e.FailedCount += info.FailedCount
+	e.InputTokens += info.InputTokens
+	e.OutputTokens += info.OutputTokens
+	e.ImagesCount += info.ImagesCount
+	e.VideosCount += info.VideosCount
+}
+
+// merge 合并另一个淘汰桶
+func (e *ipEvictedStats) merge(other ipEvictedStats) {
+	e.IPs += other.IPs
+	e.TotalCount += other.TotalCount
+	e.SuccessCount += other.SuccessCount
+	e.FailedCount += other.FailedCount
+	e.InputTokens += other.InputTokens
+	e.OutputTokens += other.OutputTokens
+	e.ImagesCount += other.ImagesCount
+	e.VideosCount += other.VideosCount
+}
+
+// defaultIPStatsMaxEntries IP 统计默认最多保留的 IP 数
+const defaultIPStatsMaxEntries = 10000
+
+// ipStatsMaxEntries 获取 IP 统计容量上限
+func ipStatsMaxEntries() int {
+	configMu.RLock()
+	limit := appConfig.Pool.IPStatsMaxEntries
+	configMu.RUnlock()
+	if limit <= 0 {
+		return defaultIPStatsMaxEntries
+	}
+	return limit
+}
+
+// evictLocked 超出容量时按 LastSeen 淘汰最久未出现的 IP（一次淘汰到容量的 90%，避免每个新 IP 都全量扫描）
+func (s *IPStats) evictLocked(limit int) {
+	if len(s.ipRequests) <= limit {
+		return
+	}
+	infos := make([]*IPRequestInfo, 0, len(s.ipRequests))
+	for _, info := range s.ipRequests {
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].LastSeen.Before(infos[j].LastSeen) })
+
+	keep := limit * 9 / 10
+	if keep < 1 {
+		keep = 1
+	}
+	for _, info := range infos[:len(infos)-keep] {
+		s.evicted.add(info)
+		delete(s.ipRequests, info.IP)
+	}
 }
 
 // IPRequestInfo 单个IP的请求信息
@@ -200,6 +484,7 @@ var ipStats = &IPStats{
 
 // RecordIPRequest 记录IP请求（包含tokens、图片、视频统计）
 func (s *IPStats) RecordIPRequest(ip, model, userAgent string, success bool, inputTokens, outputTokens, images, videos int64) {
+	limit := ipStatsMaxEntries()
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -209,11 +494,13 @@ func (s *IPStats) RecordIPRequest(ip, model, userAgent string, success bool, inp
 		info = &IPRequestInfo{
 			IP:           ip,
 			FirstSeen:    now,
+			LastSeen:     now,
 			Models:       make(map[string]int64),
 			UserAgents:   make(map[string]int64),
 			RequestTimes: make([]time.Time, 0, 100),
 		}
 		s.ipRequests[ip] = info
+		s.evictLocked(limit)
 	}
 
 	info.TotalCount++
@@ -273,9 +560,10 @@ func (s *IPStats) GetAllIPStats() map[string]interface{} {
 			sorted[j], sorted[j-1] = sorted[j-1], sorted[j]
 		}
 	}
-	var totalRequests, totalSuccess, totalFailed int64
-	var totalInputTokens, totalOutputTokens int64
-	var totalImages, totalVideos int64
+	// 总量包含已淘汰 IP 的累计统计
+	totalRequests, totalSuccess, totalFailed := s.evicted.TotalCount, s.evicted.SuccessCount, s.evicted.FailedCount
+	totalInputTokens, totalOutputTokens := s.evicted.InputTokens, s.evicted.OutputTokens
+	totalImages, totalVideos := s.evicted.ImagesCount, s.evicted.VideosCount
 	ips := make([]map[string]interface{}, 0, n)
 	for i := 0; i < n; i++ {
 		info := s.ipRequests[sorted[i].IP]
@@ -318,6 +606,7 @@ func (s *IPStats) GetAllIPStats() map[string]interface{} {
 		"total_tokens":        totalInputTokens + totalOutputTokens,
 		"total_images":        totalImages,
 		"total_videos":        totalVideos,
+		"evicted":             s.evicted,
 		"ips":                 ips,
 	}
 }
@@ -329,6 +618,173 @@ func (s *IPStats) GetIPDetail(ip string) *IPRequestInfo {
 	return s.ipRequests[ip]
 }
 
+// Reset 清空 IP 统计（含淘汰桶），返回清除的 IP 数
+func (s *IPStats) Reset() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cleared := len(s.ipRequests)
+	s.ipRequests = make(map[string]*IPRequestInfo)
+	s.evicted = ipEvictedStats{}
+	return cleared
+}
+
+// auditSink 请求审计日志写入器（runAPIServer 中初始化）
+var auditSink *audit.Sink
+
+// auditConfig 获取审计配置，采样率 0 视为全部记录
+func auditConfig() AuditConfig {
+	configMu.RLock()
+	cfg := appConfig.Audit
+	configMu.RUnlock()
+	if cfg.SampleRate == 0 {
+		cfg.SampleRate = 1
+	}
+	return cfg
+}
+
+// recordAudit 按采样率写入一条审计记录，消息中的 API Key 和 base64 媒体会被脱敏
+func recordAudit(chatID, clientIP string, req ChatRequest, upstreamStatus int, success bool, start time.Time) {
+	cfg := auditConfig()
+	if !cfg.Enable || auditSink == nil || !audit.Sampled(cfg.SampleRate) {
+		return
+	}
+	var messages interface{}
+	if raw, err := json.Marshal(req.Messages); err == nil {
+		_ = json.Unmarshal(raw, &messages)
+	}
+	entry := audit.Entry{
+		Time:           start,
+		RequestID:      chatID,
+		Model:          req.Model,
+		ClientIP:       clientIP,
+		Messages:       audit.Redact(messages),
+		UpstreamStatus: upstreamStatus,
+		Success:        success,
+		LatencyMS:      time.Since(start).Milliseconds(),
+	}
+	if err := auditSink.Write(entry); err != nil {
+		logger.Warn("⚠️ 写入审计日志失败: %v", err)
+	}
+}
+
+// IP 统计持久化
+const (
+	ipStatsFileName     = "ip_stats.json"
+	ipStatsSaveInterval = 5 * time.Minute
+)
+
+// ipStatsSnapshot IP 统计快照文件内容
+type ipStatsSnapshot struct {
+	SavedAt time.Time        `json:"saved_at"`
+	IPs     []*IPRequestInfo `json:"ips"`
+	Evicted ipEvictedStats   `json:"evicted"` // 已淘汰及超出保留时长 IP 的累计统计
+}
+
+// ipStatsRetention 获取 IP 统计保留时长
+func ipStatsRetention() time.Duration {
+	configMu.RLock()
+	days := appConfig.Pool.IPStatsRetentionDays
+	configMu.RUnlock()
+	if days <= 0 {
+		days = 7
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// Save 将 IP 统计快照原子写入文件，跳过超过保留时长未出现的 IP
+func (s *IPStats) Save(path string, retention time.Duration) (int, error) {
+	cutoff := time.Now().Add(-retention)
+
+	s.mu.RLock()
+	snapshot := ipStatsSnapshot{SavedAt: time.Now(), IPs: make([]*IPRequestInfo, 0, len(s.ipRequests)), Evicted: s.evicted}
+	for _, info := range s.ipRequests {
+		if info.LastSeen.Before(cutoff) {
+			snapshot.Evicted.add(info)
+			continue
+		}
+		snapshot.IPs = append(snapshot.IPs, info)
+	}
+	raw, err := json.Marshal(snapshot)
+	s.mu.RUnlock()
+	if err != nil {
+		return 0, fmt.Errorf("序列化 IP 统计失败: %w", err)
+	}
+
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, raw, 0644); err != nil {
+		return 0, fmt.Errorf("写入 IP 统计临时文件失败: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		return 0, fmt.Errorf("替换 IP 统计文件失败: %w", err)
+	}
+	return len(snapshot.IPs), nil
+}
+
+// Load 从快照文件恢复 IP 统计，丢弃超过保留时长的记录；文件不存在时不报错
+func (s *IPStats) Load(path string, retention time.Duration) (int, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("读取 IP 统计失败: %w", err)
+	}
+	var snapshot ipStatsSnapshot
+	if err := json.Unmarshal(raw, &snapshot); err != nil {
+		return 0, fmt.Errorf("解析 IP 统计失败: %w", err)
+	}
+
+	cutoff := time.Now().Add(-retention)
+	limit := ipStatsMaxEntries()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.evicted.merge(snapshot.Evicted)
+	loaded := 0
+	for _, info := range snapshot.IPs {
+		if info == nil || info.IP == "" {
+			continue
+		}
+		if info.LastSeen.Before(cutoff) {
+			s.evicted.add(info)
+			continue
+		}
+		if _, exists := s.ipRequests[info.IP]; exists {
+			continue
+		}
+		if info.Models == nil {
+			info.Models = make(map[string]int64)
+		}
+		if info.UserAgents == nil {
+			info.UserAgents = make(map[string]int64)
+		}
+		info.RequestTimes = make([]time.Time, 0, 100)
+		s.ipRequests[info.IP] = info
+		loaded++
+	}
+	s.evictLocked(limit)
+	return loaded, nil
+}
+
+// startIPStatsPersistence 启动时恢复 IP 统计，并定期保存快照
+func startIPStatsPersistence(dataDir string) {
+	path := filepath.Join(dataDir, ipStatsFileName)
+	if loaded, err := ipStats.Load(path, ipStatsRetention()); err != nil {
+		logger.Warn("⚠️ 恢复 IP 统计失败: %v", err)
+	} else if loaded > 0 {
+		logger.Info("📊 已恢复 %d 个 IP 的请求统计", loaded)
+	}
+
+	go func() {
+		ticker := time.NewTicker(ipStatsSaveInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if _, err := ipStats.Save(path, ipStatsRetention()); err != nil {
+				logger.Warn("⚠️ 保存 IP 统计失败: %v", err)
+			}
+		}
+	}()
+}
+
 // RecordRequest 记录请求
 func (s *APIStats) RecordRequest(success bool, inputTokens, outputTokens, images, videos int64) {
 	s.RecordRequestWithModel("", success, inputTokens, outputTokens, images, videos)
@@ -387,6 +843,16 @@ func (s *APIStats) RecordRequestWithModel(model string, success bool, inputToken
 	hs.OutputTokens += outputTokens
 }
 
+// RecordFallback 记录一次切换到回退模型的请求
+func (s *APIStats) RecordFallback(success bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fallbackUsed++
+	if success {
+		s.fallbackSuccess++
+	}
+}
+
 func (s *APIStats) GetRPM() float64 {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
@@ -426,6 +892,9 @@ func (s *APIStats) GetStats() map[string]interface{} {
 		"total_tokens":     s.inputTokens + s.outputTokens,
 		"images_generated": s.imageGenerated,
 		"videos_generated": s.videoGenerated,
+		"fallback_used":    s.fallbackUsed,
+		"fallback_success": s.fallbackSuccess,
+		"fallback_rate":    fmt.Sprintf("%.2f%%", float64(s.fallbackUsed)/float64(max(s.totalRequests, 1))*100),
 		"current_rpm":      s.GetRPM(),
 		"average_rpm":      fmt.Sprintf("%.2f", avgRPM),
 	}
@@ -483,6 +952,9 @@ func (s *APIStats) GetDetailedStats() map[string]interface{} {
 		"total_tokens":     s.inputTokens + s.outputTokens,
 		"images_generated": s.imageGenerated,
 		"videos_generated": s.videoGenerated,
+		"fallback_used":    s.fallbackUsed,
+		"fallback_success": s.fallbackSuccess,
+		"fallback_rate":    fmt.Sprintf("%.2f%%", float64(s.fallbackUsed)/float64(max(s.totalRequests, 1))*100),
 		"current_rpm":      s.GetRPM(),
 		"average_rpm":      fmt.Sprintf("%.2f", avgRPM),
 		"models":           modelStatsMap,
@@ -490,6 +962,29 @@ func (s *APIStats) GetDetailedStats() map[string]interface{} {
 	}
 }
 
+// Reset 清零 API 调用统计，keepStartTime 为 true 时保留服务启动时间
+func (s *APIStats) Reset(keepStartTime bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	if !keepStartTime {
+		s.startTime = now
+	}
+	s.totalRequests = 0
+	s.successRequests = 0
+	s.failedRequests = 0
+	s.inputTokens = 0
+	s.outputTokens = 0
+	s.imageGenerated = 0
+	s.videoGenerated = 0
+	s.fallbackUsed = 0
+	s.fallbackSuccess = 0
+	s.requestTimes = make([]time.Time, 0, 1000)
+	s.modelStats = make(map[string]*ModelStats)
+	s.hourlyStats = [24]HourlyStats{}
+	s.lastHour = now.Hour()
+}
+
 func max(a, b int64) int64 {
 	if a > b {
 		return a
@@ -563,9 +1058,36 @@ var appConfig = AppConfig{
 		EnableBrowserRefresh:   true, // 默认启用浏览器刷新
 		BrowserRefreshHeadless: false,
 		BrowserRefreshMaxRetry: 1, // 浏览器刷新最多重试1次
+		AutoDeleteMinFailures:  3,
+		AutoDeleteGraceMinutes: 10,
 		ExternalRefreshMode:    false,
 		RegistrarBaseURL:       "http://127.0.0.1:8090",
+		JWTRefreshMarginSec:    30,
+		JWTTTLSec:              270,
+		GenQueueTimeoutSec:     30,
+		MaxImageN:              4,
+		BulkRefreshThreads:     2,
+		HealthCheckThreads:     defaultHealthCheckThreads,
+		HeartbeatIntervalSec:   15,
+		MaxMediaBytes:          defaultMaxMediaBytes,
+		IPStatsRetentionDays:   7,
+		IPStatsMaxEntries:      defaultIPStatsMaxEntries,
+		MediaFetchTimeoutSec:   60,
+		MaxRequestBytes:        defaultMaxRequestBytes,
+		StorageBackend:         pool.StoreBackendFile,
 	},
+	Upstream: UpstreamConfig{
+		APIBaseURL:          defaultUpstreamAPIBaseURL,
+		Origin:              defaultUpstreamOrigin,
+		OrigAuthPassthrough: origAuthPassthroughAuto,
+	},
+	CircuitBreaker: CircuitBreakerConfig{
+		FailureRate: 0.8,
+		WindowSec:   60,
+		MinRequests: 20,
+		CooldownSec: 30,
+	},
+	ConfigBackups: defaultConfigBackups,
 }
 
 // GetAPIKeys 线程安全获取 API Keys
@@ -577,30 +1099,235 @@ func GetAPIKeys() []string {
 	return keys
 }
 
+// configValidation 配置校验结果：errors 会阻止应用，warnings 仅提示
+type configValidation struct {
+	Errors   []string `json:"errors"`
+	Warnings []string `json:"warnings"`
+}
+
+func (v *configValidation) errorf(format string, args ...interface{}) {
+	v.Errors = append(v.Errors, fmt.Sprintf(format, args...))
+}
+
+func (v *configValidation) warnf(format string, args ...interface{}) {
+	v.Warnings = append(v.Warnings, fmt.Sprintf(format, args...))
+}
+
+// validateConfigData 以试运行方式校验配置内容：解析 + mergeConfig + validateConfig，不修改运行中的配置
+func validateConfigData(data []byte) configValidation {
+	var loaded AppConfig
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		result := configValidation{Errors: []string{}, Warnings: []string{}}
+		result.errorf("解析配置文件失败: %v", err)
+		return result
+	}
+	applySensitiveEnvOverrides(&loaded)
+	envProblems := applyEnvOverrides(&loaded)
+
+	configMu.RLock()
+	merged := appConfig
+	configMu.RUnlock()
+	mergeConfig(&merged, &loaded)
+	// 以下字段热重载时直接取配置文件中的值（mergeConfig 会忽略非正数），按原值校验
+	merged.Pool.RefreshCooldownSec = loaded.Pool.RefreshCooldownSec
+	merged.Pool.UseCooldownSec = loaded.Pool.UseCooldownSec
+	merged.Pool.MaxFailCount = loaded.Pool.MaxFailCount
+	merged.CircuitBreaker = loaded.CircuitBreaker
+	if len(loaded.Pool.MailChannelOrder) > 0 {
+		merged.Pool.MailChannelOrder = loaded.Pool.MailChannelOrder
+	}
+	result := validateConfig(&merged)
+	result.Errors = append(envProblems, result.Errors...)
+	return result
+}
+
+// validateConfig 校验合并后的配置，收集全部问题：errors 为致命错误（拒绝启动/跳过重载），warnings 仅提示
+func validateConfig(cfg *AppConfig) configValidation {
+	result := configValidation{Errors: []string{}, Warnings: []string{}}
+
+	if strings.TrimSpace(cfg.ListenAddr) == "" {
+		result.errorf("listen_addr 不能为空")
+	} else if _, _, err := net.SplitHostPort(cfg.ListenAddr); err != nil {
+		result.errorf("listen_addr 无效: %q (%v)", cfg.ListenAddr, err)
+	}
+	upstream := cfg.Upstream
+	if err := validateUpstreamConfig(&upstream); err != nil {
+		result.errorf("%v", err)
+	}
+
+	seenKeys := make(map[string]bool, len(cfg.APIKeys))
+	for i, key := range cfg.APIKeys {
+		if seenKeys[key] {
+			result.warnf("api_keys 第 %d 项与前面的密钥重复", i+1)
+			continue
+		}
+		seenKeys[key] = true
+	}
+
+	if cfg.Pool.TargetCount > 0 && cfg.Pool.TargetCount < cfg.Pool.MinCount {
+		result.warnf("pool.target_count (%d) 小于 pool.min_count (%d)", cfg.Pool.TargetCount, cfg.Pool.MinCount)
+	}
+	if order := cfg.Pool.MailChannelOrder; len(order) > 0 {
+		normalized := normalizeMailChannelOrder(order)
+		if len(normalized) != len(order) {
+			result.warnf("pool.mail_channel_order 含不支持或重复的渠道，将使用 %v", normalized)
+		}
+	}
+	switch strings.ToLower(strings.TrimSpace(cfg.Pool.StorageBackend)) {
+	case "", pool.StoreBackendFile:
+	default:
+		result.warnf("pool.storage_backend 无效: %q，将使用 %s", cfg.Pool.StorageBackend, pool.StoreBackendFile)
+	}
+	if cfg.Pool.RefreshCooldownSec < 0 || cfg.Pool.UseCooldownSec < 0 {
+		result.errorf("pool.refresh_cooldown_sec / pool.use_cooldown_sec 不能为负数")
+	}
+	if cfg.Pool.MaxFailCount < 0 {
+		result.errorf("pool.max_fail_count 不能为负数")
+	}
+	if rate := cfg.CircuitBreaker.FailureRate; rate > 1 {
+		result.errorf("circuit_breaker.failure_rate 需在 0-1 之间（<0 禁用），当前为 %v", rate)
+	}
+	if cfg.ProxyPool.MinHealthy < 0 {
+		result.warnf("proxy_pool.min_healthy_proxies 不能为负数，当前为 %d，将使用 1", cfg.ProxyPool.MinHealthy)
+	}
+	if rate := cfg.ProxyPool.BlacklistRate; rate > 1 {
+		result.errorf("proxy_pool.blacklist_rate 需在 0-1 之间（<0 禁用），当前为 %v", rate)
+	}
+	if lvl := strings.TrimSpace(cfg.LogLevel); lvl != "" {
+		if _, ok := logger.ParseLevel(lvl); !ok {
+			result.warnf("log_level 无效: %q，将使用 INFO", lvl)
+		}
+	}
+	if mode := strings.TrimSpace(cfg.ReasoningOutput); mode != "" && !validReasoningOutput(mode) {
+		result.warnf("reasoning_output 无效: %q，将使用 separate", mode)
+	}
+	for _, item := range []struct{ name, model string }{
+		{"default_model", cfg.DefaultModel},
+		{"default_models.openai", cfg.DefaultModels.OpenAI},
+		{"default_models.claude", cfg.DefaultModels.Claude},
+		{"default_models.gemini", cfg.DefaultModels.Gemini},
+	} {
+		if model := strings.TrimSpace(item.model); model != "" && !knownModel(model, cfg.Flow.Enable) {
+			result.warnf("%s 不在可用模型列表中: %q，将回退到 %s", item.name, model, BaseModels[0])
+		}
+	}
+	switch strings.ToLower(strings.TrimSpace(cfg.ConfigIDPolicy)) {
+	case "", pool.ConfigIDPolicyBound, pool.ConfigIDPolicyRoundRobin:
+	default:
+		result.warnf("config_id_policy 无效: %q，将使用 %s", cfg.ConfigIDPolicy, pool.ConfigIDPolicyBound)
+	}
+	for model, fallbacks := range cfg.ModelFallbacks {
+		for _, fallback := range fallbacks {
+			fallback = strings.TrimSpace(fallback)
+			switch {
+			case flow.IsFlowModel(model) || flow.IsFlowModel(fallback):
+				result.warnf("model_fallbacks.%s 不支持 Flow 模型: %q，将忽略", model, fallback)
+			case !knownModel(fallback, false):
+				result.warnf("model_fallbacks.%s 不在可用模型列表中: %q，将忽略", model, fallback)
+			}
+		}
+	}
+
+	// 代理链接
+	for _, item := range []struct{ name, line string }{
+		{"proxy", cfg.Proxy},
+		{"proxy_pool.proxy", cfg.ProxyPool.Proxy},
+	} {
+		if strings.TrimSpace(item.line) == "" {
+			continue
+		}
+		if err := proxy.ValidateProxyLine(item.line); err != nil {
+			result.errorf("%s 无效: %v", item.name, err)
+		}
+	}
+	subscribes := append([]string{}, cfg.ProxyPool.Subscribes...)
+	if cfg.ProxySubscribe != "" {
+		subscribes = append(subscribes, cfg.ProxySubscribe)
+	}
+	for _, sub := range subscribes {
+		u, err := url.Parse(strings.TrimSpace(sub))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			result.errorf("代理订阅链接无效: %q（需为 http/https 地址）", sub)
+		}
+	}
+	for _, file := range cfg.ProxyPool.Files {
+		if _, err := os.Stat(file); err != nil {
+			result.warnf("代理文件不可读: %s (%v)", file, err)
+		}
+	}
+	return result
+}
+
 // reloadConfig 重新加载配置文件（热重载）
 func reloadConfig() error {
 	data, err := os.ReadFile(configPath)
 	if err != nil {
 		return fmt.Errorf("读取配置文件失败: %w", err)
 	}
+	// 编辑器先截断再写入时可能读到空文件，直接拒绝，保留当前配置
+	if len(bytes.TrimSpace(data)) == 0 {
+		return errors.New("配置文件为空（可能正在写入），继续使用当前配置")
+	}
+
+	validation := validateConfigData(data)
+	if len(validation.Errors) > 0 {
+		return fmt.Errorf("配置校验未通过，继续使用当前配置: %s", strings.Join(validation.Errors, "; "))
+	}
+	for _, w := range validation.Warnings {
+		logger.Warn("⚠️ 配置警告: %s", w)
+	}
 
 	var newConfig AppConfig
 	if err := json.Unmarshal(data, &newConfig); err != nil {
 		return fmt.Errorf("解析配置文件失败: %w", err)
 	}
 	applySensitiveEnvOverrides(&newConfig)
+	applyEnvOverrides(&newConfig) // 无效变量已在 validateConfigData 中报错
+	if err := validateUpstreamConfig(&newConfig.Upstream); err != nil {
+		return err
+	}
 
 	configMu.Lock()
 	oldAPIKeys := appConfig.APIKeys
 	oldDebug := appConfig.Debug
 	oldPoolConfig := appConfig.Pool
+	oldFlowConfig := appConfig.Flow
 	hasEnableGoRegister, enableGoRegister := getPoolBoolFieldFromJSON(data, "enable_go_register")
 	hasExternalRefreshMode, externalRefreshMode := getPoolBoolFieldFromJSON(data, "external_refresh_mode")
+	if envOverrideSet("pool.enable_go_register") {
+		hasEnableGoRegister, enableGoRegister = true, newConfig.Pool.EnableGoRegister
+	}
+	if envOverrideSet("pool.external_refresh_mode") {
+		hasExternalRefreshMode, externalRefreshMode = true, newConfig.Pool.ExternalRefreshMode
+	}
 
 	// 更新可热重载的配置项
 	appConfig.APIKeys = newConfig.APIKeys
 	appConfig.Debug = newConfig.Debug
+	appConfig.LogLevel = newConfig.LogLevel
 	appConfig.Note = newConfig.Note
+	appConfig.CircuitBreaker = newConfig.CircuitBreaker
+	appConfig.RateLimit = newConfig.RateLimit
+	appConfig.Audit = newConfig.Audit
+	appConfig.ModelTags = newConfig.ModelTags
+	appConfig.ReasoningOutput = newConfig.ReasoningOutput
+	appConfig.GlobalSystemPrefix = newConfig.GlobalSystemPrefix
+	appConfig.GlobalSystemSuffix = newConfig.GlobalSystemSuffix
+	appConfig.DefaultModel = newConfig.DefaultModel
+	appConfig.DefaultModels = newConfig.DefaultModels
+	appConfig.ModelFallbacks = newConfig.ModelFallbacks
+	appConfig.ModelFallbackNote = newConfig.ModelFallbackNote
+	appConfig.ConfigIDs = newConfig.ConfigIDs
+	appConfig.ConfigIDPolicy = newConfig.ConfigIDPolicy
+	pool.SetConfigIDPolicy(newConfig.ConfigIDPolicy, newConfig.ConfigIDs)
+	if newConfig.ConfigBackups != 0 {
+		appConfig.ConfigBackups = newConfig.ConfigBackups
+	}
+	appConfig.Flow = newConfig.Flow
+	// 上游地址需重启生效，透传策略与请求头覆盖可热重载
+	appConfig.Upstream.OrigAuthPassthrough = newConfig.Upstream.OrigAuthPassthrough
+	appConfig.Upstream.Referer = newConfig.Upstream.Referer
+	appConfig.Upstream.UserAgent = newConfig.Upstream.UserAgent
 
 	// 更新号池配置
 	appConfig.Pool.RefreshCooldownSec = newConfig.Pool.RefreshCooldownSec
@@ -610,6 +1337,20 @@ func reloadConfig() error {
 	appConfig.Pool.BrowserRefreshHeadless = newConfig.Pool.BrowserRefreshHeadless
 	appConfig.Pool.BrowserRefreshMaxRetry = newConfig.Pool.BrowserRefreshMaxRetry
 	appConfig.Pool.AutoDelete401 = newConfig.Pool.AutoDelete401
+	appConfig.Pool.AutoDeleteMinFailures = newConfig.Pool.AutoDeleteMinFailures
+	appConfig.Pool.AutoDeleteGraceMinutes = newConfig.Pool.AutoDeleteGraceMinutes
+	appConfig.Pool.MaxConcurrentGen = newConfig.Pool.MaxConcurrentGen
+	appConfig.Pool.GenQueueTimeoutSec = newConfig.Pool.GenQueueTimeoutSec
+	appConfig.Pool.MaxImageN = newConfig.Pool.MaxImageN
+	appConfig.Pool.BulkRefreshThreads = newConfig.Pool.BulkRefreshThreads
+	appConfig.Pool.HealthCheckThreads = newConfig.Pool.HealthCheckThreads
+	appConfig.Pool.HeartbeatIntervalSec = newConfig.Pool.HeartbeatIntervalSec
+	appConfig.Pool.MaxMediaBytes = newConfig.Pool.MaxMediaBytes
+	appConfig.Pool.IPStatsRetentionDays = newConfig.Pool.IPStatsRetentionDays
+	appConfig.Pool.IPStatsMaxEntries = newConfig.Pool.IPStatsMaxEntries
+	appConfig.Pool.MediaFetchTimeoutSec = newConfig.Pool.MediaFetchTimeoutSec
+	appConfig.Pool.ImageConvertPolicy = newConfig.Pool.ImageConvertPolicy
+	appConfig.Pool.MaxRequestBytes = newConfig.Pool.MaxRequestBytes
 	appConfig.Pool.EnableGoRegister = oldPoolConfig.EnableGoRegister
 	if hasEnableGoRegister {
 		appConfig.Pool.EnableGoRegister = enableGoRegister
@@ -620,87 +1361,546 @@ func reloadConfig() error {
 	}
 	appConfig.Pool.MailChannelOrder = normalizeMailChannelOrder(newConfig.Pool.MailChannelOrder)
 	appConfig.Pool.DuckMailBearer = strings.TrimSpace(newConfig.Pool.DuckMailBearer)
+
+	// 更新代理源配置
+	appConfig.ProxyPool.Subscribes = newConfig.ProxyPool.Subscribes
+	appConfig.ProxyPool.Files = newConfig.ProxyPool.Files
+	appConfig.ProxyPool.Sticky = newConfig.ProxyPool.Sticky
+	appConfig.ProxyPool.BlacklistRate = newConfig.ProxyPool.BlacklistRate
+	appConfig.ProxyPool.BlacklistMin = newConfig.ProxyPool.BlacklistMin
+	appConfig.ProxyPool.MinHealthy = newConfig.ProxyPool.MinHealthy
+	appConfig.ProxyPool.ReadyTimeout = newConfig.ProxyPool.ReadyTimeout
+	appConfig.ProxyPool.FailureCooldown = newConfig.ProxyPool.FailureCooldown
+	appConfig.ProxySubscribe = newConfig.ProxySubscribe
 	if v := strings.TrimSpace(newConfig.Pool.RegistrarBaseURL); v != "" {
 		appConfig.Pool.RegistrarBaseURL = v
 	}
+	if newConfig.Pool.JWTRefreshMarginSec != 0 {
+		appConfig.Pool.JWTRefreshMarginSec = newConfig.Pool.JWTRefreshMarginSec
+	}
+	appConfig.Pool.JWTTTLSec = newConfig.Pool.JWTTTLSec
+	// 补号目标与检查间隔：未配置(0)时保持当前值
+	if newConfig.Pool.TargetCount > 0 {
+		appConfig.Pool.TargetCount = newConfig.Pool.TargetCount
+	}
+	if newConfig.Pool.MinCount > 0 {
+		appConfig.Pool.MinCount = newConfig.Pool.MinCount
+	}
+	if newConfig.Pool.CheckIntervalMinutes > 0 {
+		appConfig.Pool.CheckIntervalMinutes = newConfig.Pool.CheckIntervalMinutes
+	}
 	newConfig.Pool.EnableGoRegister = appConfig.Pool.EnableGoRegister
 	newConfig.Pool.ExternalRefreshMode = appConfig.Pool.ExternalRefreshMode
 	newConfig.Pool.RegistrarBaseURL = appConfig.Pool.RegistrarBaseURL
+	newConfig.Pool.JWTRefreshMarginSec = appConfig.Pool.JWTRefreshMarginSec
+	newConfig.Pool.TargetCount = appConfig.Pool.TargetCount
+	newConfig.Pool.MinCount = appConfig.Pool.MinCount
+	newConfig.Pool.CheckIntervalMinutes = appConfig.Pool.CheckIntervalMinutes
 	configMu.Unlock()
 
 	// 应用变更
-	applyConfigChanges(oldAPIKeys, oldDebug, oldPoolConfig, newConfig)
+	applyConfigChanges(oldAPIKeys, oldDebug, oldPoolConfig, oldFlowConfig, newConfig)
+	recordConfigSnapshot(data, "reload")
 
 	return nil
 }
 
-// applyConfigChanges 应用配置变更
-func applyConfigChanges(oldAPIKeys []string, oldDebug bool, oldPoolConfig PoolConfig, newConfig AppConfig) {
-	// 日志模式变更
-	if oldDebug != newConfig.Debug {
-		logger.SetDebugMode(newConfig.Debug)
-		logger.Info("🔄 调试模式: %v -> %v", oldDebug, newConfig.Debug)
-	}
+// 配置快照（最近成功应用的配置，用于回滚）
+const configHistoryLimit = 10
 
-	// API Keys 变更
-	if len(oldAPIKeys) != len(newConfig.APIKeys) {
-		logger.Info("🔄 API Keys 数量: %d -> %d", len(oldAPIKeys), len(newConfig.APIKeys))
-	}
+type configSnapshot struct {
+	ID        int       `json:"id"`
+	AppliedAt time.Time `json:"applied_at"`
+	Source    string    `json:"source"`  // startup / reload
+	SHA256    string    `json:"sha256"`  // 配置内容摘要（前 12 位）
+	Size      int       `json:"size"`    // 配置文件字节数
+	Changes   []string  `json:"changes"` // 相对上一个快照的变更字段：+新增 -删除 ~修改
+	data      []byte
+}
 
-	// 号池配置变更
-	if oldPoolConfig.RefreshCooldownSec != newConfig.Pool.RefreshCooldownSec ||
-		oldPoolConfig.UseCooldownSec != newConfig.Pool.UseCooldownSec {
-		pool.SetCooldowns(newConfig.Pool.RefreshCooldownSec, newConfig.Pool.UseCooldownSec)
-		logger.Info("🔄 冷却配置已更新: refresh=%ds, use=%ds",
-			newConfig.Pool.RefreshCooldownSec, newConfig.Pool.UseCooldownSec)
-	}
+var (
+	configHistoryMu sync.Mutex
+	configHistory   []*configSnapshot
+	configHistoryID int
+)
 
-	if newConfig.Pool.MaxFailCount > 0 {
-		pool.MaxFailCount = newConfig.Pool.MaxFailCount
-	}
+// recordConfigSnapshot 记录一次成功应用的配置。内容与最新快照相同则忽略；
+// 与上一个快照相同（回滚或手动改回）时丢弃最新快照，使历史回到该版本
+func recordConfigSnapshot(data []byte, source string) {
+	configHistoryMu.Lock()
+	defer configHistoryMu.Unlock()
 
-	pool.EnableBrowserRefresh = newConfig.Pool.EnableBrowserRefresh
-	pool.BrowserRefreshHeadless = newConfig.Pool.BrowserRefreshHeadless
-	if newConfig.Pool.BrowserRefreshMaxRetry >= 0 {
-		pool.BrowserRefreshMaxRetry = newConfig.Pool.BrowserRefreshMaxRetry
+	n := len(configHistory)
+	if n > 0 && bytes.Equal(configHistory[n-1].data, data) {
+		return
+	}
+	if n > 1 && bytes.Equal(configHistory[n-2].data, data) {
+		configHistory = configHistory[:n-1]
+		return
 	}
-	pool.AutoDelete401 = newConfig.Pool.AutoDelete401
-	pool.ExternalRefreshMode = newConfig.Pool.ExternalRefreshMode
-	register.MailChannelOrder = normalizeMailChannelOrder(newConfig.Pool.MailChannelOrder)
-	register.DuckMailBearer = strings.TrimSpace(newConfig.Pool.DuckMailBearer)
-	register.EnableGoRegister = newConfig.Pool.EnableGoRegister
 
-	logger.Info("✅ 配置热重载完成")
+	var changes []string
+	if n > 0 {
+		changes = configDiffSummary(configHistory[n-1].data, data)
+		if _, err := writeConfigBackup(configHistory[n-1].data, source); err != nil {
+			logger.Warn("⚠️ 写入配置备份失败: %v", err)
+		}
+	}
+	if changes == nil {
+		changes = []string{}
+	}
+	sum := sha256.Sum256(data)
+	configHistoryID++
+	configHistory = append(configHistory, &configSnapshot{
+		ID:        configHistoryID,
+		AppliedAt: time.Now(),
+		Source:    source,
+		SHA256:    hex.EncodeToString(sum[:])[:12],
+		Size:      len(data),
+		Changes:   changes,
+		data:      append([]byte(nil), data...),
+	})
+	if len(configHistory) > configHistoryLimit {
+		configHistory = configHistory[len(configHistory)-configHistoryLimit:]
+	}
 }
 
-// startConfigWatcher 启动配置文件监听
-func startConfigWatcher() error {
-	watcher, err := fsnotify.NewWatcher()
-	if err != nil {
-		return fmt.Errorf("创建配置监听器失败: %w", err)
-	}
-	configWatcher = watcher
+// 配置备份：被替换的配置以时间戳命名写入 DataDir/config-backups，按 config_backups 保留最近若干份
+const (
+	defaultConfigBackups  = 10
+	configBackupDirName   = "config-backups"
+	configBackupTimestamp = "20060102-150405.000"
+)
 
-	go configWatchLoop()
+// configBackup 备份文件信息
+type configBackup struct {
+	Name      string    `json:"name"`
+	Reason    string    `json:"reason"` // reload / rollback / restore
+	CreatedAt time.Time `json:"created_at"`
+	Size      int64     `json:"size"`
+}
 
-	// 监听配置目录
-	configDir := filepath.Dir(configPath)
-	if err := watcher.Add(configDir); err != nil {
-		return fmt.Errorf("添加配置目录监听失败: %w", err)
-	}
+func configBackupDir() string {
+	return filepath.Join(DataDir, configBackupDirName)
+}
 
-	logger.Info("🔄 配置文件热重载已启用: %s", configPath)
-	return nil
+// configBackupLimit 备份保留数：0 使用默认值，<0 不写磁盘
+func configBackupLimit() int {
+	configMu.RLock()
+	keep := appConfig.ConfigBackups
+	configMu.RUnlock()
+	if keep == 0 {
+		return defaultConfigBackups
+	}
+	return keep
 }
 
-// configWatchLoop 配置文件监听循环
-func configWatchLoop() {
-	var lastReload time.Time
+// writeConfigBackup 把即将被替换的配置写入备份目录并清理超出保留数的旧备份，返回备份文件名
+func writeConfigBackup(previous []byte, reason string) (string, error) {
+	keep := configBackupLimit()
+	if keep < 0 || len(previous) == 0 {
+		return "", nil
+	}
+	dir := configBackupDir()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	// 时间戳严格晚于最新备份（同一毫秒内顺延），保证文件名顺序即备份顺序
+	at := time.Now().Truncate(time.Millisecond)
+	if backups, err := listConfigBackups(); err == nil && len(backups) > 0 {
+		// 与最新备份内容相同时不重复写入（如恢复后热重载再次触发备份）
+		if latest, err := os.ReadFile(filepath.Join(dir, backups[0].Name)); err == nil && bytes.Equal(latest, previous) {
+			return backups[0].Name, nil
+		}
+		if !at.After(backups[0].CreatedAt) {
+			at = backups[0].CreatedAt.Add(time.Millisecond)
+		}
+	}
+	name := fmt.Sprintf("config-%s-%s.json", at.Format(configBackupTimestamp), reason)
+	if err := os.WriteFile(filepath.Join(dir, name), previous, 0600); err != nil {
+		return "", err
+	}
+	pruneConfigBackups(keep)
+	return name, nil
+}
+
+// backupCurrentConfigFile 程序覆盖 config.json 之前备份当前文件，文件不存在时跳过
+func backupCurrentConfigFile(reason string) (string, error) {
+	data, err := os.ReadFile(configPath)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return writeConfigBackup(data, reason)
+}
+
+// pruneConfigBackups 只保留最近 keep 份备份
+func pruneConfigBackups(keep int) {
+	backups, err := listConfigBackups()
+	if err != nil {
+		return
+	}
+	for _, b := range backups[min(keep, len(backups)):] {
+		_ = os.Remove(filepath.Join(configBackupDir(), b.Name))
+	}
+}
+
+// parseConfigBackupName 解析备份文件名 config-<时间戳>-<原因>.json
+func parseConfigBackupName(name string) (time.Time, string, bool) {
+	if filepath.Base(name) != name || !strings.HasPrefix(name, "config-") || !strings.HasSuffix(name, ".json") {
+		return time.Time{}, "", false
+	}
+	rest := strings.TrimSuffix(strings.TrimPrefix(name, "config-"), ".json")
+	if len(rest) <= len(configBackupTimestamp)+1 || rest[len(configBackupTimestamp)] != '-' {
+		return time.Time{}, "", false
+	}
+	createdAt, err := time.ParseInLocation(configBackupTimestamp, rest[:len(configBackupTimestamp)], time.Local)
+	if err != nil {
+		return time.Time{}, "", false
+	}
+	return createdAt, rest[len(configBackupTimestamp)+1:], true
+}
+
+// listConfigBackups 列出备份（最新在前），目录不存在时返回空列表
+func listConfigBackups() ([]configBackup, error) {
+	entries, err := os.ReadDir(configBackupDir())
+	if os.IsNotExist(err) {
+		return []configBackup{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	backups := make([]configBackup, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		createdAt, reason, ok := parseConfigBackupName(entry.Name())
+		if !ok {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		backups = append(backups, configBackup{Name: entry.Name(), Reason: reason, CreatedAt: createdAt, Size: info.Size()})
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].Name > backups[j].Name })
+	return backups, nil
+}
+
+// writeConfigFileAtomic 覆盖 config.json 前先备份当前内容，再通过临时文件原子替换
+func writeConfigFileAtomic(data []byte, reason string) error {
+	if _, err := backupCurrentConfigFile(reason); err != nil {
+		logger.Warn("⚠️ 写入配置备份失败: %v", err)
+	}
+	tmpPath := configPath + "." + reason + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("写入配置失败: %w", err)
+	}
+	if err := os.Rename(tmpPath, configPath); err != nil {
+		_ = os.Remove(tmpPath)
+		return fmt.Errorf("写入配置失败: %w", err)
+	}
+	return nil
+}
+
+// restoreConfigBackup 校验并把指定备份写回 config.json，然后重新应用
+func restoreConfigBackup(name string) error {
+	if _, _, ok := parseConfigBackupName(name); !ok {
+		return fmt.Errorf("无效的备份文件名: %s", name)
+	}
+	data, err := os.ReadFile(filepath.Join(configBackupDir(), name))
+	if err != nil {
+		return fmt.Errorf("读取备份失败: %w", err)
+	}
+	if validation := validateConfigData(data); len(validation.Errors) > 0 {
+		return fmt.Errorf("备份配置校验未通过: %s", strings.Join(validation.Errors, "; "))
+	}
+	if err := writeConfigFileAtomic(data, "restore"); err != nil {
+		return err
+	}
+	if err := reloadConfig(); err != nil {
+		return err
+	}
+	logger.Info("⏪ 配置已从备份恢复: %s", name)
+	return nil
+}
+
+// configDiffSummary 比较两份配置 JSON，返回变更字段路径（只列字段名，不含值，避免泄露密钥）
+func configDiffSummary(oldData, newData []byte) []string {
+	oldFields := map[string]interface{}{}
+	newFields := map[string]interface{}{}
+	var oldRoot, newRoot map[string]interface{}
+	if json.Unmarshal(oldData, &oldRoot) == nil {
+		flattenConfigFields("", oldRoot, oldFields)
+	}
+	if json.Unmarshal(newData, &newRoot) == nil {
+		flattenConfigFields("", newRoot, newFields)
+	}
+
+	changes := []string{}
+	for path, v := range newFields {
+		old, ok := oldFields[path]
+		switch {
+		case !ok:
+			changes = append(changes, "+"+path)
+		case !reflect.DeepEqual(old, v):
+			changes = append(changes, "~"+path)
+		}
+	}
+	for path := range oldFields {
+		if _, ok := newFields[path]; !ok {
+			changes = append(changes, "-"+path)
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i][1:] < changes[j][1:] })
+	return changes
+}
+
+func flattenConfigFields(prefix string, node map[string]interface{}, out map[string]interface{}) {
+	for k, v := range node {
+		path := k
+		if prefix != "" {
+			path = prefix + "." + k
+		}
+		if child, ok := v.(map[string]interface{}); ok && len(child) > 0 {
+			flattenConfigFields(path, child, out)
+			continue
+		}
+		out[path] = v
+	}
+}
+
+// rollbackConfig 将上一个快照写回配置文件并重新应用
+func rollbackConfig() (*configSnapshot, error) {
+	configHistoryMu.Lock()
+	if len(configHistory) < 2 {
+		configHistoryMu.Unlock()
+		return nil, errors.New("没有可回滚的历史配置")
+	}
+	target := configHistory[len(configHistory)-2]
+	configHistoryMu.Unlock()
+
+	if err := writeConfigFileAtomic(target.data, "rollback"); err != nil {
+		return nil, err
+	}
+	if err := reloadConfig(); err != nil {
+		return nil, err
+	}
+	logger.Info("⏪ 配置已回滚到快照 #%d (%s)", target.ID, target.AppliedAt.Format(time.RFC3339))
+	return target, nil
+}
+
+// configHistoryView 返回快照列表（最新在前）
+func configHistoryView() []configSnapshot {
+	configHistoryMu.Lock()
+	defer configHistoryMu.Unlock()
+	items := make([]configSnapshot, 0, len(configHistory))
+	for i := len(configHistory) - 1; i >= 0; i-- {
+		items = append(items, *configHistory[i])
+	}
+	return items
+}
+
+// redactedConfigValue 运行配置中敏感字段的替换值
+const redactedConfigValue = "[redacted]"
+
+// redactSecretList 敏感列表只保留条数，内容全部替换
+func redactSecretList(values []string) []string {
+	if values == nil {
+		return nil
+	}
+	out := make([]string, len(values))
+	for i := range out {
+		out[i] = redactedConfigValue
+	}
+	return out
+}
+
+// redactSecretValue 非空敏感值替换为占位符，空值保持为空便于区分未配置
+func redactSecretValue(value string) string {
+	if value == "" {
+		return ""
+	}
+	return redactedConfigValue
+}
+
+// redactProxyURL 隐藏代理地址中的密码，无法解析时整体替换
+func redactProxyURL(raw string) string {
+	if raw == "" {
+		return ""
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return redactedConfigValue
+	}
+	return u.Redacted()
+}
+
+// redactedConfig 返回脱敏后的配置副本：API Key、Flow Token、DuckMail Bearer、
+// 号池通信密钥、Webhook 地址及代理密码均不会原样返回
+func redactedConfig(cfg AppConfig) AppConfig {
+	cfg.APIKeys = redactSecretList(cfg.APIKeys)
+	cfg.Flow.Tokens = redactSecretList(cfg.Flow.Tokens)
+	cfg.Flow.DisableWebhook = redactSecretValue(cfg.Flow.DisableWebhook)
+	cfg.Flow.Proxy = redactProxyURL(cfg.Flow.Proxy)
+	cfg.Pool.DuckMailBearer = redactSecretValue(cfg.Pool.DuckMailBearer)
+	cfg.PoolServer.Secret = redactSecretValue(cfg.PoolServer.Secret)
+	cfg.Proxy = redactProxyURL(cfg.Proxy)
+	cfg.ProxyPool.Proxy = redactProxyURL(cfg.ProxyPool.Proxy)
+	return cfg
+}
+
+// handleEffectiveConfig 返回当前生效的（合并默认值、环境变量与热重载后的）配置，敏感字段已脱敏
+func handleEffectiveConfig(c *gin.Context) {
+	configMu.RLock()
+	cfg := redactedConfig(appConfig)
+	configMu.RUnlock()
+	c.JSON(200, gin.H{"config": cfg, "path": configPath})
+}
+
+// warnJWTTimingConfig 检查JWT有效期与刷新提前量、刷新冷却的搭配，不合理时给出警告
+func warnJWTTimingConfig() {
+	if lead := pool.JWTRefreshLead(); lead >= pool.JwtTTL {
+		logger.Warn("⚠️ JWT刷新提前量 %v 不小于有效期 %v，账号将频繁刷新", lead, pool.JwtTTL)
+	}
+	if pool.RefreshCooldown > pool.JwtTTL {
+		logger.Warn("⚠️ 刷新冷却 %v 大于JWT有效期 %v，JWT 可能在冷却期内过期", pool.RefreshCooldown, pool.JwtTTL)
+	}
+}
+
+// applyLogLevel 应用日志级别：debug=true 时为 DEBUG，否则按 log_level（留空为 INFO）
+func applyLogLevel(cfg AppConfig) {
+	logger.SetDebugMode(cfg.Debug)
+	if cfg.Debug || strings.TrimSpace(cfg.LogLevel) == "" {
+		return
+	}
+	level, ok := logger.ParseLevel(cfg.LogLevel)
+	if !ok {
+		logger.Warn("⚠️ 无效的 log_level: %q，使用 INFO", cfg.LogLevel)
+		return
+	}
+	logger.SetLevel(level)
+}
+
+// applyConfigChanges 应用配置变更
+func applyConfigChanges(oldAPIKeys []string, oldDebug bool, oldPoolConfig PoolConfig, oldFlowConfig FlowConfigSection, newConfig AppConfig) {
+	// 日志模式变更
+	oldLevel := logger.GetLevel()
+	applyLogLevel(newConfig)
+	if oldDebug != newConfig.Debug {
+		logger.Info("🔄 调试模式: %v -> %v", oldDebug, newConfig.Debug)
+	}
+	if newLevel := logger.GetLevel(); newLevel != oldLevel {
+		logger.Info("🔄 日志级别: %s -> %s", oldLevel, newLevel)
+	}
+
+	// API Keys 变更
+	if len(oldAPIKeys) != len(newConfig.APIKeys) {
+		logger.Info("🔄 API Keys 数量: %d -> %d", len(oldAPIKeys), len(newConfig.APIKeys))
+	}
+
+	// 号池配置变更
+	if oldPoolConfig.RefreshCooldownSec != newConfig.Pool.RefreshCooldownSec ||
+		oldPoolConfig.UseCooldownSec != newConfig.Pool.UseCooldownSec {
+		pool.SetCooldowns(newConfig.Pool.RefreshCooldownSec, newConfig.Pool.UseCooldownSec)
+		logger.Info("🔄 冷却配置已更新: refresh=%ds, use=%ds",
+			newConfig.Pool.RefreshCooldownSec, newConfig.Pool.UseCooldownSec)
+	}
+
+	if oldPoolConfig.MaxConcurrentGen != newConfig.Pool.MaxConcurrentGen {
+		logger.Info("🔄 最大并发生成数: %d -> %d", oldPoolConfig.MaxConcurrentGen, newConfig.Pool.MaxConcurrentGen)
+		generationLimiter.Notify()
+	}
+
+	if oldPoolConfig.JWTRefreshMarginSec != newConfig.Pool.JWTRefreshMarginSec {
+		pool.SetJWTRefreshMargin(newConfig.Pool.JWTRefreshMarginSec)
+	}
+	if oldPoolConfig.JWTTTLSec != newConfig.Pool.JWTTTLSec {
+		pool.SetJWTTTL(newConfig.Pool.JWTTTLSec)
+	}
+	if oldPoolConfig.JWTRefreshMarginSec != newConfig.Pool.JWTRefreshMarginSec || oldPoolConfig.JWTTTLSec != newConfig.Pool.JWTTTLSec {
+		warnJWTTimingConfig()
+	}
+
+	if newConfig.Pool.MaxFailCount > 0 {
+		pool.MaxFailCount = newConfig.Pool.MaxFailCount
+	}
+
+	pool.EnableBrowserRefresh = newConfig.Pool.EnableBrowserRefresh
+	pool.BrowserRefreshHeadless = newConfig.Pool.BrowserRefreshHeadless
+	if newConfig.Pool.BrowserRefreshMaxRetry >= 0 {
+		pool.BrowserRefreshMaxRetry = newConfig.Pool.BrowserRefreshMaxRetry
+	}
+	pool.AutoDelete401 = newConfig.Pool.AutoDelete401
+	if oldPoolConfig.AutoDeleteMinFailures != newConfig.Pool.AutoDeleteMinFailures || oldPoolConfig.AutoDeleteGraceMinutes != newConfig.Pool.AutoDeleteGraceMinutes {
+		pool.SetAutoDeleteGrace(newConfig.Pool.AutoDeleteMinFailures, newConfig.Pool.AutoDeleteGraceMinutes)
+	}
+	pool.ExternalRefreshMode = newConfig.Pool.ExternalRefreshMode
+	register.MailChannelOrder = normalizeMailChannelOrder(newConfig.Pool.MailChannelOrder)
+	register.DuckMailBearer = strings.TrimSpace(newConfig.Pool.DuckMailBearer)
+	register.EnableGoRegister = newConfig.Pool.EnableGoRegister
+
+	// 补号目标与检查间隔（号池维护器每轮重新读取间隔）
+	if oldPoolConfig.TargetCount != newConfig.Pool.TargetCount || oldPoolConfig.MinCount != newConfig.Pool.MinCount ||
+		oldPoolConfig.CheckIntervalMinutes != newConfig.Pool.CheckIntervalMinutes {
+		register.TargetCount = newConfig.Pool.TargetCount
+		register.MinCount = newConfig.Pool.MinCount
+		register.CheckInterval = time.Duration(newConfig.Pool.CheckIntervalMinutes) * time.Minute
+		logger.Info("🔄 号池目标已更新: target=%d, min=%d, 检查间隔=%d分钟",
+			newConfig.Pool.TargetCount, newConfig.Pool.MinCount, newConfig.Pool.CheckIntervalMinutes)
+	}
+
+	// Flow 配置变更：重建客户端与 Token 池
+	if !reflect.DeepEqual(oldFlowConfig, newConfig.Flow) {
+		reloadFlowClient()
+	}
+
+	// 代理源变更（服务端模式不使用代理池）
+	if !(newConfig.PoolServer.Enable && newConfig.PoolServer.Mode == "server") {
+		subscribes, files := proxySourcesFromConfig(newConfig)
+		if proxy.Manager.UpdateSources(subscribes, files) {
+			logger.Info("🔄 代理源已更新: 订阅=%d, 文件=%d", len(subscribes), len(files))
+			proxy.Manager.StartAutoUpdate()
+		}
+		applyProxyBlacklistPolicy(newConfig.ProxyPool)
+		applyProxyReadyPolicy(newConfig.ProxyPool)
+	}
+
+	logger.Info("✅ 配置热重载完成")
+}
+
+// startConfigWatcher 启动配置文件监听
+func startConfigWatcher() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("创建配置监听器失败: %w", err)
+	}
+	configWatcher = watcher
+
+	go configWatchLoop(watcher)
+
+	// 监听配置目录
+	configDir := filepath.Dir(configPath)
+	if err := watcher.Add(configDir); err != nil {
+		return fmt.Errorf("添加配置目录监听失败: %w", err)
+	}
+
+	logger.Info("🔄 配置文件热重载已启用: %s", configPath)
+	return nil
+}
+
+// configWatchLoop 配置文件监听循环
+func configWatchLoop(watcher *fsnotify.Watcher) {
+	var lastReload time.Time
 	const debounceDelay = 500 * time.Millisecond
 
 	for {
 		select {
-		case event, ok := <-configWatcher.Events:
+		case event, ok := <-watcher.Events:
 			if !ok {
 				return
 			}
@@ -708,6 +1908,11 @@ func configWatchLoop() {
 			if filepath.Base(event.Name) != "config.json" {
 				continue
 			}
+			// 删除/重命名：部分编辑器以新文件替换原文件
+			if event.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+				handleConfigFileRemoved(watcher)
+				continue
+			}
 			// 只处理写入和创建事件
 			if event.Op&(fsnotify.Write|fsnotify.Create) == 0 {
 				continue
@@ -724,9 +1929,11 @@ func configWatchLoop() {
 			logger.Info("📝 检测到配置文件变更，正在重载...")
 			if err := reloadConfig(); err != nil {
 				logger.Error("❌ 配置重载失败: %v", err)
+				// 读到的可能是写入中途的内容，不对后续写入事件防抖，确保写完后能重载
+				lastReload = time.Time{}
 			}
 
-		case err, ok := <-configWatcher.Errors:
+		case err, ok := <-watcher.Errors:
 			if !ok {
 				return
 			}
@@ -735,6 +1942,23 @@ func configWatchLoop() {
 	}
 }
 
+// handleConfigFileRemoved 配置文件被删除或移走：保留当前配置并确认目录监听仍然有效；
+// 文件已被替换（新 inode）时直接重载
+func handleConfigFileRemoved(watcher *fsnotify.Watcher) {
+	if err := watcher.Add(filepath.Dir(configPath)); err != nil {
+		logger.Warn("⚠️ 重新添加配置目录监听失败: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, err := os.Stat(configPath); err != nil {
+		logger.Warn("⚠️ 配置文件已被删除或移走，继续使用当前配置，等待重新创建: %s", configPath)
+		return
+	}
+	logger.Info("📝 配置文件已被替换，正在重载...")
+	if err := reloadConfig(); err != nil {
+		logger.Error("❌ 配置重载失败: %v", err)
+	}
+}
+
 // stopConfigWatcher 停止配置文件监听
 func stopConfigWatcher() {
 	if configWatcher != nil {
@@ -747,7 +1971,6 @@ var (
 	Proxy         string
 	ListenAddr    string
 	DefaultConfig string
-	JwtTTL        = 270 * time.Second
 )
 
 // mergeConfig 合并配置：loaded 中有值的字段覆盖 base 中的默认值
@@ -768,8 +1991,14 @@ func mergeConfig(base, loaded *AppConfig) {
 	if loaded.DefaultConfig != "" {
 		base.DefaultConfig = loaded.DefaultConfig
 	}
+	base.ConfigIDs = loaded.ConfigIDs
+	base.ConfigIDPolicy = loaded.ConfigIDPolicy
 	// Debug 是 bool，直接覆盖
 	base.Debug = loaded.Debug
+	if strings.TrimSpace(loaded.LogLevel) != "" {
+		base.LogLevel = strings.TrimSpace(loaded.LogLevel)
+	}
+	base.RawStdout = loaded.RawStdout
 
 	// Pool 配置
 	if loaded.Pool.TargetCount > 0 {
@@ -809,9 +2038,60 @@ func mergeConfig(base, loaded *AppConfig) {
 	if loaded.Pool.MaxFailCount > 0 {
 		base.Pool.MaxFailCount = loaded.Pool.MaxFailCount
 	}
+	if loaded.Pool.AutoDeleteMinFailures > 0 {
+		base.Pool.AutoDeleteMinFailures = loaded.Pool.AutoDeleteMinFailures
+	}
+	if loaded.Pool.AutoDeleteGraceMinutes != 0 {
+		base.Pool.AutoDeleteGraceMinutes = loaded.Pool.AutoDeleteGraceMinutes
+	}
 	if loaded.Pool.BrowserRefreshMaxRetry > 0 {
 		base.Pool.BrowserRefreshMaxRetry = loaded.Pool.BrowserRefreshMaxRetry
 	}
+	if loaded.Pool.JWTRefreshMarginSec != 0 {
+		base.Pool.JWTRefreshMarginSec = loaded.Pool.JWTRefreshMarginSec
+	}
+	if loaded.Pool.JWTTTLSec > 0 {
+		base.Pool.JWTTTLSec = loaded.Pool.JWTTTLSec
+	}
+	if loaded.Pool.MaxConcurrentGen != 0 {
+		base.Pool.MaxConcurrentGen = loaded.Pool.MaxConcurrentGen
+	}
+	if loaded.Pool.GenQueueTimeoutSec != 0 {
+		base.Pool.GenQueueTimeoutSec = loaded.Pool.GenQueueTimeoutSec
+	}
+	if loaded.Pool.MaxImageN > 0 {
+		base.Pool.MaxImageN = loaded.Pool.MaxImageN
+	}
+	if loaded.Pool.BulkRefreshThreads > 0 {
+		base.Pool.BulkRefreshThreads = loaded.Pool.BulkRefreshThreads
+	}
+	if loaded.Pool.HealthCheckThreads > 0 {
+		base.Pool.HealthCheckThreads = loaded.Pool.HealthCheckThreads
+	}
+	if loaded.Pool.HeartbeatIntervalSec != 0 {
+		base.Pool.HeartbeatIntervalSec = loaded.Pool.HeartbeatIntervalSec
+	}
+	if loaded.Pool.MaxMediaBytes != 0 {
+		base.Pool.MaxMediaBytes = loaded.Pool.MaxMediaBytes
+	}
+	if loaded.Pool.IPStatsRetentionDays > 0 {
+		base.Pool.IPStatsRetentionDays = loaded.Pool.IPStatsRetentionDays
+	}
+	if loaded.Pool.IPStatsMaxEntries > 0 {
+		base.Pool.IPStatsMaxEntries = loaded.Pool.IPStatsMaxEntries
+	}
+	if loaded.Pool.MediaFetchTimeoutSec != 0 {
+		base.Pool.MediaFetchTimeoutSec = loaded.Pool.MediaFetchTimeoutSec
+	}
+	if loaded.Pool.ImageConvertPolicy != "" {
+		base.Pool.ImageConvertPolicy = loaded.Pool.ImageConvertPolicy
+	}
+	if loaded.Pool.MaxRequestBytes != 0 {
+		base.Pool.MaxRequestBytes = loaded.Pool.MaxRequestBytes
+	}
+	if loaded.Pool.StorageBackend != "" {
+		base.Pool.StorageBackend = loaded.Pool.StorageBackend
+	}
 
 	// PoolServer 配置
 	base.PoolServer = loaded.PoolServer
@@ -819,6 +2099,66 @@ func mergeConfig(base, loaded *AppConfig) {
 	// Flow 配置
 	base.Flow = loaded.Flow
 
+	// 熔断配置
+	if loaded.CircuitBreaker.FailureRate != 0 {
+		base.CircuitBreaker.FailureRate = loaded.CircuitBreaker.FailureRate
+	}
+	if loaded.CircuitBreaker.WindowSec > 0 {
+		base.CircuitBreaker.WindowSec = loaded.CircuitBreaker.WindowSec
+	}
+	if loaded.CircuitBreaker.MinRequests > 0 {
+		base.CircuitBreaker.MinRequests = loaded.CircuitBreaker.MinRequests
+	}
+	if loaded.CircuitBreaker.CooldownSec > 0 {
+		base.CircuitBreaker.CooldownSec = loaded.CircuitBreaker.CooldownSec
+	}
+
+	// 限流配置
+	base.RateLimit = loaded.RateLimit
+
+	// 审计日志配置
+	base.Audit = loaded.Audit
+
+	// 模型 → 账号标签路由
+	base.ModelTags = loaded.ModelTags
+
+	// 思考内容输出模式
+	base.ReasoningOutput = loaded.ReasoningOutput
+
+	// 全局系统提示词前后缀
+	base.GlobalSystemPrefix = loaded.GlobalSystemPrefix
+	base.GlobalSystemSuffix = loaded.GlobalSystemSuffix
+
+	// 默认模型
+	base.DefaultModel = loaded.DefaultModel
+	base.DefaultModels = loaded.DefaultModels
+
+	// 模型回退
+	base.ModelFallbacks = loaded.ModelFallbacks
+	base.ModelFallbackNote = loaded.ModelFallbackNote
+
+	// 配置备份
+	if loaded.ConfigBackups != 0 {
+		base.ConfigBackups = loaded.ConfigBackups
+	}
+
+	// 上游地址配置
+	if loaded.Upstream.APIBaseURL != "" {
+		base.Upstream.APIBaseURL = loaded.Upstream.APIBaseURL
+	}
+	if loaded.Upstream.Origin != "" {
+		base.Upstream.Origin = loaded.Upstream.Origin
+	}
+	if loaded.Upstream.OrigAuthPassthrough != "" {
+		base.Upstream.OrigAuthPassthrough = loaded.Upstream.OrigAuthPassthrough
+	}
+	base.Upstream.Referer = loaded.Upstream.Referer
+	base.Upstream.UserAgent = loaded.Upstream.UserAgent
+
+	// 真实 IP 解析
+	base.TrustedProxies = loaded.TrustedProxies
+	base.ClientIPHeader = strings.TrimSpace(loaded.ClientIPHeader)
+
 	// ProxyPool 配置
 	if len(loaded.ProxyPool.Subscribes) > 0 {
 		base.ProxyPool.Subscribes = loaded.ProxyPool.Subscribes
@@ -831,6 +2171,22 @@ func mergeConfig(base, loaded *AppConfig) {
 	}
 	base.ProxyPool.HealthCheck = loaded.ProxyPool.HealthCheck
 	base.ProxyPool.CheckOnStartup = loaded.ProxyPool.CheckOnStartup
+	base.ProxyPool.Sticky = loaded.ProxyPool.Sticky
+	if loaded.ProxyPool.BlacklistRate != 0 {
+		base.ProxyPool.BlacklistRate = loaded.ProxyPool.BlacklistRate
+	}
+	if loaded.ProxyPool.BlacklistMin > 0 {
+		base.ProxyPool.BlacklistMin = loaded.ProxyPool.BlacklistMin
+	}
+	if loaded.ProxyPool.MinHealthy > 0 {
+		base.ProxyPool.MinHealthy = loaded.ProxyPool.MinHealthy
+	}
+	if loaded.ProxyPool.ReadyTimeout > 0 {
+		base.ProxyPool.ReadyTimeout = loaded.ProxyPool.ReadyTimeout
+	}
+	if loaded.ProxyPool.FailureCooldown != 0 {
+		base.ProxyPool.FailureCooldown = loaded.ProxyPool.FailureCooldown
+	}
 
 	// Note
 	if len(loaded.Note) > 0 {
@@ -872,6 +2228,7 @@ func loadAppConfig() {
 				appConfig.Pool.ExternalRefreshMode = externalRefreshMode
 			}
 			logger.Info("✅ 加载配置文件: %s", configPath)
+			recordConfigSnapshot(data, "startup")
 		}
 	} else if os.IsNotExist(err) {
 		// 配置文件不存在，创建默认配置
@@ -893,6 +2250,24 @@ func loadAppConfig() {
 		appConfig.DefaultConfig = v
 	}
 	applySensitiveEnvOverrides(&appConfig)
+	envProblems := applyEnvOverrides(&appConfig)
+	if appConfig.RawStdout {
+		restoreStdout()
+	}
+	validation := validateConfig(&appConfig)
+	validation.Errors = append(envProblems, validation.Errors...)
+	for _, w := range validation.Warnings {
+		logger.Warn("⚠️ 配置警告: %s", w)
+	}
+	if len(validation.Errors) > 0 {
+		for _, e := range validation.Errors {
+			logger.Error("❌ 配置错误: %s", e)
+		}
+		log.Fatalf("❌ 配置校验未通过（%d 个错误），拒绝启动", len(validation.Errors))
+	}
+	if err := validateUpstreamConfig(&appConfig.Upstream); err != nil {
+		log.Fatalf("❌ 配置错误: %v", err)
+	}
 
 	// 设置全局变量
 	DataDir = appConfig.DataDir
@@ -900,11 +2275,14 @@ func loadAppConfig() {
 	ListenAddr = appConfig.ListenAddr
 	DefaultConfig = appConfig.DefaultConfig
 
-	// 应用调试模式
-	logger.SetDebugMode(appConfig.Debug)
+	// 应用调试模式与日志级别
+	applyLogLevel(appConfig)
 
 	// 应用号池配置
 	pool.SetCooldowns(appConfig.Pool.RefreshCooldownSec, appConfig.Pool.UseCooldownSec)
+	pool.SetJWTRefreshMargin(appConfig.Pool.JWTRefreshMarginSec)
+	pool.SetJWTTTL(appConfig.Pool.JWTTTLSec)
+	warnJWTTimingConfig()
 	if appConfig.Pool.MaxFailCount > 0 {
 		pool.MaxFailCount = appConfig.Pool.MaxFailCount
 	}
@@ -914,6 +2292,7 @@ func loadAppConfig() {
 		pool.BrowserRefreshMaxRetry = appConfig.Pool.BrowserRefreshMaxRetry
 	}
 	pool.AutoDelete401 = appConfig.Pool.AutoDelete401
+	pool.SetAutoDeleteGrace(appConfig.Pool.AutoDeleteMinFailures, appConfig.Pool.AutoDeleteGraceMinutes)
 	pool.ExternalRefreshMode = appConfig.Pool.ExternalRefreshMode
 	// 服务端模式下，如果 expired_action 是 delete，则同步设置 AutoDelete401
 	if appConfig.PoolServer.Enable && appConfig.PoolServer.Mode == "server" && appConfig.PoolServer.ExpiredAction == "delete" {
@@ -922,7 +2301,9 @@ func loadAppConfig() {
 	}
 	pool.DataDir = DataDir
 	pool.DefaultConfig = DefaultConfig
+	pool.SetConfigIDPolicy(appConfig.ConfigIDPolicy, appConfig.ConfigIDs)
 	pool.Proxy = Proxy
+	pool.UpstreamOrigin = appConfig.Upstream.Origin
 	register.DataDir = DataDir
 	register.TargetCount = appConfig.Pool.TargetCount
 	register.MinCount = appConfig.Pool.MinCount
@@ -960,6 +2341,7 @@ func initFlowClient() {
 		Timeout:         appConfig.Flow.Timeout,
 		PollInterval:    appConfig.Flow.PollInterval,
 		MaxPollAttempts: appConfig.Flow.MaxPollAttempts,
+		AuthRetry:       appConfig.Flow.AuthRetry,
 	}
 	if cfg.Proxy == "" {
 		cfg.Proxy = Proxy
@@ -988,7 +2370,7 @@ func initFlowClient() {
 	totalTokens := loadedFromDir + len(appConfig.Flow.Tokens)
 	if totalTokens == 0 {
 		logger.Info("📹 Flow 服务已启用但无可用 Token (请将 cookie 放入 data/at/ 目录)")
-		flowHandler = flow.NewGenerationHandler(flowClient)
+		flowHandler = newFlowHandler()
 		return
 	}
 
@@ -1000,31 +2382,122 @@ func initFlowClient() {
 		logger.Warn("⚠️ Flow 文件监听启动失败: %v", err)
 	}
 
-	flowHandler = flow.NewGenerationHandler(flowClient)
+	flowHandler = newFlowHandler()
 	logger.Info("📹 Flow 服务已启用，共 %d 个 Token (目录: %d, 配置: %d)", totalTokens, loadedFromDir, len(appConfig.Flow.Tokens))
 }
 
-func initProxyPool() {
-	// 服务端模式不需要代理池
-	if appConfig.PoolServer.Enable && appConfig.PoolServer.Mode == "server" {
-		logger.Info("🖥️ 服务端模式，跳过代理初始化")
-		return
+// reloadFlowClient 按当前配置重建 Flow 客户端与 Token 池。
+// 进行中的请求持有旧的处理器与客户端，不受影响；新请求使用新实例
+func reloadFlowClient() {
+	oldTokenPool := flowTokenPool
+	if !appConfig.Flow.Enable {
+		flowHandler = nil
+		flowTokenPool = nil
+		flowClient = nil
 	}
+	initFlowClient()
+	if oldTokenPool != nil {
+		oldTokenPool.Stop()
+	}
+	logger.Info("🔄 Flow 配置已更新，客户端与 Token 池已重建")
+}
 
-	// 初始化 sing-box（用于 hysteria2/tuic 等协议）
-	proxy.InitSingbox()
+// newFlowHandler 创建 Flow 生成处理器，并挂载 Token 禁用通知
+func newFlowHandler() *flow.GenerationHandler {
+	h := flow.NewGenerationHandler(flowClient)
+	h.OnTokenDisabled = notifyFlowTokenDisabled
+	return h
+}
 
-	// 添加订阅链接（新配置）
-	for _, sub := range appConfig.ProxyPool.Subscribes {
-		proxy.Manager.AddSubscribeURL(sub)
+// notifyFlowTokenDisabled Flow Token 认证失效被禁用时记录日志并通知 Webhook
+func notifyFlowTokenDisabled(token *flow.FlowToken, reason string) {
+	logger.Warn("⛔ Flow Token 已禁用: %s (%s) - %s", token.ShortID(), token.Email, reason)
+
+	configMu.RLock()
+	webhook := strings.TrimSpace(appConfig.Flow.DisableWebhook)
+	configMu.RUnlock()
+	if webhook == "" {
+		return
+	}
+
+	payload, _ := json.Marshal(gin.H{
+		"event":    "flow_token_disabled",
+		"token_id": token.ShortID(),
+		"email":    token.Email,
+		"reason":   reason,
+		"time":     time.Now().Format(time.RFC3339),
+	})
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(webhook, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		logger.Warn("⚠️ Flow Token 禁用通知发送失败: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		logger.Warn("⚠️ Flow Token 禁用通知返回 HTTP %d", resp.StatusCode)
 	}
+}
+
+// proxySourcesFromConfig 汇总配置中的代理订阅（含旧版 proxy_subscribe）和代理文件
+func proxySourcesFromConfig(cfg AppConfig) ([]string, []string) {
+	subscribes := append([]string{}, cfg.ProxyPool.Subscribes...)
 	// 兼容旧配置
-	if appConfig.ProxySubscribe != "" {
-		proxy.Manager.AddSubscribeURL(appConfig.ProxySubscribe)
+	if cfg.ProxySubscribe != "" {
+		subscribes = append(subscribes, cfg.ProxySubscribe)
+	}
+	files := append([]string{}, cfg.ProxyPool.Files...)
+	return subscribes, files
+}
+
+const (
+	defaultProxyBlacklistRate = 0.8
+	defaultProxyBlacklistMin  = 5
+)
+
+// applyProxyBlacklistPolicy 同步代理节点自动拉黑与近期失败降权策略（0=默认, 失败率/降权时长<0=禁用）
+func applyProxyBlacklistPolicy(cfg ProxyConfig) {
+	rate := cfg.BlacklistRate
+	if rate == 0 {
+		rate = defaultProxyBlacklistRate
+	}
+	minRequests := cfg.BlacklistMin
+	if minRequests <= 0 {
+		minRequests = defaultProxyBlacklistMin
+	}
+	proxy.Manager.SetBlacklistPolicy(rate, minRequests)
+
+	window := proxy.DefaultFailureWindow
+	if cfg.FailureCooldown != 0 {
+		window = time.Duration(cfg.FailureCooldown) * time.Second
+	}
+	proxy.Manager.SetFailureWindow(window)
+}
+
+// applyProxyReadyPolicy 设置代理池就绪门槛：健康节点数达到 min_healthy_proxies 才标记就绪
+func applyProxyReadyPolicy(cfg ProxyConfig) {
+	proxy.Manager.SetMinHealthy(cfg.MinHealthy)
+	pool.SetProxyReadyGate(cfg.MinHealthy, cfg.ReadyTimeout)
+}
+
+func initProxyPool() {
+	// 服务端模式不需要代理池
+	if appConfig.PoolServer.Enable && appConfig.PoolServer.Mode == "server" {
+		logger.Info("🖥️ 服务端模式，跳过代理初始化")
+		return
 	}
+	applyProxyBlacklistPolicy(appConfig.ProxyPool)
+	applyProxyReadyPolicy(appConfig.ProxyPool)
+
+	// 初始化 sing-box（用于 hysteria2/tuic 等协议）
+	proxy.InitSingbox()
 
-	// 添加代理文件
-	for _, file := range appConfig.ProxyPool.Files {
+	// 添加订阅链接和代理文件
+	subscribes, files := proxySourcesFromConfig(appConfig)
+	for _, sub := range subscribes {
+		proxy.Manager.AddSubscribeURL(sub)
+	}
+	for _, file := range files {
 		proxy.Manager.AddProxyFile(file)
 	}
 	if err := proxy.Manager.LoadAll(); err != nil {
@@ -1055,9 +2528,13 @@ func initProxyPool() {
 				}
 			}
 		}()
-	} else if proxy.Manager.TotalCount() > 0 {
-		// 不需要健康检查时直接标记就绪
-		proxy.Manager.SetReady(true)
+	} else if total := proxy.Manager.TotalCount(); total > 0 {
+		// 不需要健康检查时按节点总数判定就绪
+		required := proxy.Manager.RequiredHealthy()
+		if total < required {
+			logger.Warn("⚠️ 代理节点数 %d 低于就绪要求 %d，代理池保持未就绪", total, required)
+		}
+		proxy.Manager.SetReady(total >= required)
 	}
 	if proxy.Manager.TotalCount() == 0 {
 		if appConfig.ProxyPool.Proxy != "" {
@@ -1085,6 +2562,22 @@ func initProxyPool() {
 	register.ReleaseProxy = func(proxyURL string) {
 		proxy.Manager.ReleaseByURL(proxyURL)
 	}
+	register.ProxyKeyOf = proxy.Manager.NodeKey
+	register.ReportProxyResult = proxy.Manager.ReportResult
+	pool.ReportProxyResult = proxy.Manager.ReportResult
+	pool.ReleaseProxy = func(proxyURL string) {
+		proxy.Manager.ReleaseByURL(proxyURL)
+		logger.Debug("释放代理: %s", proxyURL)
+	}
+	pool.GetAccountProxy = func(proxyKey string) string {
+		if proxy.Manager.HealthyCount() > 0 {
+			if proxyURL := nextAccountProxy(proxyKey); proxyURL != "" {
+				return proxyURL
+			}
+		}
+		return Proxy
+	}
+	pool.ProxyKeyOf = proxy.Manager.NodeKey
 }
 
 var BaseModels = []string{
@@ -1160,6 +2653,84 @@ func GetAvailableModels() []string {
 	return BaseModels
 }
 
+// knownModel 检查模型是否在可用模型列表中（flowEnabled 时包含 Flow 模型）
+func knownModel(model string, flowEnabled bool) bool {
+	for _, m := range BaseModels {
+		if m == model {
+			return true
+		}
+	}
+	if flowEnabled {
+		for _, m := range FlowModels {
+			if m == model {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// 默认模型适用的 API 路径
+const (
+	apiPathOpenAI = "openai"
+	apiPathClaude = "claude"
+	apiPathGemini = "gemini"
+)
+
+// defaultModelFor 返回指定 API 路径未指定 model 时使用的模型：路径配置 → default_model → 首个基础模型。
+// 配置的模型当前不可用（如 Flow 已关闭）时回退，结果不受 Flow 开关影响
+func defaultModelFor(path string) string {
+	candidates := []string{appConfig.DefaultModel}
+	switch path {
+	case apiPathOpenAI:
+		candidates = append([]string{appConfig.DefaultModels.OpenAI}, candidates...)
+	case apiPathClaude:
+		candidates = append([]string{appConfig.DefaultModels.Claude}, candidates...)
+	case apiPathGemini:
+		candidates = append([]string{appConfig.DefaultModels.Gemini}, candidates...)
+	}
+	for _, model := range candidates {
+		if model = strings.TrimSpace(model); model != "" && knownModel(model, flowHandler != nil) {
+			return model
+		}
+	}
+	return BaseModels[0]
+}
+
+// modelFallbacksFor 返回模型配置的回退模型（去重，跳过自身、Flow 模型与未知模型），未配置返回空
+func modelFallbacksFor(model string) []string {
+	configMu.RLock()
+	configured := appConfig.ModelFallbacks[model]
+	configMu.RUnlock()
+	if flow.IsFlowModel(model) {
+		return nil
+	}
+	seen := map[string]bool{model: true}
+	var fallbacks []string
+	for _, fallback := range configured {
+		fallback = strings.TrimSpace(fallback)
+		if fallback == "" || seen[fallback] || flow.IsFlowModel(fallback) || !knownModel(fallback, false) {
+			continue
+		}
+		seen[fallback] = true
+		fallbacks = append(fallbacks, fallback)
+	}
+	return fallbacks
+}
+
+// modelFallbackNotice 使用回退模型时是否在响应中注明
+func modelFallbackNotice() bool {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return appConfig.ModelFallbackNote
+}
+
+// modelFallbackHeader 使用回退模型时的响应头，值为实际使用的模型
+const modelFallbackHeader = "X-Model-Fallback"
+
+// configIDHeader 请求头，指定本次请求使用的 configId（须属于所选账号）
+const configIDHeader = "X-Config-Id"
+
 // 模型名称映射到 Google API 的 modelId
 var modelMapping = map[string]string{
 	"gemini-2.5-flash":     "gemini-2.5-flash",
@@ -1168,6 +2739,17 @@ var modelMapping = map[string]string{
 	"gemini-3-pro":         "gemini-3-pro",
 }
 
+// modelOutputTokenLimits 上游 modelId 的单次输出 tokens 上限（与 Gemini 模型元数据的 outputTokenLimit 一致）
+var modelOutputTokenLimits = map[string]int{
+	"gemini-2.5-flash":     65536,
+	"gemini-2.5-pro":       65536,
+	"gemini-3-pro-preview": 65536,
+	"gemini-3-pro":         65536,
+}
+
+// defaultOutputTokenLimit 未收录模型在模型列表中展示的 outputTokenLimit
+const defaultOutputTokenLimit = 8192
+
 func getEnv(key, def string) string {
 	if v := os.Getenv(key); v != "" {
 		return v
@@ -1225,16 +2807,166 @@ func applySensitiveEnvOverrides(cfg *AppConfig) {
 	}
 }
 
+// envOverridePrefix 通用环境变量覆盖前缀：B2A_ + 配置路径大写（"." 换成 "_"），
+// 如 pool.target_count → B2A_POOL_TARGET_COUNT、flow.enable → B2A_FLOW_ENABLE
+const envOverridePrefix = "B2A_"
+
+// envOverrideAliasSections 这些配置段还接受不带前缀的变量名（如 POOL_TARGET_COUNT、FLOW_ENABLE），
+// 同时设置时 B2A_* 优先
+var envOverrideAliasSections = []string{"pool", "flow"}
+
+// envOverrideField 可被环境变量覆盖的配置叶子字段
+type envOverrideField struct {
+	Name  string // 环境变量名
+	Alias string // 不带前缀的别名（仅 envOverrideAliasSections 中的字段）
+	Path  string // 配置路径，如 pool.target_count
+	value reflect.Value
+}
+
+// envOverrideName 配置路径对应的环境变量名
+func envOverrideName(path string) string {
+	return envOverridePrefix + envOverrideAlias(path)
+}
+
+// envOverrideAlias 配置路径对应的不带前缀变量名
+func envOverrideAlias(path string) string {
+	return strings.ToUpper(strings.ReplaceAll(path, ".", "_"))
+}
+
+// lookupEnvOverride 读取配置路径的覆盖值，返回实际生效的变量名；未设置时 name 为空
+func lookupEnvOverride(path string) (name, raw string) {
+	if raw = strings.TrimSpace(os.Getenv(envOverrideName(path))); raw != "" {
+		return envOverrideName(path), raw
+	}
+	if envOverrideHasAlias(path) {
+		if raw = strings.TrimSpace(os.Getenv(envOverrideAlias(path))); raw != "" {
+			return envOverrideAlias(path), raw
+		}
+	}
+	return "", ""
+}
+
+// envOverrideHasAlias 配置路径是否属于接受无前缀别名的配置段
+func envOverrideHasAlias(path string) bool {
+	section, _, ok := strings.Cut(path, ".")
+	if !ok {
+		return false
+	}
+	for _, s := range envOverrideAliasSections {
+		if s == section {
+			return true
+		}
+	}
+	return false
+}
+
+// envOverrideSet 配置路径是否设置了非空的环境变量覆盖
+func envOverrideSet(path string) bool {
+	name, _ := lookupEnvOverride(path)
+	return name != ""
+}
+
+// envOverrideFields 按 json 标签遍历配置，收集字符串/布尔/数值/字符串列表字段
+func envOverrideFields(cfg *AppConfig) []envOverrideField {
+	var fields []envOverrideField
+	var walk func(prefix string, v reflect.Value)
+	walk = func(prefix string, v reflect.Value) {
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+			if name == "" || name == "-" {
+				continue
+			}
+			path := name
+			if prefix != "" {
+				path = prefix + "." + name
+			}
+			fv := v.Field(i)
+			switch fv.Kind() {
+			case reflect.Struct:
+				walk(path, fv)
+			case reflect.String, reflect.Bool, reflect.Int, reflect.Int64, reflect.Float64:
+				fields = append(fields, newEnvOverrideField(path, fv))
+			case reflect.Slice:
+				if fv.Type().Elem().Kind() == reflect.String {
+					fields = append(fields, newEnvOverrideField(path, fv))
+				}
+			}
+		}
+	}
+	walk("", reflect.ValueOf(cfg).Elem())
+	return fields
+}
+
+func newEnvOverrideField(path string, v reflect.Value) envOverrideField {
+	field := envOverrideField{Name: envOverrideName(path), Path: path, value: v}
+	if envOverrideHasAlias(path) {
+		field.Alias = envOverrideAlias(path)
+	}
+	return field
+}
+
+// setEnvOverrideValue 按字段类型解析环境变量值，列表以逗号分隔
+func setEnvOverrideValue(v reflect.Value, raw string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(raw)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return fmt.Errorf("需要布尔值 (true/false)")
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || v.OverflowInt(n) {
+			return fmt.Errorf("需要整数")
+		}
+		v.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return fmt.Errorf("需要数字")
+		}
+		v.SetFloat(f)
+	case reflect.Slice:
+		v.Set(reflect.ValueOf(splitCSV(raw)))
+	}
+	return nil
+}
+
+// applyEnvOverrides 在配置文件合并之后应用 B2A_* 及 pool/flow 别名环境变量覆盖
+// （优先级：B2A_* > 别名 > 旧环境变量 > 配置文件 > 默认值），
+// 返回无法解析的变量说明；无效的变量不会修改对应字段
+func applyEnvOverrides(cfg *AppConfig) []string {
+	if cfg == nil {
+		return nil
+	}
+	var problems []string
+	for _, field := range envOverrideFields(cfg) {
+		name, raw := lookupEnvOverride(field.Path)
+		if name == "" {
+			continue
+		}
+		if err := setEnvOverrideValue(field.value, raw); err != nil {
+			problems = append(problems, fmt.Sprintf("环境变量 %s=%q 无效: %v", name, raw, err))
+		}
+	}
+	cfg.APIKeys = normalizeAPIKeys(cfg.APIKeys)
+	return problems
+}
+
 func getCommonHeaders(jwt, origAuth string) map[string]string {
+	passthrough, referer, userAgent := upstreamHeaderSettings()
 	headers := map[string]string{
 		"accept":             "*/*",
 		"accept-encoding":    "gzip, deflate, br, zstd",
 		"accept-language":    "zh-CN,zh;q=0.9,en;q=0.8",
 		"authorization":      "Bearer " + jwt,
 		"content-type":       "application/json",
-		"origin":             "https://business.gemini.google",
-		"referer":            "https://business.gemini.google/",
-		"user-agent":         "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/140.0.0.0 Safari/537.36",
+		"origin":             upstreamOrigin(),
+		"referer":            referer,
+		"user-agent":         userAgent,
 		"x-server-timeout":   "1800",
 		"sec-ch-ua":          `"Chromium";v="124", "Google Chrome";v="124", "Not-A.Brand";v="99"`,
 		"sec-ch-ua-mobile":   "?0",
@@ -1243,8 +2975,8 @@ func getCommonHeaders(jwt, origAuth string) map[string]string {
 		"sec-fetch-mode":     "cors",
 		"sec-fetch-site":     "cross-site",
 	}
-	// 同时携带原始 authorization
-	if origAuth != "" && !strings.HasPrefix(strings.ToLower(origAuth), "bearer fallback-csesidx-") {
+	// 同时携带原始 authorization（按 upstream.orig_auth_passthrough 策略）
+	if shouldPassOrigAuth(passthrough, origAuth) {
 		headers["x-original-authorization"] = origAuth
 	}
 	return headers
@@ -1302,7 +3034,7 @@ func createSessionOnce(jwt, configID, origAuth string) (string, error) {
 	}
 
 	bodyBytes, _ := json.Marshal(body)
-	req, _ := http.NewRequest("POST", "https://biz-discoveryengine.googleapis.com/v1alpha/locations/global/widgetCreateSession", bytes.NewReader(bodyBytes))
+	req, _ := http.NewRequest("POST", upstreamAPIURL("/v1alpha/locations/global/widgetCreateSession"), bytes.NewReader(bodyBytes))
 
 	for k, v := range getCommonHeaders(jwt, origAuth) {
 		req.Header.Set(k, v)
@@ -1320,7 +3052,7 @@ func createSessionOnce(jwt, configID, origAuth string) (string, error) {
 	}
 
 	if resp.StatusCode != 200 {
-		return "", fmt.Errorf("createSession 失败: %d %s", resp.StatusCode, string(respBody))
+		return "", fmt.Errorf("createSession 失败: %d %s", resp.StatusCode, sanitizeUpstreamText(string(respBody)))
 	}
 
 	var result struct {
@@ -1340,6 +3072,10 @@ func uploadContextFile(jwt, configID, sessionName, mimeType, base64Content, orig
 		ext = parts[1]
 	}
 	fileName := fmt.Sprintf("upload_%d_%s.%s", time.Now().Unix(), uuid.New().String()[:6], ext)
+	// 上传前兜底检查大小，覆盖未经 parseMediaURL/downloadMedia 的调用路径
+	if err := checkMediaSize(int64(base64.StdEncoding.DecodedLen(len(base64Content)))); err != nil {
+		return "", err
+	}
 
 	body := map[string]interface{}{
 		"configId":         configID,
@@ -1353,7 +3089,7 @@ func uploadContextFile(jwt, configID, sessionName, mimeType, base64Content, orig
 	}
 
 	bodyBytes, _ := json.Marshal(body)
-	req, _ := http.NewRequest("POST", "https://biz-discoveryengine.googleapis.com/v1alpha/locations/global/widgetAddContextFile", bytes.NewReader(bodyBytes))
+	req, _ := http.NewRequest("POST", upstreamAPIURL("/v1alpha/locations/global/widgetAddContextFile"), bytes.NewReader(bodyBytes))
 
 	for k, v := range getCommonHeaders(jwt, origAuth) {
 		req.Header.Set(k, v)
@@ -1371,7 +3107,7 @@ func uploadContextFile(jwt, configID, sessionName, mimeType, base64Content, orig
 	}
 
 	if resp.StatusCode != 200 {
-		return "", fmt.Errorf("上传文件失败: %d %s", resp.StatusCode, string(respBody))
+		return "", fmt.Errorf("上传文件失败: %d %s", resp.StatusCode, sanitizeUpstreamText(string(respBody)))
 	}
 
 	var result struct {
@@ -1384,7 +3120,7 @@ func uploadContextFile(jwt, configID, sessionName, mimeType, base64Content, orig
 	}
 
 	if result.AddContextFileResponse.FileID == "" {
-		return "", fmt.Errorf("上传成功但 fileId 为空，响应: %s", string(respBody))
+		return "", fmt.Errorf("上传成功但 fileId 为空，响应: %s", sanitizeUpstreamText(string(respBody)))
 	}
 
 	return result.AddContextFileResponse.FileID, nil
@@ -1400,7 +3136,7 @@ func uploadContextFileByURL(jwt, configID, sessionName, imageURL, origAuth strin
 	}
 
 	bodyBytes, _ := json.Marshal(body)
-	req, _ := http.NewRequest("POST", "https://biz-discoveryengine.googleapis.com/v1alpha/locations/global/widgetAddContextFile", bytes.NewReader(bodyBytes))
+	req, _ := http.NewRequest("POST", upstreamAPIURL("/v1alpha/locations/global/widgetAddContextFile"), bytes.NewReader(bodyBytes))
 
 	for k, v := range getCommonHeaders(jwt, origAuth) {
 		req.Header.Set(k, v)
@@ -1418,7 +3154,7 @@ func uploadContextFileByURL(jwt, configID, sessionName, imageURL, origAuth strin
 	}
 
 	if resp.StatusCode != 200 {
-		return "", fmt.Errorf("URL上传文件失败: %d %s", resp.StatusCode, string(respBody))
+		return "", fmt.Errorf("URL上传文件失败: %d %s", resp.StatusCode, sanitizeUpstreamText(string(respBody)))
 	}
 
 	var result struct {
@@ -1431,7 +3167,7 @@ func uploadContextFileByURL(jwt, configID, sessionName, imageURL, origAuth strin
 	}
 
 	if result.AddContextFileResponse.FileID == "" {
-		return "", fmt.Errorf("URL上传成功但 fileId 为空，响应: %s", string(respBody))
+		return "", fmt.Errorf("URL上传成功但 fileId 为空，响应: %s", sanitizeUpstreamText(string(respBody)))
 	}
 
 	return result.AddContextFileResponse.FileID, nil
@@ -1452,7 +3188,8 @@ type ContentPart struct {
 }
 
 type ImageURL struct {
-	URL string `json:"url"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers,omitempty"` // 下载时附加的请求头（鉴权 CDN 等）
 }
 
 // OpenAI格式的工具定义
@@ -1469,6 +3206,7 @@ type FunctionDef struct {
 
 // 工具调用结果
 type ToolCall struct {
+	Index    int          `json:"index"` // 并行工具调用的序号（从 0 开始）
 	ID       string       `json:"id"`
 	Type     string       `json:"type"` // "function"
 	Function FunctionCall `json:"function"`
@@ -1480,13 +3218,334 @@ type FunctionCall struct {
 }
 
 type ChatRequest struct {
-	Model       string    `json:"model"`
-	Messages    []Message `json:"messages"`
-	Stream      bool      `json:"stream"`
-	Temperature float64   `json:"temperature"`
-	TopP        float64   `json:"top_p"`
-	Tools       []ToolDef `json:"tools,omitempty"`       // 工具定义
-	ToolChoice  string    `json:"tool_choice,omitempty"` // "auto", "none", "required"
+	Model       string      `json:"model"`
+	Messages    []Message   `json:"messages"`
+	Stream      bool        `json:"stream"`
+	Temperature float64     `json:"temperature"`
+	TopP        float64     `json:"top_p"`
+	Tools       []ToolDef   `json:"tools,omitempty"`        // 工具定义
+	ToolChoice  interface{} `json:"tool_choice,omitempty"`  // "auto" / "none" / "required" 或 {"type":"function","function":{"name":...}}
+	Size        string      `json:"size,omitempty"`         // 图片尺寸（OpenAI images 风格，如 1024x1024）
+	AspectRatio string      `json:"aspect_ratio,omitempty"` // 图片宽高比（如 16:9），优先于 size
+	Timeout     float64     `json:"timeout,omitempty"`      // 客户端最长等待时间（秒），X-Request-Timeout 头优先
+	Duration    int         `json:"duration,omitempty"`     // Flow 视频时长（秒），X-Flow-Duration 头可替代
+	Quality     string      `json:"quality,omitempty"`      // Flow 视频清晰度（720p/1080p），X-Flow-Quality 头可替代
+
+	ReasoningEffort string `json:"reasoning_effort,omitempty"` // 思考强度（low/medium/high），映射为思考预算
+	ThinkingBudget  *int   `json:"thinking_budget,omitempty"`  // 思考预算 tokens（-1 为动态），优先于 reasoning_effort
+
+	IncludeReasoning *bool  `json:"include_reasoning,omitempty"` // false 时丢弃思考内容
+	ReasoningFormat  string `json:"reasoning_format,omitempty"`  // 思考内容输出: separate / none / think，优先于 include_reasoning
+
+	Logprobs    bool `json:"logprobs,omitempty"`     // 上游不支持，为 true 时返回 400
+	TopLogprobs *int `json:"top_logprobs,omitempty"` // 需同时设置 logprobs
+
+	MaxTokens           int `json:"max_tokens,omitempty"`            // 最大输出 tokens
+	MaxCompletionTokens int `json:"max_completion_tokens,omitempty"` // 同 max_tokens（OpenAI 新字段），优先于 max_tokens
+
+	PresencePenalty  *float64 `json:"presence_penalty,omitempty"`  // 存在惩罚（上游不支持，接受后忽略）
+	FrequencyPenalty *float64 `json:"frequency_penalty,omitempty"` // 频率惩罚（上游不支持，接受后忽略）
+}
+
+// 思考内容输出模式
+const (
+	reasoningOutputSeparate = "separate" // 输出到 reasoning_content 字段（默认）
+	reasoningOutputNone     = "none"     // 丢弃思考内容
+	reasoningOutputThink    = "think"    // 以 <think>...</think> 折叠进 content
+)
+
+func validReasoningOutput(mode string) bool {
+	switch mode {
+	case reasoningOutputSeparate, reasoningOutputNone, reasoningOutputThink:
+		return true
+	}
+	return false
+}
+
+// resolveReasoningOutput 解析思考内容输出模式：reasoning_format 优先，其次 include_reasoning=false，最后使用配置 reasoning_output
+func resolveReasoningOutput(format string, include *bool) (string, error) {
+	if format = strings.ToLower(strings.TrimSpace(format)); format != "" {
+		if !validReasoningOutput(format) {
+			return "", fmt.Errorf("reasoning_format 无效: %q（可选 separate/none/think）", format)
+		}
+		return format, nil
+	}
+	if include != nil && !*include {
+		return reasoningOutputNone, nil
+	}
+	configMu.RLock()
+	mode := strings.TrimSpace(appConfig.ReasoningOutput)
+	configMu.RUnlock()
+	if validReasoningOutput(mode) {
+		return mode, nil
+	}
+	return reasoningOutputSeparate, nil
+}
+
+// reasoningStream 按输出模式转换流式思考内容，think 模式下跟踪 <think> 标签是否已打开
+type reasoningStream struct {
+	mode string
+	open bool
+}
+
+// Thought 返回思考文本对应的 delta，nil 表示丢弃
+func (s *reasoningStream) Thought(text string) map[string]interface{} {
+	switch s.mode {
+	case reasoningOutputNone:
+		return nil
+	case reasoningOutputThink:
+		if !s.open {
+			s.open = true
+			text = "<think>\n" + text
+		}
+		return map[string]interface{}{"content": text}
+	}
+	return map[string]interface{}{"reasoning_content": text}
+}
+
+// Close 返回关闭 <think> 标签的内容，未打开时为空
+func (s *reasoningStream) Close() string {
+	if !s.open {
+		return ""
+	}
+	s.open = false
+	return "\n</think>\n\n"
+}
+
+// foldReasoning 按输出模式处理非流式响应的思考内容，返回新的 content 与 reasoning_content（为空时不输出）
+func foldReasoning(mode, reasoning, content string) (string, string) {
+	if reasoning == "" {
+		return content, ""
+	}
+	switch mode {
+	case reasoningOutputNone:
+		return content, ""
+	case reasoningOutputThink:
+		return "<think>\n" + reasoning + "\n</think>\n\n" + content, ""
+	}
+	return content, reasoning
+}
+
+const maxThinkingBudget = 32768
+
+// reasoningEffortBudgets reasoning_effort 到思考预算 tokens 的映射
+var reasoningEffortBudgets = map[string]int{
+	"low":    1024,
+	"medium": 8192,
+	"high":   24576,
+}
+
+// modelSupportsThinking 判断模型是否支持思考预算（Gemini 文本/搜索模型，不含图片/视频生成）
+func modelSupportsThinking(model string) bool {
+	if strings.Contains(model, "-image") || strings.Contains(model, "-video") {
+		return false
+	}
+	_, ok := modelMapping[strings.ReplaceAll(model, "-search", "")]
+	return ok
+}
+
+// resolveThinkingBudget 根据 thinking_budget / reasoning_effort 解析思考预算，未指定时返回 nil（使用模型默认值）
+func resolveThinkingBudget(model, effort string, budget *int) (*int, error) {
+	effort = strings.ToLower(strings.TrimSpace(effort))
+	if effort == "" && budget == nil {
+		return nil, nil
+	}
+	if !modelSupportsThinking(model) {
+		return nil, fmt.Errorf("模型 %s 不支持思考预算（reasoning_effort/thinking_budget）", model)
+	}
+	if budget != nil {
+		if *budget < -1 || *budget > maxThinkingBudget {
+			return nil, fmt.Errorf("thinking_budget 无效: %d（范围 -1~%d，-1 为动态）", *budget, maxThinkingBudget)
+		}
+		return budget, nil
+	}
+	n, ok := reasoningEffortBudgets[effort]
+	if !ok {
+		return nil, fmt.Errorf("reasoning_effort 无效: %q（可选 low/medium/high）", effort)
+	}
+	return &n, nil
+}
+
+// modelOutputTokenLimit 按上游模型元数据返回单次输出 tokens 上限；-image/-video/-search 变体与基础模型相同，
+// 未知模型返回 0
+func modelOutputTokenLimit(model string) int {
+	base := strings.NewReplacer("-image", "", "-video", "", "-search", "").Replace(model)
+	return modelOutputTokenLimits[modelMapping[base]]
+}
+
+// listedOutputTokenLimit 模型列表中展示的 outputTokenLimit，未知模型使用 defaultOutputTokenLimit
+func listedOutputTokenLimit(model string) int {
+	if limit := modelOutputTokenLimit(model); limit > 0 {
+		return limit
+	}
+	return defaultOutputTokenLimit
+}
+
+// ModelCapabilities 模型能力标记（用于模型列表，便于客户端自动选择模型）
+type ModelCapabilities struct {
+	Vision          bool `json:"vision"`           // 支持图片输入
+	ImageGeneration bool `json:"image_generation"` // 支持图片生成
+	VideoGeneration bool `json:"video_generation"` // 支持视频生成
+	Search          bool `json:"search"`           // 支持联网搜索
+	ToolCalling     bool `json:"tool_calling"`     // 支持工具调用（tools / functionDeclarations）
+}
+
+// modelCapabilities 推导模型能力：Flow 模型按 FlowModelConfig，Gemini 模型按 -image/-video/-search 后缀，
+// 无后缀时与 buildToolsSpec 一致，同时启用图片、视频生成与搜索
+func modelCapabilities(model string) ModelCapabilities {
+	if cfg, ok := flow.GetFlowModelConfig(model); ok {
+		return ModelCapabilities{
+			Vision:          cfg.Type == flow.ModelTypeImage || cfg.SupportsImages,
+			ImageGeneration: cfg.Type == flow.ModelTypeImage,
+			VideoGeneration: cfg.Type == flow.ModelTypeVideo,
+		}
+	}
+	isImage := strings.Contains(model, "-image")
+	isVideo := strings.Contains(model, "-video")
+	isSearch := strings.Contains(model, "-search")
+	noSuffix := !isImage && !isVideo && !isSearch
+	return ModelCapabilities{
+		Vision:          true,
+		ImageGeneration: isImage || noSuffix,
+		VideoGeneration: isVideo || noSuffix,
+		Search:          isSearch || noSuffix,
+		ToolCalling:     modelSupportsThinking(model),
+	}
+}
+
+// geminiCapabilities 以 Gemini 风格（驼峰）输出模型能力
+func geminiCapabilities(model string) gin.H {
+	caps := modelCapabilities(model)
+	return gin.H{
+		"vision":          caps.Vision,
+		"imageGeneration": caps.ImageGeneration,
+		"videoGeneration": caps.VideoGeneration,
+		"search":          caps.Search,
+		"toolCalling":     caps.ToolCalling,
+	}
+}
+
+// isRequestParamError 判断上游 400 是否由请求参数引起（INVALID_ARGUMENT / 未知字段）
+func isRequestParamError(body []byte) bool {
+	return bytes.Contains(body, []byte("INVALID_ARGUMENT")) || bytes.Contains(body, []byte("Invalid JSON payload"))
+}
+
+// resolveMaxTokens 解析 max_completion_tokens / max_tokens，未指定时返回 0（不限制）；
+// 超出模型输出上限时按上限截取（SDK 常默认携带较大的 max_tokens），负数返回错误
+func resolveMaxTokens(model string, maxTokens, maxCompletionTokens int, reqLog *logger.Logger) (int, error) {
+	n, field := maxTokens, "max_tokens"
+	if maxCompletionTokens != 0 {
+		n, field = maxCompletionTokens, "max_completion_tokens"
+	}
+	if n < 0 {
+		return 0, fmt.Errorf("%s 无效: %d", field, n)
+	}
+	if limit := modelOutputTokenLimit(model); limit > 0 && n > limit {
+		reqLog.Debug("ℹ️ %s=%d 超过模型 %s 输出上限，按 %d 处理", field, n, model, limit)
+		return limit, nil
+	}
+	return n, nil
+}
+
+// logIgnoredPenalties presence_penalty / frequency_penalty 上游 widgetStreamAssist 没有对应字段，
+// 接受但不转发，只记录 debug 日志，避免总是携带这些字段的客户端收到 400
+func logIgnoredPenalties(presence, frequency *float64, reqLog *logger.Logger) {
+	if presence != nil {
+		reqLog.Debug("ℹ️ 上游不支持 presence_penalty=%v，已忽略", *presence)
+	}
+	if frequency != nil {
+		reqLog.Debug("ℹ️ 上游不支持 frequency_penalty=%v，已忽略", *frequency)
+	}
+}
+
+// outputBudget 按估算 tokens（约 4 字节/token，与统计口径一致）兜底截断输出文本，limit 为 0 时不限制
+type outputBudget struct {
+	limit int
+	used  int // 已输出字节数
+}
+
+// Take 返回预算内可输出的部分，超出时按字符边界截断并返回 true
+func (b *outputBudget) Take(text string) (string, bool) {
+	if b.limit <= 0 {
+		return text, false
+	}
+	remaining := b.limit*4 - b.used
+	if len(text) <= remaining {
+		b.used += len(text)
+		return text, false
+	}
+	cut := remaining
+	if cut < 0 {
+		cut = 0
+	}
+	for cut > 0 && !utf8.RuneStart(text[cut]) {
+		cut--
+	}
+	b.used += cut
+	return text[:cut], true
+}
+
+// resolveLogprobs 校验 logprobs / top_logprobs：widgetStreamAssist 不返回 token 对数概率，
+// 请求 logprobs 时返回明确的错误而非静默忽略
+func resolveLogprobs(enabled bool, top *int) error {
+	if enabled {
+		return fmt.Errorf("上游不支持 logprobs，请移除 logprobs / top_logprobs 参数")
+	}
+	if top != nil {
+		return fmt.Errorf("top_logprobs 需要同时设置 logprobs: true")
+	}
+	return nil
+}
+
+// imageAspectRatios 图片生成支持的宽高比
+var imageAspectRatios = []string{"1:1", "16:9", "9:16", "4:3", "3:4"}
+
+// imageSizeKeywords 尺寸关键字到宽高比的映射
+var imageSizeKeywords = map[string]string{
+	"square":    "1:1",
+	"landscape": "16:9",
+	"portrait":  "9:16",
+}
+
+// resolveImageAspectRatio 根据 aspect_ratio / size 参数解析图片宽高比，未指定时返回空（使用模型默认值）
+func resolveImageAspectRatio(aspectRatio, size string) (string, error) {
+	if v := strings.TrimSpace(aspectRatio); v != "" && !strings.EqualFold(v, "auto") {
+		for _, allowed := range imageAspectRatios {
+			if v == allowed {
+				return v, nil
+			}
+		}
+		return "", fmt.Errorf("不支持的 aspect_ratio: %s，可选值: %s", v, strings.Join(imageAspectRatios, ", "))
+	}
+
+	v := strings.ToLower(strings.TrimSpace(size))
+	if v == "" || v == "auto" {
+		return "", nil
+	}
+	if ratio, ok := imageSizeKeywords[v]; ok {
+		return ratio, nil
+	}
+	var width, height int
+	if n, err := fmt.Sscanf(v, "%dx%d", &width, &height); err == nil && n == 2 && width > 0 && height > 0 {
+		a, b := width, height
+		for b != 0 {
+			a, b = b, a%b
+		}
+		ratio := fmt.Sprintf("%d:%d", width/a, height/a)
+		for _, allowed := range imageAspectRatios {
+			if ratio == allowed {
+				return ratio, nil
+			}
+		}
+		// OpenAI 常用的宽屏/竖屏尺寸（1792x1024、1024x1792）近似映射
+		switch v {
+		case "1792x1024":
+			return "16:9", nil
+		case "1024x1792":
+			return "9:16", nil
+		}
+	}
+	return "", fmt.Errorf("不支持的 size: %s，可选宽高比: %s", size, strings.Join(imageAspectRatios, ", "))
 }
 
 type ChatChoice struct {
@@ -1526,8 +3585,56 @@ func createChunk(id string, created int64, model string, delta map[string]interf
 	return string(data)
 }
 
-func extractContentFromReply(replyMap map[string]interface{}, jwt, session, configID, origAuth string) (text string, imageData string, imageMime string, reasoning string, downloadErr error) {
-	groundedContent, ok := replyMap["groundedContent"].(map[string]interface{})
+// toolCallArgsChunkSize 流式输出工具调用参数时每个分片的最大字节数
+const toolCallArgsChunkSize = 64
+
+// splitToolCallArguments 按字节上限切分参数字符串，不切断 UTF-8 字符
+func splitToolCallArguments(args string, size int) []string {
+	var parts []string
+	for len(args) > size {
+		cut := size
+		for cut > 0 && !utf8.RuneStart(args[cut]) {
+			cut--
+		}
+		if cut == 0 {
+			_, cut = utf8.DecodeRuneInString(args)
+		}
+		parts = append(parts, args[:cut])
+		args = args[cut:]
+	}
+	if args != "" {
+		parts = append(parts, args)
+	}
+	return parts
+}
+
+// createToolCallChunks 按 OpenAI 流式约定生成工具调用增量：先发送 id/name 与空参数，
+// 再按 call.Index 逐段发送 function.arguments
+func createToolCallChunks(id string, created int64, model string, call ToolCall) []string {
+	chunks := []string{createChunk(id, created, model, map[string]interface{}{
+		"tool_calls": []map[string]interface{}{{
+			"index": call.Index,
+			"id":    call.ID,
+			"type":  "function",
+			"function": map[string]interface{}{
+				"name":      call.Function.Name,
+				"arguments": "",
+			},
+		}},
+	}, nil)}
+	for _, part := range splitToolCallArguments(call.Function.Arguments, toolCallArgsChunkSize) {
+		chunks = append(chunks, createChunk(id, created, model, map[string]interface{}{
+			"tool_calls": []map[string]interface{}{{
+				"index":    call.Index,
+				"function": map[string]interface{}{"arguments": part},
+			}},
+		}, nil))
+	}
+	return chunks
+}
+
+func extractContentFromReply(replyMap map[string]interface{}, jwt, session, configID, origAuth string) (text string, imageData string, imageMime string, reasoning string, downloadErr error) {
+	groundedContent, ok := replyMap["groundedContent"].(map[string]interface{})
 	if !ok {
 		return
 	}
@@ -1642,7 +3749,7 @@ func downloadGeneratedFileOnce(jwt, fileId, session, configID, origAuth string)
 	}
 	listBodyBytes, _ := json.Marshal(listBody)
 
-	listReq, _ := http.NewRequest("POST", "https://biz-discoveryengine.googleapis.com/v1alpha/locations/global/widgetListSessionFileMetadata", bytes.NewReader(listBodyBytes))
+	listReq, _ := http.NewRequest("POST", upstreamAPIURL("/v1alpha/locations/global/widgetListSessionFileMetadata"), bytes.NewReader(listBodyBytes))
 	for k, v := range getCommonHeaders(jwt, origAuth) {
 		listReq.Header.Set(k, v)
 	}
@@ -1656,7 +3763,7 @@ func downloadGeneratedFileOnce(jwt, fileId, session, configID, origAuth string)
 	listRespBody, _ := utils.ReadResponseBody(listResp)
 
 	if listResp.StatusCode != 200 {
-		return "", fmt.Errorf("获取文件元数据失败: HTTP %d: %s", listResp.StatusCode, string(listRespBody))
+		return "", fmt.Errorf("获取文件元数据失败: HTTP %d: %s", listResp.StatusCode, sanitizeUpstreamText(string(listRespBody)))
 	}
 
 	// 解析响应，查找匹配的 fileId
@@ -1686,7 +3793,7 @@ func downloadGeneratedFileOnce(jwt, fileId, session, configID, origAuth string)
 		return "", fmt.Errorf("未找到 fileId=%s 的文件信息", fileId)
 	}
 
-	downloadURL := fmt.Sprintf("https://biz-discoveryengine.googleapis.com/download/v1alpha/%s:downloadFile?fileId=%s&alt=media", fullSession, fileId)
+	downloadURL := upstreamAPIURL(fmt.Sprintf("/download/v1alpha/%s:downloadFile?fileId=%s&alt=media", fullSession, fileId))
 	downloadReq, _ := http.NewRequest("GET", downloadURL, nil)
 	for k, v := range getCommonHeaders(jwt, origAuth) {
 		downloadReq.Header.Set(k, v)
@@ -1701,7 +3808,7 @@ func downloadGeneratedFileOnce(jwt, fileId, session, configID, origAuth string)
 	imgBody, _ := utils.ReadResponseBody(downloadResp)
 
 	if downloadResp.StatusCode != 200 {
-		return "", fmt.Errorf("下载图片失败: HTTP %d: %s", downloadResp.StatusCode, string(imgBody))
+		return "", fmt.Errorf("下载图片失败: HTTP %d: %s", downloadResp.StatusCode, sanitizeUpstreamText(string(imgBody)))
 	}
 
 	// 响应是原始二进制图片数据，需要转为 base64
@@ -1716,10 +3823,210 @@ func formatImageAsMarkdown(mimeType, base64Data string) string {
 // 媒体信息（图片/视频）
 type MediaInfo struct {
 	MimeType  string
-	Data      string // base64 数据
-	URL       string // 原始 URL（如果有）
-	IsURL     bool   // 是否使用 URL 直接上传
-	MediaType string // "image" 或 "video"
+	Data      string            // base64 数据
+	URL       string            // 原始 URL（如果有）
+	IsURL     bool              // 是否使用 URL 直接上传
+	MediaType string            // "image"、"video" 或 "audio"
+	Headers   map[string]string // URL 下载时附加的请求头
+	Err       error             // 解析错误（如超过大小限制）
+}
+
+// defaultMaxMediaBytes 单个媒体文件默认大小上限 (20MB)
+const defaultMaxMediaBytes int64 = 20 << 20
+
+// errMediaTooLarge 媒体文件超过大小上限
+var errMediaTooLarge = errors.New("媒体文件过大")
+
+// maxMediaBytes 获取单个媒体文件大小上限（0 表示不限制）
+func maxMediaBytes() int64 {
+	configMu.RLock()
+	limit := appConfig.Pool.MaxMediaBytes
+	configMu.RUnlock()
+	if limit < 0 {
+		return 0
+	}
+	if limit == 0 {
+		return defaultMaxMediaBytes
+	}
+	return limit
+}
+
+// checkMediaSize 检查媒体大小是否超过上限
+func checkMediaSize(size int64) error {
+	if limit := maxMediaBytes(); limit > 0 && size > limit {
+		return fmt.Errorf("%w: %.1fMB 超过上限 %.1fMB", errMediaTooLarge, float64(size)/(1<<20), float64(limit)/(1<<20))
+	}
+	return nil
+}
+
+// mediaError 返回媒体列表中第一个解析错误
+func mediaError(medias []MediaInfo) error {
+	for _, media := range medias {
+		if media.Err != nil {
+			return media.Err
+		}
+	}
+	return nil
+}
+
+// errAudioNotSupported 模型不支持音频输入
+var errAudioNotSupported = errors.New("模型不支持音频输入")
+
+// modelSupportsAudio 判断模型是否支持音频理解（Gemini 文本/搜索模型支持，图片/视频生成及 Flow 模型不支持）
+func modelSupportsAudio(model string) bool {
+	if flow.IsFlowModel(model) || !strings.HasPrefix(model, "gemini-") {
+		return false
+	}
+	return !strings.HasSuffix(model, "-image") && !strings.HasSuffix(model, "-video")
+}
+
+// validateMedia 检查媒体解析错误，以及模型是否支持其中的音频
+func validateMedia(model string, medias []MediaInfo) error {
+	if err := mediaError(medias); err != nil {
+		return err
+	}
+	if modelSupportsAudio(model) {
+		return nil
+	}
+	for _, media := range medias {
+		if media.MediaType == "audio" {
+			return fmt.Errorf("%w: %s", errAudioNotSupported, model)
+		}
+	}
+	return nil
+}
+
+// apiFormatOf 按请求路径判断客户端使用的 API 格式（中间件在路由处理前也需要判断）
+func apiFormatOf(c *gin.Context) string {
+	if c.Request == nil || c.Request.URL == nil {
+		return apiPathOpenAI
+	}
+	path := c.Request.URL.Path
+	switch {
+	case path == "/v1/messages" || strings.HasPrefix(path, "/v1/messages/"):
+		return apiPathClaude
+	case strings.HasPrefix(path, "/v1beta/"),
+		strings.HasPrefix(path, "/v1/models/") && c.Request.Method == http.MethodPost:
+		return apiPathGemini
+	}
+	return apiPathOpenAI
+}
+
+// claudeErrorType HTTP 状态码对应的 Claude 错误类型
+func claudeErrorType(status int) string {
+	switch status {
+	case 400, 415:
+		return "invalid_request_error"
+	case 413:
+		return "request_too_large"
+	case 401:
+		return "authentication_error"
+	case 403:
+		return "permission_error"
+	case 404:
+		return "not_found_error"
+	case 429:
+		return "rate_limit_error"
+	case 503, 529:
+		return "overloaded_error"
+	case 504:
+		return "timeout_error"
+	}
+	return "api_error"
+}
+
+// geminiErrorStatus HTTP 状态码对应的 Google RPC 状态
+func geminiErrorStatus(status int) string {
+	switch status {
+	case 400, 413, 415:
+		return "INVALID_ARGUMENT"
+	case 401:
+		return "UNAUTHENTICATED"
+	case 403:
+		return "PERMISSION_DENIED"
+	case 404:
+		return "NOT_FOUND"
+	case 429:
+		return "RESOURCE_EXHAUSTED"
+	case 503:
+		return "UNAVAILABLE"
+	case 504:
+		return "DEADLINE_EXCEEDED"
+	}
+	return "INTERNAL"
+}
+
+// apiErrorBody 按 API 格式构造错误体：
+// OpenAI {"error":{message,type,code,param}}、Claude {"type":"error","error":{type,message}}、
+// Gemini {"error":{code,message,status}}。extra 中的附加字段（如 ready/pending）并入 error 对象
+func apiErrorBody(format string, status int, errType, message, code string, extra gin.H) gin.H {
+	var errObj gin.H
+	switch format {
+	case apiPathClaude:
+		errObj = gin.H{"type": claudeErrorType(status), "message": message}
+	case apiPathGemini:
+		errObj = gin.H{"code": status, "message": message, "status": geminiErrorStatus(status)}
+	default:
+		errObj = gin.H{"message": message, "type": errType, "code": nil, "param": nil}
+		if code != "" {
+			errObj["code"] = code
+		}
+	}
+	for k, v := range extra {
+		if _, exists := errObj[k]; !exists {
+			errObj[k] = v
+		}
+	}
+	if format == apiPathClaude {
+		return gin.H{"type": "error", "error": errObj}
+	}
+	return gin.H{"error": errObj}
+}
+
+// respondAPIError 以客户端所用 API 的格式返回错误
+func respondAPIError(c *gin.Context, status int, errType, message, code string, extra ...gin.H) {
+	var fields gin.H
+	if len(extra) > 0 {
+		fields = extra[0]
+	}
+	c.JSON(status, apiErrorBody(apiFormatOf(c), status, errType, message, code, fields))
+}
+
+// abortAPIError 中间件拒绝请求：返回错误并中止后续处理
+func abortAPIError(c *gin.Context, status int, errType, message, code string) {
+	respondAPIError(c, status, errType, message, code)
+	c.Abort()
+}
+
+// mediaErrorCode 将媒体错误映射为 HTTP 状态码和错误码，非媒体错误返回 0
+func mediaErrorCode(err error) (int, string) {
+	switch {
+	case errors.Is(err, errMediaTooLarge):
+		return 413, "media_too_large"
+	case errors.Is(err, errUnsupportedImage):
+		return 415, "unsupported_media_type"
+	case errors.Is(err, errAudioNotSupported):
+		return 400, "audio_not_supported"
+	}
+	return 0, ""
+}
+
+// mediaErrorResponse 将媒体错误映射为 HTTP 状态码和 OpenAI 格式错误体，非媒体错误返回 0
+func mediaErrorResponse(err error) (int, gin.H) {
+	status, code := mediaErrorCode(err)
+	if status == 0 {
+		return 0, nil
+	}
+	return status, apiErrorBody(apiPathOpenAI, status, "invalid_request_error", err.Error(), code, nil)
+}
+
+// respondMediaError 以客户端所用 API 的格式返回媒体错误
+func respondMediaError(c *gin.Context, err error) {
+	status, code := mediaErrorCode(err)
+	if status == 0 {
+		status = 400
+	}
+	respondAPIError(c, status, "invalid_request_error", err.Error(), code)
 }
 
 // 别名，保持向后兼容
@@ -1751,6 +4058,7 @@ func parseMessageContent(msg Message) (string, []MediaInfo) {
 					if urlStr, ok := imgURL["url"].(string); ok {
 						media := parseMediaURL(urlStr, "image")
 						if media != nil {
+							media.Headers = parseMediaHeaders(imgURL["headers"])
 							medias = append(medias, *media)
 						}
 					}
@@ -1761,6 +4069,17 @@ func parseMessageContent(msg Message) (string, []MediaInfo) {
 					if urlStr, ok := videoURL["url"].(string); ok {
 						media := parseMediaURL(urlStr, "video")
 						if media != nil {
+							media.Headers = parseMediaHeaders(videoURL["headers"])
+							medias = append(medias, *media)
+						}
+					}
+				}
+			case "input_audio":
+				// OpenAI 音频输入: {"data": "<base64>", "format": "wav"}
+				if audio, ok := partMap["input_audio"].(map[string]interface{}); ok {
+					if data, ok := audio["data"].(string); ok && data != "" {
+						format, _ := audio["format"].(string)
+						if media := parseInputAudio(data, format); media != nil {
 							medias = append(medias, *media)
 						}
 					}
@@ -1773,6 +4092,8 @@ func parseMessageContent(msg Message) (string, []MediaInfo) {
 						if mime, ok := fileData["mime_type"].(string); ok {
 							if strings.HasPrefix(mime, "video/") {
 								mediaType = "video"
+							} else if strings.HasPrefix(mime, "audio/") {
+								mediaType = "audio"
 							}
 						}
 						media := parseMediaURL(urlStr, mediaType)
@@ -1788,7 +4109,44 @@ func parseMessageContent(msg Message) (string, []MediaInfo) {
 	return textContent, medias
 }
 
-// 解析媒体 URL（图片或视频）
+// parseMediaHeaders 解析媒体 URL 附带的请求头（仅接受字符串值）
+func parseMediaHeaders(raw interface{}) map[string]string {
+	rawMap, ok := raw.(map[string]interface{})
+	if !ok || len(rawMap) == 0 {
+		return nil
+	}
+	headers := make(map[string]string, len(rawMap))
+	for key, value := range rawMap {
+		if str, ok := value.(string); ok && strings.TrimSpace(key) != "" {
+			headers[key] = str
+		}
+	}
+	if len(headers) == 0 {
+		return nil
+	}
+	return headers
+}
+
+// parseInputAudio 解析 input_audio 的 base64 数据（也兼容 data URI）
+func parseInputAudio(data, format string) *MediaInfo {
+	if strings.HasPrefix(data, "data:") {
+		return parseMediaURL(data, "audio")
+	}
+	if err := checkMediaSize(int64(base64.StdEncoding.DecodedLen(len(data)))); err != nil {
+		return &MediaInfo{MediaType: "audio", Err: err}
+	}
+	if _, err := base64.StdEncoding.DecodeString(data); err != nil {
+		logger.Warn("⚠️ input_audio base64 解码失败: %v", err)
+		return nil
+	}
+	return &MediaInfo{
+		MimeType:  normalizeAudioMimeType(format),
+		Data:      data,
+		MediaType: "audio",
+	}
+}
+
+// 解析媒体 URL（图片、视频或音频）
 func parseMediaURL(urlStr, defaultType string) *MediaInfo {
 	// 处理 base64 数据
 	if strings.HasPrefix(urlStr, "data:") {
@@ -1802,8 +4160,22 @@ func parseMediaURL(urlStr, defaultType string) *MediaInfo {
 		var mediaType string
 		var mimeType string
 
+		// 解码前按 base64 长度估算大小，避免解码超大数据
+		if err := checkMediaSize(int64(base64.StdEncoding.DecodedLen(len(base64Data)))); err != nil {
+			mediaType = "image"
+			if strings.Contains(parts[0], "video/") {
+				mediaType = "video"
+			} else if strings.Contains(parts[0], "audio/") {
+				mediaType = "audio"
+			}
+			return &MediaInfo{MediaType: mediaType, Err: err}
+		}
+
 		// 检测媒体类型
-		if strings.Contains(parts[0], "video/") {
+		if strings.Contains(parts[0], "audio/") {
+			mediaType = "audio"
+			mimeType = normalizeAudioMimeType(strings.SplitN(strings.TrimPrefix(parts[0], "data:"), ";", 2)[0])
+		} else if strings.Contains(parts[0], "video/") {
 			mediaType = "video"
 			// 视频格式处理
 			if strings.Contains(parts[0], "video/mp4") {
@@ -1824,22 +4196,24 @@ func parseMediaURL(urlStr, defaultType string) *MediaInfo {
 			}
 		} else {
 			mediaType = "image"
-			// 图片格式处理
-			if strings.Contains(parts[0], "image/png") {
-				mimeType = "image/png"
-			} else if strings.Contains(parts[0], "image/jpeg") {
-				mimeType = "image/jpeg"
-			} else {
-				// 其他图片格式需要转换为 PNG
-				converted, err := convertBase64ToPNG(base64Data)
-				if err != nil {
-					logger.Warn("⚠️ %s base64 转换失败: %v", parts[0], err)
-					mimeType = "image/jpeg" // 回退
-				} else {
-					logger.Info("✅ %s base64 已转换为 PNG", parts[0])
-					base64Data = converted
-					mimeType = "image/png"
+			// 图片格式处理：以解码后的实际内容为准，不信任声明的 MIME
+			declared := strings.SplitN(strings.TrimPrefix(parts[0], "data:"), ";", 2)[0]
+			data, err := base64.StdEncoding.DecodeString(base64Data)
+			if err != nil {
+				logger.Warn("⚠️ %s base64 解码失败: %v", parts[0], err)
+				mimeType = "image/jpeg" // 回退
+				if declared == "image/png" {
+					mimeType = declared
+				}
+			} else if normalized, out, err := normalizeImageData(declared, data); err != nil {
+				logger.Warn("⚠️ %s 转换失败: %v", parts[0], err)
+				if errors.Is(err, errUnsupportedImage) {
+					return &MediaInfo{MediaType: mediaType, Err: err}
 				}
+				mimeType = "image/jpeg" // 回退
+			} else {
+				mimeType = normalized
+				base64Data = base64.StdEncoding.EncodeToString(out)
 			}
 		}
 
@@ -1868,12 +4242,63 @@ func parseMediaURL(urlStr, defaultType string) *MediaInfo {
 }
 
 func downloadImage(urlStr string) (string, string, error) {
-	return downloadMedia(urlStr, "image")
+	return downloadMedia(urlStr, "image", nil)
+}
+
+// maxMediaRedirects 媒体下载最多跟随的重定向次数
+const maxMediaRedirects = 5
+
+// mediaFetchTimeout 获取单次媒体下载超时，0 表示不单独限制
+func mediaFetchTimeout() time.Duration {
+	configMu.RLock()
+	sec := appConfig.Pool.MediaFetchTimeoutSec
+	configMu.RUnlock()
+	if sec < 0 {
+		return 0
+	}
+	if sec == 0 {
+		sec = 60
+	}
+	return time.Duration(sec) * time.Second
+}
+
+// mediaRedirectPolicy 限制重定向次数和协议；跳转到其他主机时移除调用方提供的请求头，避免凭据泄露
+func mediaRedirectPolicy(headers map[string]string) func(*http.Request, []*http.Request) error {
+	return func(req *http.Request, via []*http.Request) error {
+		if len(via) >= maxMediaRedirects {
+			return fmt.Errorf("重定向次数超过 %d 次", maxMediaRedirects)
+		}
+		if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+			return fmt.Errorf("不支持重定向到 %s 协议", req.URL.Scheme)
+		}
+		if req.URL.Host != via[0].URL.Host {
+			for key := range headers {
+				req.Header.Del(key)
+			}
+		}
+		return nil
+	}
 }
 
-// downloadMedia 下载媒体文件（图片或视频）
-func downloadMedia(urlStr, mediaType string) (string, string, error) {
-	resp, err := utils.HTTPClient.Get(urlStr)
+// downloadMedia 下载媒体文件（图片或视频），headers 会附加到下载请求上
+func downloadMedia(urlStr, mediaType string, headers map[string]string) (string, string, error) {
+	ctx := context.Background()
+	if timeout := mediaFetchTimeout(); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, urlStr, nil)
+	if err != nil {
+		return "", "", err
+	}
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	client := *utils.HTTPClient
+	client.CheckRedirect = mediaRedirectPolicy(headers)
+	resp, err := client.Do(req)
 	if err != nil {
 		return "", "", err
 	}
@@ -1887,13 +4312,27 @@ func downloadMedia(urlStr, mediaType string) (string, string, error) {
 		return "", "", fmt.Errorf("UPSTREAM_%d: 上游返回状态码 %d", resp.StatusCode, resp.StatusCode)
 	}
 
-	data, err := io.ReadAll(resp.Body)
+	// 大小限制：先检查 Content-Length，再限制实际读取量
+	if err := checkMediaSize(resp.ContentLength); err != nil {
+		return "", "", err
+	}
+	body := io.Reader(resp.Body)
+	if limit := maxMediaBytes(); limit > 0 {
+		body = io.LimitReader(resp.Body, limit+1)
+	}
+	data, err := io.ReadAll(body)
 	if err != nil {
 		return "", "", err
 	}
+	if err := checkMediaSize(int64(len(data))); err != nil {
+		return "", "", err
+	}
 
 	mimeType := resp.Header.Get("Content-Type")
 
+	if mediaType == "audio" || strings.HasPrefix(mimeType, "audio/") {
+		return base64.StdEncoding.EncodeToString(data), normalizeAudioMimeType(mimeType), nil
+	}
 	if mediaType == "video" || strings.HasPrefix(mimeType, "video/") {
 		// 视频处理
 		if mimeType == "" {
@@ -1904,22 +4343,179 @@ func downloadMedia(urlStr, mediaType string) (string, string, error) {
 		return base64.StdEncoding.EncodeToString(data), mimeType, nil
 	}
 
-	// 图片处理
-	if mimeType == "" {
-		mimeType = "image/jpeg"
+	// 图片处理：以实际内容为准，非 PNG/JPEG 按转换策略处理
+	declared := strings.TrimSpace(strings.SplitN(mimeType, ";", 2)[0])
+	normalized, out, err := normalizeImageData(declared, data)
+	if errors.Is(err, errUnsupportedImage) {
+		return "", "", err
 	}
-	needConvert := !strings.Contains(mimeType, "jpeg") && !strings.Contains(mimeType, "png")
-	if needConvert {
-		converted, err := convertToPNG(data)
-		if err != nil {
-			logger.Warn("⚠️ %s 转换失败: %v，尝试原格式", mimeType, err)
-		} else {
-			logger.Info("✅ %s 已转换为 PNG", mimeType)
-			return base64.StdEncoding.EncodeToString(converted), "image/png", nil
+	if err != nil {
+		logger.Warn("⚠️ %s 转换失败: %v，尝试原格式", mimeType, err)
+		if mimeType == "" {
+			mimeType = "image/jpeg"
+		}
+		return base64.StdEncoding.EncodeToString(data), mimeType, nil
+	}
+	return base64.StdEncoding.EncodeToString(out), normalized, nil
+}
+
+// errUnsupportedImage 图片格式可识别但当前构建没有对应解码器，无法转换为 PNG
+var errUnsupportedImage = errors.New("不支持的图片格式")
+
+// heifBrands ISO BMFF ftyp 品牌到图片 MIME 的映射（AVIF/HEIC/HEIF）
+var heifBrands = map[string]string{
+	"avif": "image/avif",
+	"avis": "image/avif",
+	"heic": "image/heic",
+	"heix": "image/heic",
+	"heim": "image/heic",
+	"heis": "image/heic",
+	"hevc": "image/heic",
+	"hevx": "image/heic",
+	"mif1": "image/heif",
+	"msf1": "image/heif",
+}
+
+// sniffHEIFMime 根据 ftyp box 识别 AVIF/HEIC（iPhone 常见格式），无法识别时返回空字符串
+func sniffHEIFMime(data []byte) string {
+	if len(data) < 12 || string(data[4:8]) != "ftyp" {
+		return ""
+	}
+	boxSize := int(binary.BigEndian.Uint32(data[:4]))
+	if boxSize < 12 || boxSize > len(data) {
+		boxSize = len(data)
+	}
+	// 主品牌优先；mif1/msf1 只是通用 HEIF 容器，继续从兼容品牌中找具体编码
+	mimeType := heifBrands[string(data[8:12])]
+	if mimeType != "" && mimeType != "image/heif" {
+		return mimeType
+	}
+	for i := 16; i+4 <= boxSize; i += 4 {
+		switch brand := heifBrands[string(data[i:i+4])]; brand {
+		case "":
+		case "image/heif":
+			if mimeType == "" {
+				mimeType = brand
+			}
+		default:
+			return brand
 		}
 	}
+	return mimeType
+}
+
+// sniffImageMime 根据图片字节检测实际 MIME 类型，无法识别时返回空字符串
+func sniffImageMime(data []byte) string {
+	if detected := http.DetectContentType(data); strings.HasPrefix(detected, "image/") {
+		return detected
+	}
+	if mimeType := sniffHEIFMime(data); mimeType != "" {
+		return mimeType
+	}
+	if _, format, err := image.DecodeConfig(bytes.NewReader(data)); err == nil {
+		return "image/" + format
+	}
+	return ""
+}
+
+// 图片转换策略
+const (
+	imageConvertToPNG        = "to_png"
+	imageConvertKeepOriginal = "keep_original"
+	imageConvertToJPEG       = "to_jpeg"
+)
+
+// defaultJPEGQuality to_jpeg 未指定质量时使用的 JPEG 质量
+const defaultJPEGQuality = 85
+
+// animatedPassthroughMimes 上游可直接接受的动图类型，保留原始字节以免只剩第一帧
+var animatedPassthroughMimes = map[string]bool{
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+// parseImageConvertPolicy 解析转换策略，返回策略名和 JPEG 质量；无法识别时使用 to_png
+func parseImageConvertPolicy(raw string) (string, int) {
+	raw = strings.ToLower(strings.TrimSpace(raw))
+	switch {
+	case raw == imageConvertKeepOriginal:
+		return imageConvertKeepOriginal, 0
+	case raw == imageConvertToJPEG:
+		return imageConvertToJPEG, defaultJPEGQuality
+	case strings.HasPrefix(raw, "to_jpeg_quality:"):
+		quality, err := strconv.Atoi(strings.TrimPrefix(raw, "to_jpeg_quality:"))
+		if err != nil || quality < 1 || quality > 100 {
+			quality = defaultJPEGQuality
+		}
+		return imageConvertToJPEG, quality
+	default:
+		return imageConvertToPNG, 0
+	}
+}
+
+// imageConvertPolicy 获取当前图片转换策略
+func imageConvertPolicy() (string, int) {
+	configMu.RLock()
+	raw := appConfig.Pool.ImageConvertPolicy
+	configMu.RUnlock()
+	return parseImageConvertPolicy(raw)
+}
+
+// isAnimatedImage 判断 GIF/WebP 是否包含多帧动画
+func isAnimatedImage(mimeType string, data []byte) bool {
+	switch mimeType {
+	case "image/gif":
+		g, err := gif.DecodeAll(bytes.NewReader(data))
+		return err == nil && len(g.Image) > 1
+	case "image/webp":
+		// 扩展格式 WebP：RIFF....WEBPVP8X，flags 中 0x02 为动画标记
+		return len(data) > 20 && string(data[0:4]) == "RIFF" && string(data[8:16]) == "WEBPVP8X" && data[20]&0x02 != 0
+	}
+	return false
+}
+
+// normalizeImageData 按实际内容确定图片类型：PNG/JPEG 原样返回，其他格式按转换策略处理
+// 声明类型与检测类型不一致时记录日志
+func normalizeImageData(declared string, data []byte) (string, []byte, error) {
+	mimeType := sniffImageMime(data)
+	if mimeType == "" {
+		mimeType = declared
+	} else if declared != "" && declared != mimeType {
+		logger.Info("ℹ️ 图片声明类型 %s 与实际类型 %s 不一致，按实际类型处理", declared, mimeType)
+	}
+
+	if mimeType == "image/png" || mimeType == "image/jpeg" {
+		return mimeType, data, nil
+	}
+	if sniffHEIFMime(data) != "" {
+		// 当前构建没有 AVIF/HEIC 解码器，无法转换为 PNG/JPEG，不论转换策略都直接拒绝
+		return "", nil, fmt.Errorf("%w: %s 暂无可用解码器，请转换为 PNG/JPEG 后上传", errUnsupportedImage, mimeType)
+	}
+	if animatedPassthroughMimes[mimeType] && isAnimatedImage(mimeType, data) {
+		logger.Info("ℹ️ %s 为动图，保留原始格式上传", mimeType)
+		return mimeType, data, nil
+	}
+
+	policy, quality := imageConvertPolicy()
+	if policy == imageConvertKeepOriginal {
+		logger.Info("ℹ️ %s 转换策略 %s，保留原始格式上传", mimeType, policy)
+		return mimeType, data, nil
+	}
 
-	return base64.StdEncoding.EncodeToString(data), mimeType, nil
+	outMime := "image/png"
+	var converted []byte
+	var err error
+	if policy == imageConvertToJPEG {
+		outMime = "image/jpeg"
+		converted, err = convertToJPEG(data, quality)
+	} else {
+		converted, err = convertToPNG(data)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	logger.Info("✅ %s 按策略 %s 转换为 %s", mimeType, policy, outMime)
+	return outMime, converted, nil
 }
 
 // normalizeVideoMimeType 规范化视频 MIME 类型
@@ -1946,6 +4542,29 @@ func normalizeVideoMimeType(mimeType string) string {
 	}
 }
 
+// normalizeAudioMimeType 规范化音频 MIME 类型，支持 input_audio 的 format（wav/mp3）或完整 MIME
+func normalizeAudioMimeType(format string) string {
+	format = strings.ToLower(strings.TrimSpace(strings.SplitN(format, ";", 2)[0]))
+	format = strings.TrimPrefix(format, "audio/")
+	switch format {
+	case "wav", "wave", "x-wav", "vnd.wave":
+		return "audio/wav"
+	case "mp3", "mpeg", "mpeg3", "x-mp3", "x-mpeg":
+		return "audio/mp3"
+	case "ogg", "opus", "vorbis":
+		return "audio/ogg"
+	case "flac", "x-flac":
+		return "audio/flac"
+	case "aac", "x-aac", "m4a", "mp4", "x-m4a":
+		return "audio/aac"
+	case "aiff", "x-aiff", "aif":
+		return "audio/aiff"
+	default:
+		logger.Debug("ℹ️ 未知音频格式 %s 将作为 WAV 上传", format)
+		return "audio/wav"
+	}
+}
+
 // convertToPNG 将图片转换为 PNG 格式
 func convertToPNG(data []byte) ([]byte, error) {
 	img, _, err := image.Decode(bytes.NewReader(data))
@@ -1961,40 +4580,68 @@ func convertToPNG(data []byte) ([]byte, error) {
 	return buf.Bytes(), nil
 }
 
-// convertBase64ToPNG 将 base64 图片转换为 PNG
-func convertBase64ToPNG(base64Data string) (string, error) {
-	data, err := base64.StdEncoding.DecodeString(base64Data)
+// convertToJPEG 将图片转换为 JPEG 格式，透明区域填充白色
+func convertToJPEG(data []byte, quality int) ([]byte, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
 	if err != nil {
-		return "", fmt.Errorf("解码 base64 失败: %w", err)
+		return nil, fmt.Errorf("解码图片失败: %w", err)
 	}
 
-	converted, err := convertToPNG(data)
-	if err != nil {
-		return "", err
+	canvas := image.NewRGBA(img.Bounds())
+	draw.Draw(canvas, canvas.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.Draw(canvas, canvas.Bounds(), img, img.Bounds().Min, draw.Over)
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, canvas, &jpeg.Options{Quality: quality}); err != nil {
+		return nil, fmt.Errorf("编码 JPEG 失败: %w", err)
 	}
 
-	return base64.StdEncoding.EncodeToString(converted), nil
+	return buf.Bytes(), nil
 }
 
 const maxRetries = 3
 
-// convertMessagesToPrompt 将多轮对话转换为Gemini格式的prompt
-// extractSystemPrompt 提取并返回系统提示词
+// wrapSystemPrompt 按 全局前缀 → 请求系统提示词 → 全局后缀 的顺序拼接，空项跳过
+func wrapSystemPrompt(systemPrompt string) string {
+	configMu.RLock()
+	prefix, suffix := appConfig.GlobalSystemPrefix, appConfig.GlobalSystemSuffix
+	configMu.RUnlock()
+	var parts []string
+	for _, part := range []string{prefix, systemPrompt, suffix} {
+		if strings.TrimSpace(part) != "" {
+			parts = append(parts, part)
+		}
+	}
+	return strings.Join(parts, "\n")
+}
+
+// extractSystemPrompt 提取并返回系统提示词（已拼接全局前后缀）
 func extractSystemPrompt(messages []Message) string {
 	for _, msg := range messages {
 		if msg.Role == "system" {
 			text, _ := parseMessageContent(msg)
-			return text
+			return wrapSystemPrompt(text)
 		}
 	}
-	return ""
+	return wrapSystemPrompt("")
+}
+
+// toolCallLabel 渲染工具调用标识 "id: name(args)"，调用ID缺失时省略前缀
+func toolCallLabel(id, name, args string) string {
+	label := fmt.Sprintf("%s(%s)", name, args)
+	if id == "" {
+		return label
+	}
+	return id + ": " + label
 }
 
 // convertMessagesToPrompt 将多轮对话转换为带系统提示词的prompt
 // 支持OpenAI/Claude/Gemini格式的messages
+// 工具结果按 tool_call_id 关联到之前的调用，缺少ID时回退到 name
 func convertMessagesToPrompt(messages []Message) string {
 	var dialogParts []string
 	var systemPrompt string
+	toolCalls := make(map[string]ToolCall)
 
 	for _, msg := range messages {
 		text, _ := parseMessageContent(msg)
@@ -2015,18 +4662,33 @@ func convertMessagesToPrompt(messages []Message) string {
 		case "assistant":
 			// 检查是否有工具调用
 			if len(msg.ToolCalls) > 0 {
+				if text != "" {
+					dialogParts = append(dialogParts, fmt.Sprintf("Assistant: %s", text))
+				}
 				for _, tc := range msg.ToolCalls {
-					dialogParts = append(dialogParts, fmt.Sprintf("Assistant: [调用工具 %s(%s)]", tc.Function.Name, tc.Function.Arguments))
+					if tc.ID != "" {
+						toolCalls[tc.ID] = tc
+					}
+					dialogParts = append(dialogParts, fmt.Sprintf("Assistant: [调用工具 %s]", toolCallLabel(tc.ID, tc.Function.Name, tc.Function.Arguments)))
 				}
 			} else if text != "" {
 				dialogParts = append(dialogParts, fmt.Sprintf("Assistant: %s", text))
 			}
 		case "tool", "tool_result": // Claude使用tool_result
-			dialogParts = append(dialogParts, fmt.Sprintf("Tool Result [%s]: %s", msg.Name, text))
+			label := msg.Name
+			if tc, ok := toolCalls[msg.ToolCallID]; ok {
+				label = toolCallLabel(tc.ID, tc.Function.Name, tc.Function.Arguments)
+			} else if msg.ToolCallID != "" && label != "" {
+				label = msg.ToolCallID + ": " + label
+			} else if msg.ToolCallID != "" {
+				label = msg.ToolCallID
+			}
+			dialogParts = append(dialogParts, fmt.Sprintf("Tool Result [%s]: %s", label, text))
 		}
 	}
 
 	// 组合最终prompt，系统提示词使用更强的格式
+	systemPrompt = wrapSystemPrompt(systemPrompt)
 	var result strings.Builder
 	if systemPrompt != "" {
 		// 使用更明确的系统提示词格式，确保生效
@@ -2050,6 +4712,29 @@ type GeminiRequest struct {
 	SystemInstruction *GeminiContent           `json:"systemInstruction,omitempty"`
 	GenerationConfig  map[string]interface{}   `json:"generationConfig,omitempty"`
 	GeminiTools       []map[string]interface{} `json:"tools,omitempty"`
+	ToolConfig        map[string]interface{}   `json:"toolConfig,omitempty"`
+}
+
+// functionToolChoice 构造指定函数的 OpenAI tool_choice
+func functionToolChoice(name string) map[string]interface{} {
+	return map[string]interface{}{"type": "function", "function": map[string]interface{}{"name": name}}
+}
+
+// geminiToolChoice 将 Gemini functionCallingConfig 转为 OpenAI tool_choice
+func geminiToolChoice(config map[string]interface{}) interface{} {
+	mode, _ := config["mode"].(string)
+	switch strings.ToUpper(mode) {
+	case "NONE":
+		return toolChoiceNone
+	case "ANY":
+		if names, _ := config["allowedFunctionNames"].([]interface{}); len(names) == 1 {
+			if name, ok := names[0].(string); ok {
+				return functionToolChoice(name)
+			}
+		}
+		return toolChoiceRequired
+	}
+	return toolChoiceAuto
 }
 
 type GeminiContent struct {
@@ -2071,7 +4756,7 @@ type GeminiInlineData struct {
 func handleGeminiGenerate(c *gin.Context) {
 	action := c.Param("action")
 	if action == "" {
-		c.JSON(400, gin.H{"error": gin.H{"code": 400, "message": "Missing model action", "status": "INVALID_ARGUMENT"}})
+		respondAPIError(c, 400, "invalid_request_error", "Missing model action", "")
 		return
 	}
 
@@ -2088,12 +4773,12 @@ func handleGeminiGenerate(c *gin.Context) {
 	}
 
 	if model == "" {
-		model = GetAvailableModels()[0]
+		model = defaultModelFor(apiPathGemini)
 	}
 
 	var geminiReq GeminiRequest
 	if err := c.ShouldBindJSON(&geminiReq); err != nil {
-		c.JSON(400, gin.H{"error": gin.H{"code": 400, "message": err.Error(), "status": "INVALID_ARGUMENT"}})
+		respondAPIError(c, 400, "invalid_request_error", err.Error(), "")
 		return
 	}
 
@@ -2176,6 +4861,27 @@ func handleGeminiGenerate(c *gin.Context) {
 		Stream:   stream,
 		Tools:    tools,
 	}
+	if imageConfig, ok := geminiReq.GenerationConfig["imageConfig"].(map[string]interface{}); ok {
+		req.AspectRatio, _ = imageConfig["aspectRatio"].(string)
+	}
+	if fcc, ok := geminiReq.ToolConfig["functionCallingConfig"].(map[string]interface{}); ok {
+		req.ToolChoice = geminiToolChoice(fcc)
+	}
+	if thinkingConfig, ok := geminiReq.GenerationConfig["thinkingConfig"].(map[string]interface{}); ok {
+		if budget, ok := thinkingConfig["thinkingBudget"].(float64); ok {
+			n := int(budget)
+			req.ThinkingBudget = &n
+		}
+	}
+	if maxOutput, ok := geminiReq.GenerationConfig["maxOutputTokens"].(float64); ok {
+		req.MaxTokens = int(maxOutput)
+	}
+	if v, ok := geminiReq.GenerationConfig["presencePenalty"].(float64); ok {
+		req.PresencePenalty = &v
+	}
+	if v, ok := geminiReq.GenerationConfig["frequencyPenalty"].(float64); ok {
+		req.FrequencyPenalty = &v
+	}
 
 	streamChat(c, req)
 }
@@ -2190,13 +4896,21 @@ type ClaudeRequest struct {
 	Stream      bool      `json:"stream"`
 	Temperature float64   `json:"temperature,omitempty"`
 	Tools       []ToolDef `json:"tools,omitempty"`
+	Thinking    *struct {
+		Type         string `json:"type"` // "enabled" / "disabled"
+		BudgetTokens int    `json:"budget_tokens,omitempty"`
+	} `json:"thinking,omitempty"`
+	ToolChoice *struct {
+		Type string `json:"type"` // "auto" / "any" / "tool" / "none"
+		Name string `json:"name,omitempty"`
+	} `json:"tool_choice,omitempty"`
 }
 
 // handleClaudeMessages 处理Claude Messages API格式的请求
 func handleClaudeMessages(c *gin.Context) {
 	var claudeReq ClaudeRequest
 	if err := c.ShouldBindJSON(&claudeReq); err != nil {
-		c.JSON(400, gin.H{"type": "error", "error": gin.H{"type": "invalid_request_error", "message": err.Error()}})
+		respondAPIError(c, 400, "invalid_request_error", err.Error(), "")
 		return
 	}
 
@@ -2206,6 +4920,20 @@ func handleClaudeMessages(c *gin.Context) {
 		Stream:      claudeReq.Stream,
 		Temperature: claudeReq.Temperature,
 		Tools:       claudeReq.Tools,
+		MaxTokens:   claudeReq.MaxTokens,
+	}
+	if claudeReq.Thinking != nil && claudeReq.Thinking.Type == "enabled" {
+		req.ThinkingBudget = &claudeReq.Thinking.BudgetTokens
+	}
+	if tc := claudeReq.ToolChoice; tc != nil {
+		switch tc.Type {
+		case "any":
+			req.ToolChoice = toolChoiceRequired
+		case "tool":
+			req.ToolChoice = functionToolChoice(tc.Name)
+		default:
+			req.ToolChoice = tc.Type
+		}
 	}
 
 	// 如果Claude格式有单独的system字段，插入到messages开头
@@ -2215,2646 +4943,6190 @@ func handleClaudeMessages(c *gin.Context) {
 	}
 
 	if req.Model == "" {
-		req.Model = GetAvailableModels()[0]
+		req.Model = defaultModelFor(apiPathClaude)
 	}
 
 	streamChat(c, req)
 }
 
-// buildToolsSpec 将OpenAI格式的工具定义转换为Gemini的toolsSpec
-// 支持混合后缀同时启用多个功能，如 -image-search 同时启用图片生成和搜索
-func buildToolsSpec(tools []ToolDef, isImageModel, isVideoModel, isSearchModel bool) map[string]interface{} {
-	toolsSpec := make(map[string]interface{})
+// ==================== OpenAI Images API 兼容 ====================
 
-	// 检查是否指定了任何功能后缀
-	hasAnySpec := isImageModel || isVideoModel || isSearchModel
+// ImageGenerationRequest OpenAI Images API 请求
+type ImageGenerationRequest struct {
+	Prompt         string `json:"prompt"`
+	Model          string `json:"model,omitempty"`
+	N              int    `json:"n,omitempty"`
+	Size           string `json:"size,omitempty"`
+	ResponseFormat string `json:"response_format,omitempty"`
+}
 
-	if !hasAnySpec {
-		toolsSpec["webGroundingSpec"] = map[string]interface{}{}
-		toolsSpec["toolRegistry"] = "default_tool_registry"
-		toolsSpec["imageGenerationSpec"] = map[string]interface{}{}
-		toolsSpec["videoGenerationSpec"] = map[string]interface{}{}
-	} else {
-		if isImageModel {
-			toolsSpec["imageGenerationSpec"] = map[string]interface{}{}
-		}
-		if isVideoModel {
-			toolsSpec["videoGenerationSpec"] = map[string]interface{}{}
-		}
-		if isSearchModel {
-			toolsSpec["webGroundingSpec"] = map[string]interface{}{}
-		}
-	}
-	_ = tools
+const (
+	defaultImageModel      = "gemini-2.5-flash-image"
+	defaultImageMaxN       = 4
+	generatedImageTTL      = 1 * time.Hour // 生成图片通过 URL 可访问的时长
+	generatedImageMaxCount = 200           // 内存中最多保留的生成图片数
+)
 
-	return toolsSpec
+// markdownImageRE 从聊天响应内容中提取 ![..](url) 形式的图片
+var markdownImageRE = regexp.MustCompile(`!\[[^\]]*\]\(([^)\s]+)\)`)
+
+// generatedImage 等待客户端通过 URL 拉取的生成图片
+type generatedImage struct {
+	mimeType string
+	data     []byte
+	expires  time.Time
 }
 
-// extractToolCalls 从Gemini响应中提取工具调用
-func extractToolCalls(dataList []map[string]interface{}) []ToolCall {
-	var toolCalls []ToolCall
+// generatedImageStore 以随机 ID 在内存中暂存生成图片，供 response_format=url 使用
+type generatedImageStore struct {
+	mu    sync.Mutex
+	items map[string]*generatedImage
+	order []string
+}
 
-	for _, data := range dataList {
-		streamResp, ok := data["streamAssistResponse"].(map[string]interface{})
-		if !ok {
-			continue
-		}
-		answer, ok := streamResp["answer"].(map[string]interface{})
-		if !ok {
-			continue
-		}
-		replies, ok := answer["replies"].([]interface{})
-		if !ok {
-			continue
-		}
+var imageStore = &generatedImageStore{items: make(map[string]*generatedImage)}
 
-		for _, reply := range replies {
-			replyMap, ok := reply.(map[string]interface{})
-			if !ok {
-				continue
-			}
-			groundedContent, ok := replyMap["groundedContent"].(map[string]interface{})
-			if !ok {
-				continue
-			}
-			content, ok := groundedContent["content"].(map[string]interface{})
-			if !ok {
-				continue
-			}
+// Put 保存图片并返回访问 ID，超过上限时淘汰最早的图片
+func (s *generatedImageStore) Put(mimeType string, data []byte) string {
+	id := uuid.New().String()
+	now := time.Now()
 
-			// 检查functionCall
-			if fc, ok := content["functionCall"].(map[string]interface{}); ok {
-				name, _ := fc["name"].(string)
-				args, _ := fc["args"].(map[string]interface{})
-				argsBytes, _ := json.Marshal(args)
-
-				toolCalls = append(toolCalls, ToolCall{
-					ID:   "call_" + uuid.New().String()[:8],
-					Type: "function",
-					Function: FunctionCall{
-						Name:      name,
-						Arguments: string(argsBytes),
-					},
-				})
-			}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kept := s.order[:0]
+	for _, old := range s.order {
+		if item, ok := s.items[old]; ok && now.Before(item.expires) {
+			kept = append(kept, old)
+		} else {
+			delete(s.items, old)
 		}
 	}
+	s.order = kept
+	for len(s.order) >= generatedImageMaxCount {
+		delete(s.items, s.order[0])
+		s.order = s.order[1:]
+	}
+	s.items[id] = &generatedImage{mimeType: mimeType, data: data, expires: now.Add(generatedImageTTL)}
+	s.order = append(s.order, id)
+	return id
+}
 
-	return toolCalls
+// Get 获取未过期的图片
+func (s *generatedImageStore) Get(id string) (*generatedImage, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	item, ok := s.items[id]
+	if !ok || time.Now().After(item.expires) {
+		return nil, false
+	}
+	return item, true
 }
 
-// needsConversationContext 检查是否需要对话上下文（多轮对话）
-func needsConversationContext(messages []Message) bool {
-	// 检查是否有多轮对话标志：存在assistant或tool消息
-	for _, msg := range messages {
-		if msg.Role == "assistant" || msg.Role == "tool" || msg.Role == "tool_result" {
-			return true
-		}
+// imageCaptureWriter 捕获内部生成请求的响应，心跳写入与最终响应可能并发
+type imageCaptureWriter struct {
+	mu     sync.Mutex
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *imageCaptureWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *imageCaptureWriter) WriteHeader(status int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.status == 0 {
+		w.status = status
 	}
-	return false
 }
 
-// handleFlowRequest 处理 Flow 模型请求
-func handleFlowRequest(c *gin.Context, req ChatRequest, chatID string, createdTime int64) {
-	if flowHandler == nil {
-		c.JSON(503, gin.H{"error": gin.H{
-			"message": "Flow 服务未启用，请在配置文件中启用并添加 Token",
-			"type":    "service_unavailable",
-		}})
-		return
+func (w *imageCaptureWriter) Write(data []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.status == 0 {
+		w.status = http.StatusOK
 	}
+	return w.body.Write(data)
+}
 
-	// 解析消息内容和图片
-	var prompt string
-	var imageBytes [][]byte
+func (w *imageCaptureWriter) Flush() {}
 
-	for _, msg := range req.Messages {
-		if msg.Role == "user" || msg.Role == "human" {
-			text, images := parseMessageContent(msg)
-			if text != "" {
-				prompt = text
-			}
-			// 提取图片数据
-			for _, img := range images {
-				if img.Data != "" {
-					imgData, err := base64.StdEncoding.DecodeString(img.Data)
-					if err == nil {
-						imageBytes = append(imageBytes, imgData)
-					}
-				}
-			}
-		}
+// modelFamily 模型类别：video / image / text
+func modelFamily(model string) string {
+	switch {
+	case strings.Contains(model, "-video"):
+		return "video"
+	case strings.Contains(model, "-image"):
+		return "image"
 	}
+	return "text"
+}
 
-	if prompt == "" {
-		c.JSON(400, gin.H{"error": gin.H{
-			"message": "Prompt cannot be empty",
-			"type":    "invalid_request_error",
-		}})
-		return
+// accountTagForModel 按 model_tags 路由获取模型所需的账号标签（模型名优先，其次类别），未配置返回空
+func accountTagForModel(model string) string {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	if tag, ok := appConfig.ModelTags[model]; ok {
+		return strings.TrimSpace(tag)
 	}
+	return strings.TrimSpace(appConfig.ModelTags[modelFamily(model)])
+}
 
-	flowReq := flow.GenerationRequest{
-		Model:  req.Model,
-		Prompt: prompt,
-		Images: imageBytes,
-		Stream: req.Stream,
-	}
+// isImageGenerationModel 判断模型是否支持图片生成（Gemini -image 或 Flow 图片模型）
+func isImageGenerationModel(model string) bool {
+	return strings.Contains(model, "image") && !strings.Contains(model, "video")
+}
 
-	if req.Stream {
-		// 流式响应
-		c.Header("Content-Type", "text/event-stream")
-		c.Header("Cache-Control", "no-cache")
-		c.Header("Connection", "keep-alive")
-		c.Header("X-Accel-Buffering", "no")
-		c.Status(200)
+// imageGenerationMaxN 单次请求最多生成的图片数
+func imageGenerationMaxN() int {
+	configMu.RLock()
+	maxN := appConfig.Pool.MaxImageN
+	configMu.RUnlock()
+	if maxN <= 0 {
+		return defaultImageMaxN
+	}
+	return maxN
+}
 
-		flusher, ok := c.Writer.(http.Flusher)
-		if !ok {
-			c.JSON(500, gin.H{"error": "Streaming not supported"})
-			return
-		}
+// imageGenerationResult 单次生成的结果
+type imageGenerationResult struct {
+	images     []string // data URI 或远程 URL
+	status     int
+	retryAfter string
+	err        error
+}
 
-		result, _ := flowHandler.HandleGeneration(flowReq, func(chunk string) {
-			c.Writer.WriteString(chunk)
-			flusher.Flush()
-		})
+// runImageGeneration 复用聊天生成流程（号池选择/Flow/重试）执行一次图片生成
+func runImageGeneration(c *gin.Context, req ChatRequest) imageGenerationResult {
+	w := &imageCaptureWriter{header: make(http.Header)}
+	gc, _ := gin.CreateTestContext(w)
+	gc.Request = c.Request.Clone(c.Request.Context())
+	doStreamChat(gc, req)
 
-		// 发送 [DONE]
-		c.Writer.WriteString("data: [DONE]\n\n")
-		flusher.Flush()
+	result := imageGenerationResult{status: w.status, retryAfter: w.header.Get("Retry-After")}
+	result.images, result.err = parseImageGenerationBody(w.body.Bytes())
+	if result.err == nil && result.status >= 400 {
+		result.err = fmt.Errorf("上游返回状态码 %d", result.status)
+	}
+	return result
+}
 
-		if result != nil && !result.Success && result.Error != "" {
-			logger.Error("❌ [Flow] 生成失败: %s", result.Error)
+// parseImageGenerationBody 从非流式 chat.completion 响应中提取生成的图片
+func parseImageGenerationBody(body []byte) ([]string, error) {
+	var resp struct {
+		Choices []struct {
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+		} `json:"choices"`
+		Error json.RawMessage `json:"error"`
+	}
+	if err := json.Unmarshal(bytes.TrimSpace(body), &resp); err != nil {
+		return nil, fmt.Errorf("解析生成结果失败: %w", err)
+	}
+	if len(resp.Error) > 0 && string(resp.Error) != "null" {
+		var msg string
+		if json.Unmarshal(resp.Error, &msg) != nil {
+			var obj struct {
+				Message string `json:"message"`
+			}
+			json.Unmarshal(resp.Error, &obj)
+			msg = obj.Message
 		}
-	} else {
-		// 非流式响应
-		result, err := flowHandler.HandleGeneration(flowReq, nil)
-		if err != nil {
-			c.JSON(500, gin.H{"error": gin.H{
-				"message": err.Error(),
-				"type":    "internal_error",
-			}})
-			return
+		if msg == "" {
+			msg = string(resp.Error)
 		}
+		return nil, errors.New(msg)
+	}
 
-		if !result.Success {
-			c.JSON(500, gin.H{"error": gin.H{
-				"message": result.Error,
-				"type":    "generation_failed",
-			}})
-			return
+	var images []string
+	for _, choice := range resp.Choices {
+		for _, m := range markdownImageRE.FindAllStringSubmatch(choice.Message.Content, -1) {
+			images = append(images, m[1])
 		}
+	}
+	if len(images) == 0 {
+		return nil, errors.New("上游未返回图片")
+	}
+	return images, nil
+}
 
-		// 构建响应
-		content := result.URL
-		if result.Type == "image" {
-			content = fmt.Sprintf("![Generated Image](%s)", result.URL)
-		} else if result.Type == "video" {
-			content = fmt.Sprintf("<video src='%s' controls></video>", result.URL)
+// buildImageDataItem 按 response_format 转换单张图片（url 或 b64_json）
+func buildImageDataItem(c *gin.Context, image, responseFormat string) (gin.H, error) {
+	if strings.HasPrefix(image, "data:") {
+		header, b64, ok := strings.Cut(strings.TrimPrefix(image, "data:"), ",")
+		if !ok {
+			return nil, errors.New("无效的图片 data URI")
 		}
+		if responseFormat == "b64_json" {
+			return gin.H{"b64_json": b64}, nil
+		}
+		data, err := base64.StdEncoding.DecodeString(b64)
+		if err != nil {
+			return nil, fmt.Errorf("解码图片失败: %w", err)
+		}
+		mimeType := strings.TrimSuffix(header, ";base64")
+		id := imageStore.Put(mimeType, data)
+		return gin.H{"url": generatedImageURL(c, id)}, nil
+	}
 
-		c.JSON(200, gin.H{
-			"id":      chatID,
-			"object":  "chat.completion",
-			"created": createdTime,
-			"model":   req.Model,
-			"choices": []gin.H{{
-				"index": 0,
-				"message": gin.H{
-					"role":    "assistant",
-					"content": content,
-				},
-				"finish_reason": "stop",
-			}},
-		})
+	if responseFormat == "url" {
+		return gin.H{"url": image}, nil
+	}
+	b64, _, err := downloadImage(image)
+	if err != nil {
+		return nil, fmt.Errorf("下载图片失败: %w", err)
 	}
+	return gin.H{"b64_json": b64}, nil
 }
 
-func streamChat(c *gin.Context, req ChatRequest) {
-	chatID := "chatcmpl-" + uuid.New().String()
-	createdTime := time.Now().Unix()
-	clientIP := c.ClientIP()
-	userAgent := c.GetHeader("User-Agent")
-
-	// 统计变量
-	var statsSuccess bool
-	var statsInputTokens int64
-	var statsOutputTokens int64
-	var statsImages int64
-	var statsVideos int64
-	statsModel := req.Model
-	defer func() {
-		apiStats.RecordRequestWithModel(statsModel, statsSuccess, statsInputTokens, statsOutputTokens, statsImages, statsVideos)
-		// 记录IP统计（包含tokens、图片、视频）
-		ipStats.RecordIPRequest(clientIP, statsModel, userAgent, statsSuccess, statsInputTokens, statsOutputTokens, statsImages, statsVideos)
-	}()
+// generatedImageURL 根据请求地址构造生成图片的访问 URL
+func generatedImageURL(c *gin.Context, id string) string {
+	scheme := "http"
+	if c.Request.TLS != nil {
+		scheme = "https"
+	}
+	if proto := strings.TrimSpace(c.GetHeader("X-Forwarded-Proto")); proto != "" {
+		scheme = proto
+	}
+	return fmt.Sprintf("%s://%s/v1/images/files/%s", scheme, c.Request.Host, id)
+}
 
-	// 入站日志
-	logger.Info("📥 [%s] 请求: model=%s ", clientIP, req.Model)
-	if flow.IsFlowModel(req.Model) {
-		handleFlowRequest(c, req, chatID, createdTime)
+// handleImagesGenerations 处理 OpenAI Images API 格式的图片生成请求
+func handleImagesGenerations(c *gin.Context) {
+	var imgReq ImageGenerationRequest
+	if err := c.ShouldBindJSON(&imgReq); err != nil {
+		respondAPIError(c, 400, "invalid_request_error", err.Error(), "")
 		return
 	}
-	var textContent string
-	var images []MediaInfo
-	systemPrompt := extractSystemPrompt(req.Messages)
-	if needsConversationContext(req.Messages) {
-		// 多轮对话：拼接所有消息（包含system）
-		textContent = convertMessagesToPrompt(req.Messages)
-		// 只从最后一条用户消息提取图片
-		for i := len(req.Messages) - 1; i >= 0; i-- {
-			if req.Messages[i].Role == "user" || req.Messages[i].Role == "human" {
-				_, images = parseMessageContent(req.Messages[i])
-				break
-			}
-		}
-	} else {
-		lastMsg := req.Messages[len(req.Messages)-1]
-		userText, userImages := parseMessageContent(lastMsg)
-		images = userImages
-		if systemPrompt != "" {
-			textContent = fmt.Sprintf("<system>\n%s\n</system>\n\nHuman: %s\n\nAssistant:", systemPrompt, userText)
-		} else {
-			textContent = userText
+	prompt := strings.TrimSpace(imgReq.Prompt)
+	if prompt == "" {
+		respondAPIError(c, 400, "invalid_request_error", "prompt 不能为空", "")
+		return
+	}
+	model := strings.TrimSpace(imgReq.Model)
+	if model == "" {
+		model = defaultImageModel
+	}
+	if !isImageGenerationModel(model) {
+		respondAPIError(c, 400, "invalid_request_error", fmt.Sprintf("模型 %s 不支持图片生成", model), "")
+		return
+	}
+	responseFormat := strings.ToLower(strings.TrimSpace(imgReq.ResponseFormat))
+	if responseFormat == "" {
+		responseFormat = "url"
+	}
+	if responseFormat != "url" && responseFormat != "b64_json" {
+		respondAPIError(c, 400, "invalid_request_error", "response_format 仅支持 url 或 b64_json", "")
+		return
+	}
+	if !flow.IsFlowModel(model) {
+		if _, err := resolveImageAspectRatio("", imgReq.Size); err != nil {
+			respondAPIError(c, 400, "invalid_request_error", err.Error(), "")
+			return
 		}
 	}
-	var respBody []byte
-	var lastErr error
-	var lastErrStatusCode int // 保存最后一次错误的 HTTP 状态码
-	var lastErrBody []byte    // 保存最后一次错误的响应体
-	var usedAcc *pool.Account
-	var usedJWT, usedOrigAuth, usedConfigID, usedSession string
-	isLongRunning := !req.Stream && (strings.Contains(req.Model, "video") ||
-		strings.Contains(req.Model, "imagen") ||
-		strings.Contains(req.Model, "image"))
+	n := imgReq.N
+	if n <= 0 {
+		n = 1
+	}
+	if maxN := imageGenerationMaxN(); n > maxN {
+		requestLogger(c).Warn("⚠️ [%s] 图片生成数量 %d 超过上限，已限制为 %d", c.ClientIP(), n, maxN)
+		n = maxN
+	}
 
-	var heartbeatDone chan struct{}
-	if isLongRunning {
-		heartbeatDone = make(chan struct{})
-		c.Header("Content-Type", "application/json")
-		c.Header("Transfer-Encoding", "chunked")
-		c.Status(200)
-		writer := c.Writer
-		flusher, ok := writer.(http.Flusher)
-		if ok {
-			flusher.Flush() // 先发送头部
+	req := ChatRequest{
+		Model:    model,
+		Messages: []Message{{Role: "user", Content: prompt}},
+		Size:     imgReq.Size,
+	}
+	results := make([]imageGenerationResult, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = runImageGeneration(c, req)
+		}(i)
+	}
+	wg.Wait()
+
+	data := make([]gin.H, 0, n)
+	var firstErr *imageGenerationResult
+	for i := range results {
+		if results[i].err != nil {
+			requestLogger(c).Warn("⚠️ [%s] 图片生成 %d/%d 失败: %v", c.ClientIP(), i+1, n, results[i].err)
+			if firstErr == nil {
+				firstErr = &results[i]
+			}
+			continue
 		}
-		go func() {
-			defer func() {
-				if r := recover(); r != nil {
-				}
-			}()
-			ticker := time.NewTicker(15 * time.Second)
-			defer ticker.Stop()
-			for {
-				select {
-				case <-heartbeatDone:
-					return
-				case <-ticker.C:
-					if _, err := writer.Write([]byte(" ")); err != nil {
-						return
-					}
-					if flusher, ok := writer.(http.Flusher); ok {
-						flusher.Flush()
-					}
-				}
+		for _, image := range results[i].images {
+			item, err := buildImageDataItem(c, image, responseFormat)
+			if err != nil {
+				requestLogger(c).Warn("⚠️ [%s] 图片结果转换失败: %v", c.ClientIP(), err)
+				continue
 			}
-		}()
+			data = append(data, item)
+		}
 	}
-	defer func() {
-		if heartbeatDone != nil {
-			select {
-			case <-heartbeatDone:
-			default:
-				close(heartbeatDone)
+
+	if len(data) == 0 {
+		status := 502
+		message := "图片生成失败"
+		if firstErr != nil {
+			message = firstErr.err.Error()
+			if firstErr.status >= 400 {
+				status = firstErr.status
+			}
+			if firstErr.retryAfter != "" {
+				c.Header("Retry-After", firstErr.retryAfter)
 			}
 		}
-	}()
+		respondAPIError(c, status, "generation_failed", message, "")
+		return
+	}
 
-	// 估算输入 tokens（基于文本长度）
-	statsInputTokens = int64(len(textContent)/4) + int64(len(images)*500) // 文本 + 图片估算
+	c.JSON(200, gin.H{
+		"created": time.Now().Unix(),
+		"data":    data,
+	})
+}
 
-	// 流式请求：提前发送 SSE 头部，避免上游请求期间客户端等待超时
-	var streamWriter http.ResponseWriter
-	var streamFlusher http.Flusher
-	var streamStarted bool
-	if req.Stream {
-		c.Header("Content-Type", "text/event-stream")
-		c.Header("Cache-Control", "no-cache")
-		c.Header("Connection", "keep-alive")
-		c.Header("X-Accel-Buffering", "no")
-		streamWriter = c.Writer
-		streamFlusher, _ = streamWriter.(http.Flusher)
-		chunk := createChunk(chatID, createdTime, req.Model, map[string]interface{}{"role": "assistant"}, nil)
-		fmt.Fprintf(streamWriter, "data: %s\n\n", chunk)
-		streamFlusher.Flush()
-		streamStarted = true
+// handleGeneratedImageFile 提供 response_format=url 生成图片的下载
+func handleGeneratedImageFile(c *gin.Context) {
+	item, ok := imageStore.Get(c.Param("id"))
+	if !ok {
+		respondAPIError(c, 404, "invalid_request_error", "图片不存在或已过期", "")
+		return
 	}
+	c.Header("Cache-Control", "private, max-age=3600")
+	c.Data(200, item.mimeType, item.data)
+}
 
-	for retry := 0; retry < maxRetries; retry++ {
-		acc := pool.Pool.Next()
-		if acc == nil {
-			if streamStarted {
-				// 流式请求已开始，发送 SSE 格式错误
-				errChunk := createChunk(chatID, createdTime, req.Model, map[string]interface{}{"content": "[错误] 没有可用账号"}, nil)
-				fmt.Fprintf(streamWriter, "data: %s\n\n", errChunk)
-				finishReason := "stop"
-				finalChunk := createChunk(chatID, createdTime, req.Model, nil, &finishReason)
-				fmt.Fprintf(streamWriter, "data: %s\n\n", finalChunk)
-				fmt.Fprintf(streamWriter, "data: [DONE]\n\n")
-				streamFlusher.Flush()
-			} else {
-				c.JSON(500, gin.H{"error": "没有可用账号"})
-			}
-			return
-		}
-		usedAcc = acc
-		logger.Info("📤 [%s] 使用账号: %s", clientIP, acc.Data.Email)
+// buildToolsSpec 将OpenAI格式的工具定义转换为Gemini的toolsSpec
+// 支持混合后缀同时启用多个功能，如 -image-search 同时启用图片生成和搜索
+func buildToolsSpec(tools []ToolDef, isImageModel, isVideoModel, isSearchModel bool) map[string]interface{} {
+	toolsSpec := make(map[string]interface{})
 
-		if retry > 0 {
-			logger.Info("🔄 第 %d 次重试，切换账号: %s", retry+1, acc.Data.Email)
-		}
+	// 检查是否指定了任何功能后缀
+	hasAnySpec := isImageModel || isVideoModel || isSearchModel
 
-		jwt, configID, err := acc.GetJWT()
-		if err != nil {
-			logger.Error("❌ [%s] 获取 JWT 失败: %v", acc.Data.Email, err)
-			lastErr = err
-			continue
+	if !hasAnySpec {
+		toolsSpec["webGroundingSpec"] = map[string]interface{}{}
+		toolsSpec["toolRegistry"] = "default_tool_registry"
+		toolsSpec["imageGenerationSpec"] = map[string]interface{}{}
+		toolsSpec["videoGenerationSpec"] = map[string]interface{}{}
+	} else {
+		if isImageModel {
+			toolsSpec["imageGenerationSpec"] = map[string]interface{}{}
 		}
+		if isVideoModel {
+			toolsSpec["videoGenerationSpec"] = map[string]interface{}{}
+		}
+		if isSearchModel {
+			toolsSpec["webGroundingSpec"] = map[string]interface{}{}
+		}
+	}
+	if decls := functionDeclarations(tools); len(decls) > 0 {
+		toolsSpec["functionDeclarations"] = decls
+	}
 
-		session, err := createSession(jwt, configID, acc.Data.Authorization)
-		if err != nil {
-			logger.Error("❌ [%s] 创建 Session 失败: %v", acc.Data.Email, err)
-			// 401 错误标记账号需要刷新
-			if strings.Contains(err.Error(), "401") || strings.Contains(err.Error(), "UNAUTHENTICATED") {
-				pool.Pool.MarkNeedsRefresh(acc)
-			}
-			lastErr = err
+	return toolsSpec
+}
+
+// functionDeclarations 将 OpenAI 的 function 工具转为 Gemini functionDeclarations，跳过非 function 类型与无名工具
+func functionDeclarations(tools []ToolDef) []map[string]interface{} {
+	var decls []map[string]interface{}
+	for _, tool := range tools {
+		if (tool.Type != "" && tool.Type != "function") || tool.Function.Name == "" {
 			continue
 		}
+		decl := map[string]interface{}{"name": tool.Function.Name}
+		if tool.Function.Description != "" {
+			decl["description"] = tool.Function.Description
+		}
+		if len(tool.Function.Parameters) > 0 {
+			decl["parameters"] = tool.Function.Parameters
+		}
+		decls = append(decls, decl)
+	}
+	return decls
+}
 
-		// 上传媒体文件并获取 fileIds
-		var fileIds []string
-		uploadFailed := false
-		for _, media := range images {
-			var fileId string
-			var err error
+// tool_choice 模式
+const (
+	toolChoiceAuto     = "auto"
+	toolChoiceNone     = "none"
+	toolChoiceRequired = "required"
+)
 
-			mediaTypeName := "图片"
-			if media.MediaType == "video" {
-				mediaTypeName = "视频"
-			}
+// toolChoice 解析后的 tool_choice：Function 非空时只允许调用该函数（Mode 为 required）
+type toolChoice struct {
+	Mode     string
+	Function string
+}
 
-			if media.IsURL {
-				// 优先尝试 URL 直接上传
-				fileId, err = uploadContextFileByURL(jwt, configID, session, media.URL, acc.Data.Authorization)
-				if err != nil {
-					// URL 上传失败，回退到下载后上传
-					mediaData, mimeType, dlErr := downloadMedia(media.URL, media.MediaType)
-					if dlErr != nil {
-						logger.Warn("⚠️ [%s] %s下载失败: %v", acc.Data.Email, mediaTypeName, dlErr)
-						if strings.Contains(dlErr.Error(), "UPSTREAM_401") || strings.Contains(dlErr.Error(), "UPSTREAM_403") {
-							c.JSON(500, gin.H{"error": gin.H{
-								"message": dlErr.Error(),
-								"type":    "upstream_error",
-								"code":    "media_download_failed",
-							}})
-							return
-						}
-						uploadFailed = true
-						break
-					}
-					fileId, err = uploadContextFile(jwt, configID, session, mimeType, mediaData, acc.Data.Authorization)
-				}
-			} else {
-				fileId, err = uploadContextFile(jwt, configID, session, media.MimeType, media.Data, acc.Data.Authorization)
-			}
-			if err != nil {
-				logger.Warn("⚠️ [%s] %s上传失败: %v", acc.Data.Email, mediaTypeName, err)
-				uploadFailed = true
+// parseToolChoice 解析 OpenAI 风格的 tool_choice 并校验与 tools 是否匹配
+func parseToolChoice(raw interface{}, tools []ToolDef) (toolChoice, error) {
+	choice := toolChoice{Mode: toolChoiceAuto}
+	switch v := raw.(type) {
+	case nil:
+	case string:
+		switch mode := strings.ToLower(strings.TrimSpace(v)); mode {
+		case "", toolChoiceAuto:
+		case toolChoiceNone, toolChoiceRequired:
+			choice.Mode = mode
+		default:
+			return choice, fmt.Errorf("tool_choice 无效: %q（可选 auto/none/required 或指定函数）", v)
+		}
+	case map[string]interface{}:
+		fn, _ := v["function"].(map[string]interface{})
+		name, _ := fn["name"].(string)
+		if t, _ := v["type"].(string); t != "function" || strings.TrimSpace(name) == "" {
+			return choice, fmt.Errorf("tool_choice 对象需为 {\"type\":\"function\",\"function\":{\"name\":...}}")
+		}
+		choice = toolChoice{Mode: toolChoiceRequired, Function: strings.TrimSpace(name)}
+	default:
+		return choice, fmt.Errorf("tool_choice 类型无效")
+	}
+
+	if choice.Mode == toolChoiceRequired && len(tools) == 0 {
+		return choice, fmt.Errorf("tool_choice 要求调用工具，但未提供 tools")
+	}
+	if choice.Function != "" {
+		found := false
+		for _, tool := range tools {
+			if tool.Function.Name == choice.Function {
+				found = true
 				break
 			}
-			fileIds = append(fileIds, fileId)
-		}
-		if uploadFailed {
-			lastErr = fmt.Errorf("媒体上传失败")
-			continue
 		}
-		// 构建 query parts（只包含文本）
-		queryParts := []map[string]interface{}{}
-		if textContent != "" {
-			queryParts = append(queryParts, map[string]interface{}{"text": textContent})
+		if !found {
+			return choice, fmt.Errorf("tool_choice 指定的函数 %q 不在 tools 中", choice.Function)
 		}
-		// 确保 queryParts 不为空，避免 Google 返回空响应
-		if len(queryParts) == 0 {
-			queryParts = append(queryParts, map[string]interface{}{"text": " "})
+	}
+	return choice, nil
+}
+
+// filterTools 按 tool_choice 过滤工具：none 不提供任何工具，指定函数时只保留该函数
+func (tc toolChoice) filterTools(tools []ToolDef) []ToolDef {
+	if tc.Mode == toolChoiceNone {
+		return nil
+	}
+	if tc.Function == "" {
+		return tools
+	}
+	var kept []ToolDef
+	for _, tool := range tools {
+		if tool.Function.Name == tc.Function {
+			kept = append(kept, tool)
 		}
-		isImageModel := strings.Contains(req.Model, "-image")
-		isVideoModel := strings.Contains(req.Model, "-video")
-		isSearchModel := strings.Contains(req.Model, "-search")
-		actualModel := req.Model
-		actualModel = strings.ReplaceAll(actualModel, "-image", "")
-		actualModel = strings.ReplaceAll(actualModel, "-video", "")
-		actualModel = strings.ReplaceAll(actualModel, "-search", "")
+	}
+	return kept
+}
 
-		// 构建 toolsSpec（支持自定义工具）
-		toolsSpec := buildToolsSpec(req.Tools, isImageModel, isVideoModel, isSearchModel)
+// instruction 返回注入系统提示词的工具调用要求，auto/none 时为空
+func (tc toolChoice) instruction(tools []ToolDef) string {
+	if tc.Mode != toolChoiceRequired {
+		return ""
+	}
+	if tc.Function != "" {
+		return fmt.Sprintf("你必须调用工具 %s 来回答，不要直接输出文本答案。", tc.Function)
+	}
+	names := make([]string, 0, len(tools))
+	for _, tool := range tools {
+		names = append(names, tool.Function.Name)
+	}
+	return fmt.Sprintf("你必须调用以下工具之一来回答，不要直接输出文本答案：%s。", strings.Join(names, ", "))
+}
 
-		body := map[string]interface{}{
-			"configId":         configID,
-			"additionalParams": map[string]string{"token": "-"},
-			"streamAssistRequest": map[string]interface{}{
-				"session":              session,
-				"query":                map[string]interface{}{"parts": queryParts},
-				"filter":               "",
-				"fileIds":              fileIds,
-				"answerGenerationMode": "NORMAL",
-				"toolsSpec":            toolsSpec,
-				"languageCode":         "zh-CN",
-				"userMetadata":         map[string]string{"timeZone": "Asia/Shanghai"},
-				"assistSkippingMode":   "REQUEST_ASSIST",
-			},
+// withSystemInstruction 将指令追加到第一条 system 消息（单轮对话只使用第一条），没有时在开头插入
+func withSystemInstruction(messages []Message, instruction string) []Message {
+	out := append([]Message(nil), messages...)
+	for i, msg := range out {
+		if msg.Role == "system" {
+			text, _ := parseMessageContent(msg)
+			out[i].Content = text + "\n\n" + instruction
+			return out
 		}
+	}
+	return append([]Message{{Role: "system", Content: instruction}}, out...)
+}
 
-		// 设置模型 ID（去掉 -image 后缀）
-		if targetModelID, ok := modelMapping[actualModel]; ok && targetModelID != "" {
-			body["streamAssistRequest"].(map[string]interface{})["assistGenerationConfig"] = map[string]interface{}{
-				"modelId": targetModelID,
-			}
-		}
+// applyImageAspectRatio 将宽高比写入 imageGenerationSpec（仅在启用图片生成时生效）
+func applyImageAspectRatio(toolsSpec map[string]interface{}, aspectRatio string) bool {
+	if aspectRatio == "" {
+		return false
+	}
+	spec, ok := toolsSpec["imageGenerationSpec"].(map[string]interface{})
+	if !ok {
+		return false
+	}
+	spec["aspectRatio"] = aspectRatio
+	return true
+}
 
-		bodyBytes, _ := json.Marshal(body)
-		httpReq, _ := http.NewRequest("POST", "https://biz-discoveryengine.googleapis.com/v1alpha/locations/global/widgetStreamAssist", bytes.NewReader(bodyBytes))
+// newToolCall 将 Gemini functionCall 转为 OpenAI 工具调用，index 为该调用在本次响应中的序号
+func newToolCall(fc map[string]interface{}, index int) ToolCall {
+	name, _ := fc["name"].(string)
+	args, _ := fc["args"].(map[string]interface{})
+	argsBytes, _ := json.Marshal(args)
+	return ToolCall{
+		Index: index,
+		ID:    "call_" + uuid.New().String()[:8],
+		Type:  "function",
+		Function: FunctionCall{
+			Name:      name,
+			Arguments: string(argsBytes),
+		},
+	}
+}
 
-		for k, v := range getCommonHeaders(jwt, acc.Data.Authorization) {
-			httpReq.Header.Set(k, v)
+// parseUpstreamResponse 解析缓冲的上游响应：标准 JSON 数组，失败时依次尝试修复不完整数组与 NDJSON
+func parseUpstreamResponse(respBody []byte, reqLog *logger.Logger) []map[string]interface{} {
+	var dataList []map[string]interface{}
+	parseErr := json.Unmarshal(respBody, &dataList)
+	if parseErr == nil {
+		return dataList
+	}
+	reqLog.Warn("⚠️ JSON 数组解析失败: %v, 响应前100字符: %s", parseErr, sanitizeUpstreamText(string(respBody[:min(100, len(respBody))])))
+
+	dataList = parseUpstreamFallback(respBody, reqLog)
+	if len(dataList) == 0 {
+		// 输出完整响应用于调试
+		respStr := sanitizeUpstreamText(string(respBody))
+		if len(respStr) > 500 {
+			reqLog.Error("❌ 所有解析方式均失败, 响应长度: %d, 前500字符: %s", len(respBody), respStr[:500])
+			reqLog.Error("❌ 后200字符: %s", respStr[len(respStr)-200:])
+		} else {
+			reqLog.Error("❌ 所有解析方式均失败, 响应长度: %d, 完整响应: %s", len(respBody), respStr)
 		}
+		return nil
+	}
+	reqLog.Info("✅ 备用解析成功，共 %d 个对象", len(dataList))
+	return dataList
+}
 
-		resp, err := utils.HTTPClient.Do(httpReq)
-		if err != nil {
-			logger.Error("❌ [%s] 请求失败: %v", acc.Data.Email, err)
-			lastErr = err
-			continue
-		}
+// parseUpstreamFallback 修复不完整的 JSON 数组，仍失败时按 NDJSON 解析
+func parseUpstreamFallback(respBody []byte, reqLog *logger.Logger) []map[string]interface{} {
+	dataList := utils.ParseIncompleteJSONArray(respBody)
+	if dataList == nil {
+		reqLog.Warn("⚠️ 尝试 NDJSON 格式...")
+		dataList = utils.ParseNDJSON(respBody)
+	}
+	return dataList
+}
 
-		if resp.StatusCode != 200 {
-			body, _ := utils.ReadResponseBody(resp)
-			resp.Body.Close()
-			logger.Error("❌ [%s] Google 报错: %d %s (重试 %d/%d)", acc.Data.Email, resp.StatusCode, string(body), retry+1, maxRetries)
-			lastErr = fmt.Errorf("HTTP %d: %s", resp.StatusCode, string(body))
-			lastErrStatusCode = resp.StatusCode
-			lastErrBody = body
-			// 401/403 无权限，标记需要刷新
-			if resp.StatusCode == 401 || resp.StatusCode == 403 {
-				logger.Warn("⚠️ [%s] %d 无权限，标记需要刷新", acc.Data.Email, resp.StatusCode)
-				pool.Pool.MarkNeedsRefresh(acc)
-			}
-			// 429 限流，延长使用冷却时间（3倍冷却）
-			if resp.StatusCode == 429 {
-				cooldownTime := pool.UseCooldown * 3
-				acc.Mu.Lock()
-				acc.LastUsed = time.Now().Add(cooldownTime)
-				acc.Mu.Unlock()
-				logger.Info("⏳ [%s] 429 限流，账号进入延长冷却 %v", acc.Data.Email, cooldownTime)
-				pool.Pool.MarkUsed(acc, false)
-				time.Sleep(1 * time.Second) // 短暂等待后切换账号
-				retry--                     // 不计入重试次数
-				continue
-			}
-			if resp.StatusCode == 400 {
-				logger.Warn("⚠️ [%s] 400 错误，换账号重试", acc.Data.Email)
-				pool.Pool.MarkUsed(acc, false)
-				time.Sleep(500 * time.Millisecond)
-				continue
+// logUpstreamSummary 检查解析结果中是否有有效响应并输出统计
+func logUpstreamSummary(dataList []map[string]interface{}, reqLog *logger.Logger) {
+	hasValidResponse := false
+	hasFileContent := false
+	for _, data := range dataList {
+		if _, ok := data["streamAssistResponse"].(map[string]interface{}); ok {
+			hasValidResponse = true
+		}
+		for _, content := range upstreamReplyContents(data) {
+			if _, ok := content["file"]; ok {
+				hasFileContent = true
 			}
-			pool.Pool.MarkUsed(acc, false) // 标记失败
-			continue
 		}
-		// 成功，读取响应
-		respBody, _ = utils.ReadResponseBody(resp)
-		resp.Body.Close()
+	}
+	if !hasValidResponse {
+		reqLog.Warn("⚠️ 响应中没有 streamAssistResponse，响应内容: %v", dataList[0])
+	}
+	reqLog.Debug("📊 响应统计: %d 个数据块, 有效响应=%v, 包含文件=%v", len(dataList), hasValidResponse, hasFileContent)
+}
 
-		// Debug 模式输出上游响应
-		if logger.IsDebug() {
-			respSnippet := string(respBody)
-			if len(respSnippet) > 2000 {
-				respSnippet = respSnippet[:2000] + "..."
+// resolveResponseSession 从响应中提取 session（用于下载图片），缺失时回退到请求时创建的 session
+func resolveResponseSession(dataList []map[string]interface{}, usedSession string, reqLog *logger.Logger) string {
+	for _, data := range dataList {
+		if streamResp, ok := data["streamAssistResponse"].(map[string]interface{}); ok {
+			if sessionInfo, ok := streamResp["sessionInfo"].(map[string]interface{}); ok {
+				if s, ok := sessionInfo["session"].(string); ok && s != "" {
+					return s
+				}
 			}
-			logger.Debug("[%s] 上游响应: %s", acc.Data.Email, respSnippet)
 		}
+	}
+	if usedSession != "" {
+		reqLog.Warn("⚠️ 响应中未找到 session，使用请求时创建的 session: %s", usedSession)
+	} else {
+		reqLog.Warn("⚠️ 响应中未找到 session 且无回退 session，图片/视频下载可能失败")
+	}
+	return usedSession
+}
 
-		// 快速检查是否是认证错误响应
-		if bytes.Contains(respBody, []byte("uToken")) && !bytes.Contains(respBody, []byte("streamAssistResponse")) {
-			logger.Warn("[%s] 收到认证响应，标记需要刷新", acc.Data.Email)
-			pool.Pool.MarkNeedsRefresh(acc)
-			lastErr = fmt.Errorf("认证失败，需要刷新账号")
-			continue
+// upstreamReplyContents 返回单个上游对象中各 reply 的 groundedContent.content
+func upstreamReplyContents(data map[string]interface{}) []map[string]interface{} {
+	streamResp, _ := data["streamAssistResponse"].(map[string]interface{})
+	answer, _ := streamResp["answer"].(map[string]interface{})
+	replies, _ := answer["replies"].([]interface{})
+	var contents []map[string]interface{}
+	for _, reply := range replies {
+		replyMap, _ := reply.(map[string]interface{})
+		gc, _ := replyMap["groundedContent"].(map[string]interface{})
+		if content, ok := gc["content"].(map[string]interface{}); ok {
+			contents = append(contents, content)
 		}
+	}
+	return contents
+}
 
-		// 检查是否有实际内容（非空返回）
-		hasText := bytes.Contains(respBody, []byte(`"text"`))
-		hasFile := bytes.Contains(respBody, []byte(`"file"`))
-		hasInlineData := bytes.Contains(respBody, []byte(`"inlineData"`))
-		hasThought := bytes.Contains(respBody, []byte(`"thought"`))
-		hasFunctionCall := bytes.Contains(respBody, []byte(`"functionCall"`))
-		hasError := bytes.Contains(respBody, []byte(`"error"`)) || bytes.Contains(respBody, []byte(`"errorMessage"`))
-		hasContent := hasText || hasFile || hasInlineData || hasFunctionCall
-
-		// 检测是否有服务端错误信息
-		if hasError && !hasContent {
-			logger.Warn("[%s] 响应包含错误信息，重试 (%d/%d)", acc.Data.Email, retry+1, maxRetries)
-			// 简单解析错误类型
-			if bytes.Contains(respBody, []byte("RESOURCE_EXHAUSTED")) || bytes.Contains(respBody, []byte("quota")) {
-				logger.Info("⏳ [%s] 检测到配额耗尽，标记冷却", acc.Data.Email)
-				acc.SetCooldownMultiplier(5) // 5倍冷却
-				pool.Pool.MarkUsed(acc, false)
+// upstreamHasOutput 判断上游对象是否带有可输出内容，与缓冲路径的 text/file/inlineData/functionCall 判定一致
+func upstreamHasOutput(data map[string]interface{}) bool {
+	for _, content := range upstreamReplyContents(data) {
+		for _, key := range []string{"text", "file", "inlineData", "functionCall"} {
+			if _, ok := content[key]; ok {
+				return true
 			}
-			lastErr = fmt.Errorf("上游返回错误响应")
-			continue
 		}
-
-		// 响应完全为空或只有思考内容
-		if !hasContent {
-			if hasThought {
-				logger.Warn("[%s] 响应只有思考内容，无实际输出，换号重试 (%d/%d)", acc.Data.Email, retry+1, maxRetries)
-				lastErr = fmt.Errorf("空返回，只有思考内容")
-				// 思考中的账号不标记失败，可能只是请求太慢
-				time.Sleep(500 * time.Millisecond)
-			} else {
-				logger.Warn("[%s] 响应无有效内容 (text/file/inlineData/functionCall)，换号重试 (%d/%d)", acc.Data.Email, retry+1, maxRetries)
-				lastErr = fmt.Errorf("空返回，无有效内容")
-				pool.Pool.MarkUsed(acc, false)
-			}
-			continue
-		}
-
-		usedJWT = jwt
-		usedOrigAuth = acc.Data.Authorization
-		usedConfigID = configID
-		usedSession = session // 保存创建的 session 作为回退
-		usedAcc = acc
-		lastErr = nil
-		pool.Pool.MarkUsed(acc, true) // 标记成功
-		break
 	}
+	return false
+}
 
-	if lastErr != nil {
-		logger.Error("❌ 所有重试均失败: %v", lastErr)
-		if streamStarted {
-			// 流式请求已开始，发送 SSE 格式错误
-			errMsg := fmt.Sprintf("[错误] %v", lastErr)
-			errChunk := createChunk(chatID, createdTime, req.Model, map[string]interface{}{"content": errMsg}, nil)
-			fmt.Fprintf(streamWriter, "data: %s\n\n", errChunk)
-			finishReason := "stop"
-			finalChunk := createChunk(chatID, createdTime, req.Model, nil, &finishReason)
-			fmt.Fprintf(streamWriter, "data: %s\n\n", finalChunk)
-			fmt.Fprintf(streamWriter, "data: [DONE]\n\n")
-			streamFlusher.Flush()
-		} else if lastErrStatusCode > 0 && len(lastErrBody) > 0 {
-			// 如果有 HTTP 错误响应体，原样透传
-			c.Data(lastErrStatusCode, "application/json", lastErrBody)
-		} else {
-			c.JSON(500, gin.H{"error": lastErr.Error()})
+// liveUpstream 流式请求的增量上游响应：先回放预读的对象，再边读边返回剩余对象
+type liveUpstream struct {
+	decoder  *utils.JSONStreamDecoder
+	pending  []map[string]interface{} // 已读取但尚未返回的对象
+	returned int                      // 已返回的对象数，备用解析时据此跳过已输出部分
+	done     bool
+	log      *logger.Logger
+}
+
+// openLiveUpstream 增量读取上游响应，出现可输出内容即返回 live，调用方负责在转发结束后关闭响应体；
+// 流结束前仍无内容或解析失败时读完剩余数据，返回完整原始响应交给缓冲路径检查与解析
+func openLiveUpstream(resp *http.Response, reqLog *logger.Logger) (*liveUpstream, []byte) {
+	reader, err := utils.ResponseBodyReader(resp)
+	if err != nil {
+		return nil, nil
+	}
+	u := &liveUpstream{decoder: utils.NewJSONStreamDecoder(reader), log: reqLog}
+	for {
+		obj, err := u.decoder.Next()
+		if err != nil {
+			return nil, u.decoder.Drain()
+		}
+		u.pending = append(u.pending, obj)
+		if upstreamHasOutput(obj) {
+			return u, append([]byte(nil), u.decoder.Raw()...)
 		}
-		return
 	}
+}
 
-	_ = usedAcc
-
-	// 检查空响应
-	if len(respBody) == 0 {
-		logger.Error("❌ 响应为空")
-		if streamStarted {
-			errChunk := createChunk(chatID, createdTime, req.Model, map[string]interface{}{"content": "[错误] 上游返回空响应"}, nil)
-			fmt.Fprintf(streamWriter, "data: %s\n\n", errChunk)
-			finishReason := "stop"
-			finalChunk := createChunk(chatID, createdTime, req.Model, nil, &finishReason)
-			fmt.Fprintf(streamWriter, "data: %s\n\n", finalChunk)
-			fmt.Fprintf(streamWriter, "data: [DONE]\n\n")
-			streamFlusher.Flush()
-		} else {
-			c.JSON(500, gin.H{"error": "Empty response from Google"})
+// Next 返回下一个对象；增量解析中断时读完剩余响应，用备用解析补齐尚未输出的对象
+func (u *liveUpstream) Next() (map[string]interface{}, bool) {
+	if len(u.pending) > 0 {
+		obj := u.pending[0]
+		u.pending = u.pending[1:]
+		u.returned++
+		return obj, true
+	}
+	if u.done {
+		return nil, false
+	}
+	obj, err := u.decoder.Next()
+	if err == nil {
+		u.returned++
+		return obj, true
+	}
+	u.done = true
+	if err != io.EOF {
+		u.log.Warn("⚠️ 增量解析中断: %v，改用备用解析补齐剩余内容", err)
+		if rest := parseUpstreamFallback(u.decoder.Drain(), u.log); len(rest) > u.returned {
+			u.pending = rest[u.returned:]
+			return u.Next()
 		}
-		return
 	}
+	return nil, false
+}
 
-	// 解析响应：支持多种格式
-	var dataList []map[string]interface{}
-	var parseErr error
+// upstreamObjects 返回上游对象迭代器：增量响应边读边返回，否则遍历已解析的结果
+func upstreamObjects(dataList []map[string]interface{}, live *liveUpstream) func() (map[string]interface{}, bool) {
+	if live != nil {
+		return live.Next
+	}
+	i := 0
+	return func() (map[string]interface{}, bool) {
+		if i >= len(dataList) {
+			return nil, false
+		}
+		i++
+		return dataList[i-1], true
+	}
+}
 
-	// 1. 尝试标准 JSON 数组
-	if parseErr = json.Unmarshal(respBody, &dataList); parseErr != nil {
-		logger.Warn("⚠️ JSON 数组解析失败: %v, 响应前100字符: %s", parseErr, string(respBody[:min(100, len(respBody))]))
+// extractToolCalls 从Gemini响应中提取工具调用
+func extractToolCalls(dataList []map[string]interface{}) []ToolCall {
+	var toolCalls []ToolCall
 
-		// 2. 尝试修复不完整的 JSON 数组
-		dataList = utils.ParseIncompleteJSONArray(respBody)
-		if dataList == nil {
-			// 3. 尝试 NDJSON 格式
-			logger.Warn("⚠️ 尝试 NDJSON 格式...")
-			dataList = utils.ParseNDJSON(respBody)
+	for _, data := range dataList {
+		streamResp, ok := data["streamAssistResponse"].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		answer, ok := streamResp["answer"].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		replies, ok := answer["replies"].([]interface{})
+		if !ok {
+			continue
 		}
 
-		if len(dataList) == 0 {
-			// 输出完整响应用于调试
-			respStr := string(respBody)
-			if len(respStr) > 500 {
-				logger.Error("❌ 所有解析方式均失败, 响应长度: %d, 前500字符: %s", len(respBody), respStr[:500])
-				logger.Error("❌ 后200字符: %s", respStr[len(respStr)-200:])
-			} else {
-				logger.Error("❌ 所有解析方式均失败, 响应长度: %d, 完整响应: %s", len(respBody), respStr)
+		for _, reply := range replies {
+			replyMap, ok := reply.(map[string]interface{})
+			if !ok {
+				continue
 			}
-			if streamStarted {
-				errChunk := createChunk(chatID, createdTime, req.Model, map[string]interface{}{"content": "[错误] 响应解析失败"}, nil)
-				fmt.Fprintf(streamWriter, "data: %s\n\n", errChunk)
-				finishReason := "stop"
-				finalChunk := createChunk(chatID, createdTime, req.Model, nil, &finishReason)
-				fmt.Fprintf(streamWriter, "data: %s\n\n", finalChunk)
-				fmt.Fprintf(streamWriter, "data: [DONE]\n\n")
-				streamFlusher.Flush()
-			} else {
-				c.JSON(500, gin.H{"error": "JSON Parse Error"})
+			groundedContent, ok := replyMap["groundedContent"].(map[string]interface{})
+			if !ok {
+				continue
+			}
+			content, ok := groundedContent["content"].(map[string]interface{})
+			if !ok {
+				continue
 			}
-			return
-		}
-		logger.Info("✅ 备用解析成功，共 %d 个对象", len(dataList))
-	}
 
-	// 检查是否有有效响应
-	if len(dataList) > 0 {
-		hasValidResponse := false
-		hasFileContent := false
-		for _, data := range dataList {
-			if streamResp, ok := data["streamAssistResponse"].(map[string]interface{}); ok {
-				hasValidResponse = true
-				// 检查是否有文件内容
-				if answer, ok := streamResp["answer"].(map[string]interface{}); ok {
-					if replies, ok := answer["replies"].([]interface{}); ok {
-						for _, reply := range replies {
-							if replyMap, ok := reply.(map[string]interface{}); ok {
-								if gc, ok := replyMap["groundedContent"].(map[string]interface{}); ok {
-									if content, ok := gc["content"].(map[string]interface{}); ok {
-										if _, ok := content["file"]; ok {
-											hasFileContent = true
-										}
-									}
-								}
-							}
-						}
-					}
-				}
+			// 检查functionCall
+			if fc, ok := content["functionCall"].(map[string]interface{}); ok {
+				toolCalls = append(toolCalls, newToolCall(fc, len(toolCalls)))
 			}
 		}
-		if !hasValidResponse {
-			logger.Warn("⚠️ 响应中没有 streamAssistResponse，响应内容: %v", dataList[0])
-		}
-		logger.Debug("📊 响应统计: %d 个数据块, 有效响应=%v, 包含文件=%v", len(dataList), hasValidResponse, hasFileContent)
 	}
 
-	// 从响应中提取 session（用于下载图片）
-	var respSession string
-	for _, data := range dataList {
-		if streamResp, ok := data["streamAssistResponse"].(map[string]interface{}); ok {
-			if sessionInfo, ok := streamResp["sessionInfo"].(map[string]interface{}); ok {
-				if s, ok := sessionInfo["session"].(string); ok && s != "" {
-					respSession = s
-					break
-				}
-			}
+	return toolCalls
+}
+
+// needsConversationContext 检查是否需要对话上下文（多轮对话）
+func needsConversationContext(messages []Message) bool {
+	// 检查是否有多轮对话标志：存在assistant或tool消息
+	for _, msg := range messages {
+		if msg.Role == "assistant" || msg.Role == "tool" || msg.Role == "tool_result" {
+			return true
 		}
 	}
+	return false
+}
 
-	// 如果响应中没有 session，使用请求时创建的 session 作为回退
-	if respSession == "" {
-		if usedSession != "" {
-			logger.Warn("⚠️ 响应中未找到 session，使用请求时创建的 session: %s", usedSession)
-			respSession = usedSession
-		} else {
-			logger.Warn("⚠️ 响应中未找到 session 且无回退 session，图片/视频下载可能失败")
-		}
-	} else {
+// Flow 请求/响应头
+const (
+	flowProgressHeader     = "X-Flow-Progress"      // 请求头：0/false/off 关闭视频渲染进度推送
+	flowDurationHeader     = "X-Flow-Duration"      // 请求头：视频时长（秒），请求体 duration 优先
+	flowQualityHeader      = "X-Flow-Quality"       // 请求头：视频清晰度，请求体 quality 优先
+	flowPollAttemptsHeader = "X-Flow-Poll-Attempts" // 响应头：非流式视频生成的轮询次数
+)
+
+// flowProgressEnabled 流式视频生成默认推送渲染进度，可通过 X-Flow-Progress 关闭
+func flowProgressEnabled(c *gin.Context) bool {
+	switch strings.ToLower(strings.TrimSpace(c.GetHeader(flowProgressHeader))) {
+	case "0", "false", "off", "no":
+		return false
 	}
+	return true
+}
 
-	// 待下载的文件信息
-	type PendingFile struct {
-		FileID   string
-		MimeType string
+// flowVideoOutput 解析视频时长/清晰度（请求体优先，其次请求头）并按模型支持范围校验
+func flowVideoOutput(c *gin.Context, req ChatRequest) (flow.VideoOutput, error) {
+	duration := req.Duration
+	if duration == 0 {
+		if raw := strings.TrimSpace(c.GetHeader(flowDurationHeader)); raw != "" {
+			parsed, err := strconv.Atoi(strings.TrimSuffix(raw, "s"))
+			if err != nil {
+				return flow.VideoOutput{}, fmt.Errorf("无效的 %s: %s", flowDurationHeader, raw)
+			}
+			duration = parsed
+		}
 	}
+	if duration < 0 {
+		return flow.VideoOutput{}, fmt.Errorf("duration 不能为负数")
+	}
+	quality := req.Quality
+	if strings.TrimSpace(quality) == "" {
+		quality = c.GetHeader(flowQualityHeader)
+	}
+	return flow.ValidateVideoOutput(req.Model, duration, quality)
+}
 
-	if req.Stream {
-		// 流式响应：文本/思考实时输出，图片最后处理
-		// SSE 头部和 role chunk 已在请求前发送，复用 streamWriter/streamFlusher
-		writer := streamWriter
-		flusher := streamFlusher
+// handleFlowRequest 处理 Flow 模型请求
+func handleFlowRequest(c *gin.Context, req ChatRequest, chatID string, createdTime int64) {
+	reqLog := requestLogger(c)
+	if flowHandler == nil {
+		respondAPIError(c, 503, "service_unavailable", "Flow 服务未启用，请在配置文件中启用并添加 Token", "")
+		return
+	}
 
-		// 统计输出内容长度
-		var outputLen int64
+	// 解析消息内容和图片
+	var prompt string
+	var imageBytes [][]byte
 
-		// 收集待下载的文件和工具调用
-		var pendingFiles []PendingFile
-		hasToolCalls := false
-		for _, data := range dataList {
-			streamResp, ok := data["streamAssistResponse"].(map[string]interface{})
-			if !ok {
-				continue
-			}
-			answer, ok := streamResp["answer"].(map[string]interface{})
-			if !ok {
-				continue
+	for _, msg := range req.Messages {
+		if msg.Role == "user" || msg.Role == "human" {
+			text, images := parseMessageContent(msg)
+			if text != "" {
+				prompt = text
 			}
-			replies, ok := answer["replies"].([]interface{})
-			if !ok {
-				continue
+			if err := validateMedia(req.Model, images); err != nil {
+				respondMediaError(c, err)
+				return
 			}
-			for _, reply := range replies {
-				replyMap, ok := reply.(map[string]interface{})
-				if !ok {
-					continue
-				}
-				groundedContent, ok := replyMap["groundedContent"].(map[string]interface{})
-				if !ok {
-					continue
-				}
-				content, ok := groundedContent["content"].(map[string]interface{})
-				if !ok {
-					continue
-				}
-				// 检查是否是思考内容
-				if thought, ok := content["thought"].(bool); ok && thought {
-					if t, ok := content["text"].(string); ok && t != "" {
-						chunk := createChunk(chatID, createdTime, req.Model, map[string]interface{}{"reasoning_content": t}, nil)
-						fmt.Fprintf(writer, "data: %s\n\n", chunk)
-						flusher.Flush()
-						outputLen += int64(len(t))
+			// 提取图片数据
+			for _, img := range images {
+				if img.Data != "" {
+					imgData, err := base64.StdEncoding.DecodeString(img.Data)
+					if err == nil {
+						imageBytes = append(imageBytes, imgData)
 					}
-					continue
-				}
-				// 输出文本（实时）
-				if t, ok := content["text"].(string); ok && t != "" {
-					chunk := createChunk(chatID, createdTime, req.Model, map[string]interface{}{"content": t}, nil)
-					fmt.Fprintf(writer, "data: %s\n\n", chunk)
-					flusher.Flush()
-					outputLen += int64(len(t))
 				}
+			}
+		}
+	}
 
-				// 处理 inlineData（直接有 base64 数据的图片）
-				if inlineData, ok := content["inlineData"].(map[string]interface{}); ok {
-					mime, _ := inlineData["mimeType"].(string)
-					data, _ := inlineData["data"].(string)
-					if mime != "" && data != "" {
-						imgMarkdown := formatImageAsMarkdown(mime, data)
-						chunk := createChunk(chatID, createdTime, req.Model, map[string]interface{}{"content": imgMarkdown}, nil)
-						fmt.Fprintf(writer, "data: %s\n\n", chunk)
-						flusher.Flush()
-					}
-				}
+	if prompt == "" {
+		respondAPIError(c, 400, "invalid_request_error", "Prompt cannot be empty", "")
+		return
+	}
 
-				// 收集需要下载的文件（图片/视频）
-				if file, ok := content["file"].(map[string]interface{}); ok {
-					fileId, _ := file["fileId"].(string)
-					mimeType, _ := file["mimeType"].(string)
-					if fileId != "" {
-						pendingFiles = append(pendingFiles, PendingFile{FileID: fileId, MimeType: mimeType})
-					}
-				}
-				if fc, ok := content["functionCall"].(map[string]interface{}); ok {
-					hasToolCalls = true
-					name, _ := fc["name"].(string)
-					args, _ := fc["args"].(map[string]interface{})
-					argsBytes, _ := json.Marshal(args)
+	// 视频模型按类型划分图片角色：I2V 第 1 张为首帧、第 2 张为尾帧，R2V 全部为参考图
+	roles, err := flow.AssignVideoImageRoles(req.Model, imageBytes)
+	if err != nil {
+		respondAPIError(c, 400, "invalid_request_error", err.Error(), "")
+		return
+	}
 
-					toolCall := ToolCall{
-						ID:   "call_" + uuid.New().String()[:8],
-						Type: "function",
-						Function: FunctionCall{
-							Name:      name,
-							Arguments: string(argsBytes),
-						},
-					}
-					chunk := createChunk(chatID, createdTime, req.Model, map[string]interface{}{
-						"tool_calls": []map[string]interface{}{{
-							"index": 0,
-							"id":    toolCall.ID,
-							"type":  "function",
-							"function": map[string]interface{}{
-								"name":      toolCall.Function.Name,
-								"arguments": toolCall.Function.Arguments,
-							},
-						}},
-					}, nil)
-					fmt.Fprintf(writer, "data: %s\n\n", chunk)
-					flusher.Flush()
-				}
-			}
-		}
-		if len(pendingFiles) > 0 {
-			logger.Info("📥 开始下载 %d 个文件...", len(pendingFiles))
-			type downloadResult struct {
-				Index    int
-				Data     string
-				MimeType string
-				Err      error
-			}
-			results := make(chan downloadResult, len(pendingFiles))
-			var wg sync.WaitGroup
-			for i, pf := range pendingFiles {
-				wg.Add(1)
-				go func(idx int, file PendingFile) {
-					defer wg.Done()
-					data, err := downloadGeneratedFile(usedJWT, file.FileID, respSession, usedConfigID, usedOrigAuth)
-					results <- downloadResult{Index: idx, Data: data, MimeType: file.MimeType, Err: err}
-				}(i, pf)
-			}
-			go func() {
-				wg.Wait()
-				close(results)
-			}()
-			downloaded := make([]downloadResult, len(pendingFiles))
-			for r := range results {
-				downloaded[r.Index] = r
-			}
+	output, err := flowVideoOutput(c, req)
+	if err != nil {
+		respondAPIError(c, 400, "invalid_request_error", err.Error(), "")
+		return
+	}
 
-			// 按顺序输出
-			successCount := 0
-			var lastErr error
-			needsRetry := false
-			for i, r := range downloaded {
-				if r.Err != nil {
-					logger.Error("❌ 下载文件[%d]失败: %v", i, r.Err)
-					lastErr = r.Err
-					// 检测是否需要换号重试
-					if errors.Is(r.Err, ErrDownloadNeedsRetry) {
-						needsRetry = true
-					}
-					continue
-				}
-				imgMarkdown := formatImageAsMarkdown(r.MimeType, r.Data)
-				chunk := createChunk(chatID, createdTime, req.Model, map[string]interface{}{"content": imgMarkdown}, nil)
-				fmt.Fprintf(writer, "data: %s\n\n", chunk)
-				flusher.Flush()
-				successCount++
-			}
+	flowReq := flow.GenerationRequest{
+		Model:           req.Model,
+		Prompt:          prompt,
+		Images:          imageBytes,
+		Stream:          req.Stream,
+		NoProgress:      !flowProgressEnabled(c),
+		StartImage:      roles.StartFrame,
+		EndImage:        roles.EndFrame,
+		ReferenceImages: roles.References,
+		Output:          output,
+	}
+	// 客户端截止时间：到期后停止轮询，非流式返回 504
+	deadline := requestDeadline(c, req.Timeout)
+	ctx, cancelDeadline := withRequestDeadline(c, deadline)
+	defer cancelDeadline()
+	if deadline > 0 {
+		flowReq.Ctx = ctx
+	}
 
-			// 如果所有文件都下载失败
-			if successCount == 0 && lastErr != nil {
-				var errMsg string
-				if needsRetry {
-					// 401/403 认证失败，提示用户重试（下次会使用新账号）
-					errMsg = "[提示] 文件下载认证失败，请重新发送请求（系统将自动切换账号）"
-					pool.Pool.MarkNeedsRefresh(usedAcc) // 标记当前账号需要刷新
-				} else {
-					errMsg = fmt.Sprintf("生成的文件下载失败: %v", lastErr)
-				}
-				chunk := createChunk(chatID, createdTime, req.Model, map[string]interface{}{"content": errMsg}, nil)
-				fmt.Fprintf(writer, "data: %s\n\n", chunk)
-				flusher.Flush()
-			}
-		}
+	if req.Stream {
+		// 流式响应
+		c.Header("Content-Type", "text/event-stream")
+		c.Header("Cache-Control", "no-cache")
+		c.Header("Connection", "keep-alive")
+		c.Header("X-Accel-Buffering", "no")
+		c.Status(200)
 
-		// 发送结束
-		finishReason := "stop"
-		if hasToolCalls {
-			finishReason = "tool_calls"
+		flusher, ok := c.Writer.(http.Flusher)
+		if !ok {
+			respondAPIError(c, 500, "internal_error", "Streaming not supported", "")
+			return
 		}
-		finalChunk := createChunk(chatID, createdTime, req.Model, nil, &finishReason)
-		fmt.Fprintf(writer, "data: %s\n\n", finalChunk)
-		fmt.Fprintf(writer, "data: [DONE]\n\n")
+
+		// 与 streamChat 一致：先发送 role 块和状态提示，客户端可立即显示活动
+		roleChunk := createChunk(chatID, createdTime, req.Model, map[string]interface{}{"role": "assistant"}, nil)
+		fmt.Fprintf(c.Writer, "data: %s\n\n", roleChunk)
+		statusChunk := createChunk(chatID, createdTime, req.Model, map[string]interface{}{"reasoning_content": "⏳ 已收到 Flow 生成请求，正在准备...\n"}, nil)
+		fmt.Fprintf(c.Writer, "data: %s\n\n", statusChunk)
 		flusher.Flush()
 
-		// 更新统计（区分图片和视频）
-		statsSuccess = true
-		statsOutputTokens = outputLen / 4 // 估算输出 tokens
-		for _, pf := range pendingFiles {
-			if strings.HasPrefix(pf.MimeType, "video/") {
-				statsVideos++
-			} else {
-				statsImages++
-			}
+		// 首个内容到达前发送 SSE 注释心跳（关闭进度推送时，视频生成可能数分钟没有输出）
+		heartbeat := startSSEHeartbeat(c.Writer, heartbeatInterval())
+		defer heartbeat.Stop()
+		result, err := flowHandler.HandleGeneration(flowReq, func(chunk string) {
+			heartbeat.Stop()
+			c.Writer.WriteString(chunk)
+			flusher.Flush()
+		})
+		heartbeat.Stop()
+
+		errMsg := flowStreamError(result, err)
+		writeFlowStreamEnd(c.Writer, chatID, createdTime, req.Model, errMsg)
+		flusher.Flush()
+
+		if errMsg != "" {
+			reqLog.Error("❌ [Flow] 生成失败: %s", errMsg)
 		}
 	} else {
 		// 非流式响应
-		var fullContent strings.Builder
-		var fullReasoning strings.Builder
-		replyCount := 0
-		var fileCount int64
-		var videoCount int64
-
-		for _, data := range dataList {
-			streamResp, ok := data["streamAssistResponse"].(map[string]interface{})
-			if !ok {
-				continue
-			}
-			answer, ok := streamResp["answer"].(map[string]interface{})
-			if !ok {
-				continue
-			}
-			replies, ok := answer["replies"].([]interface{})
-			if !ok {
-				continue
-			}
-
-			for _, reply := range replies {
-				replyMap, ok := reply.(map[string]interface{})
-				if !ok {
-					continue
-				}
-				replyCount++
-				if gc, ok := replyMap["groundedContent"].(map[string]interface{}); ok {
-					if content, ok := gc["content"].(map[string]interface{}); ok {
-						if file, ok := content["file"].(map[string]interface{}); ok {
-							if mimeType, _ := file["mimeType"].(string); strings.HasPrefix(mimeType, "video/") {
-								videoCount++
-							} else {
-								fileCount++
-							}
-						}
-					}
-				}
-
-				text, imageData, imageMime, reasoning, dlErr := extractContentFromReply(replyMap, usedJWT, respSession, usedConfigID, usedOrigAuth)
-				if reasoning != "" {
-					fullReasoning.WriteString(reasoning)
-				}
-				if text != "" {
-					fullContent.WriteString(text)
-				}
-				if imageData != "" && imageMime != "" {
-					fullContent.WriteString(formatImageAsMarkdown(imageMime, imageData))
-				}
-				// 检测下载是否需要重试（401/403）
-				if dlErr != nil && errors.Is(dlErr, ErrDownloadNeedsRetry) {
-					pool.Pool.MarkNeedsRefresh(usedAcc)
-					fullContent.WriteString("\n\n[提示] 文件下载认证失败，请重新发送请求（系统将自动切换账号）")
-				}
+		result, err := flowHandler.HandleGeneration(flowReq, nil)
+		if deadlineExceeded(ctx) {
+			reqLog.Warn("⏱️ [Flow] 超过客户端截止时间 %v，已停止轮询", deadline)
+			if result != nil && result.PollAttempts > 0 {
+				c.Header(flowPollAttemptsHeader, strconv.Itoa(result.PollAttempts))
 			}
+			respondRequestTimeout(c, deadline)
+			return
+		}
+		if err != nil {
+			respondAPIError(c, 500, "internal_error", err.Error(), "")
+			return
 		}
-		toolCalls := extractToolCalls(dataList)
-		// 调试日志
-		logger.Debug("📊 非流式响应统计: %d 个 reply, 图片=%d, 视频=%d, content长度=%d, reasoning长度=%d, 工具调用=%d",
-			replyCount, fileCount, videoCount, fullContent.Len(), fullReasoning.Len(), len(toolCalls))
 
-		// 构建响应消息
-		message := gin.H{
-			"role":    "assistant",
-			"content": fullContent.String(),
+		if result.PollAttempts > 0 {
+			c.Header(flowPollAttemptsHeader, strconv.Itoa(result.PollAttempts))
 		}
-		if fullReasoning.Len() > 0 {
-			message["reasoning_content"] = fullReasoning.String()
+		if !result.Success {
+			respondAPIError(c, 500, "generation_failed", result.Error, "")
+			return
 		}
-		finishReason := "stop"
-		if len(toolCalls) > 0 {
-			message["tool_calls"] = toolCalls
-			message["content"] = nil
-			finishReason = "tool_calls"
+
+		// 构建响应
+		content := result.URL
+		if result.Type == "image" {
+			content = fmt.Sprintf("![Generated Image](%s)", result.URL)
+		} else if result.Type == "video" {
+			content = fmt.Sprintf("<video src='%s' controls></video>", result.URL)
 		}
 
-		// 构建最终响应（完全符合OpenAI格式）
-		response := gin.H{
-			"id":                 chatID,
-			"object":             "chat.completion",
-			"created":            createdTime,
-			"model":              req.Model,
-			"system_fingerprint": "fp_gemini_" + req.Model,
+		c.JSON(200, gin.H{
+			"id":      chatID,
+			"object":  "chat.completion",
+			"created": createdTime,
+			"model":   req.Model,
 			"choices": []gin.H{{
-				"index":         0,
-				"message":       message,
-				"logprobs":      nil,
-				"finish_reason": finishReason,
+				"index": 0,
+				"message": gin.H{
+					"role":    "assistant",
+					"content": content,
+				},
+				"finish_reason": "stop",
 			}},
-			"usage": gin.H{
-				"prompt_tokens":     0,
-				"completion_tokens": 0,
-				"total_tokens":      0,
-			},
-		}
-		if isLongRunning && heartbeatDone != nil {
-			close(heartbeatDone) // 停止心跳
-			jsonBytes, _ := json.Marshal(response)
-			c.Writer.Write(jsonBytes)
-		} else {
-			c.JSON(200, response)
+		})
+	}
+}
+
+// flowStreamError 返回流式 Flow 生成的失败原因，成功时为空
+func flowStreamError(result *flow.GenerationResult, err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	if result == nil {
+		return "Flow 未返回结果"
+	}
+	if !result.Success {
+		if result.Error != "" {
+			return result.Error
 		}
+		return "Flow 生成失败"
+	}
+	return ""
+}
 
-		// 更新统计
-		statsSuccess = true
-		statsOutputTokens = int64(fullContent.Len() / 4) // 粗略估算输出 tokens
-		statsImages = fileCount
-		statsVideos = videoCount
+// writeFlowStreamEnd 结束 Flow 流式响应：失败时先输出错误内容，随后发送 finish_reason 块和 [DONE]
+func writeFlowStreamEnd(w io.Writer, chatID string, createdTime int64, model, errMsg string) {
+	if errMsg != "" {
+		errChunk := createChunk(chatID, createdTime, model, map[string]interface{}{"content": "[错误] " + errMsg}, nil)
+		fmt.Fprintf(w, "data: %s\n\n", errChunk)
 	}
+	finishReason := "stop"
+	finalChunk := createChunk(chatID, createdTime, model, nil, &finishReason)
+	fmt.Fprintf(w, "data: %s\n\n", finalChunk)
+	fmt.Fprintf(w, "data: [DONE]\n\n")
 }
-func extractAPIKey(c *gin.Context) string {
-	authHeader := c.GetHeader("Authorization")
-	if strings.HasPrefix(authHeader, "Bearer ") {
-		return strings.TrimSpace(strings.TrimPrefix(authHeader, "Bearer "))
+
+// 并发生成限制默认值
+const (
+	generationAutoRatio       = 0.8             // 自动模式下并发上限占就绪账号数的比例，为重试预留账号
+	generationDefaultQueueSec = 30              // 默认排队等待时间(秒)
+	generationRecheckInterval = 1 * time.Second // 排队期间重新检查上限的间隔（就绪账号数可能变化）
+)
+
+var errGenerationBusy = errors.New("当前并发生成数已达上限，请稍后重试")
+
+// GenerationLimiter 限制同时进行的上游生成请求数，避免突发请求占满号池
+type GenerationLimiter struct {
+	mu       sync.Mutex
+	inFlight int
+	waiting  int
+	rejected int64
+	notify   chan struct{}
+	limitFn  func() int
+}
+
+var generationLimiter = newGenerationLimiter(generationConcurrencyLimit)
+
+func newGenerationLimiter(limitFn func() int) *GenerationLimiter {
+	return &GenerationLimiter{
+		notify:  make(chan struct{}),
+		limitFn: limitFn,
 	}
-	return strings.TrimSpace(c.GetHeader("X-API-Key"))
 }
 
-func isValidAPIKey(apiKey string) bool {
-	apiKey = strings.TrimSpace(apiKey)
-	if apiKey == "" {
-		return false
+// generationConcurrencyLimit 计算当前并发上限，<=0 表示不限制
+func generationConcurrencyLimit() int {
+	configMu.RLock()
+	maxGen := appConfig.Pool.MaxConcurrentGen
+	configMu.RUnlock()
+
+	if maxGen != 0 {
+		return maxGen
 	}
-	for _, key := range GetAPIKeys() {
-		if key == apiKey {
-			return true
-		}
+	limit := int(float64(pool.Pool.ReadyCount()) * generationAutoRatio)
+	if limit < 1 {
+		limit = 1
 	}
-	return false
+	return limit
 }
 
-func isSessionAuthorized(c *gin.Context) bool {
-	if panelSessions == nil {
-		return false
+// generationQueueTimeout 获取排队等待时间，0 表示不排队直接拒绝
+func generationQueueTimeout() time.Duration {
+	configMu.RLock()
+	sec := appConfig.Pool.GenQueueTimeoutSec
+	configMu.RUnlock()
+
+	if sec < 0 {
+		return 0
 	}
-	token, err := c.Cookie(adminauth.SessionCookieName)
-	if err != nil || strings.TrimSpace(token) == "" {
-		return false
+	if sec == 0 {
+		sec = generationDefaultQueueSec
 	}
-	session, ok := panelSessions.Validate(token)
-	if !ok {
+	return time.Duration(sec) * time.Second
+}
+
+// tryAcquireLocked 在持有锁时尝试占用一个并发名额
+func (l *GenerationLimiter) tryAcquireLocked() bool {
+	limit := l.limitFn()
+	if limit > 0 && l.inFlight >= limit {
 		return false
 	}
-	c.Set("panel_username", session.Username)
-	c.Set("auth_type", "session")
+	l.inFlight++
 	return true
 }
 
-func apiKeyAuth() gin.HandlerFunc {
-	return func(c *gin.Context) {
-		if len(GetAPIKeys()) == 0 {
-			c.Next()
-			return
-		}
+// Acquire 获取生成名额，并发已满时最多排队 timeout，超时或请求取消返回 errGenerationBusy
+func (l *GenerationLimiter) Acquire(ctx context.Context, timeout time.Duration) error {
+	l.mu.Lock()
+	if l.tryAcquireLocked() {
+		l.mu.Unlock()
+		return nil
+	}
+	if timeout <= 0 {
+		l.rejected++
+		l.mu.Unlock()
+		return errGenerationBusy
+	}
+	l.waiting++
+	l.mu.Unlock()
 
-		apiKey := extractAPIKey(c)
-		if apiKey == "" {
-			c.JSON(401, gin.H{"error": "Missing API key"})
-			c.Abort()
-			return
-		}
-		if !isValidAPIKey(apiKey) {
-			c.JSON(401, gin.H{"error": "Invalid API key"})
-			c.Abort()
-			return
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	recheck := time.NewTicker(generationRecheckInterval)
+	defer recheck.Stop()
+
+	for {
+		l.mu.Lock()
+		notify := l.notify
+		l.mu.Unlock()
+
+		select {
+		case <-notify:
+		case <-recheck.C:
+		case <-deadline.C:
+			l.mu.Lock()
+			l.waiting--
+			l.rejected++
+			l.mu.Unlock()
+			return errGenerationBusy
+		case <-ctx.Done():
+			l.mu.Lock()
+			l.waiting--
+			l.mu.Unlock()
+			return ctx.Err()
+		}
+
+		l.mu.Lock()
+		if l.tryAcquireLocked() {
+			l.waiting--
+			l.mu.Unlock()
+			return nil
 		}
-		c.Set("auth_type", "api_key")
-		c.Set("api_key", apiKey)
-		c.Next()
+		l.mu.Unlock()
 	}
 }
 
-func adminAuth() gin.HandlerFunc {
-	return func(c *gin.Context) {
-		if isSessionAuthorized(c) {
-			c.Next()
-			return
-		}
-		if isValidAPIKey(extractAPIKey(c)) {
-			c.Set("auth_type", "api_key")
-			c.Next()
-			return
-		}
-		c.JSON(401, gin.H{"error": "Unauthorized"})
-		c.Abort()
+// Release 释放生成名额并唤醒排队的请求
+func (l *GenerationLimiter) Release() {
+	l.mu.Lock()
+	if l.inFlight > 0 {
+		l.inFlight--
 	}
+	l.mu.Unlock()
+	l.Notify()
 }
 
-func requireSessionAuth() gin.HandlerFunc {
-	return func(c *gin.Context) {
-		if isSessionAuthorized(c) {
-			c.Next()
-			return
-		}
-		c.JSON(401, gin.H{"error": "Unauthorized"})
-		c.Abort()
-	}
+// Notify 唤醒排队的请求重新检查上限（上限变化时调用）
+func (l *GenerationLimiter) Notify() {
+	l.mu.Lock()
+	close(l.notify)
+	l.notify = make(chan struct{})
+	l.mu.Unlock()
 }
 
-// runBrowserRefreshMode 有头浏览器刷新模式
-func runBrowserRefreshMode(email string) {
-	loadAppConfig()
-	utils.InitHTTPClient(Proxy)
+// Snapshot 返回当前并发状态
+func (l *GenerationLimiter) Snapshot() map[string]interface{} {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return map[string]interface{}{
+		"in_flight": l.inFlight,
+		"waiting":   l.waiting,
+		"limit":     l.limitFn(),
+		"rejected":  l.rejected,
+	}
+}
 
-	// 强制有头模式
-	pool.BrowserRefreshHeadless = false
-	logger.Info("🌐 有头浏览器刷新模式")
+// respondGenerationBusy 排队超时：服务整体已满属于暂时不可用，返回 503（单 IP 限流仍为 429）
+func respondGenerationBusy(c *gin.Context) {
+	snapshot := generationLimiter.Snapshot()
+	c.Header("Retry-After", "5")
+	respondAPIError(c, 503, "server_busy", errGenerationBusy.Error(), "", gin.H{
+		"in_flight": snapshot["in_flight"],
+		"waiting":   snapshot["waiting"],
+	})
+}
 
-	if err := pool.Pool.Load(DataDir); err != nil {
-		log.Fatalf("❌ 加载账号失败: %v", err)
+// heartbeatInterval 获取等待上游期间的心跳间隔（0 表示禁用）
+func heartbeatInterval() time.Duration {
+	configMu.RLock()
+	sec := appConfig.Pool.HeartbeatIntervalSec
+	configMu.RUnlock()
+	if sec < 0 {
+		return 0
 	}
-
-	if pool.Pool.TotalCount() == 0 {
-		log.Fatal("❌ 没有可用账号")
+	if sec == 0 {
+		sec = 15
 	}
+	return time.Duration(sec) * time.Second
+}
 
-	// 查找目标账号
-	var targetAcc *pool.Account
-	pool.Pool.WithLock(func(ready, pending []*pool.Account) {
-		if email != "" {
-			// 指定邮箱
-			for _, acc := range ready {
-				if acc.Data.Email == email {
-					targetAcc = acc
-					break
+// sseKeepAliveComment SSE 注释行，OpenAI 兼容客户端会忽略以 ":" 开头的行
+const sseKeepAliveComment = ": keep-alive\n\n"
+
+// sseHeartbeat 流式请求在首个内容到达前定时发送 SSE 注释，防止反代空闲超时断开连接
+type sseHeartbeat struct {
+	mu      sync.Mutex
+	w       http.ResponseWriter
+	done    chan struct{}
+	stopped bool
+}
+
+// startSSEHeartbeat 启动心跳，interval <= 0 时返回 nil（Stop 可安全调用）
+func startSSEHeartbeat(w http.ResponseWriter, interval time.Duration) *sseHeartbeat {
+	if interval <= 0 {
+		return nil
+	}
+	h := &sseHeartbeat{w: w, done: make(chan struct{})}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-h.done:
+				return
+			case <-ticker.C:
+				h.mu.Lock()
+				if h.stopped {
+					h.mu.Unlock()
+					return
 				}
-			}
-			if targetAcc == nil {
-				for _, acc := range pending {
-					if acc.Data.Email == email {
-						targetAcc = acc
-						break
-					}
+				_, err := h.w.Write([]byte(sseKeepAliveComment))
+				if flusher, ok := h.w.(http.Flusher); ok && err == nil {
+					flusher.Flush()
+				}
+				h.mu.Unlock()
+				if err != nil {
+					return
 				}
-			}
-		} else {
-			// 使用第一个账号
-			if len(ready) > 0 {
-				targetAcc = ready[0]
-			} else if len(pending) > 0 {
-				targetAcc = pending[0]
 			}
 		}
-	})
+	}()
+	return h
+}
 
-	if targetAcc == nil {
-		if email != "" {
-			log.Fatalf("❌ 找不到账号: %s", email)
-		}
-		log.Fatal("❌ 没有可用账号")
+// Stop 停止心跳；返回后不会再有心跳写入，可安全写入正式内容
+func (h *sseHeartbeat) Stop() {
+	if h == nil {
+		return
 	}
-	result := register.RefreshCookieWithBrowser(targetAcc, false, Proxy)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if !h.stopped {
+		h.stopped = true
+		close(h.done)
+	}
+}
 
-	if result.Success {
+// 熔断状态
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half_open"
+)
 
-		if len(result.NewCookies) > 0 {
-		}
-		if len(result.ResponseHeaders) > 0 {
-		}
+// CircuitBreaker 全局熔断器：滑动窗口内失败率超过阈值时，在冷却期内直接拒绝新请求
+type CircuitBreaker struct {
+	mu        sync.Mutex
+	buckets   []breakerBucket
+	state     string
+	openUntil time.Time
+	trips     int64
+	rejected  int64
+	configFn  func() CircuitBreakerConfig
+	now       func() time.Time
+}
 
-		// 更新账号数据
-		targetAcc.Mu.Lock()
-		targetAcc.Data.Cookies = result.SecureCookies
-		if result.Authorization != "" {
-			targetAcc.Data.Authorization = result.Authorization
-		}
-		if result.ConfigID != "" {
-			targetAcc.ConfigID = result.ConfigID
-			targetAcc.Data.ConfigID = result.ConfigID
-		}
-		if result.CSESIDX != "" {
-			targetAcc.CSESIDX = result.CSESIDX
-			targetAcc.Data.CSESIDX = result.CSESIDX
-		}
-		// 保存响应头
-		if len(result.ResponseHeaders) > 0 {
-			targetAcc.Data.ResponseHeaders = result.ResponseHeaders
-		}
-		targetAcc.Mu.Unlock()
+// breakerBucket 每秒的请求结果计数
+type breakerBucket struct {
+	second   int64
+	success  int
+	failures int
+}
 
-		// 保存到文件
-		if err := targetAcc.SaveToFile(); err != nil {
-			logger.Warn("⚠️ 保存失败: %v", err)
-		} else {
-			logger.Info("💾 已保存到: %s", targetAcc.FilePath)
-		}
-	} else {
-		logger.Error("❌ 刷新失败: %v", result.Error)
+var circuitBreaker = newCircuitBreaker(circuitBreakerConfig)
+
+func newCircuitBreaker(configFn func() CircuitBreakerConfig) *CircuitBreaker {
+	return &CircuitBreaker{
+		state:    breakerClosed,
+		configFn: configFn,
+		now:      time.Now,
 	}
 }
 
-var AutoSubscribeEnabled bool
-
-var (
-	bearerSecretRE   = regexp.MustCompile(`(?i)(authorization[^A-Za-z0-9]+Bearer[ \t]+)[A-Za-z0-9\-._~+/=]+`)
-	xPoolSecretRE    = regexp.MustCompile(`(?i)(x-pool-secret[^A-Za-z0-9]+)[^\s",;]+`)
-	apiKeyTokenRE    = regexp.MustCompile(`(?i)\bsk-[A-Za-z0-9\-_]{8,}\b`)
-	duckmailBearerRE = regexp.MustCompile(`(?i)(duckmail[_-]?bearer[^A-Za-z0-9]+)[^\s",;]+`)
-)
+// circuitBreakerConfig 获取熔断配置（未配置的字段使用默认值）
+func circuitBreakerConfig() CircuitBreakerConfig {
+	configMu.RLock()
+	cfg := appConfig.CircuitBreaker
+	configMu.RUnlock()
 
-func sanitizeSensitiveLine(line string) string {
-	clean := strings.TrimSpace(line)
-	if clean == "" {
-		return ""
+	if cfg.FailureRate == 0 {
+		cfg.FailureRate = 0.8
 	}
-	clean = bearerSecretRE.ReplaceAllString(clean, "${1}***")
-	clean = xPoolSecretRE.ReplaceAllString(clean, "${1}***")
-	clean = duckmailBearerRE.ReplaceAllString(clean, "${1}***")
-	clean = apiKeyTokenRE.ReplaceAllString(clean, "sk-***")
-	return clean
+	if cfg.WindowSec <= 0 {
+		cfg.WindowSec = 60
+	}
+	if cfg.MinRequests <= 0 {
+		cfg.MinRequests = 20
+	}
+	if cfg.CooldownSec <= 0 {
+		cfg.CooldownSec = 30
+	}
+	return cfg
 }
 
-func init() {
-	// 设置环境变量禁用 quic-go 的警告
-	os.Setenv("QUIC_GO_DISABLE_RECEIVE_BUFFER_WARNING", "true")
-	filterStdout()
-}
-func filterStdout() {
-	// 创建 stdout 管道，用于统一过滤与日志聚合
-	r, w, err := os.Pipe()
-	if err != nil {
-		return
+// Allow 检查是否允许新请求，熔断中返回 false 及剩余冷却时间
+func (b *CircuitBreaker) Allow() (bool, time.Duration) {
+	if b.configFn().FailureRate < 0 {
+		return true, 0
 	}
-	origStdout := os.Stdout
-	os.Stdout = w
-	log.SetOutput(w)
 
-	go func() {
-		scanner := bufio.NewScanner(r)
-		buf := make([]byte, 0, 64*1024)
-		scanner.Buffer(buf, 1024*1024)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state != breakerOpen {
+		return true, 0
+	}
+	now := b.now()
+	if now.Before(b.openUntil) {
+		b.rejected++
+		return false, b.openUntil.Sub(now)
+	}
+	// 冷却结束，进入半开状态，由下一个请求结果决定恢复或再次熔断
+	b.state = breakerHalfOpen
+	logger.Info("🔌 熔断冷却结束，进入半开状态")
+	return true, 0
+}
 
-		for scanner.Scan() {
-			line := strings.TrimSpace(scanner.Text())
-			if line == "" {
-				continue
-			}
+// Record 记录一次请求结果
+func (b *CircuitBreaker) Record(success bool) {
+	cfg := b.configFn()
+	if cfg.FailureRate < 0 {
+		return
+	}
 
-			// 过滤特定噪音日志
-			if strings.Contains(line, "REALITY localAddr:") ||
-				strings.Contains(line, "DialTLSContext") ||
-				strings.Contains(line, "sys_conn.go") ||
-				strings.Contains(line, "failed to sufficiently increase receive buffer size") {
-				continue
-			}
+	b.mu.Lock()
+	defer b.mu.Unlock()
 
-			safeLine := sanitizeSensitiveLine(line)
-			if safeLine == "" {
-				continue
-			}
-			_, _ = origStdout.WriteString(safeLine + "\n")
-			logger.AppendRaw("business2api", safeLine)
+	now := b.now()
+	switch b.state {
+	case breakerOpen:
+		// 熔断前已放行的请求结果不再计入
+		return
+	case breakerHalfOpen:
+		if success {
+			b.state = breakerClosed
+			b.buckets = nil
+			logger.Info("✅ 熔断已恢复，请求恢复正常转发")
+		} else {
+			b.tripLocked(now, cfg, "半开探测失败")
 		}
-	}()
-}
+		return
+	}
 
-func main() {
-	log.SetFlags(log.Ltime | log.Lshortfile)
+	b.pruneLocked(now, cfg.WindowSec)
+	sec := now.Unix()
+	if n := len(b.buckets); n == 0 || b.buckets[n-1].second != sec {
+		b.buckets = append(b.buckets, breakerBucket{second: sec})
+	}
+	bucket := &b.buckets[len(b.buckets)-1]
+	if success {
+		bucket.success++
+	} else {
+		bucket.failures++
+	}
 
-	var refreshEmail string
-	var refreshMode bool
+	total, failures := b.countLocked()
+	if total >= cfg.MinRequests && float64(failures)/float64(total) >= cfg.FailureRate {
+		b.tripLocked(now, cfg, fmt.Sprintf("失败率 %.0f%% (%d/%d)", float64(failures)*100/float64(total), failures, total))
+	}
+}
 
-	// 解析命令行参数
-	for i, arg := range os.Args[1:] {
-		switch arg {
-		case "--debug", "-d":
-			register.RegisterDebug = true
-			logger.Info("🔧 调试模式已启用，将保存截图到 data/screenshots/")
-		case "--once":
-			register.RegisterOnce = true
-			logger.Info("🔧 单次运行模式")
-		case "--auto":
-			AutoSubscribeEnabled = true
-		case "--refresh":
-			refreshMode = true
-			// 检查下一个参数是否是邮箱
-			if i+2 < len(os.Args) && !strings.HasPrefix(os.Args[i+2], "-") {
-				refreshEmail = os.Args[i+2]
-			}
-		case "--help", "-h":
-			fmt.Println(`用法: ./business2api [选项]
+func (b *CircuitBreaker) tripLocked(now time.Time, cfg CircuitBreakerConfig, reason string) {
+	b.state = breakerOpen
+	b.openUntil = now.Add(time.Duration(cfg.CooldownSec) * time.Second)
+	b.buckets = nil
+	b.trips++
+	logger.Warn("🚨 熔断触发: %s，%d 秒内拒绝新请求", reason, cfg.CooldownSec)
+}
 
-选项:
-  --debug, -d           调试模式，保存注册过程截图
-  --auto                自动订阅模式，每小时注册获取代理
-  --refresh [email]     有头浏览器刷新账号（不指定email则使用第一个账号）
-  --help, -h            显示帮助`)
-			os.Exit(0)
-		}
+func (b *CircuitBreaker) pruneLocked(now time.Time, windowSec int) {
+	cutoff := now.Unix() - int64(windowSec)
+	i := 0
+	for i < len(b.buckets) && b.buckets[i].second <= cutoff {
+		i++
 	}
+	b.buckets = b.buckets[i:]
+}
 
-	// 刷新模式：直接执行浏览器刷新后退出
-	if refreshMode {
-		runBrowserRefreshMode(refreshEmail)
-		return
+func (b *CircuitBreaker) countLocked() (int, int) {
+	total, failures := 0, 0
+	for _, bucket := range b.buckets {
+		total += bucket.success + bucket.failures
+		failures += bucket.failures
 	}
+	return total, failures
+}
 
-	loadAppConfig()
-	utils.InitHTTPClient(Proxy)
-	if appConfig.PoolServer.Enable {
-		switch appConfig.PoolServer.Mode {
-		case "client":
-			runAsClient()
-			return
-		case "server":
-			runAsServer()
-			return
-		}
+// State 返回当前熔断状态
+func (b *CircuitBreaker) State() string {
+	if b.configFn().FailureRate < 0 {
+		return "disabled"
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerOpen && !b.now().Before(b.openUntil) {
+		return breakerHalfOpen
 	}
+	return b.state
+}
 
-	// 本地模式
-	runLocalMode()
+// Snapshot 返回熔断器状态详情
+func (b *CircuitBreaker) Snapshot() map[string]interface{} {
+	cfg := b.configFn()
+	state := b.State()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	b.pruneLocked(now, cfg.WindowSec)
+	total, failures := b.countLocked()
+	failureRate := float64(0)
+	if total > 0 {
+		failureRate = float64(failures) / float64(total)
+	}
+	remaining := 0
+	if state == breakerOpen {
+		remaining = int(b.openUntil.Sub(now).Seconds() + 0.5)
+	}
+	return map[string]interface{}{
+		"state":         state,
+		"requests":      total,
+		"failures":      failures,
+		"failure_rate":  failureRate,
+		"remaining_sec": remaining,
+		"trips":         b.trips,
+		"rejected":      b.rejected,
+		"config":        cfg,
+	}
 }
-func runAsClient() {
-	logger.Info("🔌 启动客户端模式...")
 
-	// 代理实例池由异步健康检查完成后初始化
-	// 设置代理就绪检查回调
-	pool.IsProxyReady = func() bool {
-		return proxy.Manager.IsReady()
+// IPRateLimiter 单 IP 滑动窗口限流器：统计每个 IP 最近一分钟的请求数
+type IPRateLimiter struct {
+	mu        sync.Mutex
+	hits      map[string][]time.Time
+	lastSweep time.Time
+	rejected  int64
+	configFn  func() RateLimitConfig
+	now       func() time.Time
+}
+
+// rateLimitWindow 限流统计窗口
+const rateLimitWindow = time.Minute
+
+var ipRateLimiter = newIPRateLimiter(rateLimitConfig)
+
+func newIPRateLimiter(configFn func() RateLimitConfig) *IPRateLimiter {
+	return &IPRateLimiter{
+		hits:     make(map[string][]time.Time),
+		configFn: configFn,
+		now:      time.Now,
 	}
-	pool.WaitProxyReady = func(timeout time.Duration) bool {
-		logger.Info("⏳ 等待代理就绪...")
-		result := proxy.Manager.WaitReady(timeout)
-		if result {
-			logger.Info("✅ 代理已就绪")
-		} else {
-			logger.Warn("⚠️ 代理等待超时")
+}
+
+// rateLimitConfig 获取限流配置
+func rateLimitConfig() RateLimitConfig {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	cfg := appConfig.RateLimit
+	cfg.Whitelist = append([]string(nil), cfg.Whitelist...)
+	return cfg
+}
+
+// ipInList 判断 IP 是否命中白名单（支持单个 IP 与 CIDR）
+func ipInList(ip string, list []string) bool {
+	parsed := net.ParseIP(ip)
+	for _, entry := range list {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if strings.Contains(entry, "/") {
+			if _, cidr, err := net.ParseCIDR(entry); err == nil && parsed != nil && cidr.Contains(parsed) {
+				return true
+			}
+			continue
+		}
+		if entry == ip || (parsed != nil && parsed.Equal(net.ParseIP(entry))) {
+			return true
 		}
-		return result
 	}
+	return false
+}
 
-	pool.RunBrowserRegister = func(headless bool, proxyURL string, id int) *pool.BrowserRegisterResult {
-		result := register.RunBrowserRegister(headless, proxyURL, id)
-		return &pool.BrowserRegisterResult{
-			Success:       result.Success,
-			Email:         result.Email,
-			FullName:      result.FullName,
-			MailProvider:  result.MailProvider,
-			MailPassword:  result.MailPassword,
-			SecureCookies: result.Cookies,
-			Authorization: result.Authorization,
-			ConfigID:      result.ConfigID,
-			CSESIDX:       result.CSESIDX,
-			Error:         result.Error,
+// Allow 记录一次请求并判断是否超出限制，超限时返回需等待的时间
+func (l *IPRateLimiter) Allow(ip string) (bool, time.Duration) {
+	cfg := l.configFn()
+	if cfg.PerIPRPM <= 0 || ipInList(ip, cfg.Whitelist) {
+		return true, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.sweepLocked(now)
+
+	hits := pruneHits(l.hits[ip], now)
+	if len(hits) >= cfg.PerIPRPM {
+		l.hits[ip] = hits
+		l.rejected++
+		return false, hits[0].Add(rateLimitWindow).Sub(now)
+	}
+	l.hits[ip] = append(hits, now)
+	return true, 0
+}
+
+// sweepLocked 定期清理窗口内已无请求的 IP，避免 map 无限增长
+func (l *IPRateLimiter) sweepLocked(now time.Time) {
+	if now.Sub(l.lastSweep) < rateLimitWindow {
+		return
+	}
+	l.lastSweep = now
+	for ip, hits := range l.hits {
+		if hits = pruneHits(hits, now); len(hits) == 0 {
+			delete(l.hits, ip)
+		} else {
+			l.hits[ip] = hits
 		}
 	}
-	pool.RefreshCookieWithBrowser = func(acc *pool.Account, headless bool, proxyURL string) *pool.BrowserRefreshResult {
-		result := register.RefreshCookieWithBrowser(acc, headless, proxyURL)
-		return &pool.BrowserRefreshResult{
-			Success:         result.Success,
-			SecureCookies:   result.SecureCookies,
-			ConfigID:        result.ConfigID,
-			CSESIDX:         result.CSESIDX,
-			Authorization:   result.Authorization,
-			ResponseHeaders: result.ResponseHeaders,
-			Error:           result.Error,
+}
+
+func pruneHits(hits []time.Time, now time.Time) []time.Time {
+	cutoff := now.Add(-rateLimitWindow)
+	i := 0
+	for i < len(hits) && !hits[i].After(cutoff) {
+		i++
+	}
+	return hits[i:]
+}
+
+// Snapshot 返回限流器状态
+func (l *IPRateLimiter) Snapshot() map[string]interface{} {
+	cfg := l.configFn()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return map[string]interface{}{
+		"enabled":     cfg.PerIPRPM > 0,
+		"per_ip_rpm":  cfg.PerIPRPM,
+		"tracked_ips": len(l.hits),
+		"rejected":    l.rejected,
+		"whitelist":   cfg.Whitelist,
+	}
+}
+
+// ipRateLimit 单 IP 限流中间件，在鉴权后、获取账号前拦截超限请求
+func ipRateLimit() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		ip := c.ClientIP()
+		allowed, wait := ipRateLimiter.Allow(ip)
+		if !allowed {
+			retryAfter := int(wait.Seconds()) + 1
+			logger.Warn("⚠️ [%s] 超出单 IP 限流，拒绝请求 (%d 秒后重试)", ip, retryAfter)
+			c.Header("Retry-After", strconv.Itoa(retryAfter))
+			abortAPIError(c, 429, "rate_limit_error", "请求过于频繁，请稍后重试", "rate_limit_exceeded")
+			return
 		}
+		c.Next()
 	}
-	pool.ClientHeadless = appConfig.Pool.RegisterHeadless
-	pool.ClientProxy = Proxy
-	pool.GetClientProxy = func() string {
-		if proxy.Manager.HealthyCount() > 0 {
-			proxyURL := proxy.Manager.Next()
-			if proxyURL != "" {
-				return proxyURL
+}
+
+// defaultMaxRequestBytes API 请求体默认大小上限 (50MB，需容纳多张内联 base64 媒体)
+const defaultMaxRequestBytes int64 = 50 << 20
+
+// maxRequestBytes 获取 API 请求体大小上限（0 表示不限制）
+func maxRequestBytes() int64 {
+	configMu.RLock()
+	limit := appConfig.Pool.MaxRequestBytes
+	configMu.RUnlock()
+	if limit < 0 {
+		return 0
+	}
+	if limit == 0 {
+		return defaultMaxRequestBytes
+	}
+	return limit
+}
+
+// requestBodyLimit 请求体大小限制中间件，超限返回 413（区别于单个媒体的 max_media_bytes）
+func requestBodyLimit() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		limit := maxRequestBytes()
+		if limit <= 0 || c.Request.Body == nil {
+			c.Next()
+			return
+		}
+		tooLarge := func() {
+			logger.Warn("⚠️ [%s] 请求体超过上限 %.1fMB，拒绝请求", c.ClientIP(), float64(limit)/(1<<20))
+			abortAPIError(c, 413, "invalid_request_error", fmt.Sprintf("请求体超过上限 %.1fMB", float64(limit)/(1<<20)), "request_too_large")
+		}
+		if c.Request.ContentLength > limit {
+			tooLarge()
+			return
+		}
+		// 先按上限读完请求体，保证超限时能返回 413，而不是绑定阶段的 400
+		body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, limit))
+		if err != nil {
+			var maxErr *http.MaxBytesError
+			if errors.As(err, &maxErr) {
+				tooLarge()
+				return
 			}
+			abortAPIError(c, 400, "invalid_request_error", fmt.Sprintf("读取请求体失败: %v", err), "")
+			return
 		}
-		return Proxy
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+		c.Next()
 	}
-	pool.ReleaseProxy = func(proxyURL string) {
-		proxy.Manager.ReleaseByURL(proxyURL)
-		logger.Debug("释放代理: %s", proxyURL)
+}
+
+// singleFlightHeader 请求头开启后，并发的相同请求共享同一次上游生成
+const singleFlightHeader = "X-Single-Flight"
+
+// singleFlightCall 一次正在进行的共享生成，完成后保存响应供等待者复用
+type singleFlightCall struct {
+	done      chan struct{}
+	leaderID  string // 执行上游生成的请求 ID，等待者日志中引用
+	status    int
+	header    http.Header
+	body      []byte
+	followers int
+}
+
+// singleFlightGroup 按请求内容哈希合并并发的相同生成请求
+type singleFlightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*singleFlightCall
+}
+
+var chatSingleFlight = &singleFlightGroup{calls: make(map[string]*singleFlightCall)}
+
+// singleFlightRecorder 记录首个请求写出的响应体，同时正常写给客户端
+type singleFlightRecorder struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *singleFlightRecorder) Write(data []byte) (int, error) {
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *singleFlightRecorder) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// wantsSingleFlight 检查请求是否显式开启 single-flight
+func wantsSingleFlight(c *gin.Context) bool {
+	v := strings.ToLower(strings.TrimSpace(c.GetHeader(singleFlightHeader)))
+	return v == "1" || v == "true" || v == "on"
+}
+
+// singleFlightKey 基于解析后的上游请求计算哈希：最终模型、输出模式、消息（含提示词与图片）、工具、
+// 生成参数（宽高比、思考预算、max_tokens、思考输出模式、Flow 视频时长/清晰度）和 X-Config-Id 等请求头，
+// 只有会发出相同上游请求的客户端请求才合并；参数无效时以错误信息参与计算，各自返回 400
+func singleFlightKey(c *gin.Context, req ChatRequest) string {
+	key := struct {
+		Model          string           `json:"model"`
+		Stream         bool             `json:"stream"`
+		Messages       []Message        `json:"messages"`
+		Tools          []ToolDef        `json:"tools,omitempty"`
+		ToolChoice     interface{}      `json:"tool_choice,omitempty"`
+		AspectRatio    string           `json:"aspect_ratio,omitempty"`
+		ThinkingBudget *int             `json:"thinking_budget,omitempty"`
+		MaxTokens      int              `json:"max_tokens,omitempty"`
+		Reasoning      string           `json:"reasoning,omitempty"`
+		ConfigID       string           `json:"config_id,omitempty"`
+		FlowVideo      flow.VideoOutput `json:"flow_video"`
+		FlowProgress   bool             `json:"flow_progress"`
+		Errors         []string         `json:"errors,omitempty"`
+	}{
+		Model:      req.Model,
+		Stream:     req.Stream,
+		Messages:   req.Messages,
+		Tools:      req.Tools,
+		ToolChoice: req.ToolChoice,
+		ConfigID:   strings.TrimSpace(c.GetHeader(configIDHeader)),
 	}
-	pool.GetHealthyCount = func() int {
-		return proxy.Manager.HealthyCount()
+	addErr := func(err error) {
+		if err != nil {
+			key.Errors = append(key.Errors, err.Error())
+		}
 	}
-	go func() {
-		proxy.Manager.CheckAllHealth()
-		if proxy.Manager.HealthyCount() > 0 {
-			poolSize := appConfig.Pool.RegisterThreads
-			if poolSize <= 0 {
-				poolSize = pool.DefaultProxyCount
-			}
-			if poolSize > 10 {
-				poolSize = 10
+	var err error
+	if flow.IsFlowModel(req.Model) {
+		key.FlowVideo, err = flowVideoOutput(c, req)
+		addErr(err)
+		key.FlowProgress = flowProgressEnabled(c)
+	} else {
+		key.AspectRatio, err = resolveImageAspectRatio(req.AspectRatio, req.Size)
+		addErr(err)
+		key.ThinkingBudget, err = resolveThinkingBudget(req.Model, req.ReasoningEffort, req.ThinkingBudget)
+		addErr(err)
+		key.MaxTokens, err = resolveMaxTokens(req.Model, req.MaxTokens, req.MaxCompletionTokens, requestLogger(c))
+		addErr(err)
+		key.Reasoning, err = resolveReasoningOutput(req.ReasoningFormat, req.IncludeReasoning)
+		addErr(err)
+	}
+	raw, _ := json.Marshal(key)
+	sum := sha256.Sum256(raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// Do 相同 key 的并发请求只执行一次 run，其余请求等待并复用其响应
+func (g *singleFlightGroup) Do(c *gin.Context, key string, run func(c *gin.Context)) {
+	g.mu.Lock()
+	if call, ok := g.calls[key]; ok {
+		call.followers++
+		g.mu.Unlock()
+
+		requestLogger(c).Info("🔗 [%s] 复用进行中的相同生成请求 (leader=%s)", c.ClientIP(), call.leaderID)
+		select {
+		case <-call.done:
+		case <-c.Request.Context().Done():
+			return
+		}
+		for k, values := range call.header {
+			for _, v := range values {
+				c.Writer.Header().Add(k, v)
 			}
-			proxy.Manager.SetMaxPoolSize(poolSize)
-			proxy.Manager.InitInstancePool(poolSize)
 		}
-	}()
-	client := pool.NewPoolClient(appConfig.PoolServer)
-	if err := client.Start(); err != nil {
-		log.Fatalf("❌ 客户端启动失败: %v", err)
+		c.Header(singleFlightHeader, "shared")
+		c.Status(call.status)
+		c.Writer.Write(call.body)
+		return
 	}
+	call := &singleFlightCall{done: make(chan struct{}), leaderID: requestID(c)}
+	g.calls[key] = call
+	g.mu.Unlock()
+
+	c.Header(singleFlightHeader, "leader")
+	recorder := &singleFlightRecorder{ResponseWriter: c.Writer}
+	c.Writer = recorder
+	defer func() {
+		call.status = recorder.Status()
+		call.header = recorder.Header().Clone()
+		call.header.Del(singleFlightHeader)
+		call.header.Del(requestIDHeader) // 等待者保留自己的请求 ID
+		call.body = recorder.body.Bytes()
+
+		g.mu.Lock()
+		delete(g.calls, key)
+		followers := call.followers
+		g.mu.Unlock()
+		close(call.done)
+		if followers > 0 {
+			requestLogger(c).Info("🔗 相同生成请求已合并: 1 次上游调用服务 %d 个请求", followers+1)
+		}
+	}()
+	run(c)
 }
 
-var poolServer *pool.PoolServer
+// parseRetryAfter 解析 Retry-After 响应头（秒数或 HTTP 日期），返回需等待的时长
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(value); err == nil {
+		if secs < 0 {
+			return 0, false
+		}
+		return time.Duration(secs) * time.Second, true
+	}
+	when, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	if d := when.Sub(now); d > 0 {
+		return d, true
+	}
+	return 0, true
+}
 
-func runAsServer() {
-	logger.Info("🖥️ 启动服务器模式...")
+// requestTimeoutHeader 客户端声明的最长等待时间（秒），优先于请求体 timeout
+const requestTimeoutHeader = "X-Request-Timeout"
 
-	// 加载账号
-	dataDir := appConfig.PoolServer.DataDir
-	if dataDir == "" {
-		dataDir = DataDir
+// requestDeadline 解析 X-Request-Timeout 头或请求体 timeout（秒），未指定或无效时返回 0
+func requestDeadline(c *gin.Context, bodyTimeout float64) time.Duration {
+	secs := bodyTimeout
+	if v := strings.TrimSpace(c.GetHeader(requestTimeoutHeader)); v != "" {
+		if parsed, err := strconv.ParseFloat(v, 64); err == nil {
+			secs = parsed
+		}
 	}
-	if err := pool.Pool.Load(dataDir); err != nil {
-		log.Fatalf("❌ 加载账号失败: %v", err)
+	if secs <= 0 || math.IsNaN(secs) || math.IsInf(secs, 0) {
+		return 0
 	}
+	return time.Duration(secs * float64(time.Second))
+}
 
-	// 启动配置文件热重载监听
-	if err := startConfigWatcher(); err != nil {
-		logger.Warn("⚠️ 配置热重载启动失败: %v", err)
+// withRequestDeadline 按客户端截止时间派生 context（客户端断开时同样取消）
+// 未指定截止时间时返回 Background，上游请求不受客户端连接影响
+func withRequestDeadline(c *gin.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.Background(), func() {}
 	}
+	return context.WithTimeout(c.Request.Context(), timeout)
+}
 
-	poolServer = pool.NewPoolServer(pool.Pool, appConfig.PoolServer)
-	poolServer.StartBackground() // 启动后台任务分发和心跳检测
-	pool.Pool.StartPoolManager()
-	runAPIServer()
+// deadlineExceeded 是否因超过客户端截止时间而中止
+func deadlineExceeded(ctx context.Context) bool {
+	return errors.Is(ctx.Err(), context.DeadlineExceeded)
 }
 
-// runAPIServer 启动 API 服务
-func runAPIServer() {
-	gin.SetMode(gin.ReleaseMode)
-	r := gin.New()
-	r.Use(gin.Recovery())
-	setupAPIRoutes(r)
-	logger.Info("🚀 API 服务启动于 %s，账号: ready=%d, pending=%d", ListenAddr, pool.Pool.ReadyCount(), pool.Pool.PendingCount())
-	if err := r.Run(ListenAddr); err != nil {
-		log.Fatalf("❌ API 服务启动失败: %v", err)
-	}
+// respondRequestTimeout 超过客户端截止时间返回 504
+func respondRequestTimeout(c *gin.Context, timeout time.Duration) {
+	respondAPIError(c, 504, "request_timeout", fmt.Sprintf("超过客户端截止时间 (%v)，已中止上游生成", timeout), "")
 }
 
-const (
-	defaultRegistrarBaseURL = "http://127.0.0.1:8090"
-	maxListPageSize         = 200
-	defaultListPageSize     = 20
-)
+// handlePing 配置自检：校验 API Key，报告模型解析结果、可用账号与 Flow 状态，不请求上游
+func handlePing(c *gin.Context) {
+	requested := strings.TrimSpace(c.Query("model"))
+	available := GetAvailableModels()
+	resolved := requested
+	if resolved == "" {
+		resolved = defaultModelFor(apiPathOpenAI)
+	}
+	known := false
+	for _, m := range available {
+		if m == resolved {
+			known = true
+			break
+		}
+	}
 
-type adminAccountView struct {
-	Email          string    `json:"email"`
-	EmailMasked    string    `json:"email_masked"`
-	Status         string    `json:"status"`
-	IsValid        bool      `json:"is_valid"`
-	InvalidReason  string    `json:"invalid_reason,omitempty"`
-	FailCount      int       `json:"fail_count"`
-	LastUsed       time.Time `json:"last_used,omitempty"`
-	LastRefresh    time.Time `json:"last_refresh,omitempty"`
-	DailyCount     int       `json:"daily_count"`
-	DailyLimit     int       `json:"daily_limit"`
-	DailyRemaining int       `json:"daily_remaining"`
-	SuccessCount   int       `json:"success_count"`
-	TotalCount     int       `json:"total_count"`
-	JWTExpires     time.Time `json:"jwt_expires,omitempty"`
+	problems := []string{}
+	if !known {
+		problems = append(problems, fmt.Sprintf("未知模型: %s", resolved))
+	}
+	modelInfo := gin.H{"requested": requested, "resolved": resolved, "known": known}
+	flowInfo := gin.H{"enabled": flowHandler != nil}
+	if flowTokenPool != nil {
+		flowInfo["tokens"] = flowTokenPool.Count()
+		flowInfo["ready_tokens"] = flowTokenPool.ReadyCount()
+	}
+	breaker := circuitBreaker.State()
+	servable := 0
+	if flow.IsFlowModel(resolved) {
+		modelInfo["backend"] = "flow"
+		if flowHandler == nil || flowTokenPool == nil {
+			problems = append(problems, "Flow 服务未启用")
+		} else if flowTokenPool.ReadyCount() == 0 {
+			problems = append(problems, "没有可用的 Flow Token")
+		}
+	} else {
+		tag := accountTagForModel(resolved)
+		base := strings.NewReplacer("-image", "", "-video", "", "-search", "").Replace(resolved)
+		modelInfo["backend"] = "gemini"
+		modelInfo["upstream_model"] = modelMapping[base]
+		modelInfo["account_tag"] = tag
+		servable = pool.Pool.ServableCount(tag)
+		if servable == 0 {
+			problems = append(problems, "没有可服务该模型的就绪账号")
+		}
+		if breaker == breakerOpen {
+			problems = append(problems, "熔断中，请求会被直接拒绝")
+		}
+	}
+
+	c.JSON(200, gin.H{
+		"ok":            len(problems) == 0,
+		"request_id":    requestID(c),
+		"authenticated": true,
+		"model":         modelInfo,
+		"accounts": gin.H{
+			"ready":    pool.Pool.ReadyCount(),
+			"pending":  pool.Pool.PendingCount(),
+			"servable": servable,
+		},
+		"flow":            flowInfo,
+		"circuit_breaker": breaker,
+		"problems":        problems,
+	})
 }
 
-type adminPoolFileView struct {
-	FileName          string    `json:"file_name"`
-	EmailFromFilename string    `json:"email_from_filename"`
-	ParseOK           bool      `json:"parse_ok"`
-	ParseError        string    `json:"parse_error,omitempty"`
-	ExistsInPool      bool      `json:"exists_in_pool"`
-	PoolStatus        string    `json:"pool_status"`
-	HasConfigID       bool      `json:"has_config_id"`
-	HasCSESIDX        bool      `json:"has_csesidx"`
-	SizeBytes         int64     `json:"size_bytes"`
-	ModifiedAt        time.Time `json:"modified_at"`
+// streamChat 处理聊天请求，携带 X-Single-Flight 头时合并并发的相同请求
+func streamChat(c *gin.Context, req ChatRequest) {
+	if wantsSingleFlight(c) {
+		chatSingleFlight.Do(c, singleFlightKey(c, req), func(c *gin.Context) {
+			doStreamChat(c, req)
+		})
+		return
+	}
+	doStreamChat(c, req)
 }
 
-type adminPoolFileRecord struct {
-	view          adminPoolFileView
-	filePath      string
-	accountEmail  string
-	invalidReason string
-}
+func doStreamChat(c *gin.Context, req ChatRequest) {
+	// 复用请求 ID 作为响应 id，便于按同一 ID 检索日志、审计与客户端反馈
+	chatID := "chatcmpl-" + requestID(c)
+	reqLog := requestLogger(c)
+	startTime := time.Now()
+	createdTime := startTime.Unix()
+	clientIP := c.ClientIP()
+	userAgent := c.GetHeader("User-Agent")
+
+	// 统计变量
+	var statsSuccess bool
+	var statsInputTokens int64
+	var statsOutputTokens int64
+	var statsImages int64
+	var statsVideos int64
+	var upstreamStatus int
+	var fallbackModel string // 请求模型失败后改用的回退模型（未回退为空）
+	statsModel := req.Model
+	defer func() {
+		apiStats.RecordRequestWithModel(statsModel, statsSuccess, statsInputTokens, statsOutputTokens, statsImages, statsVideos)
+		if fallbackModel != "" {
+			apiStats.RecordFallback(statsSuccess)
+		}
+		// 记录IP统计（包含tokens、图片、视频）
+		ipStats.RecordIPRequest(clientIP, statsModel, userAgent, statsSuccess, statsInputTokens, statsOutputTokens, statsImages, statsVideos)
+		recordAudit(chatID, clientIP, req, upstreamStatus, statsSuccess, startTime)
+	}()
+
+	// 入站日志
+	reqLog.Info("📥 [%s] 请求: model=%s ", clientIP, req.Model)
+	if flow.IsFlowModel(req.Model) {
+		handleFlowRequest(c, req, chatID, createdTime)
+		return
+	}
+
+	aspectRatio, err := resolveImageAspectRatio(req.AspectRatio, req.Size)
+	if err != nil {
+		respondAPIError(c, 400, "invalid_request_error", err.Error(), "")
+		return
+	}
+	thinkingBudget, err := resolveThinkingBudget(req.Model, req.ReasoningEffort, req.ThinkingBudget)
+	if err != nil {
+		respondAPIError(c, 400, "invalid_request_error", err.Error(), "")
+		return
+	}
+	reasoningMode, err := resolveReasoningOutput(req.ReasoningFormat, req.IncludeReasoning)
+	if err != nil {
+		respondAPIError(c, 400, "invalid_request_error", err.Error(), "")
+		return
+	}
+	if err := resolveLogprobs(req.Logprobs, req.TopLogprobs); err != nil {
+		respondAPIError(c, 400, "invalid_request_error", err.Error(), "")
+		return
+	}
+	maxTokens, err := resolveMaxTokens(req.Model, req.MaxTokens, req.MaxCompletionTokens, reqLog)
+	if err != nil {
+		respondAPIError(c, 400, "invalid_request_error", err.Error(), "")
+		return
+	}
+	logIgnoredPenalties(req.PresencePenalty, req.FrequencyPenalty, reqLog)
+	choice, err := parseToolChoice(req.ToolChoice, req.Tools)
+	if err != nil {
+		respondAPIError(c, 400, "invalid_request_error", err.Error(), "")
+		return
+	}
+	// X-Config-Id：只在可使用该 configId 的账号间选择
+	configOverride := strings.TrimSpace(c.GetHeader(configIDHeader))
+	if configOverride != "" && !pool.Pool.HasConfigID(configOverride) {
+		respondAPIError(c, 400, "invalid_request_error", fmt.Sprintf("没有账号可使用 configId: %s", configOverride), "invalid_config_id")
+		return
+	}
+	// 按 tool_choice 过滤工具并注入调用要求（不修改 req，审计记录客户端原始请求）
+	tools := choice.filterTools(req.Tools)
+	messages := req.Messages
+	if instruction := choice.instruction(tools); instruction != "" {
+		messages = withSystemInstruction(messages, instruction)
+	}
+
+	// 客户端截止时间：到期后中止排队、重试与上游请求，返回 504
+	deadline := requestDeadline(c, req.Timeout)
+	ctx, cancelDeadline := withRequestDeadline(c, deadline)
+	defer cancelDeadline()
+
+	// 熔断：大面积失败时直接拒绝，避免每个请求都在账号间重试放大负载
+	if allowed, remaining := circuitBreaker.Allow(); !allowed {
+		reqLog.Warn("⚠️ [%s] 熔断中，拒绝请求 (剩余 %.0f 秒)", clientIP, remaining.Seconds())
+		c.Header("Retry-After", strconv.Itoa(int(remaining.Seconds())+1))
+		respondAPIError(c, 503, "circuit_breaker", "服务暂时熔断（上游大面积失败），请稍后重试", "")
+		return
+	}
+
+	// 并发生成限制：超出上限时排队，超时返回 503
+	queueCtx := c.Request.Context()
+	if deadline > 0 {
+		queueCtx = ctx
+	}
+	if err := generationLimiter.Acquire(queueCtx, generationQueueTimeout()); err != nil {
+		if deadlineExceeded(ctx) {
+			reqLog.Warn("⏱️ [%s] 排队超过客户端截止时间 %v", clientIP, deadline)
+			respondRequestTimeout(c, deadline)
+			return
+		}
+		reqLog.Warn("⚠️ [%s] 并发生成已满，拒绝请求: %v", clientIP, err)
+		respondGenerationBusy(c)
+		return
+	}
+	defer generationLimiter.Release()
+
+	var textContent string
+	var images []MediaInfo
+	systemPrompt := extractSystemPrompt(messages)
+	if needsConversationContext(messages) {
+		// 多轮对话：拼接所有消息（包含system）
+		textContent = convertMessagesToPrompt(messages)
+		// 只从最后一条用户消息提取图片
+		for i := len(messages) - 1; i >= 0; i-- {
+			if messages[i].Role == "user" || messages[i].Role == "human" {
+				_, images = parseMessageContent(messages[i])
+				break
+			}
+		}
+	} else {
+		lastMsg := messages[len(messages)-1]
+		userText, userImages := parseMessageContent(lastMsg)
+		images = userImages
+		if systemPrompt != "" {
+			textContent = fmt.Sprintf("<system>\n%s\n</system>\n\nHuman: %s\n\nAssistant:", systemPrompt, userText)
+		} else {
+			textContent = userText
+		}
+	}
+	if err := validateMedia(req.Model, images); err != nil {
+		reqLog.Warn("⚠️ [%s] %v", clientIP, err)
+		respondMediaError(c, err)
+		return
+	}
+	// 熔断只统计上游与号池的结果：请求参数错误、客户端截止时间与断开连接不计入失败
+	var clientFault bool
+	defer func() {
+		if statsSuccess {
+			circuitBreaker.Record(true)
+		} else if !clientFault && !deadlineExceeded(ctx) && c.Request.Context().Err() == nil {
+			circuitBreaker.Record(false)
+		}
+	}()
+	var respBody []byte
+	var liveStream *liveUpstream // 流式请求已确定账号后的增量上游响应
+	var lastErr error
+	var lastErrStatusCode int // 保存最后一次错误的 HTTP 状态码
+	var lastErrBody []byte    // 保存最后一次错误的响应体
+	var usedAcc *pool.Account
+	var usedJWT, usedOrigAuth, usedConfigID, usedSession string
+	isLongRunning := !req.Stream && (strings.Contains(req.Model, "video") ||
+		strings.Contains(req.Model, "imagen") ||
+		strings.Contains(req.Model, "image"))
+
+	var heartbeatDone chan struct{}
+	if isLongRunning {
+		heartbeatDone = make(chan struct{})
+		c.Header("Content-Type", "application/json")
+		c.Header("Transfer-Encoding", "chunked")
+		c.Status(200)
+		writer := c.Writer
+		flusher, ok := writer.(http.Flusher)
+		if ok {
+			flusher.Flush() // 先发送头部
+		}
+		interval := heartbeatInterval()
+		go func() {
+			defer func() {
+				if r := recover(); r != nil {
+				}
+			}()
+			if interval <= 0 {
+				return
+			}
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-heartbeatDone:
+					return
+				case <-ticker.C:
+					if _, err := writer.Write([]byte(" ")); err != nil {
+						return
+					}
+					if flusher, ok := writer.(http.Flusher); ok {
+						flusher.Flush()
+					}
+				}
+			}
+		}()
+	}
+	defer func() {
+		if heartbeatDone != nil {
+			select {
+			case <-heartbeatDone:
+			default:
+				close(heartbeatDone)
+			}
+		}
+	}()
+
+	// 估算输入 tokens（基于文本长度）
+	statsInputTokens = int64(len(textContent)/4) + int64(len(images)*500) // 文本 + 图片估算
+
+	// 流式请求：提前发送 SSE 头部，避免上游请求期间客户端等待超时
+	var streamWriter http.ResponseWriter
+	var streamFlusher http.Flusher
+	var streamStarted bool
+	if req.Stream {
+		c.Header("Content-Type", "text/event-stream")
+		c.Header("Cache-Control", "no-cache")
+		c.Header("Connection", "keep-alive")
+		c.Header("X-Accel-Buffering", "no")
+		streamWriter = c.Writer
+		streamFlusher, _ = streamWriter.(http.Flusher)
+		chunk := createChunk(chatID, createdTime, req.Model, map[string]interface{}{"role": "assistant"}, nil)
+		fmt.Fprintf(streamWriter, "data: %s\n\n", chunk)
+		streamFlusher.Flush()
+		streamStarted = true
+	}
+	// 等待上游期间发送 SSE 注释心跳，收到上游响应后停止
+	var streamHeartbeat *sseHeartbeat
+	if streamStarted {
+		streamHeartbeat = startSSEHeartbeat(streamWriter, heartbeatInterval())
+	}
+	defer streamHeartbeat.Stop()
+
+	// upstreamModel 实际请求上游的模型，请求模型重试耗尽后依次换用 model_fallbacks 中的回退模型
+	upstreamModel := req.Model
+	fallbacks := modelFallbacksFor(req.Model)
+	accountTag := accountTagForModel(upstreamModel)
+	// liveBody 增量转发中尚未读完的响应体：换号重试前关闭，选定后在请求结束时关闭
+	var liveBody io.Closer
+	for retry := 0; ; retry++ {
+		if liveBody != nil {
+			liveBody.Close()
+			liveBody = nil
+		}
+		if retry >= maxRetries {
+			if len(fallbacks) == 0 {
+				break
+			}
+			reqLog.Warn("🔁 模型 %s 重试均失败 (%v)，改用回退模型 %s", upstreamModel, lastErr, fallbacks[0])
+			upstreamModel, fallbacks = fallbacks[0], fallbacks[1:]
+			fallbackModel = upstreamModel
+			accountTag = accountTagForModel(upstreamModel)
+			// 思考预算与输出上限按回退模型重新解析：不支持思考的模型不发送思考预算，max_tokens 按其输出上限截断
+			if budget, err := resolveThinkingBudget(upstreamModel, req.ReasoningEffort, req.ThinkingBudget); err != nil {
+				reqLog.Info("ℹ️ 回退模型 %s 不使用思考预算: %v", upstreamModel, err)
+				thinkingBudget = nil
+			} else {
+				thinkingBudget = budget
+			}
+			maxTokens, _ = resolveMaxTokens(upstreamModel, req.MaxTokens, req.MaxCompletionTokens, reqLog)
+			lastErrStatusCode, lastErrBody = 0, nil
+			retry = 0
+		}
+		if ctx.Err() != nil {
+			lastErr = fmt.Errorf("超过客户端截止时间 (%v): %w", deadline, ctx.Err())
+			break
+		}
+		acc := pool.Pool.NextWithConfigID(accountTag, configOverride)
+		if acc == nil {
+			if lastErr != nil {
+				// 之前的重试已失败，按上游失败处理（配置了回退模型时换模型继续）
+				retry = maxRetries - 1
+				continue
+			}
+			streamHeartbeat.Stop()
+			ready, pending := pool.Pool.ReadyCount(), pool.Pool.PendingCount()
+			reqLog.Warn("⚠️ [%s] 没有可用账号 (ready=%d, pending=%d)", clientIP, ready, pending)
+			if streamStarted {
+				// 流式请求已开始，发送 SSE 格式错误
+				errMsg := fmt.Sprintf("[错误] 没有可用账号 (ready=%d, pending=%d)", ready, pending)
+				errChunk := createChunk(chatID, createdTime, req.Model, map[string]interface{}{"content": errMsg}, nil)
+				fmt.Fprintf(streamWriter, "data: %s\n\n", errChunk)
+				finishReason := "stop"
+				finalChunk := createChunk(chatID, createdTime, req.Model, nil, &finishReason)
+				fmt.Fprintf(streamWriter, "data: %s\n\n", finalChunk)
+				fmt.Fprintf(streamWriter, "data: [DONE]\n\n")
+				streamFlusher.Flush()
+			} else {
+				// 号池为空属于暂时不可用，返回 503 便于客户端稍后重试
+				respondAPIError(c, 503, "no_accounts_available", "没有可用账号", "", gin.H{
+					"ready":   ready,
+					"pending": pending,
+				})
+			}
+			return
+		}
+		usedAcc = acc
+		reqLog.Info("📤 [%s] 使用账号: %s", clientIP, acc.Data.Email)
+
+		if retry > 0 {
+			reqLog.Info("🔄 第 %d 次重试，切换账号: %s", retry+1, acc.Data.Email)
+		}
+
+		jwt, _, err := acc.GetJWT()
+		if err != nil {
+			reqLog.Error("❌ [%s] 获取 JWT 失败: %v", acc.Data.Email, err)
+			lastErr = err
+			continue
+		}
+		// 按 config_id_policy / X-Config-Id 选择 configId，并校验其属于该账号
+		configID, err := acc.SelectConfigID(configOverride)
+		if err != nil {
+			reqLog.Warn("⚠️ [%s] %v", acc.Data.Email, err)
+			lastErr = err
+			continue
+		}
+
+		session, err := createSession(jwt, configID, acc.Data.Authorization)
+		if err != nil {
+			reqLog.Error("❌ [%s] 创建 Session 失败: %v", acc.Data.Email, err)
+			// 401 错误标记账号需要刷新
+			if strings.Contains(err.Error(), "401") || strings.Contains(err.Error(), "UNAUTHENTICATED") {
+				pool.Pool.MarkNeedsRefreshReason(acc, "创建 Session 失败: HTTP 401")
+			}
+			lastErr = err
+			continue
+		}
+
+		// 上传媒体文件并获取 fileIds
+		var fileIds []string
+		uploadFailed := false
+		mediaRejected := false
+		// rejectMedia 媒体本身不合法（过大/格式不支持）时记录错误响应，换账号也无法解决
+		rejectMedia := func(err error) bool {
+			status, code := mediaErrorCode(err)
+			if status == 0 {
+				return false
+			}
+			body := apiErrorBody(apiFormatOf(c), status, "invalid_request_error", err.Error(), code, nil)
+			mediaRejected = true
+			lastErr = err
+			lastErrStatusCode = status
+			lastErrBody, _ = json.Marshal(body)
+			return true
+		}
+		for _, media := range images {
+			var fileId string
+			var err error
+
+			mediaTypeName := "图片"
+			if media.MediaType == "video" {
+				mediaTypeName = "视频"
+			} else if media.MediaType == "audio" {
+				mediaTypeName = "音频"
+			}
+
+			if media.IsURL {
+				// 优先尝试 URL 直接上传；带请求头的 URL 上游无法直接访问，直接下载后上传
+				if len(media.Headers) > 0 {
+					err = errors.New("URL 需要附加请求头")
+				} else {
+					fileId, err = uploadContextFileByURL(jwt, configID, session, media.URL, acc.Data.Authorization)
+				}
+				if err != nil {
+					// URL 上传失败，回退到下载后上传
+					mediaData, mimeType, dlErr := downloadMedia(media.URL, media.MediaType, media.Headers)
+					if dlErr != nil {
+						reqLog.Warn("⚠️ [%s] %s下载失败: %v", acc.Data.Email, mediaTypeName, dlErr)
+						if rejectMedia(dlErr) {
+							break
+						}
+						if strings.Contains(dlErr.Error(), "UPSTREAM_401") || strings.Contains(dlErr.Error(), "UPSTREAM_403") {
+							respondAPIError(c, 500, "upstream_error", dlErr.Error(), "media_download_failed")
+							return
+						}
+						uploadFailed = true
+						break
+					}
+					fileId, err = uploadContextFile(jwt, configID, session, mimeType, mediaData, acc.Data.Authorization)
+				}
+			} else {
+				fileId, err = uploadContextFile(jwt, configID, session, media.MimeType, media.Data, acc.Data.Authorization)
+			}
+			if err != nil {
+				reqLog.Warn("⚠️ [%s] %s上传失败: %v", acc.Data.Email, mediaTypeName, err)
+				if !rejectMedia(err) {
+					uploadFailed = true
+				}
+				break
+			}
+			fileIds = append(fileIds, fileId)
+		}
+		if mediaRejected {
+			// 换账号也无法解决，直接结束重试
+			break
+		}
+		if uploadFailed {
+			lastErr = fmt.Errorf("媒体上传失败")
+			continue
+		}
+		// 构建 query parts（只包含文本）
+		queryParts := []map[string]interface{}{}
+		if textContent != "" {
+			queryParts = append(queryParts, map[string]interface{}{"text": textContent})
+		}
+		// 确保 queryParts 不为空，避免 Google 返回空响应
+		if len(queryParts) == 0 {
+			queryParts = append(queryParts, map[string]interface{}{"text": " "})
+		}
+		isImageModel := strings.Contains(upstreamModel, "-image")
+		isVideoModel := strings.Contains(upstreamModel, "-video")
+		isSearchModel := strings.Contains(upstreamModel, "-search")
+		actualModel := upstreamModel
+		actualModel = strings.ReplaceAll(actualModel, "-image", "")
+		actualModel = strings.ReplaceAll(actualModel, "-video", "")
+		actualModel = strings.ReplaceAll(actualModel, "-search", "")
+
+		// 构建 toolsSpec（支持自定义工具）
+		toolsSpec := buildToolsSpec(tools, isImageModel, isVideoModel, isSearchModel)
+		if applyImageAspectRatio(toolsSpec, aspectRatio) && retry == 0 {
+			reqLog.Debug("🖼️ 图片宽高比: %s", aspectRatio)
+		}
+
+		body := map[string]interface{}{
+			"configId":         configID,
+			"additionalParams": map[string]string{"token": "-"},
+			"streamAssistRequest": map[string]interface{}{
+				"session":              session,
+				"query":                map[string]interface{}{"parts": queryParts},
+				"filter":               "",
+				"fileIds":              fileIds,
+				"answerGenerationMode": "NORMAL",
+				"toolsSpec":            toolsSpec,
+				"languageCode":         "zh-CN",
+				"userMetadata":         map[string]string{"timeZone": "Asia/Shanghai"},
+				"assistSkippingMode":   "REQUEST_ASSIST",
+			},
+		}
+
+		// 设置模型 ID（去掉 -image 后缀）
+		if targetModelID, ok := modelMapping[actualModel]; ok && targetModelID != "" {
+			genConfig := map[string]interface{}{
+				"modelId": targetModelID,
+			}
+			if thinkingBudget != nil {
+				genConfig["thinkingConfig"] = map[string]interface{}{"thinkingBudget": *thinkingBudget}
+			}
+			if maxTokens > 0 {
+				genConfig["maxOutputTokens"] = maxTokens
+			}
+			body["streamAssistRequest"].(map[string]interface{})["assistGenerationConfig"] = genConfig
+		}
+
+		bodyBytes, _ := json.Marshal(body)
+		httpReq, _ := http.NewRequestWithContext(ctx, "POST", upstreamAPIURL("/v1alpha/locations/global/widgetStreamAssist"), bytes.NewReader(bodyBytes))
+
+		for k, v := range getCommonHeaders(jwt, acc.Data.Authorization) {
+			httpReq.Header.Set(k, v)
+		}
+
+		resp, err := utils.HTTPClient.Do(httpReq)
+		if err == nil {
+			upstreamStatus = resp.StatusCode
+		}
+		if err != nil {
+			reqLog.Error("❌ [%s] 请求失败: %v", acc.Data.Email, err)
+			lastErr = err
+			continue
+		}
+
+		if resp.StatusCode != 200 {
+			body, _ := utils.ReadResponseBody(resp)
+			resp.Body.Close()
+			body = sanitizeUpstreamBody(body) // 透传与日志前脱敏 JWT/Cookie/projects 路径
+			reqLog.Error("❌ [%s] Google 报错: %d %s (重试 %d/%d)", acc.Data.Email, resp.StatusCode, string(body), retry+1, maxRetries)
+			lastErr = fmt.Errorf("HTTP %d: %s", resp.StatusCode, string(body))
+			lastErrStatusCode = resp.StatusCode
+			lastErrBody = body
+			// 401/403 无权限，标记需要刷新
+			if resp.StatusCode == 401 || resp.StatusCode == 403 {
+				reqLog.Warn("⚠️ [%s] %d 无权限，标记需要刷新", acc.Data.Email, resp.StatusCode)
+				pool.Pool.MarkNeedsRefreshReason(acc, fmt.Sprintf("HTTP %d", resp.StatusCode))
+			}
+			// 429 限流，按连续限流次数指数退避（3倍起步，Retry-After 更长时以其为准）
+			if resp.StatusCode == 429 {
+				cooldownTime := acc.MarkRateLimited()
+				if retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After"), time.Now()); ok && retryAfter > cooldownTime {
+					cooldownTime = retryAfter
+					reqLog.Info("⏳ [%s] 429 限流，遵循 Retry-After 退避 %v", acc.Data.Email, cooldownTime)
+				} else {
+					reqLog.Info("⏳ [%s] 429 限流，账号进入延长冷却 %v", acc.Data.Email, cooldownTime)
+				}
+				acc.Mu.Lock()
+				acc.LastUsed = time.Now().Add(cooldownTime)
+				acc.Mu.Unlock()
+				pool.Pool.MarkFailed(acc, "HTTP 429 限流")
+				time.Sleep(1 * time.Second) // 短暂等待后切换账号
+				retry--                     // 不计入重试次数
+				continue
+			}
+			if resp.StatusCode == 400 && isRequestParamError(body) {
+				// 请求参数导致的 400 换账号也无法恢复，不标记账号失败，直接返回给客户端
+				reqLog.Warn("⚠️ [%s] 400 请求参数无效，不换账号重试", acc.Data.Email)
+				clientFault = true
+				break
+			}
+			if resp.StatusCode == 400 {
+				reqLog.Warn("⚠️ [%s] 400 错误，换账号重试", acc.Data.Email)
+				pool.Pool.MarkFailed(acc, "HTTP 400")
+				time.Sleep(500 * time.Millisecond)
+				continue
+			}
+			pool.Pool.MarkFailed(acc, fmt.Sprintf("HTTP %d", resp.StatusCode)) // 标记失败
+			continue
+		}
+		// 成功，读取响应；流式请求增量解析，出现可输出内容后不再等待完整响应
+		var live *liveUpstream
+		if req.Stream {
+			live, respBody = openLiveUpstream(resp, reqLog)
+		} else {
+			respBody, _ = utils.ReadResponseBody(resp)
+		}
+		if live != nil {
+			liveBody = resp.Body // 增量转发结束后关闭
+		} else {
+			resp.Body.Close()
+		}
+
+		// Debug 模式输出上游响应
+		if logger.IsDebug() {
+			respSnippet := sanitizeUpstreamText(string(respBody))
+			if len(respSnippet) > 2000 {
+				respSnippet = respSnippet[:2000] + "..."
+			}
+			reqLog.Debug("[%s] 上游响应: %s", acc.Data.Email, respSnippet)
+		}
+
+		// 快速检查是否是认证错误响应
+		if bytes.Contains(respBody, []byte("uToken")) && !bytes.Contains(respBody, []byte("streamAssistResponse")) {
+			reqLog.Warn("[%s] 收到认证响应，标记需要刷新", acc.Data.Email)
+			pool.Pool.MarkNeedsRefreshReason(acc, "认证失败（上游返回 uToken 响应）")
+			lastErr = fmt.Errorf("认证失败，需要刷新账号")
+			continue
+		}
+
+		// 检查是否有实际内容（非空返回）
+		hasText := bytes.Contains(respBody, []byte(`"text"`))
+		hasFile := bytes.Contains(respBody, []byte(`"file"`))
+		hasInlineData := bytes.Contains(respBody, []byte(`"inlineData"`))
+		hasThought := bytes.Contains(respBody, []byte(`"thought"`))
+		hasFunctionCall := bytes.Contains(respBody, []byte(`"functionCall"`))
+		hasError := bytes.Contains(respBody, []byte(`"error"`)) || bytes.Contains(respBody, []byte(`"errorMessage"`))
+		hasContent := hasText || hasFile || hasInlineData || hasFunctionCall
+
+		// 检测是否有服务端错误信息
+		if hasError && !hasContent {
+			reqLog.Warn("[%s] 响应包含错误信息，重试 (%d/%d)", acc.Data.Email, retry+1, maxRetries)
+			// 简单解析错误类型
+			if bytes.Contains(respBody, []byte("RESOURCE_EXHAUSTED")) || bytes.Contains(respBody, []byte("quota")) {
+				reqLog.Info("⏳ [%s] 检测到配额耗尽，标记冷却", acc.Data.Email)
+				acc.SetCooldownMultiplier(5) // 5倍冷却
+				pool.Pool.MarkFailed(acc, "配额耗尽")
+			}
+			lastErr = fmt.Errorf("上游返回错误响应")
+			continue
+		}
+
+		// 响应完全为空或只有思考内容
+		if !hasContent {
+			if hasThought {
+				reqLog.Warn("[%s] 响应只有思考内容，无实际输出，换号重试 (%d/%d)", acc.Data.Email, retry+1, maxRetries)
+				lastErr = fmt.Errorf("空返回，只有思考内容")
+				// 思考中的账号不标记失败，可能只是请求太慢
+				time.Sleep(500 * time.Millisecond)
+			} else {
+				reqLog.Warn("[%s] 响应无有效内容 (text/file/inlineData/functionCall)，换号重试 (%d/%d)", acc.Data.Email, retry+1, maxRetries)
+				lastErr = fmt.Errorf("空返回，无有效内容")
+				pool.Pool.MarkFailed(acc, lastErr.Error())
+			}
+			continue
+		}
+
+		usedJWT = jwt
+		usedOrigAuth = acc.Data.Authorization
+		usedConfigID = configID
+		usedSession = session // 保存创建的 session 作为回退
+		usedAcc = acc
+		liveStream = live
+		lastErr = nil
+		pool.Pool.MarkUsed(acc, true) // 标记成功
+		break
+	}
+	if liveBody != nil {
+		defer liveBody.Close()
+	}
+	streamHeartbeat.Stop()
+
+	if lastErr != nil {
+		reqLog.Error("❌ 所有重试均失败: %v", lastErr)
+		if streamStarted {
+			// 流式请求已开始，发送 SSE 格式错误
+			errMsg := fmt.Sprintf("[错误] %v", lastErr)
+			errChunk := createChunk(chatID, createdTime, req.Model, map[string]interface{}{"content": errMsg}, nil)
+			fmt.Fprintf(streamWriter, "data: %s\n\n", errChunk)
+			finishReason := "stop"
+			finalChunk := createChunk(chatID, createdTime, req.Model, nil, &finishReason)
+			fmt.Fprintf(streamWriter, "data: %s\n\n", finalChunk)
+			fmt.Fprintf(streamWriter, "data: [DONE]\n\n")
+			streamFlusher.Flush()
+		} else if deadlineExceeded(ctx) {
+			respondRequestTimeout(c, deadline)
+		} else if lastErrStatusCode > 0 && len(lastErrBody) > 0 {
+			// 如果有 HTTP 错误响应体，保留状态码透传（已脱敏）
+			c.Data(lastErrStatusCode, "application/json", lastErrBody)
+		} else {
+			// 账号可用但上游全部失败，返回 502 与号池为空（503）区分
+			respondAPIError(c, 502, "upstream_error", lastErr.Error(), "", gin.H{
+				"ready":   pool.Pool.ReadyCount(),
+				"pending": pool.Pool.PendingCount(),
+			})
+		}
+		return
+	}
+
+	_ = usedAcc
+
+	if fallbackModel != "" {
+		reqLog.Info("🔁 请求模型 %s 不可用，已由回退模型 %s 响应", req.Model, fallbackModel)
+		if modelFallbackNotice() {
+			if streamStarted {
+				// SSE 头部已发送，以注释行注明，不影响客户端解析
+				fmt.Fprintf(streamWriter, ": %s: %s\n\n", modelFallbackHeader, fallbackModel)
+			} else {
+				c.Header(modelFallbackHeader, fallbackModel)
+			}
+		}
+	}
+
+	var dataList []map[string]interface{}
+	if liveStream == nil {
+		// 检查空响应
+		if len(respBody) == 0 {
+			reqLog.Error("❌ 响应为空")
+			if streamStarted {
+				errChunk := createChunk(chatID, createdTime, req.Model, map[string]interface{}{"content": "[错误] 上游返回空响应"}, nil)
+				fmt.Fprintf(streamWriter, "data: %s\n\n", errChunk)
+				finishReason := "stop"
+				finalChunk := createChunk(chatID, createdTime, req.Model, nil, &finishReason)
+				fmt.Fprintf(streamWriter, "data: %s\n\n", finalChunk)
+				fmt.Fprintf(streamWriter, "data: [DONE]\n\n")
+				streamFlusher.Flush()
+			} else {
+				respondAPIError(c, 500, "upstream_error", "Empty response from Google", "empty_response")
+			}
+			return
+		}
+
+		dataList = parseUpstreamResponse(respBody, reqLog)
+		if len(dataList) == 0 {
+			if streamStarted {
+				errChunk := createChunk(chatID, createdTime, req.Model, map[string]interface{}{"content": "[错误] 响应解析失败"}, nil)
+				fmt.Fprintf(streamWriter, "data: %s\n\n", errChunk)
+				finishReason := "stop"
+				finalChunk := createChunk(chatID, createdTime, req.Model, nil, &finishReason)
+				fmt.Fprintf(streamWriter, "data: %s\n\n", finalChunk)
+				fmt.Fprintf(streamWriter, "data: [DONE]\n\n")
+				streamFlusher.Flush()
+			} else {
+				respondAPIError(c, 500, "upstream_error", "JSON Parse Error", "invalid_response")
+			}
+			return
+		}
+		logUpstreamSummary(dataList, reqLog)
+	}
+
+	// 从响应中提取 session（用于下载图片）；增量流式响应在读完后再提取
+	var respSession string
+	if liveStream == nil {
+		respSession = resolveResponseSession(dataList, usedSession, reqLog)
+	}
+
+	// 待下载的文件信息
+	type PendingFile struct {
+		FileID   string
+		MimeType string
+	}
+
+	if req.Stream {
+		// 流式响应：文本/思考实时输出，图片最后处理
+		// SSE 头部和 role chunk 已在请求前发送，复用 streamWriter/streamFlusher
+		writer := streamWriter
+		flusher := streamFlusher
+
+		// 统计输出内容长度
+		var outputLen int64
+
+		// 收集待下载的文件和工具调用
+		var pendingFiles []PendingFile
+		toolCallCount := 0
+		budget := &outputBudget{limit: maxTokens}
+		lengthExceeded := false
+		reasoning := &reasoningStream{mode: reasoningMode}
+		// closeThink think 模式下在正文、图片或工具调用之前关闭 <think> 标签
+		closeThink := func() {
+			if closing := reasoning.Close(); closing != "" {
+				chunk := createChunk(chatID, createdTime, req.Model, map[string]interface{}{"content": closing}, nil)
+				fmt.Fprintf(writer, "data: %s\n\n", chunk)
+				flusher.Flush()
+			}
+		}
+		nextObject := upstreamObjects(dataList, liveStream)
+		for data, ok := nextObject(); ok && !lengthExceeded; data, ok = nextObject() {
+			if liveStream != nil {
+				dataList = append(dataList, data)
+			}
+			streamResp, ok := data["streamAssistResponse"].(map[string]interface{})
+			if !ok {
+				continue
+			}
+			answer, ok := streamResp["answer"].(map[string]interface{})
+			if !ok {
+				continue
+			}
+			replies, ok := answer["replies"].([]interface{})
+			if !ok {
+				continue
+			}
+			for _, reply := range replies {
+				replyMap, ok := reply.(map[string]interface{})
+				if !ok {
+					continue
+				}
+				groundedContent, ok := replyMap["groundedContent"].(map[string]interface{})
+				if !ok {
+					continue
+				}
+				content, ok := groundedContent["content"].(map[string]interface{})
+				if !ok {
+					continue
+				}
+				// 检查是否是思考内容
+				if thought, ok := content["thought"].(bool); ok && thought {
+					if t, ok := content["text"].(string); ok && t != "" {
+						if delta := reasoning.Thought(t); delta != nil {
+							chunk := createChunk(chatID, createdTime, req.Model, delta, nil)
+							fmt.Fprintf(writer, "data: %s\n\n", chunk)
+							flusher.Flush()
+						}
+						outputLen += int64(len(t))
+					}
+					continue
+				}
+				closeThink()
+				// 输出文本（实时），超出 max_tokens 估算值时截断并结束
+				if t, ok := content["text"].(string); ok && t != "" {
+					t, lengthExceeded = budget.Take(t)
+					if t != "" {
+						chunk := createChunk(chatID, createdTime, req.Model, map[string]interface{}{"content": t}, nil)
+						fmt.Fprintf(writer, "data: %s\n\n", chunk)
+						flusher.Flush()
+						outputLen += int64(len(t))
+					}
+					if lengthExceeded {
+						reqLog.Info("✂️ 输出达到 max_tokens=%d（估算），截断", maxTokens)
+						break
+					}
+				}
+
+				// 处理 inlineData（直接有 base64 数据的图片）
+				if inlineData, ok := content["inlineData"].(map[string]interface{}); ok {
+					mime, _ := inlineData["mimeType"].(string)
+					data, _ := inlineData["data"].(string)
+					if mime != "" && data != "" {
+						imgMarkdown := formatImageAsMarkdown(mime, data)
+						chunk := createChunk(chatID, createdTime, req.Model, map[string]interface{}{"content": imgMarkdown}, nil)
+						fmt.Fprintf(writer, "data: %s\n\n", chunk)
+						flusher.Flush()
+					}
+				}
+
+				// 收集需要下载的文件（图片/视频）
+				if file, ok := content["file"].(map[string]interface{}); ok {
+					fileId, _ := file["fileId"].(string)
+					mimeType, _ := file["mimeType"].(string)
+					if fileId != "" {
+						pendingFiles = append(pendingFiles, PendingFile{FileID: fileId, MimeType: mimeType})
+					}
+				}
+				if fc, ok := content["functionCall"].(map[string]interface{}); ok {
+					// 每个工具调用使用独立的 index，客户端按 index 拼装并行调用
+					toolCall := newToolCall(fc, toolCallCount)
+					toolCallCount++
+					for _, chunk := range createToolCallChunks(chatID, createdTime, req.Model, toolCall) {
+						fmt.Fprintf(writer, "data: %s\n\n", chunk)
+					}
+					flusher.Flush()
+				}
+			}
+		}
+		closeThink()
+		if liveStream != nil {
+			respSession = resolveResponseSession(dataList, usedSession, reqLog)
+		}
+		if len(pendingFiles) > 0 {
+			reqLog.Info("📥 开始下载 %d 个文件...", len(pendingFiles))
+			type downloadResult struct {
+				Index    int
+				Data     string
+				MimeType string
+				Err      error
+			}
+			results := make(chan downloadResult, len(pendingFiles))
+			var wg sync.WaitGroup
+			for i, pf := range pendingFiles {
+				wg.Add(1)
+				go func(idx int, file PendingFile) {
+					defer wg.Done()
+					data, err := downloadGeneratedFile(usedJWT, file.FileID, respSession, usedConfigID, usedOrigAuth)
+					results <- downloadResult{Index: idx, Data: data, MimeType: file.MimeType, Err: err}
+				}(i, pf)
+			}
+			go func() {
+				wg.Wait()
+				close(results)
+			}()
+			downloaded := make([]downloadResult, len(pendingFiles))
+			for r := range results {
+				downloaded[r.Index] = r
+			}
+
+			// 按顺序输出
+			successCount := 0
+			var lastErr error
+			needsRetry := false
+			for i, r := range downloaded {
+				if r.Err != nil {
+					reqLog.Error("❌ 下载文件[%d]失败: %v", i, r.Err)
+					lastErr = r.Err
+					// 检测是否需要换号重试
+					if errors.Is(r.Err, ErrDownloadNeedsRetry) {
+						needsRetry = true
+					}
+					continue
+				}
+				imgMarkdown := formatImageAsMarkdown(r.MimeType, r.Data)
+				chunk := createChunk(chatID, createdTime, req.Model, map[string]interface{}{"content": imgMarkdown}, nil)
+				fmt.Fprintf(writer, "data: %s\n\n", chunk)
+				flusher.Flush()
+				successCount++
+			}
+
+			// 如果所有文件都下载失败
+			if successCount == 0 && lastErr != nil {
+				var errMsg string
+				if needsRetry {
+					// 401/403 认证失败，提示用户重试（下次会使用新账号）
+					errMsg = "[提示] 文件下载认证失败，请重新发送请求（系统将自动切换账号）"
+					pool.Pool.MarkNeedsRefreshReason(usedAcc, "文件下载认证失败") // 标记当前账号需要刷新
+				} else {
+					errMsg = fmt.Sprintf("生成的文件下载失败: %v", lastErr)
+				}
+				chunk := createChunk(chatID, createdTime, req.Model, map[string]interface{}{"content": errMsg}, nil)
+				fmt.Fprintf(writer, "data: %s\n\n", chunk)
+				flusher.Flush()
+			}
+		}
+
+		// 发送结束
+		finishReason := "stop"
+		if lengthExceeded {
+			finishReason = "length"
+		} else if toolCallCount > 0 {
+			finishReason = "tool_calls"
+		}
+		finalChunk := createChunk(chatID, createdTime, req.Model, nil, &finishReason)
+		fmt.Fprintf(writer, "data: %s\n\n", finalChunk)
+		fmt.Fprintf(writer, "data: [DONE]\n\n")
+		flusher.Flush()
+
+		// 更新统计（区分图片和视频）
+		statsSuccess = true
+		statsOutputTokens = outputLen / 4 // 估算输出 tokens
+		for _, pf := range pendingFiles {
+			if strings.HasPrefix(pf.MimeType, "video/") {
+				statsVideos++
+			} else {
+				statsImages++
+			}
+		}
+	} else {
+		// 非流式响应
+		var fullContent strings.Builder
+		var fullReasoning strings.Builder
+		replyCount := 0
+		var fileCount int64
+		var videoCount int64
+		budget := &outputBudget{limit: maxTokens}
+		lengthExceeded := false
+
+		for _, data := range dataList {
+			streamResp, ok := data["streamAssistResponse"].(map[string]interface{})
+			if !ok {
+				continue
+			}
+			answer, ok := streamResp["answer"].(map[string]interface{})
+			if !ok {
+				continue
+			}
+			replies, ok := answer["replies"].([]interface{})
+			if !ok {
+				continue
+			}
+
+			for _, reply := range replies {
+				replyMap, ok := reply.(map[string]interface{})
+				if !ok {
+					continue
+				}
+				replyCount++
+				if gc, ok := replyMap["groundedContent"].(map[string]interface{}); ok {
+					if content, ok := gc["content"].(map[string]interface{}); ok {
+						if file, ok := content["file"].(map[string]interface{}); ok {
+							if mimeType, _ := file["mimeType"].(string); strings.HasPrefix(mimeType, "video/") {
+								videoCount++
+							} else {
+								fileCount++
+							}
+						}
+					}
+				}
+
+				text, imageData, imageMime, reasoning, dlErr := extractContentFromReply(replyMap, usedJWT, respSession, usedConfigID, usedOrigAuth)
+				if reasoning != "" {
+					fullReasoning.WriteString(reasoning)
+				}
+				if text != "" && !lengthExceeded {
+					text, lengthExceeded = budget.Take(text)
+					fullContent.WriteString(text)
+				}
+				if imageData != "" && imageMime != "" {
+					fullContent.WriteString(formatImageAsMarkdown(imageMime, imageData))
+				}
+				// 检测下载是否需要重试（401/403）
+				if dlErr != nil && errors.Is(dlErr, ErrDownloadNeedsRetry) {
+					pool.Pool.MarkNeedsRefreshReason(usedAcc, "文件下载认证失败")
+					fullContent.WriteString("\n\n[提示] 文件下载认证失败，请重新发送请求（系统将自动切换账号）")
+				}
+			}
+		}
+		toolCalls := extractToolCalls(dataList)
+		// 调试日志
+		reqLog.Debug("📊 非流式响应统计: %d 个 reply, 图片=%d, 视频=%d, content长度=%d, reasoning长度=%d, 工具调用=%d",
+			replyCount, fileCount, videoCount, fullContent.Len(), fullReasoning.Len(), len(toolCalls))
+
+		// 构建响应消息
+		contentText, reasoningText := foldReasoning(reasoningMode, fullReasoning.String(), fullContent.String())
+		message := gin.H{
+			"role":    "assistant",
+			"content": contentText,
+		}
+		if reasoningText != "" {
+			message["reasoning_content"] = reasoningText
+		}
+		finishReason := "stop"
+		if len(toolCalls) > 0 {
+			message["tool_calls"] = toolCalls
+			message["content"] = nil
+			finishReason = "tool_calls"
+		}
+		if lengthExceeded {
+			reqLog.Info("✂️ 输出达到 max_tokens=%d（估算），截断", maxTokens)
+			finishReason = "length"
+		}
+
+		// 构建最终响应（完全符合OpenAI格式）
+		response := gin.H{
+			"id":                 chatID,
+			"object":             "chat.completion",
+			"created":            createdTime,
+			"model":              req.Model,
+			"system_fingerprint": "fp_gemini_" + req.Model,
+			"choices": []gin.H{{
+				"index":         0,
+				"message":       message,
+				"logprobs":      nil,
+				"finish_reason": finishReason,
+			}},
+			"usage": gin.H{
+				"prompt_tokens":     0,
+				"completion_tokens": 0,
+				"total_tokens":      0,
+			},
+		}
+		if isLongRunning && heartbeatDone != nil {
+			close(heartbeatDone) // 停止心跳
+			jsonBytes, _ := json.Marshal(response)
+			c.Writer.Write(jsonBytes)
+		} else {
+			c.JSON(200, response)
+		}
+
+		// 更新统计
+		statsSuccess = true
+		statsOutputTokens = int64(fullContent.Len() / 4) // 粗略估算输出 tokens
+		statsImages = fileCount
+		statsVideos = videoCount
+	}
+}
+func extractAPIKey(c *gin.Context) string {
+	authHeader := c.GetHeader("Authorization")
+	if strings.HasPrefix(authHeader, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(authHeader, "Bearer "))
+	}
+	return strings.TrimSpace(c.GetHeader("X-API-Key"))
+}
+
+func isValidAPIKey(apiKey string) bool {
+	apiKey = strings.TrimSpace(apiKey)
+	if apiKey == "" {
+		return false
+	}
+	for _, key := range GetAPIKeys() {
+		if key == apiKey {
+			return true
+		}
+	}
+	return false
+}
+
+func isSessionAuthorized(c *gin.Context) bool {
+	if panelSessions == nil {
+		return false
+	}
+	token, err := c.Cookie(adminauth.SessionCookieName)
+	if err != nil || strings.TrimSpace(token) == "" {
+		return false
+	}
+	session, ok := panelSessions.Validate(token)
+	if !ok {
+		return false
+	}
+	c.Set("panel_username", session.Username)
+	c.Set("auth_type", "session")
+	return true
+}
+
+func apiKeyAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if len(GetAPIKeys()) == 0 {
+			c.Next()
+			return
+		}
+
+		apiKey := extractAPIKey(c)
+		if apiKey == "" {
+			abortAPIError(c, 401, "authentication_error", "Missing API key", "missing_api_key")
+			return
+		}
+		if !isValidAPIKey(apiKey) {
+			abortAPIError(c, 401, "authentication_error", "Invalid API key", "invalid_api_key")
+			return
+		}
+		c.Set("auth_type", "api_key")
+		c.Set("api_key", apiKey)
+		c.Next()
+	}
+}
+
+func adminAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if isSessionAuthorized(c) {
+			c.Next()
+			return
+		}
+		if isValidAPIKey(extractAPIKey(c)) {
+			c.Set("auth_type", "api_key")
+			c.Next()
+			return
+		}
+		c.JSON(401, gin.H{"error": "Unauthorized"})
+		c.Abort()
+	}
+}
+
+func requireSessionAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if isSessionAuthorized(c) {
+			c.Next()
+			return
+		}
+		c.JSON(401, gin.H{"error": "Unauthorized"})
+		c.Abort()
+	}
+}
+
+// runBrowserRefreshMode 有头浏览器刷新模式
+func runBrowserRefreshMode(email string) {
+	loadAppConfig()
+	utils.InitHTTPClient(Proxy)
+
+	// 强制有头模式
+	pool.BrowserRefreshHeadless = false
+	logger.Info("🌐 有头浏览器刷新模式")
+
+	if err := pool.Pool.Load(DataDir); err != nil {
+		log.Fatalf("❌ 加载账号失败: %v", err)
+	}
+
+	if pool.Pool.TotalCount() == 0 {
+		log.Fatal("❌ 没有可用账号")
+	}
+
+	// 查找目标账号
+	var targetAcc *pool.Account
+	pool.Pool.WithLock(func(ready, pending []*pool.Account) {
+		if email != "" {
+			// 指定邮箱
+			for _, acc := range ready {
+				if acc.Data.Email == email {
+					targetAcc = acc
+					break
+				}
+			}
+			if targetAcc == nil {
+				for _, acc := range pending {
+					if acc.Data.Email == email {
+						targetAcc = acc
+						break
+					}
+				}
+			}
+		} else {
+			// 使用第一个账号
+			if len(ready) > 0 {
+				targetAcc = ready[0]
+			} else if len(pending) > 0 {
+				targetAcc = pending[0]
+			}
+		}
+	})
+
+	if targetAcc == nil {
+		if email != "" {
+			log.Fatalf("❌ 找不到账号: %s", email)
+		}
+		log.Fatal("❌ 没有可用账号")
+	}
+	result := register.RefreshCookieWithBrowser(targetAcc, false, Proxy)
+
+	if result.Success {
+
+		if len(result.NewCookies) > 0 {
+		}
+		if len(result.ResponseHeaders) > 0 {
+		}
+
+		// 更新账号数据
+		targetAcc.Mu.Lock()
+		targetAcc.Data.Cookies = result.SecureCookies
+		if result.Authorization != "" {
+			targetAcc.Data.Authorization = result.Authorization
+		}
+		if result.ConfigID != "" {
+			targetAcc.ConfigID = result.ConfigID
+			targetAcc.Data.ConfigID = result.ConfigID
+		}
+		if result.CSESIDX != "" {
+			targetAcc.CSESIDX = result.CSESIDX
+			targetAcc.Data.CSESIDX = result.CSESIDX
+		}
+		// 保存响应头
+		if len(result.ResponseHeaders) > 0 {
+			targetAcc.Data.ResponseHeaders = result.ResponseHeaders
+		}
+		targetAcc.Mu.Unlock()
+
+		// 保存到文件
+		if err := targetAcc.SaveToFile(); err != nil {
+			logger.Warn("⚠️ 保存失败: %v", err)
+		} else {
+			logger.Info("💾 已保存到: %s", targetAcc.FilePath)
+		}
+	} else {
+		logger.Error("❌ 刷新失败: %v", result.Error)
+	}
+}
+
+var AutoSubscribeEnabled bool
+
+var (
+	bearerSecretRE   = regexp.MustCompile(`(?i)(authorization[^A-Za-z0-9]+Bearer[ \t]+)[A-Za-z0-9\-._~+/=]+`)
+	xPoolSecretRE    = regexp.MustCompile(`(?i)(x-pool-secret[^A-Za-z0-9]+)[^\s",;]+`)
+	apiKeyTokenRE    = regexp.MustCompile(`(?i)\bsk-[A-Za-z0-9\-_]{8,}\b`)
+	duckmailBearerRE = regexp.MustCompile(`(?i)(duckmail[_-]?bearer[^A-Za-z0-9]+)[^\s",;]+`)
+
+	// 上游错误体中的凭证与资源路径
+	jwtTokenRE     = regexp.MustCompile(`\beyJ[A-Za-z0-9_-]{4,}\.[A-Za-z0-9_-]{4,}\.[A-Za-z0-9_-]*`)
+	bareBearerRE   = regexp.MustCompile(`(?i)(\bBearer[ \t]+)[A-Za-z0-9\-._~+/=]{8,}`)
+	cookieSecretRE = regexp.MustCompile(`(?i)((?:__Secure-|__Host-)[A-Za-z0-9_-]+=|\b(?:C_SES|C_OSES|csesidx|NID|SID|HSID|SSID|SAPISID)=)[^;,\s"\\&()]+`)
+	projectPathRE  = regexp.MustCompile(`\bprojects/[^/\s"\\?&]+`)
+)
+
+func sanitizeSensitiveLine(line string) string {
+	clean := strings.TrimSpace(line)
+	if clean == "" {
+		return ""
+	}
+	clean = bearerSecretRE.ReplaceAllString(clean, "${1}***")
+	clean = xPoolSecretRE.ReplaceAllString(clean, "${1}***")
+	clean = duckmailBearerRE.ReplaceAllString(clean, "${1}***")
+	clean = apiKeyTokenRE.ReplaceAllString(clean, "sk-***")
+	return clean
+}
+
+// sanitizeUpstreamText 脱敏上游错误体/日志片段：JWT、Bearer、Cookie 值、API Key 与 projects/<id> 路径，
+// 保留其余文本以便定位问题
+func sanitizeUpstreamText(text string) string {
+	text = jwtTokenRE.ReplaceAllString(text, "***")
+	text = bareBearerRE.ReplaceAllString(text, "${1}***")
+	text = cookieSecretRE.ReplaceAllString(text, "${1}***")
+	text = apiKeyTokenRE.ReplaceAllString(text, "sk-***")
+	text = projectPathRE.ReplaceAllString(text, "projects/***")
+	return text
+}
+
+// sanitizeUpstreamBody 同 sanitizeUpstreamText，用于透传给客户端的原始响应体
+func sanitizeUpstreamBody(body []byte) []byte {
+	return []byte(sanitizeUpstreamText(string(body)))
+}
+
+func init() {
+	// 设置环境变量禁用 quic-go 的警告
+	os.Setenv("QUIC_GO_DISABLE_RECEIVE_BUFFER_WARNING", "true")
+	if raw, _ := strconv.ParseBool(os.Getenv("RAW_STDOUT")); !raw {
+		filterStdout()
+	}
+}
+
+// stdout 过滤管道状态（origStdout 为 nil 表示未启用）
+var (
+	stdoutFilterMu sync.Mutex
+	origStdout     *os.File
+)
+
+// restoreStdout 恢复原始 stdout 并关闭过滤（可重复调用）
+func restoreStdout() {
+	stdoutFilterMu.Lock()
+	defer stdoutFilterMu.Unlock()
+	if origStdout == nil {
+		return
+	}
+	os.Stdout = origStdout
+	log.SetOutput(origStdout)
+	origStdout = nil
+}
+
+// filterStdoutLine 过滤噪音并脱敏一行 stdout 输出，返回空字符串表示丢弃
+func filterStdoutLine(line string) string {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return ""
+	}
+	// 过滤特定噪音日志
+	if strings.Contains(line, "REALITY localAddr:") ||
+		strings.Contains(line, "DialTLSContext") ||
+		strings.Contains(line, "sys_conn.go") ||
+		strings.Contains(line, "failed to sufficiently increase receive buffer size") {
+		return ""
+	}
+	return sanitizeSensitiveLine(line)
+}
+
+func filterStdout() {
+	// 创建 stdout 管道，用于统一过滤与日志聚合
+	r, w, err := os.Pipe()
+	if err != nil {
+		return
+	}
+	stdoutFilterMu.Lock()
+	orig := os.Stdout
+	origStdout = orig
+	os.Stdout = w
+	log.SetOutput(w)
+	stdoutFilterMu.Unlock()
+
+	go func() {
+		// 读取协程异常退出时恢复原始 stdout，并继续转发管道剩余内容，
+		// 保证仍持有管道的写入方（如子进程）不会因管道写满而阻塞
+		defer func() {
+			if p := recover(); p != nil {
+				_, _ = fmt.Fprintf(orig, "⚠️ stdout 过滤异常，已恢复原始输出: %v\n", p)
+				restoreStdout()
+				_, _ = io.Copy(orig, r)
+			}
+		}()
+
+		// 按行读取（不限行长），未以换行结尾的内容在 EOF 时同样输出
+		reader := bufio.NewReaderSize(r, 64*1024)
+		for {
+			line, err := reader.ReadString('\n')
+			if safeLine := filterStdoutLine(line); safeLine != "" {
+				_, _ = orig.WriteString(safeLine + "\n")
+				logger.AppendRaw("business2api", safeLine)
+			}
+			if err != nil {
+				if err != io.EOF {
+					_, _ = fmt.Fprintf(orig, "⚠️ stdout 过滤已停止，恢复原始输出: %v\n", err)
+				}
+				restoreStdout()
+				return
+			}
+		}
+	}()
+}
+
+func main() {
+	log.SetFlags(log.Ltime | log.Lshortfile)
+
+	var refreshEmail string
+	var refreshMode bool
+
+	// 解析命令行参数
+	for i, arg := range os.Args[1:] {
+		switch arg {
+		case "--debug", "-d":
+			register.RegisterDebug = true
+			logger.Info("🔧 调试模式已启用，将保存截图到 data/screenshots/")
+		case "--once":
+			register.RegisterOnce = true
+			logger.Info("🔧 单次运行模式")
+		case "--auto":
+			AutoSubscribeEnabled = true
+		case "--refresh":
+			refreshMode = true
+			// 检查下一个参数是否是邮箱
+			if i+2 < len(os.Args) && !strings.HasPrefix(os.Args[i+2], "-") {
+				refreshEmail = os.Args[i+2]
+			}
+		case "--help", "-h":
+			fmt.Println(`用法: ./business2api [选项]
+
+选项:
+  --debug, -d           调试模式，保存注册过程截图
+  --auto                自动订阅模式，每小时注册获取代理
+  --refresh [email]     有头浏览器刷新账号（不指定email则使用第一个账号）
+  --help, -h            显示帮助`)
+			os.Exit(0)
+		}
+	}
+
+	// 刷新模式：直接执行浏览器刷新后退出
+	if refreshMode {
+		runBrowserRefreshMode(refreshEmail)
+		return
+	}
+
+	loadAppConfig()
+	utils.InitHTTPClient(Proxy)
+	if appConfig.PoolServer.Enable {
+		switch appConfig.PoolServer.Mode {
+		case "client":
+			runAsClient()
+			return
+		case "server":
+			runAsServer()
+			return
+		}
+	}
+
+	// 本地模式
+	runLocalMode()
+}
+func runAsClient() {
+	logger.Info("🔌 启动客户端模式...")
+
+	// 代理实例池由异步健康检查完成后初始化
+	// 设置代理就绪检查回调
+	pool.IsProxyReady = func() bool {
+		return proxy.Manager.IsReady()
+	}
+	pool.WaitProxyReady = func(timeout time.Duration) bool {
+		logger.Info("⏳ 等待代理就绪...")
+		result := proxy.Manager.WaitReady(timeout)
+		if result {
+			logger.Info("✅ 代理已就绪")
+		} else {
+			logger.Warn("⚠️ 代理等待超时")
+		}
+		return result
+	}
+
+	pool.RunBrowserRegister = func(headless bool, proxyURL string, id int) *pool.BrowserRegisterResult {
+		result := register.RunBrowserRegister(headless, proxyURL, id)
+		return &pool.BrowserRegisterResult{
+			Success:       result.Success,
+			Email:         result.Email,
+			FullName:      result.FullName,
+			MailProvider:  result.MailProvider,
+			MailPassword:  result.MailPassword,
+			SecureCookies: result.Cookies,
+			Authorization: result.Authorization,
+			ConfigID:      result.ConfigID,
+			CSESIDX:       result.CSESIDX,
+			Error:         result.Error,
+		}
+	}
+	pool.RefreshCookieWithBrowser = func(acc *pool.Account, headless bool, proxyURL string) *pool.BrowserRefreshResult {
+		result := register.RefreshCookieWithBrowser(acc, headless, proxyURL)
+		return &pool.BrowserRefreshResult{
+			Success:         result.Success,
+			SecureCookies:   result.SecureCookies,
+			ConfigID:        result.ConfigID,
+			CSESIDX:         result.CSESIDX,
+			Authorization:   result.Authorization,
+			ResponseHeaders: result.ResponseHeaders,
+			Error:           result.Error,
+		}
+	}
+	pool.ClientHeadless = appConfig.Pool.RegisterHeadless
+	pool.ClientProxy = Proxy
+	pool.GetClientProxy = func() string {
+		if proxy.Manager.HealthyCount() > 0 {
+			proxyURL := proxy.Manager.Next()
+			if proxyURL != "" {
+				return proxyURL
+			}
+		}
+		return Proxy
+	}
+	pool.GetHealthyCount = func() int {
+		return proxy.Manager.HealthyCount()
+	}
+	go func() {
+		proxy.Manager.CheckAllHealth()
+		if proxy.Manager.HealthyCount() > 0 {
+			poolSize := appConfig.Pool.RegisterThreads
+			if poolSize <= 0 {
+				poolSize = pool.DefaultProxyCount
+			}
+			if poolSize > 10 {
+				poolSize = 10
+			}
+			proxy.Manager.SetMaxPoolSize(poolSize)
+			proxy.Manager.InitInstancePool(poolSize)
+		}
+	}()
+	client := pool.NewPoolClient(appConfig.PoolServer)
+	if err := client.Start(); err != nil {
+		log.Fatalf("❌ 客户端启动失败: %v", err)
+	}
+}
+
+var poolServer *pool.PoolServer
+
+func runAsServer() {
+	logger.Info("🖥️ 启动服务器模式...")
+
+	// 加载账号
+	dataDir := appConfig.PoolServer.DataDir
+	if dataDir == "" {
+		dataDir = DataDir
+	}
+	if err := pool.Pool.Load(dataDir); err != nil {
+		log.Fatalf("❌ 加载账号失败: %v", err)
+	}
+
+	// 启动配置文件热重载监听
+	if err := startConfigWatcher(); err != nil {
+		logger.Warn("⚠️ 配置热重载启动失败: %v", err)
+	}
+
+	poolServer = pool.NewPoolServer(pool.Pool, appConfig.PoolServer)
+	poolServer.StartBackground() // 启动后台任务分发和心跳检测
+	pool.Pool.StartPoolManager()
+	runAPIServer()
+}
+
+// handleReadyz 就绪探针：使用代理池时需健康节点数达到 min_healthy_proxies，未就绪返回 503
+func handleReadyz(c *gin.Context) {
+	total := proxy.Manager.TotalCount()
+	proxyInfo := gin.H{
+		"total":    total,
+		"healthy":  proxy.Manager.HealthyCount(),
+		"required": proxy.Manager.RequiredHealthy(),
+		"ready":    true,
+	}
+	// 服务端模式与直连（无代理节点）不依赖代理池
+	if poolMode != PoolModeServer && total > 0 {
+		proxyInfo["ready"] = proxy.Manager.IsReady()
+	}
+	ready := proxyInfo["ready"].(bool)
+	status := 200
+	if !ready {
+		status = 503
+	}
+	c.JSON(status, gin.H{
+		"ready":          ready,
+		"proxy":          proxyInfo,
+		"ready_accounts": pool.Pool.ReadyCount(),
+	})
+}
+
+// configureClientIP 设置可信反代与真实 IP 请求头，使 c.ClientIP() 在 CDN/反代后返回真实客户端地址。
+// 未配置可信反代时不信任任何转发头，c.ClientIP() 即连接地址，避免客户端伪造 IP
+func configureClientIP(r *gin.Engine, trustedProxies []string, header string) error {
+	header = strings.TrimSpace(header)
+	if len(trustedProxies) == 0 {
+		if header != "" {
+			logger.Warn("⚠️ 未配置 trusted_proxies，忽略 client_ip_header: %s", header)
+		}
+		return r.SetTrustedProxies(nil)
+	}
+	if err := r.SetTrustedProxies(trustedProxies); err != nil {
+		return err
+	}
+	logger.Info("🛡️ 可信反代: %s", strings.Join(trustedProxies, ", "))
+	if header != "" {
+		r.RemoteIPHeaders = []string{header}
+		logger.Info("🛡️ 真实 IP 请求头: %s", header)
+	}
+	return nil
+}
+
+// runAPIServer 启动 API 服务
+func runAPIServer() {
+	gin.SetMode(gin.ReleaseMode)
+	r := gin.New()
+	if err := configureClientIP(r, appConfig.TrustedProxies, appConfig.ClientIPHeader); err != nil {
+		log.Fatalf("❌ 可信代理配置无效: %v", err)
+	}
+	r.Use(gin.Recovery())
+	setupAPIRoutes(r)
+	pool.OnAccountInvalid = recordAccountInvalid
+	startIPStatsPersistence(DataDir)
+	pool.Pool.StartHistorySampler()
+	auditSink = audit.NewSink(filepath.Join(DataDir, "audit"))
+	logger.Info("🚀 API 服务启动于 %s，账号: ready=%d, pending=%d", ListenAddr, pool.Pool.ReadyCount(), pool.Pool.PendingCount())
+	if err := r.Run(ListenAddr); err != nil {
+		log.Fatalf("❌ API 服务启动失败: %v", err)
+	}
+}
+
+const (
+	defaultRegistrarBaseURL = "http://127.0.0.1:8090"
+	maxListPageSize         = 200
+	defaultListPageSize     = 20
+)
+
+type adminAccountView struct {
+	Email          string    `json:"email"`
+	EmailMasked    string    `json:"email_masked"`
+	Status         string    `json:"status"`
+	IsValid        bool      `json:"is_valid"`
+	InvalidReason  string    `json:"invalid_reason,omitempty"`
+	FailCount      int       `json:"fail_count"`
+	LastUsed       time.Time `json:"last_used,omitempty"`
+	LastRefresh    time.Time `json:"last_refresh,omitempty"`
+	DailyCount     int       `json:"daily_count"`
+	DailyLimit     int       `json:"daily_limit"`
+	DailyRemaining int       `json:"daily_remaining"`
+	SuccessCount   int       `json:"success_count"`
+	TotalCount     int       `json:"total_count"`
+	JWTExpires     time.Time `json:"jwt_expires,omitempty"`
+	JWTRefreshDue  bool      `json:"jwt_in_refresh_window"` // JWT 已进入刷新窗口（到期前提前量内或已过期）
+	CooldownMult   int       `json:"cooldown_multiplier"`   // 当前 429 退避冷却倍数（1=未限流）
+	ModifiedAt     time.Time `json:"modified_at,omitempty"`
+
+	UpstreamFailure     string    `json:"upstream_failure,omitempty"`      // 最近一次请求上游失败原因，如 HTTP 401
+	UpstreamFailureKind string    `json:"upstream_failure_kind,omitempty"` // unauthorized / forbidden / quota_exhausted / rate_limited / empty_reply / upstream_error
+	UpstreamFailureAt   time.Time `json:"upstream_failure_at,omitempty"`
+}
+
+type adminPoolFileView struct {
+	FileName          string    `json:"file_name"`
+	EmailFromFilename string    `json:"email_from_filename"`
+	ParseOK           bool      `json:"parse_ok"`
+	ParseError        string    `json:"parse_error,omitempty"`
+	ExistsInPool      bool      `json:"exists_in_pool"`
+	PoolStatus        string    `json:"pool_status"`
+	HasConfigID       bool      `json:"has_config_id"`
+	HasCSESIDX        bool      `json:"has_csesidx"`
+	SizeBytes         int64     `json:"size_bytes"`
+	ModifiedAt        time.Time `json:"modified_at"`
+}
+
+type adminPoolFileRecord struct {
+	view          adminPoolFileView
+	filePath      string
+	accountEmail  string // 以文件内的 email 为准（文件名已规范化，可能带哈希后缀），缺失或解析失败时取文件名
+	invalidReason string
+}
+
+type adminDeleteCandidate struct {
+	FileName     string    `json:"file_name"`
+	Email        string    `json:"email"`
+	Reason       string    `json:"reason"`
+	SizeBytes    int64     `json:"size_bytes"`
+	ModifiedAt   time.Time `json:"modified_at"`
+	Status       string    `json:"status"`
+	EmailMasked  string    `json:"email_masked"`
+	ParseError   string    `json:"parse_error,omitempty"`
+	ExistsInPool bool      `json:"exists_in_pool"`
+	ScopeMatched bool      `json:"scope_matched"`
+}
+
+type adminImportResult struct {
+	Total          int      `json:"total"`
+	Success        int      `json:"success"`
+	Failed         int      `json:"failed"`
+	Skipped        int      `json:"skipped"`
+	Errors         []string `json:"errors"`
+	ImportedEmails []string `json:"imported_emails"`
+}
+
+type adminDeleteExecuteRequest struct {
+	Files      []string `json:"files"`
+	AutoBackup *bool    `json:"auto_backup"`
+}
+
+func getRegistrarBaseURL() string {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	if v := strings.TrimSpace(appConfig.Pool.RegistrarBaseURL); v != "" {
+		return v
+	}
+	return defaultRegistrarBaseURL
+}
+
+func initPanelServices() error {
+	panelAuthMu.Lock()
+	defer panelAuthMu.Unlock()
+
+	if panelAuthStore != nil && panelSessions != nil && logStreamHandler != nil && panelAuthDataDir == DataDir {
+		return nil
+	}
+
+	store, err := adminauth.NewStore(DataDir)
+	if err != nil {
+		return fmt.Errorf("初始化管理员账号失败: %w", err)
+	}
+	panelAuthStore = store
+	panelSessions = adminauth.NewSessionManager(adminauth.DefaultSessionTTL)
+	streamHandler := adminlogs.NewStreamHandler(adminlogs.StreamHandlerConfig{
+		GetRegistrarBaseURL: getRegistrarBaseURL,
+		HTTPClient: &http.Client{
+			Timeout: 5 * time.Second,
+		},
+	})
+	logStreamHandler = streamHandler.Handler()
+	logWSHandler = streamHandler.WSHandler()
+	panelAuthDataDir = DataDir
+	return nil
+}
+
+func setSessionCookie(c *gin.Context, token string, expiresAt time.Time) {
+	maxAge := int(time.Until(expiresAt).Seconds())
+	if maxAge < 0 {
+		maxAge = 0
+	}
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(adminauth.SessionCookieName, token, maxAge, "/", "", false, true)
+}
+
+func clearSessionCookie(c *gin.Context) {
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(adminauth.SessionCookieName, "", -1, "/", "", false, true)
+}
+
+func normalizeStateFilter(raw string) string {
+	state := strings.ToLower(strings.TrimSpace(raw))
+	switch state {
+	case "", "all":
+		return "all"
+	case "active":
+		return "active"
+	case "invalid":
+		return "invalid"
+	default:
+		return "all"
+	}
+}
+
+func parseStatusFilter(raw string) map[string]struct{} {
+	result := make(map[string]struct{})
+	for _, item := range strings.Split(raw, ",") {
+		status := pool.NormalizeStatus(item)
+		if status == "" {
+			continue
+		}
+		result[status] = struct{}{}
+	}
+	return result
+}
+
+func containsStatus(filter map[string]struct{}, status string) bool {
+	if len(filter) == 0 {
+		return true
+	}
+	_, ok := filter[pool.NormalizeStatus(status)]
+	return ok
+}
+
+func containsIgnoreCase(haystack, needle string) bool {
+	if strings.TrimSpace(needle) == "" {
+		return true
+	}
+	return strings.Contains(strings.ToLower(haystack), strings.ToLower(strings.TrimSpace(needle)))
+}
+
+func matchState(status, state string) bool {
+	switch state {
+	case "active":
+		return pool.IsActiveStatus(status)
+	case "invalid":
+		return !pool.IsActiveStatus(status)
+	default:
+		return true
+	}
+}
+
+func parsePageParams(c *gin.Context) (int, int) {
+	page := 1
+	pageSize := defaultListPageSize
+	if v := strings.TrimSpace(c.Query("page")); v != "" {
+		if parsed, err := strconv.Atoi(v); err == nil && parsed > 0 {
+			page = parsed
+		}
+	}
+	if v := strings.TrimSpace(c.Query("page_size")); v != "" {
+		if parsed, err := strconv.Atoi(v); err == nil && parsed > 0 {
+			pageSize = parsed
+		}
+	}
+	if pageSize > maxListPageSize {
+		pageSize = maxListPageSize
+	}
+	return page, pageSize
+}
+
+func maskEmail(email string) string {
+	email = strings.TrimSpace(email)
+	parts := strings.Split(email, "@")
+	if len(parts) != 2 {
+		if len(email) <= 3 {
+			return "***"
+		}
+		return email[:1] + "***" + email[len(email)-1:]
+	}
+	local := parts[0]
+	domain := parts[1]
+	if len(local) <= 2 {
+		local = local[:1] + "***"
+	} else {
+		local = local[:1] + "***" + local[len(local)-1:]
+	}
+	return local + "@" + domain
+}
+
+// 列表排序字段（sort 参数），未指定时保持默认的状态+名称顺序
+var (
+	accountSortKeys  = []string{"last_used", "fail_count", "daily_remaining", "email", "modified_at"}
+	poolFileSortKeys = []string{"email", "modified_at"}
+)
+
+// parseSortParams 解析 sort/order 参数，sort 为空时返回空字符串表示默认顺序
+func parseSortParams(c *gin.Context, allowed []string) (string, string, error) {
+	key := strings.ToLower(strings.TrimSpace(c.Query("sort")))
+	order := strings.ToLower(strings.TrimSpace(c.Query("order")))
+	switch order {
+	case "":
+		order = "asc"
+	case "asc", "desc":
+	default:
+		return "", "", fmt.Errorf("无效的 order: %s（支持 asc/desc）", order)
+	}
+	if key == "" {
+		return "", order, nil
+	}
+	for _, k := range allowed {
+		if k == key {
+			return key, order, nil
+		}
+	}
+	return "", "", fmt.Errorf("无效的 sort: %s（支持 %s）", key, strings.Join(allowed, "/"))
+}
+
+// compareTimes 比较两个时间，返回 -1/0/1
+func compareTimes(a, b time.Time) int {
+	switch {
+	case a.Before(b):
+		return -1
+	case a.After(b):
+		return 1
+	default:
+		return 0
+	}
+}
+
+// sortAccountViews 按指定字段稳定排序，字段相同时保留默认顺序
+func sortAccountViews(items []adminAccountView, key string, desc bool) {
+	if key == "" {
+		return
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		var cmp int
+		switch key {
+		case "last_used":
+			cmp = compareTimes(items[i].LastUsed, items[j].LastUsed)
+		case "fail_count":
+			cmp = items[i].FailCount - items[j].FailCount
+		case "daily_remaining":
+			cmp = items[i].DailyRemaining - items[j].DailyRemaining
+		case "email":
+			cmp = strings.Compare(strings.ToLower(items[i].Email), strings.ToLower(items[j].Email))
+		case "modified_at":
+			cmp = compareTimes(items[i].ModifiedAt, items[j].ModifiedAt)
+		}
+		if desc {
+			return cmp > 0
+		}
+		return cmp < 0
+	})
+}
+
+// sortPoolFileRecords 按指定字段稳定排序，字段相同时保留默认顺序
+func sortPoolFileRecords(records []adminPoolFileRecord, key string, desc bool) {
+	if key == "" {
+		return
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		var cmp int
+		switch key {
+		case "email":
+			cmp = strings.Compare(strings.ToLower(records[i].view.EmailFromFilename), strings.ToLower(records[j].view.EmailFromFilename))
+		case "modified_at":
+			cmp = compareTimes(records[i].view.ModifiedAt, records[j].view.ModifiedAt)
+		}
+		if desc {
+			return cmp > 0
+		}
+		return cmp < 0
+	})
+}
+
+func statusOrder(status string) int {
+	switch pool.NormalizeStatus(status) {
+	case "ready":
+		return 1
+	case "pending":
+		return 2
+	case "cooldown":
+		return 3
+	case "pending_external":
+		return 4
+	case "invalid":
+		return 5
+	default:
+		return 6
+	}
+}
+
+func getPoolAccountIndex() map[string]pool.AccountInfo {
+	result := make(map[string]pool.AccountInfo)
+	for _, info := range pool.Pool.ListAccounts() {
+		email := strings.ToLower(strings.TrimSpace(info.Email))
+		if email == "" {
+			continue
+		}
+		result[email] = info
+	}
+	return result
+}
+
+// 账号存储（按数据目录缓存，目录变化时重建）
+var (
+	accountStoreMu  sync.Mutex
+	accountStore    pool.Store
+	accountStoreDir string
+)
+
+// getAccountStore 获取数据目录对应的账号存储，后端由 pool.storage_backend 决定
+func getAccountStore(dataDir string) pool.Store {
+	accountStoreMu.Lock()
+	defer accountStoreMu.Unlock()
+	if accountStore == nil || accountStoreDir != dataDir {
+		configMu.RLock()
+		backend := appConfig.Pool.StorageBackend
+		configMu.RUnlock()
+		store, err := pool.NewStore(backend, dataDir)
+		if err != nil {
+			logger.Warn("⚠️ 账号存储: %v", err)
+		}
+		accountStore = store
+		accountStoreDir = dataDir
+	}
+	return accountStore
+}
+
+func collectPoolFileRecords(dataDir string) ([]adminPoolFileRecord, error) {
+	stored, err := getAccountStore(dataDir).List()
+	if err != nil {
+		return nil, err
+	}
+
+	accountIndex := getPoolAccountIndex()
+	records := make([]adminPoolFileRecord, 0, len(stored))
+	for _, item := range stored {
+		baseName := item.Name
+		emailFromFilename := strings.TrimSuffix(baseName, filepath.Ext(baseName))
+		record := adminPoolFileRecord{
+			filePath: item.Path,
+			view: adminPoolFileView{
+				FileName:          baseName,
+				EmailFromFilename: emailFromFilename,
+				PoolStatus:        "invalid",
+				SizeBytes:         item.Size,
+				ModifiedAt:        item.ModifiedAt,
+			},
+		}
+		if item.Data == nil {
+			record.accountEmail = emailFromFilename
+			record.view.ParseError = item.Err.Error()
+			record.invalidReason = item.ErrReason
+			records = append(records, record)
+			continue
+		}
+		accData := *item.Data
+
+		record.view.ParseOK = true
+		record.accountEmail = strings.TrimSpace(accData.Email)
+		if record.accountEmail == "" {
+			record.accountEmail = emailFromFilename
+		}
+		record.view.HasConfigID = strings.TrimSpace(accData.ConfigID) != ""
+		record.view.HasCSESIDX = strings.TrimSpace(accData.CSESIDX) != ""
+
+		valid, reason := pool.ValidateAccountData(&accData)
+		if !valid {
+			record.invalidReason = reason
+			record.view.ParseError = reason
+		}
+
+		if info, ok := accountIndex[strings.ToLower(record.accountEmail)]; ok {
+			record.view.ExistsInPool = true
+			record.view.PoolStatus = pool.NormalizeStatus(info.Status)
+		} else if valid {
+			record.view.PoolStatus = "unknown"
+		} else {
+			record.view.PoolStatus = "invalid"
+		}
+
+		records = append(records, record)
+	}
+
+	sort.SliceStable(records, func(i, j int) bool {
+		if statusOrder(records[i].view.PoolStatus) == statusOrder(records[j].view.PoolStatus) {
+			return strings.ToLower(records[i].view.FileName) < strings.ToLower(records[j].view.FileName)
+		}
+		return statusOrder(records[i].view.PoolStatus) < statusOrder(records[j].view.PoolStatus)
+	})
+	return records, nil
+}
+
+func buildAdminAccountViews(dataDir string) ([]adminAccountView, error) {
+	accountIndex := getPoolAccountIndex()
+	fileRecords, err := collectPoolFileRecords(dataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	views := make([]adminAccountView, 0, len(fileRecords)+len(accountIndex))
+	seen := make(map[string]struct{})
+	now := time.Now()
+	for _, rec := range fileRecords {
+		email := strings.TrimSpace(rec.accountEmail)
+		if email == "" {
+			email = rec.view.EmailFromFilename
+		}
+		status := pool.NormalizeStatus(rec.view.PoolStatus)
+		if status == "" {
+			status = "invalid"
+		}
+
+		view := adminAccountView{
+			Email:       email,
+			EmailMasked: maskEmail(email),
+			Status:      status,
+			IsValid:     rec.view.ParseOK && rec.invalidReason == "" && pool.IsActiveStatus(status),
+			ModifiedAt:  rec.view.ModifiedAt,
+		}
+
+		if rec.view.ParseError != "" {
+			view.InvalidReason = rec.view.ParseError
+		}
+		if view.InvalidReason == "" && !pool.IsActiveStatus(status) {
+			view.InvalidReason = "status_not_active"
+		}
+
+		if info, ok := accountIndex[strings.ToLower(email)]; ok {
+			view.FailCount = info.FailCount
+			view.LastUsed = info.LastUsed
+			view.LastRefresh = info.LastRefresh
+			view.DailyCount = info.DailyCount
+			view.DailyLimit = info.DailyLimit
+			view.DailyRemaining = info.DailyRemaining
+			view.SuccessCount = info.SuccessCount
+			view.TotalCount = info.TotalCount
+			view.JWTExpires = info.JWTExpires
+			view.JWTRefreshDue = pool.InJWTRefreshWindow(info.JWTExpires, now)
+			view.CooldownMult = info.CooldownMult
+			view.UpstreamFailure = info.UpstreamFailure
+			view.UpstreamFailureKind = info.UpstreamFailureKind
+			view.UpstreamFailureAt = info.UpstreamFailureAt
+			view.Status = pool.NormalizeStatus(info.Status)
+			view.IsValid = rec.invalidReason == "" && pool.IsActiveStatus(view.Status)
+			if rec.invalidReason == "" && !pool.IsActiveStatus(view.Status) {
+				view.InvalidReason = "status_not_active"
+			}
+			delete(accountIndex, strings.ToLower(email))
+		}
+
+		views = append(views, view)
+		seen[strings.ToLower(email)] = struct{}{}
+	}
+
+	for _, info := range accountIndex {
+		email := strings.TrimSpace(info.Email)
+		if email == "" {
+			continue
+		}
+		if _, ok := seen[strings.ToLower(email)]; ok {
+			continue
+		}
+		status := pool.NormalizeStatus(info.Status)
+		view := adminAccountView{
+			Email:          email,
+			EmailMasked:    maskEmail(email),
+			Status:         status,
+			IsValid:        pool.IsActiveStatus(status),
+			FailCount:      info.FailCount,
+			LastUsed:       info.LastUsed,
+			LastRefresh:    info.LastRefresh,
+			DailyCount:     info.DailyCount,
+			DailyLimit:     info.DailyLimit,
+			DailyRemaining: info.DailyRemaining,
+			SuccessCount:   info.SuccessCount,
+			TotalCount:     info.TotalCount,
+			JWTExpires:     info.JWTExpires,
+			JWTRefreshDue:  pool.InJWTRefreshWindow(info.JWTExpires, now),
+			CooldownMult:   info.CooldownMult,
+
+			UpstreamFailure:     info.UpstreamFailure,
+			UpstreamFailureKind: info.UpstreamFailureKind,
+			UpstreamFailureAt:   info.UpstreamFailureAt,
+		}
+		if !view.IsValid {
+			view.InvalidReason = "status_not_active"
+		}
+		views = append(views, view)
+	}
+
+	// 排序需稳定且无并列，保证分页结果一致
+	sort.SliceStable(views, func(i, j int) bool {
+		if statusOrder(views[i].Status) != statusOrder(views[j].Status) {
+			return statusOrder(views[i].Status) < statusOrder(views[j].Status)
+		}
+		if li, lj := strings.ToLower(views[i].Email), strings.ToLower(views[j].Email); li != lj {
+			return li < lj
+		}
+		return views[i].Email < views[j].Email
+	})
+	return views, nil
+}
+
+func filterAccountViews(items []adminAccountView, state string, statusFilter map[string]struct{}, q string) []adminAccountView {
+	filtered := make([]adminAccountView, 0, len(items))
+	for _, item := range items {
+		if !matchState(item.Status, state) {
+			continue
+		}
+		if !containsStatus(statusFilter, item.Status) {
+			continue
+		}
+		if !containsIgnoreCase(item.Email, q) {
+			continue
+		}
+		filtered = append(filtered, item)
+	}
+	return filtered
+}
+
+func filterPoolFileRecords(items []adminPoolFileRecord, state string, statusFilter map[string]struct{}, q string) []adminPoolFileRecord {
+	filtered := make([]adminPoolFileRecord, 0, len(items))
+	for _, item := range items {
+		status := pool.NormalizeStatus(item.view.PoolStatus)
+		if !matchState(status, state) {
+			continue
+		}
+		if !containsStatus(statusFilter, status) {
+			continue
+		}
+		if !containsIgnoreCase(item.view.FileName, q) && !containsIgnoreCase(item.accountEmail, q) {
+			continue
+		}
+		filtered = append(filtered, item)
+	}
+	return filtered
+}
+
+func paginateAccountViews(items []adminAccountView, page, pageSize int) ([]adminAccountView, int) {
+	total := len(items)
+	if total == 0 {
+		return []adminAccountView{}, 0
+	}
+	start := (page - 1) * pageSize
+	if start >= total {
+		return []adminAccountView{}, total
+	}
+	end := start + pageSize
+	if end > total {
+		end = total
+	}
+	return items[start:end], total
+}
+
+func paginatePoolFileViews(items []adminPoolFileView, page, pageSize int) ([]adminPoolFileView, int) {
+	total := len(items)
+	if total == 0 {
+		return []adminPoolFileView{}, 0
+	}
+	start := (page - 1) * pageSize
+	if start >= total {
+		return []adminPoolFileView{}, total
+	}
+	end := start + pageSize
+	if end > total {
+		end = total
+	}
+	return items[start:end], total
+}
+
+func isStructureInvalid(record adminPoolFileRecord) bool {
+	if record.invalidReason == "" {
+		return false
+	}
+	return record.invalidReason != "status_not_active"
+}
+
+func buildDeleteInvalidCandidates(records []adminPoolFileRecord, scope string) []adminDeleteCandidate {
+	candidates := make([]adminDeleteCandidate, 0)
+	for _, record := range records {
+		reason := ""
+		scopeMatched := false
+
+		if isStructureInvalid(record) {
+			reason = record.invalidReason
+			scopeMatched = true
+		} else if pool.NormalizeStatus(record.view.PoolStatus) == "invalid" {
+			reason = "status_invalid"
+			scopeMatched = true
+		}
+
+		if scope == "invalid_files_and_invalid_accounts" && !scopeMatched {
+			continue
+		}
+
+		email := strings.TrimSpace(record.accountEmail)
+		if email == "" {
+			email = record.view.EmailFromFilename
+		}
+
+		candidates = append(candidates, adminDeleteCandidate{
+			FileName:     record.view.FileName,
+			Email:        email,
+			Reason:       reason,
+			SizeBytes:    record.view.SizeBytes,
+			ModifiedAt:   record.view.ModifiedAt,
+			Status:       record.view.PoolStatus,
+			EmailMasked:  maskEmail(email),
+			ParseError:   record.view.ParseError,
+			ExistsInPool: record.view.ExistsInPool,
+			ScopeMatched: scopeMatched,
+		})
+	}
+	return candidates
+}
+
+func createBackupZip(dataDir string, filePaths []string) (string, error) {
+	backupName := fmt.Sprintf("invalid-backup-%s.zip", time.Now().Format("20060102-150405"))
+	backupPath := filepath.Join(dataDir, backupName)
+	outFile, err := os.Create(backupPath)
+	if err != nil {
+		return "", err
+	}
+	zipWriter := zip.NewWriter(outFile)
+
+	writeErr := func(err error) (string, error) {
+		_ = zipWriter.Close()
+		_ = outFile.Close()
+		_ = os.Remove(backupPath)
+		return "", err
+	}
+
+	for _, path := range filePaths {
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			return writeErr(fmt.Errorf("读取备份文件失败 %s: %w", filepath.Base(path), err))
+		}
+		entry, err := zipWriter.Create(filepath.Base(path))
+		if err != nil {
+			return writeErr(fmt.Errorf("写入备份 ZIP 失败 %s: %w", filepath.Base(path), err))
+		}
+		if _, err := entry.Write(raw); err != nil {
+			return writeErr(fmt.Errorf("写入备份内容失败 %s: %w", filepath.Base(path), err))
+		}
+	}
+
+	if err := zipWriter.Close(); err != nil {
+		return writeErr(fmt.Errorf("关闭备份 ZIP 失败: %w", err))
+	}
+	if err := outFile.Close(); err != nil {
+		return "", fmt.Errorf("关闭备份文件失败: %w", err)
+	}
+	return backupPath, nil
+}
+
+func importSingleAccountPayload(name string, payload []byte, overwrite bool, result *adminImportResult) {
+	result.Total++
+	var accData pool.AccountData
+	if err := json.Unmarshal(payload, &accData); err != nil {
+		result.Failed++
+		result.Errors = append(result.Errors, fmt.Sprintf("%s: JSON 解析失败: %v", name, err))
+		return
+	}
+	importAccountData(name, accData, overwrite, result)
+}
+
+// importAccountData 校验并写入单个账号（调用方负责累加 Total）
+func importAccountData(name string, accData pool.AccountData, overwrite bool, result *adminImportResult) {
+	accData.Email = strings.TrimSpace(accData.Email)
+	cookies := accData.Cookies
+	if len(cookies) == 0 && strings.TrimSpace(accData.CookieString) != "" {
+		cookies = pool.ParseCookieString(accData.CookieString)
+	}
+	accData.Cookies = cookies
+
+	if valid, reason := pool.ValidateAccountData(&accData); !valid {
+		result.Failed++
+		result.Errors = append(result.Errors, fmt.Sprintf("%s: 校验失败: %s", name, reason))
+		return
+	}
+
+	if !overwrite {
+		if _, exists := pool.FindAccountFile(DataDir, accData.Email); exists {
+			result.Skipped++
+			result.Errors = append(result.Errors, fmt.Sprintf("%s: 邮箱 %s 已存在，跳过", name, accData.Email))
+			return
+		}
+	}
+
+	req := &pool.AccountUploadRequest{
+		Email:         accData.Email,
+		FullName:      accData.FullName,
+		MailProvider:  accData.MailProvider,
+		MailPassword:  accData.MailPassword,
+		Cookies:       cookies,
+		CookieString:  accData.CookieString,
+		Authorization: accData.Authorization,
+		ConfigID:      accData.ConfigID,
+		ConfigIDs:     accData.ConfigIDs,
+		CSESIDX:       accData.CSESIDX,
+		IsNew:         false,
+	}
+	if err := pool.ProcessAccountUpload(pool.Pool, DataDir, req); err != nil {
+		result.Failed++
+		result.Errors = append(result.Errors, fmt.Sprintf("%s: 写入失败: %v", name, err))
+		return
+	}
+	result.Success++
+	result.ImportedEmails = append(result.ImportedEmails, accData.Email)
+}
+
+// parseCookieLineAccount 解析一行 Cookie 字符串为账号数据
+// 支持行首 "email----" / "email<TAB>" / "email|" 前缀，以及行内 email/authorization/configId/csesidx 键
+func parseCookieLineAccount(line string) (pool.AccountData, error) {
+	var accData pool.AccountData
+	line = strings.TrimSpace(line)
+
+	for _, sep := range []string{"----", "\t", "|"} {
+		idx := strings.Index(line, sep)
+		if idx <= 0 {
+			continue
+		}
+		prefix := strings.TrimSpace(line[:idx])
+		if strings.Contains(prefix, "@") && !strings.Contains(prefix, "=") {
+			accData.Email = prefix
+			line = strings.TrimSpace(line[idx+len(sep):])
+			break
+		}
+	}
+
+	// 统一分隔符为 "; "，兼容从浏览器复制的 "a=1;b=2"
+	parts := strings.Split(line, ";")
+	for i := range parts {
+		parts[i] = strings.TrimSpace(parts[i])
+	}
+	var cookies []pool.Cookie
+	for _, cookie := range pool.ParseCookieString(strings.Join(parts, "; ")) {
+		switch strings.ToLower(cookie.Name) {
+		case "email":
+			if accData.Email == "" {
+				accData.Email = strings.TrimSpace(cookie.Value)
+			}
+		case "authorization":
+			accData.Authorization = strings.TrimSpace(cookie.Value)
+		case "configid", "config_id":
+			accData.ConfigID = strings.TrimSpace(cookie.Value)
+		case "csesidx":
+			accData.CSESIDX = strings.TrimSpace(cookie.Value)
+		default:
+			cookies = append(cookies, cookie)
+		}
+	}
+
+	if len(cookies) == 0 {
+		return accData, fmt.Errorf("未解析到 Cookie")
+	}
+	hasSES := false
+	for _, cookie := range cookies {
+		if cookie.Name == "__Secure-C_SES" && strings.TrimSpace(cookie.Value) != "" {
+			hasSES = true
+			break
+		}
+	}
+	if !hasSES {
+		return accData, fmt.Errorf("缺少必需的 __Secure-C_SES Cookie")
+	}
+	if accData.Email == "" {
+		return accData, fmt.Errorf("无法识别邮箱（可在行首添加 \"email----\" 或在行内添加 email=...）")
+	}
+	if accData.CSESIDX == "" && accData.Authorization != "" {
+		accData.CSESIDX = pool.ExtractCSESIDX(accData.Authorization)
+	}
+	if accData.ConfigID == "" {
+		accData.ConfigID = DefaultConfig
+	}
+
+	accData.Cookies = cookies
+	accData.CookieString = pool.BuildCookieString(cookies)
+	return accData, nil
+}
+
+// importCookieTextPayload 导入纯文本 Cookie 列表（每行一个 Cookie 字符串，# 开头为注释）
+func importCookieTextPayload(fileName string, payload []byte, overwrite bool, result *adminImportResult) bool {
+	content := strings.TrimPrefix(string(payload), "\ufeff")
+	content = strings.ReplaceAll(content, "\r\n", "\n")
+
+	found := false
+	for i, raw := range strings.Split(content, "\n") {
+		line := strings.TrimSpace(raw)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		found = true
+		name := fmt.Sprintf("%s 第 %d 行", fileName, i+1)
+		result.Total++
+		accData, err := parseCookieLineAccount(line)
+		if err != nil {
+			result.Failed++
+			result.Errors = append(result.Errors, fmt.Sprintf("%s: %v", name, err))
+			continue
+		}
+		importAccountData(name, accData, overwrite, result)
+	}
+	if !found {
+		result.Total++
+		result.Failed++
+		result.Errors = append(result.Errors, fmt.Sprintf("%s: 文件中没有 Cookie 行", fileName))
+	}
+	return found
+}
+
+func handlePoolFilesImport(c *gin.Context) {
+	overwrite := true
+	if raw := strings.TrimSpace(c.PostForm("overwrite")); raw != "" {
+		overwrite = strings.EqualFold(raw, "true") || raw == "1"
+	}
+
+	var fileHeaders []*multipart.FileHeader
+	if form, err := c.MultipartForm(); err == nil && form != nil {
+		if files, ok := form.File["files"]; ok && len(files) > 0 {
+			fileHeaders = append(fileHeaders, files...)
+		}
+		if len(fileHeaders) == 0 {
+			if files, ok := form.File["file"]; ok && len(files) > 0 {
+				fileHeaders = append(fileHeaders, files...)
+			}
+		}
+	}
+	if len(fileHeaders) == 0 {
+		if single, err := c.FormFile("file"); err == nil && single != nil {
+			fileHeaders = append(fileHeaders, single)
+		}
+	}
+	if len(fileHeaders) == 0 {
+		c.JSON(400, gin.H{"error": "缺少上传文件字段 files/file"})
+		return
+	}
+
+	result := &adminImportResult{
+		Errors:         make([]string, 0),
+		ImportedEmails: make([]string, 0),
+	}
+	importAttempted := false
+
+	for _, fileHeader := range fileHeaders {
+		if fileHeader == nil {
+			continue
+		}
+		fileName := strings.TrimSpace(fileHeader.Filename)
+		if fileName == "" {
+			result.Total++
+			result.Failed++
+			result.Errors = append(result.Errors, "上传文件名称为空")
+			continue
+		}
+
+		fileReader, err := fileHeader.Open()
+		if err != nil {
+			result.Total++
+			result.Failed++
+			result.Errors = append(result.Errors, fmt.Sprintf("%s: 打开上传文件失败: %v", fileName, err))
+			continue
+		}
+
+		payload, err := io.ReadAll(fileReader)
+		_ = fileReader.Close()
+		if err != nil {
+			result.Total++
+			result.Failed++
+			result.Errors = append(result.Errors, fmt.Sprintf("%s: 读取上传文件失败: %v", fileName, err))
+			continue
+		}
+
+		lowerName := strings.ToLower(fileName)
+		switch {
+		case strings.HasSuffix(lowerName, ".json"):
+			if trimmed := bytes.TrimSpace(payload); len(trimmed) > 0 && trimmed[0] == '[' {
+				// 单文件 JSON 数组（format=json 导出格式）
+				var items []json.RawMessage
+				if err := json.Unmarshal(trimmed, &items); err != nil {
+					result.Total++
+					result.Failed++
+					result.Errors = append(result.Errors, fmt.Sprintf("%s: JSON 数组解析失败: %v", fileName, err))
+					continue
+				}
+				for i, item := range items {
+					importSingleAccountPayload(fmt.Sprintf("%s[%d]", fileName, i), item, overwrite, result)
+				}
+				importAttempted = len(items) > 0 || importAttempted
+				continue
+			}
+			importSingleAccountPayload(fileName, payload, overwrite, result)
+			importAttempted = true
+		case strings.HasSuffix(lowerName, ".txt"):
+			if importCookieTextPayload(fileName, payload, overwrite, result) {
+				importAttempted = true
+			}
+		case strings.HasSuffix(lowerName, ".zip"):
+			zipReader, err := zip.NewReader(bytes.NewReader(payload), int64(len(payload)))
+			if err != nil {
+				result.Total++
+				result.Failed++
+				result.Errors = append(result.Errors, fmt.Sprintf("%s: ZIP 解析失败: %v", fileName, err))
+				continue
+			}
+
+			foundJSON := false
+			for _, file := range zipReader.File {
+				if file.FileInfo().IsDir() {
+					continue
+				}
+				if !strings.HasSuffix(strings.ToLower(file.Name), ".json") {
+					continue
+				}
+				foundJSON = true
+				entry, err := file.Open()
+				if err != nil {
+					result.Total++
+					result.Failed++
+					result.Errors = append(result.Errors, fmt.Sprintf("%s/%s: 打开 ZIP 条目失败: %v", fileName, file.Name, err))
+					continue
+				}
+				entryPayload, readErr := io.ReadAll(entry)
+				_ = entry.Close()
+				if readErr != nil {
+					result.Total++
+					result.Failed++
+					result.Errors = append(result.Errors, fmt.Sprintf("%s/%s: 读取 ZIP 条目失败: %v", fileName, file.Name, readErr))
+					continue
+				}
+				importSingleAccountPayload(file.Name, entryPayload, overwrite, result)
+				importAttempted = true
+			}
+			if !foundJSON {
+				result.Total++
+				result.Failed++
+				result.Errors = append(result.Errors, fmt.Sprintf("%s: ZIP 内未找到 JSON 文件", fileName))
+			}
+		default:
+			result.Total++
+			result.Failed++
+			result.Errors = append(result.Errors, fmt.Sprintf("%s: 仅支持 .zip、.json 或 .txt 文件", fileName))
+		}
+	}
+
+	if !importAttempted {
+		c.JSON(400, gin.H{
+			"error":   "未检测到可导入的账号文件",
+			"details": result.Errors,
+		})
+		return
+	}
+
+	_ = pool.Pool.Load(DataDir)
+
+	c.JSON(200, gin.H{
+		"total":           result.Total,
+		"success":         result.Success,
+		"failed":          result.Failed,
+		"skipped":         result.Skipped,
+		"errors":          result.Errors,
+		"imported_emails": result.ImportedEmails,
+		"overwrite":       overwrite,
+	})
+}
+
+func handlePanelLogin(c *gin.Context) {
+	if panelAuthStore == nil || panelSessions == nil {
+		c.JSON(500, gin.H{"error": "panel auth unavailable"})
+		return
+	}
+
+	var req struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	req.Username = strings.TrimSpace(req.Username)
+	req.Password = strings.TrimSpace(req.Password)
+	if req.Username == "" || req.Password == "" {
+		c.JSON(400, gin.H{"error": "用户名和密码不能为空"})
+		return
+	}
+
+	if !panelAuthStore.Verify(req.Username, req.Password) {
+		c.JSON(401, gin.H{"error": "用户名或密码错误"})
+		return
+	}
 
-type adminDeleteCandidate struct {
-	FileName     string    `json:"file_name"`
-	Email        string    `json:"email"`
-	Reason       string    `json:"reason"`
-	SizeBytes    int64     `json:"size_bytes"`
-	ModifiedAt   time.Time `json:"modified_at"`
-	Status       string    `json:"status"`
-	EmailMasked  string    `json:"email_masked"`
-	ParseError   string    `json:"parse_error,omitempty"`
-	ExistsInPool bool      `json:"exists_in_pool"`
-	ScopeMatched bool      `json:"scope_matched"`
-}
+	session, err := panelSessions.Create(req.Username)
+	if err != nil {
+		c.JSON(500, gin.H{"error": fmt.Sprintf("创建会话失败: %v", err)})
+		return
+	}
 
-type adminImportResult struct {
-	Total          int      `json:"total"`
-	Success        int      `json:"success"`
-	Failed         int      `json:"failed"`
-	Skipped        int      `json:"skipped"`
-	Errors         []string `json:"errors"`
-	ImportedEmails []string `json:"imported_emails"`
+	setSessionCookie(c, session.Token, session.ExpiresAt)
+	c.JSON(200, gin.H{
+		"success":    true,
+		"username":   session.Username,
+		"expires_at": session.ExpiresAt,
+	})
 }
 
-type adminDeleteExecuteRequest struct {
-	Files      []string `json:"files"`
-	AutoBackup *bool    `json:"auto_backup"`
+func handlePanelLogout(c *gin.Context) {
+	if panelSessions != nil {
+		if token, err := c.Cookie(adminauth.SessionCookieName); err == nil && strings.TrimSpace(token) != "" {
+			panelSessions.Delete(token)
+		}
+	}
+	clearSessionCookie(c)
+	c.JSON(200, gin.H{"success": true})
 }
 
-func getRegistrarBaseURL() string {
-	configMu.RLock()
-	defer configMu.RUnlock()
-	if v := strings.TrimSpace(appConfig.Pool.RegistrarBaseURL); v != "" {
-		return v
+func handlePanelMe(c *gin.Context) {
+	if !isSessionAuthorized(c) {
+		c.JSON(200, gin.H{"authenticated": false})
+		return
 	}
-	return defaultRegistrarBaseURL
+
+	username, _ := c.Get("panel_username")
+	token, _ := c.Cookie(adminauth.SessionCookieName)
+	session, ok := panelSessions.Validate(token)
+	if !ok {
+		c.JSON(200, gin.H{"authenticated": false})
+		return
+	}
+	c.JSON(200, gin.H{
+		"authenticated": true,
+		"username":      username,
+		"expires_at":    session.ExpiresAt,
+	})
 }
 
-func initPanelServices() error {
-	panelAuthMu.Lock()
-	defer panelAuthMu.Unlock()
+func handlePanelChangePassword(c *gin.Context) {
+	if panelAuthStore == nil || panelSessions == nil {
+		c.JSON(500, gin.H{"error": "panel auth unavailable"})
+		return
+	}
+	authType, _ := c.Get("auth_type")
+	if authType != "session" {
+		c.JSON(403, gin.H{"error": "仅允许登录会话修改密码"})
+		return
+	}
 
-	if panelAuthStore != nil && panelSessions != nil && logStreamHandler != nil && panelAuthDataDir == DataDir {
-		return nil
+	var req struct {
+		NewPassword string `json:"new_password"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	req.NewPassword = strings.TrimSpace(req.NewPassword)
+	if len(req.NewPassword) < adminauth.MinPasswordLength {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("新密码长度至少 %d 位", adminauth.MinPasswordLength)})
+		return
 	}
 
-	store, err := adminauth.NewStore(DataDir)
+	updatedAt, err := panelAuthStore.ChangePassword(req.NewPassword)
 	if err != nil {
-		return fmt.Errorf("初始化管理员账号失败: %w", err)
+		c.JSON(500, gin.H{"error": err.Error()})
+		return
 	}
-	panelAuthStore = store
-	panelSessions = adminauth.NewSessionManager(adminauth.DefaultSessionTTL)
-	logStreamHandler = adminlogs.NewStreamHandler(adminlogs.StreamHandlerConfig{
-		GetRegistrarBaseURL: getRegistrarBaseURL,
-		HTTPClient: &http.Client{
-			Timeout: 5 * time.Second,
-		},
-	}).Handler()
-	panelAuthDataDir = DataDir
-	return nil
+
+	username := panelAuthStore.Username()
+	panelSessions.DeleteByUsername(username)
+	clearSessionCookie(c)
+	c.JSON(200, gin.H{
+		"success":             true,
+		"username":            username,
+		"password_updated_at": updatedAt,
+	})
 }
 
-func setSessionCookie(c *gin.Context, token string, expiresAt time.Time) {
-	maxAge := int(time.Until(expiresAt).Seconds())
-	if maxAge < 0 {
-		maxAge = 0
+func handleLogsStream(c *gin.Context) {
+	if logStreamHandler == nil {
+		c.JSON(500, gin.H{"error": "log stream unavailable"})
+		return
 	}
-	c.SetSameSite(http.SameSiteLaxMode)
-	c.SetCookie(adminauth.SessionCookieName, token, maxAge, "/", "", false, true)
+	logStreamHandler(c)
 }
 
-func clearSessionCookie(c *gin.Context) {
-	c.SetSameSite(http.SameSiteLaxMode)
-	c.SetCookie(adminauth.SessionCookieName, "", -1, "/", "", false, true)
+// 管理端实时事件：定时比对号池数量与请求统计，变化时推送；账号失效由号池回调记入环形缓存
+const (
+	adminEventInterval     = time.Second
+	adminEventPing         = 15 * time.Second
+	adminAccountEventLimit = 200
+)
+
+// accountEvent 账号状态变化事件
+type accountEvent struct {
+	ID     int64     `json:"id"`
+	Email  string    `json:"email"`
+	Status string    `json:"status"`
+	Time   time.Time `json:"time"`
 }
 
-func normalizeStateFilter(raw string) string {
-	state := strings.ToLower(strings.TrimSpace(raw))
-	switch state {
-	case "", "all":
-		return "all"
-	case "active":
-		return "active"
-	case "invalid":
-		return "invalid"
-	default:
-		return "all"
+var (
+	accountEventsMu sync.Mutex
+	accountEvents   []accountEvent
+	accountEventID  int64
+)
+
+// recordAccountInvalid 记录账号失效事件（pool.OnAccountInvalid 回调）
+func recordAccountInvalid(email string) {
+	accountEventsMu.Lock()
+	defer accountEventsMu.Unlock()
+	accountEventID++
+	accountEvents = append(accountEvents, accountEvent{ID: accountEventID, Email: email, Status: "invalid", Time: time.Now()})
+	if len(accountEvents) > adminAccountEventLimit {
+		accountEvents = accountEvents[len(accountEvents)-adminAccountEventLimit:]
 	}
 }
 
-func parseStatusFilter(raw string) map[string]struct{} {
-	result := make(map[string]struct{})
-	for _, item := range strings.Split(raw, ",") {
-		status := pool.NormalizeStatus(item)
-		if status == "" {
-			continue
+// accountEventsAfter 返回 ID 大于 afterID 的账号事件及最新 ID
+func accountEventsAfter(afterID int64) ([]accountEvent, int64) {
+	accountEventsMu.Lock()
+	defer accountEventsMu.Unlock()
+	var items []accountEvent
+	for _, ev := range accountEvents {
+		if ev.ID > afterID {
+			items = append(items, ev)
 		}
-		result[status] = struct{}{}
 	}
-	return result
+	return items, accountEventID
 }
 
-func containsStatus(filter map[string]struct{}, status string) bool {
-	if len(filter) == 0 {
-		return true
-	}
-	_, ok := filter[pool.NormalizeStatus(status)]
-	return ok
+// poolEventSnapshot 号池数量快照（event: pool）
+type poolEventSnapshot struct {
+	Ready   int `json:"ready"`
+	Pending int `json:"pending"`
+	Total   int `json:"total"`
 }
 
-func containsIgnoreCase(haystack, needle string) bool {
-	if strings.TrimSpace(needle) == "" {
-		return true
-	}
-	return strings.Contains(strings.ToLower(haystack), strings.ToLower(strings.TrimSpace(needle)))
+// statsEventSnapshot 请求统计快照（event: stats）
+type statsEventSnapshot struct {
+	CurrentRPM      float64 `json:"current_rpm"`
+	TotalRequests   int64   `json:"total_requests"`
+	SuccessRequests int64   `json:"success_requests"`
+	FailedRequests  int64   `json:"failed_requests"`
 }
 
-func matchState(status, state string) bool {
-	switch state {
-	case "active":
-		return pool.IsActiveStatus(status)
-	case "invalid":
-		return !pool.IsActiveStatus(status)
-	default:
-		return true
-	}
+func currentPoolEventSnapshot() poolEventSnapshot {
+	return poolEventSnapshot{Ready: pool.Pool.ReadyCount(), Pending: pool.Pool.PendingCount(), Total: pool.Pool.TotalCount()}
 }
 
-func parsePageParams(c *gin.Context) (int, int) {
-	page := 1
-	pageSize := defaultListPageSize
-	if v := strings.TrimSpace(c.Query("page")); v != "" {
-		if parsed, err := strconv.Atoi(v); err == nil && parsed > 0 {
-			page = parsed
-		}
-	}
-	if v := strings.TrimSpace(c.Query("page_size")); v != "" {
-		if parsed, err := strconv.Atoi(v); err == nil && parsed > 0 {
-			pageSize = parsed
-		}
-	}
-	if pageSize > maxListPageSize {
-		pageSize = maxListPageSize
+func currentStatsEventSnapshot() statsEventSnapshot {
+	apiStats.mu.RLock()
+	snapshot := statsEventSnapshot{
+		TotalRequests:   apiStats.totalRequests,
+		SuccessRequests: apiStats.successRequests,
+		FailedRequests:  apiStats.failedRequests,
 	}
-	return page, pageSize
+	apiStats.mu.RUnlock()
+	snapshot.CurrentRPM = apiStats.GetRPM()
+	return snapshot
 }
 
-func maskEmail(email string) string {
-	email = strings.TrimSpace(email)
-	parts := strings.Split(email, "@")
-	if len(parts) != 2 {
-		if len(email) <= 3 {
-			return "***"
-		}
-		return email[:1] + "***" + email[len(email)-1:]
-	}
-	local := parts[0]
-	domain := parts[1]
-	if len(local) <= 2 {
-		local = local[:1] + "***"
-	} else {
-		local = local[:1] + "***" + local[len(local)-1:]
-	}
-	return local + "@" + domain
+// adminEventSink 事件推送目标，返回错误时结束推送
+type adminEventSink interface {
+	Event(name string, payload interface{}) error
+	Ping() error
 }
 
-func statusOrder(status string) int {
-	switch pool.NormalizeStatus(status) {
-	case "ready":
-		return 1
-	case "pending":
-		return 2
-	case "cooldown":
-		return 3
-	case "pending_external":
-		return 4
-	case "invalid":
-		return 5
-	default:
-		return 6
+// streamAdminEvents 先推送 pool/stats 快照，之后每个 interval 推送变化，直到 ctx 结束或写入失败
+func streamAdminEvents(ctx context.Context, sink adminEventSink, interval, pingInterval time.Duration) {
+	lastPool := currentPoolEventSnapshot()
+	lastStats := currentStatsEventSnapshot()
+	_, lastAccountID := accountEventsAfter(math.MaxInt64)
+	if sink.Event("pool", lastPool) != nil || sink.Event("stats", lastStats) != nil {
+		return
 	}
-}
 
-func getPoolAccountIndex() map[string]pool.AccountInfo {
-	result := make(map[string]pool.AccountInfo)
-	for _, info := range pool.Pool.ListAccounts() {
-		email := strings.ToLower(strings.TrimSpace(info.Email))
-		if email == "" {
-			continue
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	pingTicker := time.NewTicker(pingInterval)
+	defer pingTicker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-pingTicker.C:
+			if sink.Ping() != nil {
+				return
+			}
+		case <-ticker.C:
+			var items []accountEvent
+			items, lastAccountID = accountEventsAfter(lastAccountID)
+			for _, ev := range items {
+				if sink.Event("account", ev) != nil {
+					return
+				}
+			}
+			if snapshot := currentPoolEventSnapshot(); snapshot != lastPool {
+				lastPool = snapshot
+				if sink.Event("pool", snapshot) != nil {
+					return
+				}
+			}
+			if snapshot := currentStatsEventSnapshot(); snapshot != lastStats {
+				lastStats = snapshot
+				if sink.Event("stats", snapshot) != nil {
+					return
+				}
+			}
 		}
-		result[email] = info
 	}
-	return result
 }
 
-func collectPoolFileRecords(dataDir string) ([]adminPoolFileRecord, error) {
-	files, err := filepath.Glob(filepath.Join(dataDir, "*.json"))
-	if err != nil {
-		return nil, err
+// handleEventsStream 管理端实时事件 SSE：event: pool / account / stats
+func handleEventsStream(c *gin.Context) {
+	sse, ok := adminlogs.StartSSE(c)
+	if !ok {
+		return
 	}
-	sort.Strings(files)
-
-	accountIndex := getPoolAccountIndex()
-	records := make([]adminPoolFileRecord, 0, len(files))
-	for _, path := range files {
-		baseName := filepath.Base(path)
-		emailFromFilename := strings.TrimSuffix(baseName, filepath.Ext(baseName))
-		record := adminPoolFileRecord{
-			filePath:     path,
-			accountEmail: emailFromFilename,
-			view: adminPoolFileView{
-				FileName:          baseName,
-				EmailFromFilename: emailFromFilename,
-				PoolStatus:        "invalid",
-			},
-		}
-
-		stat, statErr := os.Stat(path)
-		if statErr != nil {
-			record.view.ParseError = fmt.Sprintf("读取文件元数据失败: %v", statErr)
-			record.invalidReason = "stat_failed"
-			records = append(records, record)
-			continue
-		}
-		record.view.SizeBytes = stat.Size()
-		record.view.ModifiedAt = stat.ModTime()
+	streamAdminEvents(c.Request.Context(), sse, adminEventInterval, adminEventPing)
+}
 
-		raw, readErr := os.ReadFile(path)
-		if readErr != nil {
-			record.view.ParseError = fmt.Sprintf("读取文件失败: %v", readErr)
-			record.invalidReason = "read_failed"
-			records = append(records, record)
-			continue
-		}
+func handleLogsWS(c *gin.Context) {
+	if logWSHandler == nil {
+		c.JSON(500, gin.H{"error": "log stream unavailable"})
+		return
+	}
+	logWSHandler(c)
+}
 
-		var accData pool.AccountData
-		if err := json.Unmarshal(raw, &accData); err != nil {
-			record.view.ParseError = fmt.Sprintf("JSON 解析失败: %v", err)
-			record.invalidReason = "json_parse_error"
-			records = append(records, record)
-			continue
-		}
+// 日志搜索的正则长度上限，避免超大模式占用过多编译资源
+const maxLogSearchPatternLen = 256
 
-		record.view.ParseOK = true
-		accEmail := strings.TrimSpace(accData.Email)
-		if accEmail != "" {
-			record.accountEmail = accEmail
+// buildLogSearchMatcher 构造日志搜索匹配函数：默认不区分大小写的子串匹配，regex 模式下编译正则
+func buildLogSearchMatcher(q string, useRegex bool) (func(string) bool, error) {
+	if useRegex {
+		if len(q) > maxLogSearchPatternLen {
+			return nil, fmt.Errorf("正则长度不能超过 %d 个字符", maxLogSearchPatternLen)
 		}
-		record.view.HasConfigID = strings.TrimSpace(accData.ConfigID) != ""
-		record.view.HasCSESIDX = strings.TrimSpace(accData.CSESIDX) != ""
-
-		valid, reason := pool.ValidateAccountData(&accData)
-		if !valid {
-			record.invalidReason = reason
-			record.view.ParseError = reason
+		re, err := regexp.Compile(q)
+		if err != nil {
+			return nil, fmt.Errorf("无效的正则: %v", err)
 		}
+		return re.MatchString, nil
+	}
+	needle := strings.ToLower(q)
+	return func(message string) bool {
+		return strings.Contains(strings.ToLower(message), needle)
+	}, nil
+}
 
-		if info, ok := accountIndex[strings.ToLower(record.accountEmail)]; ok {
-			record.view.ExistsInPool = true
-			record.view.PoolStatus = pool.NormalizeStatus(info.Status)
-		} else if valid {
-			record.view.PoolStatus = "unknown"
-		} else {
-			record.view.PoolStatus = "invalid"
+func handleLogsSearch(c *gin.Context) {
+	q := c.Query("q")
+	if strings.TrimSpace(q) == "" {
+		c.JSON(400, gin.H{"error": "q is required"})
+		return
+	}
+	useRegex := false
+	if raw := strings.TrimSpace(c.Query("regex")); raw != "" {
+		useRegex, _ = strconv.ParseBool(raw)
+	}
+	match, err := buildLogSearchMatcher(q, useRegex)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	limit := 0
+	if raw := strings.TrimSpace(c.Query("limit")); raw != "" {
+		if parsed, err := strconv.Atoi(raw); err == nil && parsed > 0 {
+			limit = parsed
 		}
-
-		records = append(records, record)
 	}
 
-	sort.Slice(records, func(i, j int) bool {
-		if statusOrder(records[i].view.PoolStatus) == statusOrder(records[j].view.PoolStatus) {
-			return strings.ToLower(records[i].view.FileName) < strings.ToLower(records[j].view.FileName)
-		}
-		return statusOrder(records[i].view.PoolStatus) < statusOrder(records[j].view.PoolStatus)
+	items := logger.Search(match, limit, c.Query("source"), c.Query("level"))
+	c.JSON(200, gin.H{
+		"items": items,
+		"count": len(items),
+		"q":     q,
+		"regex": useRegex,
 	})
-	return records, nil
 }
 
-func buildAdminAccountViews(dataDir string) ([]adminAccountView, error) {
-	accountIndex := getPoolAccountIndex()
-	fileRecords, err := collectPoolFileRecords(dataDir)
+// handleConfigValidate 试运行校验配置，返回错误与警告，不应用任何变更：
+// 请求体为 JSON 时校验请求体（保存前检查），为空时校验当前 config.json
+func handleConfigValidate(c *gin.Context) {
+	body, err := io.ReadAll(c.Request.Body)
 	if err != nil {
-		return nil, err
+		c.JSON(400, gin.H{"error": fmt.Sprintf("读取请求体失败: %v", err)})
+		return
 	}
-
-	views := make([]adminAccountView, 0, len(fileRecords)+len(accountIndex))
-	seen := make(map[string]struct{})
-	for _, rec := range fileRecords {
-		email := strings.TrimSpace(rec.accountEmail)
-		if email == "" {
-			email = rec.view.EmailFromFilename
-		}
-		status := pool.NormalizeStatus(rec.view.PoolStatus)
-		if status == "" {
-			status = "invalid"
-		}
-
-		view := adminAccountView{
-			Email:       email,
-			EmailMasked: maskEmail(email),
-			Status:      status,
-			IsValid:     rec.view.ParseOK && rec.invalidReason == "" && pool.IsActiveStatus(status),
-		}
-
-		if rec.view.ParseError != "" {
-			view.InvalidReason = rec.view.ParseError
-		}
-		if view.InvalidReason == "" && !pool.IsActiveStatus(status) {
-			view.InvalidReason = "status_not_active"
+	source := "body"
+	data := bytes.TrimSpace(body)
+	if len(data) == 0 {
+		source = "file"
+		data, err = os.ReadFile(configPath)
+		if err != nil {
+			c.JSON(500, gin.H{"error": fmt.Sprintf("读取配置文件失败: %v", err)})
+			return
 		}
+	}
+	result := validateConfigData(data)
+	response := gin.H{
+		"source":   source,
+		"valid":    len(result.Errors) == 0,
+		"errors":   result.Errors,
+		"warnings": result.Warnings,
+	}
+	if source == "file" {
+		response["path"] = configPath
+	}
+	c.JSON(200, response)
+}
 
-		if info, ok := accountIndex[strings.ToLower(email)]; ok {
-			view.FailCount = info.FailCount
-			view.LastUsed = info.LastUsed
-			view.LastRefresh = info.LastRefresh
-			view.DailyCount = info.DailyCount
-			view.DailyLimit = info.DailyLimit
-			view.DailyRemaining = info.DailyRemaining
-			view.SuccessCount = info.SuccessCount
-			view.TotalCount = info.TotalCount
-			view.JWTExpires = info.JWTExpires
-			view.Status = pool.NormalizeStatus(info.Status)
-			view.IsValid = rec.invalidReason == "" && pool.IsActiveStatus(view.Status)
-			if rec.invalidReason == "" && !pool.IsActiveStatus(view.Status) {
-				view.InvalidReason = "status_not_active"
-			}
-			delete(accountIndex, strings.ToLower(email))
-		}
+func handleAdminPanel(c *gin.Context) {
+	panelPath := filepath.Join("web", "admin", "index.html")
+	if _, err := os.Stat(panelPath); err != nil {
+		c.JSON(404, gin.H{"error": "admin panel not found"})
+		return
+	}
+	c.File(panelPath)
+}
 
-		views = append(views, view)
-		seen[strings.ToLower(email)] = struct{}{}
+func handleAdminPanelAsset(c *gin.Context) {
+	assetPath := strings.TrimPrefix(c.Param("filepath"), "/")
+	assetPath = filepath.Clean(assetPath)
+	if assetPath == "." || strings.HasPrefix(assetPath, "..") {
+		c.JSON(400, gin.H{"error": "invalid asset path"})
+		return
+	}
+	fullPath := filepath.Join("web", "admin", assetPath)
+	base := filepath.Clean(filepath.Join("web", "admin"))
+	cleanFullPath := filepath.Clean(fullPath)
+	if !strings.HasPrefix(cleanFullPath, base+string(os.PathSeparator)) && cleanFullPath != base {
+		c.JSON(400, gin.H{"error": "invalid asset path"})
+		return
+	}
+	if _, err := os.Stat(cleanFullPath); err != nil {
+		c.JSON(404, gin.H{"error": "asset not found"})
+		return
 	}
+	c.File(cleanFullPath)
+}
 
-	for _, info := range accountIndex {
-		email := strings.TrimSpace(info.Email)
-		if email == "" {
-			continue
+// jwtExpiringWindow 账号统计中"即将过期"的 JWT 判定窗口
+const jwtExpiringWindow = 5 * time.Minute
+
+// summarizeAccounts 汇总号池账号：按状态计数、活跃账号今日剩余额度、平均失败次数、JWT 即将过期数
+func summarizeAccounts(accounts []pool.AccountInfo, now time.Time) gin.H {
+	byStatus := map[string]int{"ready": 0, "pending": 0, "cooldown": 0, "pending_external": 0, "invalid": 0}
+	dailyRemaining := 0
+	unlimited := false
+	failTotal := 0
+	expiring, expired := 0, 0
+	for _, acc := range accounts {
+		byStatus[acc.Status]++
+		failTotal += acc.FailCount
+		if acc.Status != "invalid" {
+			if acc.DailyRemaining < 0 {
+				unlimited = true
+			} else {
+				dailyRemaining += acc.DailyRemaining
+			}
 		}
-		if _, ok := seen[strings.ToLower(email)]; ok {
+		if acc.JWTExpires.IsZero() {
 			continue
 		}
-		status := pool.NormalizeStatus(info.Status)
-		view := adminAccountView{
-			Email:          email,
-			EmailMasked:    maskEmail(email),
-			Status:         status,
-			IsValid:        pool.IsActiveStatus(status),
-			FailCount:      info.FailCount,
-			LastUsed:       info.LastUsed,
-			LastRefresh:    info.LastRefresh,
-			DailyCount:     info.DailyCount,
-			DailyLimit:     info.DailyLimit,
-			DailyRemaining: info.DailyRemaining,
-			SuccessCount:   info.SuccessCount,
-			TotalCount:     info.TotalCount,
-			JWTExpires:     info.JWTExpires,
-		}
-		if !view.IsValid {
-			view.InvalidReason = "status_not_active"
+		if !acc.JWTExpires.After(now) {
+			expired++
+		} else if acc.JWTExpires.Sub(now) <= jwtExpiringWindow {
+			expiring++
 		}
-		views = append(views, view)
 	}
+	if unlimited {
+		dailyRemaining = -1 // -1 表示无限制
+	}
+	avgFail := 0.0
+	if len(accounts) > 0 {
+		avgFail = math.Round(float64(failTotal)/float64(len(accounts))*100) / 100
+	}
+	return gin.H{
+		"total":                 len(accounts),
+		"by_status":             byStatus,
+		"daily_quota_remaining": dailyRemaining,
+		"avg_fail_count":        avgFail,
+		"jwt_expiring_5m":       expiring,
+		"jwt_expired":           expired,
+	}
+}
+
+// handleAdminAccountsStats 号池账号精简统计，不返回账号列表
+func handleAdminAccountsStats(c *gin.Context) {
+	c.JSON(200, summarizeAccounts(pool.Pool.ListAccounts(), time.Now()))
+}
 
-	sort.Slice(views, func(i, j int) bool {
-		if statusOrder(views[i].Status) == statusOrder(views[j].Status) {
-			return strings.ToLower(views[i].Email) < strings.ToLower(views[j].Email)
+// handleAdminPoolHistory 返回号池数量时间序列（每分钟一次，最多 24 小时），minutes 限定最近 N 分钟
+func handleAdminPoolHistory(c *gin.Context) {
+	var since time.Time
+	if raw := strings.TrimSpace(c.Query("minutes")); raw != "" {
+		minutes, err := strconv.Atoi(raw)
+		if err != nil || minutes <= 0 {
+			c.JSON(400, gin.H{"error": "minutes 必须为正整数"})
+			return
 		}
-		return statusOrder(views[i].Status) < statusOrder(views[j].Status)
+		since = time.Now().Add(-time.Duration(minutes) * time.Minute)
+	}
+	items := pool.Pool.History(since)
+	c.JSON(200, gin.H{"items": items, "count": len(items), "interval_sec": int(pool.HistoryInterval.Seconds())})
+}
+
+func handleAdminAccounts(c *gin.Context) {
+	state := normalizeStateFilter(c.Query("state"))
+	statusFilter := parseStatusFilter(c.Query("status"))
+	q := strings.TrimSpace(c.Query("q"))
+	page, pageSize := parsePageParams(c)
+	sortKey, order, err := parseSortParams(c, accountSortKeys)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+
+	accounts, err := buildAdminAccountViews(DataDir)
+	if err != nil {
+		c.JSON(500, gin.H{"error": fmt.Sprintf("读取账号列表失败: %v", err)})
+		return
+	}
+	filtered := filterAccountViews(accounts, state, statusFilter, q)
+	sortAccountViews(filtered, sortKey, order == "desc")
+	pageItems, total := paginateAccountViews(filtered, page, pageSize)
+	c.JSON(200, gin.H{
+		"items":      pageItems,
+		"total":      total,
+		"page":       page,
+		"page_size":  pageSize,
+		"state":      state,
+		"status":     c.Query("status"),
+		"q":          q,
+		"sort":       sortKey,
+		"order":      order,
+		"total_page": (total + pageSize - 1) / pageSize,
 	})
-	return views, nil
 }
 
-func filterAccountViews(items []adminAccountView, state string, statusFilter map[string]struct{}, q string) []adminAccountView {
-	filtered := make([]adminAccountView, 0, len(items))
-	for _, item := range items {
-		if !matchState(item.Status, state) {
-			continue
-		}
-		if !containsStatus(statusFilter, item.Status) {
-			continue
-		}
-		if !containsIgnoreCase(item.Email, q) {
-			continue
+// secretPresence 敏感值只返回是否存在及长度，不返回内容
+func secretPresence(value string) gin.H {
+	return gin.H{"present": value != "", "length": len(value)}
+}
+
+// maskedCredentials 汇总账号凭据（Cookie/Authorization 等）的存在性与长度
+func maskedCredentials(data pool.AccountData) gin.H {
+	cookies := make([]gin.H, 0, len(data.Cookies))
+	hasSES := false
+	for _, cookie := range data.Cookies {
+		item := secretPresence(cookie.Value)
+		item["name"] = cookie.Name
+		item["domain"] = cookie.Domain
+		cookies = append(cookies, item)
+		if cookie.Name == "__Secure-C_SES" && cookie.Value != "" {
+			hasSES = true
 		}
-		filtered = append(filtered, item)
 	}
-	return filtered
+	return gin.H{
+		"authorization":    secretPresence(data.Authorization),
+		"cookie_string":    secretPresence(data.CookieString),
+		"cookies":          cookies,
+		"has_secure_c_ses": hasSES,
+		"config_id":        secretPresence(data.ConfigID),
+		"csesidx":          secretPresence(data.CSESIDX),
+	}
 }
 
-func filterPoolFileRecords(items []adminPoolFileRecord, state string, statusFilter map[string]struct{}, q string) []adminPoolFileRecord {
-	filtered := make([]adminPoolFileRecord, 0, len(items))
-	for _, item := range items {
-		status := pool.NormalizeStatus(item.view.PoolStatus)
-		if !matchState(status, state) {
+// handleAdminAccountDetail 单个账号详情：列表视图 + 文件元数据 + 凭据概况 + 最近请求/刷新记录
+func handleAdminAccountDetail(c *gin.Context) {
+	email := strings.TrimSpace(c.Param("email"))
+	if email == "" {
+		c.JSON(400, gin.H{"error": "需要提供 email"})
+		return
+	}
+
+	accounts, err := buildAdminAccountViews(DataDir)
+	if err != nil {
+		c.JSON(500, gin.H{"error": fmt.Sprintf("读取账号列表失败: %v", err)})
+		return
+	}
+	var view *adminAccountView
+	for i := range accounts {
+		if strings.EqualFold(accounts[i].Email, email) {
+			view = &accounts[i]
+			break
+		}
+	}
+	if view == nil {
+		c.JSON(404, gin.H{"error": "账号未找到", "email": email})
+		return
+	}
+
+	response := gin.H{
+		"account":         view,
+		"file":            nil,
+		"credentials":     nil,
+		"last_error":      "",
+		"recent_requests": []pool.AccountEvent{},
+		"refresh_history": []pool.AccountEvent{},
+	}
+
+	var fileData *pool.AccountData
+	records, err := collectPoolFileRecords(DataDir)
+	if err != nil {
+		c.JSON(500, gin.H{"error": fmt.Sprintf("读取账号文件失败: %v", err)})
+		return
+	}
+	for _, rec := range records {
+		if !strings.EqualFold(rec.accountEmail, email) && !strings.EqualFold(rec.view.EmailFromFilename, email) {
 			continue
 		}
-		if !containsStatus(statusFilter, status) {
-			continue
+		response["file"] = rec.view
+		if rec.invalidReason != "" {
+			response["file_invalid_reason"] = rec.invalidReason
 		}
-		if !containsIgnoreCase(item.view.FileName, q) && !containsIgnoreCase(item.accountEmail, q) {
-			continue
+		if raw, err := os.ReadFile(rec.filePath); err == nil {
+			var accData pool.AccountData
+			if json.Unmarshal(raw, &accData) == nil {
+				fileData = &accData
+			}
 		}
-		filtered = append(filtered, item)
+		break
 	}
-	return filtered
-}
 
-func paginatePoolFileViews(items []adminPoolFileView, page, pageSize int) ([]adminPoolFileView, int) {
-	total := len(items)
-	if total == 0 {
-		return []adminPoolFileView{}, 0
-	}
-	start := (page - 1) * pageSize
-	if start >= total {
-		return []adminPoolFileView{}, total
-	}
-	end := start + pageSize
-	if end > total {
-		end = total
+	if detail, ok := pool.Pool.GetAccountDetail(email); ok {
+		response["credentials"] = maskedCredentials(detail.Data)
+		response["has_jwt"] = detail.HasJWT
+		response["browser_refresh_count"] = detail.BrowserRefreshCount
+		response["last_error"] = detail.LastError
+		if !detail.LastErrorAt.IsZero() {
+			response["last_error_at"] = detail.LastErrorAt
+		}
+		if len(detail.RecentUsage) > 0 {
+			response["recent_requests"] = detail.RecentUsage
+		}
+		if len(detail.RefreshHistory) > 0 {
+			response["refresh_history"] = detail.RefreshHistory
+		}
+	} else if fileData != nil {
+		response["credentials"] = maskedCredentials(*fileData)
 	}
-	return items[start:end], total
+
+	c.JSON(200, response)
 }
 
-func isStructureInvalid(record adminPoolFileRecord) bool {
-	if record.invalidReason == "" {
-		return false
-	}
-	return record.invalidReason != "status_not_active"
+// accountPatchRequest 账号字段局部更新；未提供（空）的字段保留文件中的旧值
+type accountPatchRequest struct {
+	Authorization string        `json:"authorization"`
+	ConfigID      string        `json:"config_id"`
+	ConfigIDs     []string      `json:"config_ids"` // 提供时整体替换额外 configId，空数组表示清除
+	CSESIDX       string        `json:"csesidx"`
+	Cookies       []pool.Cookie `json:"cookies"`
+	CookieString  string        `json:"cookie_string"`
 }
 
-func buildDeleteInvalidCandidates(records []adminPoolFileRecord, scope string) []adminDeleteCandidate {
-	candidates := make([]adminDeleteCandidate, 0)
-	for _, record := range records {
-		reason := ""
-		scopeMatched := false
+func (r *accountPatchRequest) empty() bool {
+	return r.Authorization == "" && r.ConfigID == "" && r.ConfigIDs == nil && r.CSESIDX == "" && len(r.Cookies) == 0 && r.CookieString == ""
+}
 
-		if isStructureInvalid(record) {
-			reason = record.invalidReason
-			scopeMatched = true
-		} else if pool.NormalizeStatus(record.view.PoolStatus) == "invalid" {
-			reason = "status_invalid"
-			scopeMatched = true
-		}
+// mergeAccountPatch 将局部更新合并到已有账号数据，生成走上传流程的请求
+func mergeAccountPatch(existing pool.AccountData, patch accountPatchRequest) *pool.AccountUploadRequest {
+	req := &pool.AccountUploadRequest{
+		Email:         existing.Email,
+		FullName:      existing.FullName,
+		Cookies:       existing.Cookies,
+		CookieString:  existing.CookieString,
+		Authorization: existing.Authorization,
+		ConfigID:      existing.ConfigID,
+		ConfigIDs:     existing.ConfigIDs,
+		CSESIDX:       existing.CSESIDX,
+	}
+	if v := strings.TrimSpace(patch.Authorization); v != "" {
+		req.Authorization = v
+	}
+	if v := strings.TrimSpace(patch.ConfigID); v != "" {
+		req.ConfigID = v
+	}
+	if patch.ConfigIDs != nil {
+		req.ConfigIDs = patch.ConfigIDs
+	}
+	if v := strings.TrimSpace(patch.CSESIDX); v != "" {
+		req.CSESIDX = v
+	}
+	// cookies 与 cookie_string 需保持一致：只给一个时由另一个推导
+	cookieString := strings.TrimSpace(patch.CookieString)
+	switch {
+	case len(patch.Cookies) > 0:
+		req.Cookies = patch.Cookies
+		req.CookieString = cookieString
+	case cookieString != "":
+		req.Cookies = pool.ParseCookieString(cookieString)
+		req.CookieString = cookieString
+	}
+	return req
+}
+
+// handleAdminAccountPatch 修改账号凭据字段（authorization/config_id/config_ids/csesidx/cookies），
+// 合并后复用上传流程校验并落盘，账号重新进入待刷新队列验证
+func handleAdminAccountPatch(c *gin.Context) {
+	email := strings.TrimSpace(c.Param("email"))
+	if email == "" {
+		c.JSON(400, gin.H{"error": "需要提供 email"})
+		return
+	}
+	var patch accountPatchRequest
+	if err := c.ShouldBindJSON(&patch); err != nil {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("无效的请求格式: %v", err)})
+		return
+	}
+	if patch.empty() {
+		c.JSON(400, gin.H{"error": "至少需要提供 authorization/config_id/config_ids/csesidx/cookies/cookie_string 之一"})
+		return
+	}
 
-		if scope == "invalid_files_and_invalid_accounts" && !scopeMatched {
+	records, err := collectPoolFileRecords(DataDir)
+	if err != nil {
+		c.JSON(500, gin.H{"error": fmt.Sprintf("读取账号文件失败: %v", err)})
+		return
+	}
+	var existing *pool.AccountData
+	for _, rec := range records {
+		if !strings.EqualFold(rec.accountEmail, email) && !strings.EqualFold(rec.view.EmailFromFilename, email) {
 			continue
 		}
+		raw, err := os.ReadFile(rec.filePath)
+		if err != nil {
+			c.JSON(500, gin.H{"error": fmt.Sprintf("读取账号文件失败: %v", err)})
+			return
+		}
+		var accData pool.AccountData
+		if err := json.Unmarshal(raw, &accData); err != nil {
+			c.JSON(409, gin.H{"error": fmt.Sprintf("账号文件无法解析，请重新导入: %v", err)})
+			return
+		}
+		if strings.TrimSpace(accData.Email) == "" {
+			accData.Email = rec.view.EmailFromFilename
+		}
+		existing = &accData
+		break
+	}
+	if existing == nil {
+		c.JSON(404, gin.H{"error": "账号未找到", "email": email})
+		return
+	}
 
-		email := strings.TrimSpace(record.accountEmail)
-		if email == "" {
-			email = record.view.EmailFromFilename
+	req := mergeAccountPatch(*existing, patch)
+	if err := pool.ProcessAccountUpload(pool.Pool, DataDir, req); err != nil {
+		statusCode := 500
+		if errors.Is(err, pool.ErrInvalidAccountUpload) {
+			statusCode = 400
 		}
+		c.JSON(statusCode, gin.H{"error": err.Error()})
+		return
+	}
+	logger.Info("✏️ [%s] 管理端更新账号字段，已重新加入待刷新队列", maskEmail(req.Email))
 
-		candidates = append(candidates, adminDeleteCandidate{
-			FileName:     record.view.FileName,
-			Email:        email,
-			Reason:       reason,
-			SizeBytes:    record.view.SizeBytes,
-			ModifiedAt:   record.view.ModifiedAt,
-			Status:       record.view.PoolStatus,
-			EmailMasked:  maskEmail(email),
-			ParseError:   record.view.ParseError,
-			ExistsInPool: record.view.ExistsInPool,
-			ScopeMatched: scopeMatched,
-		})
+	response := gin.H{"success": true, "account": nil}
+	if accounts, err := buildAdminAccountViews(DataDir); err == nil {
+		for i := range accounts {
+			if strings.EqualFold(accounts[i].Email, req.Email) {
+				response["account"] = accounts[i]
+				break
+			}
+		}
 	}
-	return candidates
+	if detail, ok := pool.Pool.GetAccountDetail(req.Email); ok {
+		response["credentials"] = maskedCredentials(detail.Data)
+	}
+	c.JSON(200, response)
 }
 
-func createBackupZip(dataDir string, filePaths []string) (string, error) {
-	backupName := fmt.Sprintf("invalid-backup-%s.zip", time.Now().Format("20060102-150405"))
-	backupPath := filepath.Join(dataDir, backupName)
-	outFile, err := os.Create(backupPath)
+func handleAdminPoolFiles(c *gin.Context) {
+	state := normalizeStateFilter(c.Query("state"))
+	statusFilter := parseStatusFilter(c.Query("status"))
+	q := strings.TrimSpace(c.Query("q"))
+	page, pageSize := parsePageParams(c)
+	sortKey, order, err := parseSortParams(c, poolFileSortKeys)
 	if err != nil {
-		return "", err
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
 	}
-	zipWriter := zip.NewWriter(outFile)
 
-	writeErr := func(err error) (string, error) {
-		_ = zipWriter.Close()
-		_ = outFile.Close()
-		_ = os.Remove(backupPath)
-		return "", err
+	records, err := collectPoolFileRecords(DataDir)
+	if err != nil {
+		c.JSON(500, gin.H{"error": fmt.Sprintf("读取号池文件失败: %v", err)})
+		return
+	}
+	filteredRecords := filterPoolFileRecords(records, state, statusFilter, q)
+	sortPoolFileRecords(filteredRecords, sortKey, order == "desc")
+	items := make([]adminPoolFileView, 0, len(filteredRecords))
+	for _, rec := range filteredRecords {
+		items = append(items, rec.view)
 	}
+	pageItems, total := paginatePoolFileViews(items, page, pageSize)
 
-	for _, path := range filePaths {
-		raw, err := os.ReadFile(path)
-		if err != nil {
-			return writeErr(fmt.Errorf("读取备份文件失败 %s: %w", filepath.Base(path), err))
+	c.JSON(200, gin.H{
+		"items":      pageItems,
+		"total":      total,
+		"page":       page,
+		"page_size":  pageSize,
+		"state":      state,
+		"status":     c.Query("status"),
+		"q":          q,
+		"sort":       sortKey,
+		"order":      order,
+		"total_page": (total + pageSize - 1) / pageSize,
+	})
+}
+
+func handleAdminPoolFilesExport(c *gin.Context) {
+	state := normalizeStateFilter(c.Query("state"))
+	statusFilter := parseStatusFilter(c.Query("status"))
+	q := strings.TrimSpace(c.Query("q"))
+	format := strings.ToLower(strings.TrimSpace(c.DefaultQuery("format", "zip")))
+	if format != "zip" && format != "json" {
+		c.JSON(400, gin.H{"error": "format 仅支持 zip 或 json"})
+		return
+	}
+
+	records, err := collectPoolFileRecords(DataDir)
+	if err != nil {
+		c.JSON(500, gin.H{"error": fmt.Sprintf("读取号池文件失败: %v", err)})
+		return
+	}
+	filtered := filterPoolFileRecords(records, state, statusFilter, q)
+
+	if format == "json" {
+		exportPoolFilesJSON(c, filtered)
+		return
+	}
+
+	buffer := bytes.NewBuffer(nil)
+	zipWriter := zip.NewWriter(buffer)
+
+	manifestFiles := make([]adminPoolFileView, 0, len(filtered))
+	exportErrors := make([]string, 0)
+	for _, record := range filtered {
+		manifestFiles = append(manifestFiles, record.view)
+		raw, readErr := os.ReadFile(record.filePath)
+		if readErr != nil {
+			exportErrors = append(exportErrors, fmt.Sprintf("%s: %v", record.view.FileName, readErr))
+			continue
 		}
-		entry, err := zipWriter.Create(filepath.Base(path))
+		entry, err := zipWriter.Create(record.view.FileName)
 		if err != nil {
-			return writeErr(fmt.Errorf("写入备份 ZIP 失败 %s: %w", filepath.Base(path), err))
+			exportErrors = append(exportErrors, fmt.Sprintf("%s: %v", record.view.FileName, err))
+			continue
 		}
 		if _, err := entry.Write(raw); err != nil {
-			return writeErr(fmt.Errorf("写入备份内容失败 %s: %w", filepath.Base(path), err))
+			exportErrors = append(exportErrors, fmt.Sprintf("%s: %v", record.view.FileName, err))
+			continue
 		}
 	}
 
-	if err := zipWriter.Close(); err != nil {
-		return writeErr(fmt.Errorf("关闭备份 ZIP 失败: %w", err))
-	}
-	if err := outFile.Close(); err != nil {
-		return "", fmt.Errorf("关闭备份文件失败: %w", err)
+	manifest := map[string]interface{}{
+		"generated_at":   time.Now().UTC().Format(time.RFC3339),
+		"state":          state,
+		"status":         c.Query("status"),
+		"q":              q,
+		"total":          len(filtered),
+		"exported_count": len(filtered) - len(exportErrors),
+		"errors":         exportErrors,
+		"files":          manifestFiles,
 	}
-	return backupPath, nil
-}
-
-func importSingleAccountPayload(name string, payload []byte, overwrite bool, result *adminImportResult) {
-	result.Total++
-	var accData pool.AccountData
-	if err := json.Unmarshal(payload, &accData); err != nil {
-		result.Failed++
-		result.Errors = append(result.Errors, fmt.Sprintf("%s: JSON 解析失败: %v", name, err))
+	manifestRaw, _ := json.MarshalIndent(manifest, "", "  ")
+	manifestEntry, err := zipWriter.Create("manifest.json")
+	if err != nil {
+		c.JSON(500, gin.H{"error": fmt.Sprintf("创建 manifest 失败: %v", err)})
 		return
 	}
-
-	accData.Email = strings.TrimSpace(accData.Email)
-	cookies := accData.Cookies
-	if len(cookies) == 0 && strings.TrimSpace(accData.CookieString) != "" {
-		cookies = pool.ParseCookieString(accData.CookieString)
+	if _, err := manifestEntry.Write(manifestRaw); err != nil {
+		c.JSON(500, gin.H{"error": fmt.Sprintf("写入 manifest 失败: %v", err)})
+		return
 	}
-	accData.Cookies = cookies
-
-	if valid, reason := pool.ValidateAccountData(&accData); !valid {
-		result.Failed++
-		result.Errors = append(result.Errors, fmt.Sprintf("%s: 校验失败: %s", name, reason))
+	if err := zipWriter.Close(); err != nil {
+		c.JSON(500, gin.H{"error": fmt.Sprintf("导出 ZIP 失败: %v", err)})
 		return
 	}
 
-	filePath := filepath.Join(DataDir, fmt.Sprintf("%s.json", accData.Email))
-	if !overwrite {
-		if _, err := os.Stat(filePath); err == nil {
-			result.Skipped++
-			result.Errors = append(result.Errors, fmt.Sprintf("%s: 邮箱 %s 已存在，跳过", name, accData.Email))
-			return
-		}
-	}
+	filename := fmt.Sprintf("pool-export-%s.zip", time.Now().Format("20060102-150405"))
+	c.Header("Content-Type", "application/zip")
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	c.Header("X-Export-Count", strconv.Itoa(len(filtered)))
+	c.Header("X-Export-Errors", strconv.Itoa(len(exportErrors)))
+	c.Data(200, "application/zip", buffer.Bytes())
+}
 
-	req := &pool.AccountUploadRequest{
-		Email:         accData.Email,
-		FullName:      accData.FullName,
-		MailProvider:  accData.MailProvider,
-		MailPassword:  accData.MailPassword,
-		Cookies:       cookies,
-		CookieString:  accData.CookieString,
-		Authorization: accData.Authorization,
-		ConfigID:      accData.ConfigID,
-		CSESIDX:       accData.CSESIDX,
-		IsNew:         false,
+// exportPoolFilesJSON 导出为单个 AccountData JSON 数组，可直接通过导入接口还原
+// 数据取自账号文件原始内容，不包含面板视图中的脱敏字段
+func exportPoolFilesJSON(c *gin.Context, records []adminPoolFileRecord) {
+	accounts := make([]pool.AccountData, 0, len(records))
+	exportErrors := make([]string, 0)
+	for _, record := range records {
+		raw, err := os.ReadFile(record.filePath)
+		if err != nil {
+			exportErrors = append(exportErrors, fmt.Sprintf("%s: %v", record.view.FileName, err))
+			continue
+		}
+		var accData pool.AccountData
+		if err := json.Unmarshal(raw, &accData); err != nil {
+			exportErrors = append(exportErrors, fmt.Sprintf("%s: JSON 解析失败: %v", record.view.FileName, err))
+			continue
+		}
+		if len(accData.Cookies) == 0 && accData.CookieString != "" {
+			accData.Cookies = pool.ParseCookieString(accData.CookieString)
+		}
+		accounts = append(accounts, accData)
 	}
-	if err := pool.ProcessAccountUpload(pool.Pool, DataDir, req); err != nil {
-		result.Failed++
-		result.Errors = append(result.Errors, fmt.Sprintf("%s: 写入失败: %v", name, err))
+
+	payload, err := json.MarshalIndent(accounts, "", "  ")
+	if err != nil {
+		c.JSON(500, gin.H{"error": fmt.Sprintf("导出 JSON 失败: %v", err)})
 		return
 	}
-	result.Success++
-	result.ImportedEmails = append(result.ImportedEmails, accData.Email)
+
+	filename := fmt.Sprintf("pool-export-%s.json", time.Now().Format("20060102-150405"))
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	c.Header("X-Export-Count", strconv.Itoa(len(accounts)))
+	c.Header("X-Export-Errors", strconv.Itoa(len(exportErrors)))
+	c.Data(200, "application/json; charset=utf-8", payload)
 }
 
-func handlePoolFilesImport(c *gin.Context) {
-	overwrite := true
-	if raw := strings.TrimSpace(c.PostForm("overwrite")); raw != "" {
-		overwrite = strings.EqualFold(raw, "true") || raw == "1"
+func handleDeleteInvalidPreview(c *gin.Context) {
+	scope := strings.TrimSpace(c.DefaultQuery("scope", "invalid_files_and_invalid_accounts"))
+	if scope == "" {
+		scope = "invalid_files_and_invalid_accounts"
 	}
 
-	var fileHeaders []*multipart.FileHeader
-	if form, err := c.MultipartForm(); err == nil && form != nil {
-		if files, ok := form.File["files"]; ok && len(files) > 0 {
-			fileHeaders = append(fileHeaders, files...)
-		}
-		if len(fileHeaders) == 0 {
-			if files, ok := form.File["file"]; ok && len(files) > 0 {
-				fileHeaders = append(fileHeaders, files...)
-			}
-		}
+	records, err := collectPoolFileRecords(DataDir)
+	if err != nil {
+		c.JSON(500, gin.H{"error": fmt.Sprintf("读取号池文件失败: %v", err)})
+		return
 	}
-	if len(fileHeaders) == 0 {
-		if single, err := c.FormFile("file"); err == nil && single != nil {
-			fileHeaders = append(fileHeaders, single)
+	candidates := buildDeleteInvalidCandidates(records, scope)
+
+	structureInvalid := 0
+	statusInvalid := 0
+	for _, c := range candidates {
+		if c.Reason == "status_invalid" {
+			statusInvalid++
+		} else {
+			structureInvalid++
 		}
 	}
-	if len(fileHeaders) == 0 {
-		c.JSON(400, gin.H{"error": "缺少上传文件字段 files/file"})
+
+	c.JSON(200, gin.H{
+		"scope":      scope,
+		"candidates": candidates,
+		"total":      len(candidates),
+		"summary": gin.H{
+			"structure_invalid": structureInvalid,
+			"status_invalid":    statusInvalid,
+		},
+	})
+}
+
+func handleDeleteInvalidExecute(c *gin.Context) {
+	var req adminDeleteExecuteRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return
+	}
+	if len(req.Files) == 0 {
+		c.JSON(400, gin.H{"error": "files 不能为空"})
 		return
 	}
+	autoBackup := true
+	if req.AutoBackup != nil {
+		autoBackup = *req.AutoBackup
+	}
 
-	result := &adminImportResult{
-		Errors:         make([]string, 0),
-		ImportedEmails: make([]string, 0),
+	records, err := collectPoolFileRecords(DataDir)
+	if err != nil {
+		c.JSON(500, gin.H{"error": fmt.Sprintf("读取号池文件失败: %v", err)})
+		return
+	}
+	allowed := make(map[string]adminPoolFileRecord)
+	for _, record := range buildDeleteInvalidCandidates(records, "invalid_files_and_invalid_accounts") {
+		allowed[record.FileName] = adminPoolFileRecord{
+			filePath: filepath.Join(DataDir, record.FileName),
+		}
 	}
-	importAttempted := false
 
-	for _, fileHeader := range fileHeaders {
-		if fileHeader == nil {
+	uniqueFiles := make([]string, 0, len(req.Files))
+	seen := make(map[string]struct{})
+	for _, file := range req.Files {
+		name := filepath.Base(strings.TrimSpace(file))
+		if name == "" || name != strings.TrimSpace(file) {
 			continue
 		}
-		fileName := strings.TrimSpace(fileHeader.Filename)
-		if fileName == "" {
-			result.Total++
-			result.Failed++
-			result.Errors = append(result.Errors, "上传文件名称为空")
+		if !strings.HasSuffix(strings.ToLower(name), ".json") {
 			continue
 		}
-
-		fileReader, err := fileHeader.Open()
-		if err != nil {
-			result.Total++
-			result.Failed++
-			result.Errors = append(result.Errors, fmt.Sprintf("%s: 打开上传文件失败: %v", fileName, err))
+		if _, ok := allowed[name]; !ok {
 			continue
 		}
-
-		payload, err := io.ReadAll(fileReader)
-		_ = fileReader.Close()
-		if err != nil {
-			result.Total++
-			result.Failed++
-			result.Errors = append(result.Errors, fmt.Sprintf("%s: 读取上传文件失败: %v", fileName, err))
+		if _, ok := seen[name]; ok {
 			continue
 		}
+		seen[name] = struct{}{}
+		uniqueFiles = append(uniqueFiles, name)
+	}
+	if len(uniqueFiles) == 0 {
+		c.JSON(400, gin.H{"error": "未提供可删除文件（需来自 preview 结果）"})
+		return
+	}
 
-		lowerName := strings.ToLower(fileName)
-		switch {
-		case strings.HasSuffix(lowerName, ".json"):
-			importSingleAccountPayload(fileName, payload, overwrite, result)
-			importAttempted = true
-		case strings.HasSuffix(lowerName, ".zip"):
-			zipReader, err := zip.NewReader(bytes.NewReader(payload), int64(len(payload)))
-			if err != nil {
-				result.Total++
-				result.Failed++
-				result.Errors = append(result.Errors, fmt.Sprintf("%s: ZIP 解析失败: %v", fileName, err))
-				continue
-			}
+	pathsToDelete := make([]string, 0, len(uniqueFiles))
+	for _, name := range uniqueFiles {
+		pathsToDelete = append(pathsToDelete, filepath.Join(DataDir, name))
+	}
 
-			foundJSON := false
-			for _, file := range zipReader.File {
-				if file.FileInfo().IsDir() {
-					continue
-				}
-				if !strings.HasSuffix(strings.ToLower(file.Name), ".json") {
-					continue
-				}
-				foundJSON = true
-				entry, err := file.Open()
-				if err != nil {
-					result.Total++
-					result.Failed++
-					result.Errors = append(result.Errors, fmt.Sprintf("%s/%s: 打开 ZIP 条目失败: %v", fileName, file.Name, err))
-					continue
-				}
-				entryPayload, readErr := io.ReadAll(entry)
-				_ = entry.Close()
-				if readErr != nil {
-					result.Total++
-					result.Failed++
-					result.Errors = append(result.Errors, fmt.Sprintf("%s/%s: 读取 ZIP 条目失败: %v", fileName, file.Name, readErr))
-					continue
-				}
-				importSingleAccountPayload(file.Name, entryPayload, overwrite, result)
-				importAttempted = true
-			}
-			if !foundJSON {
-				result.Total++
-				result.Failed++
-				result.Errors = append(result.Errors, fmt.Sprintf("%s: ZIP 内未找到 JSON 文件", fileName))
-			}
-		default:
-			result.Total++
-			result.Failed++
-			result.Errors = append(result.Errors, fmt.Sprintf("%s: 仅支持 .zip 或 .json 文件", fileName))
+	backupFile := ""
+	if autoBackup {
+		if created, err := createBackupZip(DataDir, pathsToDelete); err != nil {
+			c.JSON(500, gin.H{"error": fmt.Sprintf("创建备份失败: %v", err)})
+			return
+		} else {
+			backupFile = created
 		}
 	}
 
-	if !importAttempted {
-		c.JSON(400, gin.H{
-			"error":   "未检测到可导入的 JSON 账号文件",
-			"details": result.Errors,
-		})
-		return
+	deletedFiles := make([]string, 0, len(pathsToDelete))
+	failed := make([]string, 0)
+	store := getAccountStore(DataDir)
+	for _, name := range uniqueFiles {
+		if err := store.Delete(name); err != nil {
+			failed = append(failed, fmt.Sprintf("%s: %v", name, err))
+			continue
+		}
+		deletedFiles = append(deletedFiles, name)
 	}
 
 	_ = pool.Pool.Load(DataDir)
 
-	c.JSON(200, gin.H{
-		"total":           result.Total,
-		"success":         result.Success,
-		"failed":          result.Failed,
-		"skipped":         result.Skipped,
-		"errors":          result.Errors,
-		"imported_emails": result.ImportedEmails,
-		"overwrite":       overwrite,
-	})
-}
-
-func handlePanelLogin(c *gin.Context) {
-	if panelAuthStore == nil || panelSessions == nil {
-		c.JSON(500, gin.H{"error": "panel auth unavailable"})
-		return
-	}
-
-	var req struct {
-		Username string `json:"username"`
-		Password string `json:"password"`
-	}
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(400, gin.H{"error": err.Error()})
-		return
+	resp := gin.H{
+		"deleted_count": len(deletedFiles),
+		"deleted_files": deletedFiles,
+		"failed":        failed,
+		"stats":         pool.Pool.Stats(),
 	}
-	req.Username = strings.TrimSpace(req.Username)
-	req.Password = strings.TrimSpace(req.Password)
-	if req.Username == "" || req.Password == "" {
-		c.JSON(400, gin.H{"error": "用户名和密码不能为空"})
-		return
+	if backupFile != "" {
+		resp["backup_file"] = backupFile
 	}
+	c.JSON(200, resp)
+}
 
-	if !panelAuthStore.Verify(req.Username, req.Password) {
-		c.JSON(401, gin.H{"error": "用户名或密码错误"})
-		return
+// adminActor 返回当前管理操作的执行者（会话用户名或 api_key）
+func adminActor(c *gin.Context) string {
+	if username, ok := c.Get("panel_username"); ok {
+		if name, _ := username.(string); name != "" {
+			return name
+		}
 	}
-
-	session, err := panelSessions.Create(req.Username)
-	if err != nil {
-		c.JSON(500, gin.H{"error": fmt.Sprintf("创建会话失败: %v", err)})
-		return
+	if authType, ok := c.Get("auth_type"); ok {
+		if name, _ := authType.(string); name != "" {
+			return name
+		}
 	}
+	return "unknown"
+}
 
-	setSessionCookie(c, session.Token, session.ExpiresAt)
-	c.JSON(200, gin.H{
-		"success":    true,
-		"username":   session.Username,
-		"expires_at": session.ExpiresAt,
-	})
+// adminResetRequest 统计清零请求，必须显式 confirm 防止误操作
+type adminResetRequest struct {
+	Confirm       bool `json:"confirm"`
+	KeepStartTime bool `json:"keep_start_time"`
 }
 
-func handlePanelLogout(c *gin.Context) {
-	if panelSessions != nil {
-		if token, err := c.Cookie(adminauth.SessionCookieName); err == nil && strings.TrimSpace(token) != "" {
-			panelSessions.Delete(token)
-		}
+// bindAdminResetRequest 解析清零请求并校验确认参数，失败时已写入响应
+func bindAdminResetRequest(c *gin.Context) (adminResetRequest, bool) {
+	var req adminResetRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(400, gin.H{"error": err.Error()})
+		return req, false
 	}
-	clearSessionCookie(c)
-	c.JSON(200, gin.H{"success": true})
+	if !req.Confirm {
+		c.JSON(400, gin.H{"error": "需要确认清零操作：请求体传入 {\"confirm\": true}"})
+		return req, false
+	}
+	return req, true
 }
 
-func handlePanelMe(c *gin.Context) {
-	if !isSessionAuthorized(c) {
-		c.JSON(200, gin.H{"authenticated": false})
+func handleAdminStatsReset(c *gin.Context) {
+	req, ok := bindAdminResetRequest(c)
+	if !ok {
 		return
 	}
+	before := apiStats.GetStats()["total_requests"]
+	apiStats.Reset(req.KeepStartTime)
+	logger.Warn("🧹 [%s] 已清零 API 统计（清零前总请求 %v，保留启动时间: %v）", adminActor(c), before, req.KeepStartTime)
+	c.JSON(200, gin.H{"success": true, "stats": apiStats.GetStats()})
+}
 
-	username, _ := c.Get("panel_username")
-	token, _ := c.Cookie(adminauth.SessionCookieName)
-	session, ok := panelSessions.Validate(token)
-	if !ok {
-		c.JSON(200, gin.H{"authenticated": false})
+func handleAdminIPReset(c *gin.Context) {
+	if _, ok := bindAdminResetRequest(c); !ok {
 		return
 	}
-	c.JSON(200, gin.H{
-		"authenticated": true,
-		"username":      username,
-		"expires_at":    session.ExpiresAt,
-	})
+	cleared := ipStats.Reset()
+	logger.Warn("🧹 [%s] 已清空 IP 统计（%d 个 IP）", adminActor(c), cleared)
+	c.JSON(200, gin.H{"success": true, "cleared_ips": cleared})
 }
 
-func handlePanelChangePassword(c *gin.Context) {
-	if panelAuthStore == nil || panelSessions == nil {
-		c.JSON(500, gin.H{"error": "panel auth unavailable"})
+// 统计 CSV 导出列，顺序与 GetDetailedStats 中的字段对应
+var (
+	statsModelCSVColumns  = []string{"requests", "success", "success_rate", "input_tokens", "output_tokens", "total_tokens", "images"}
+	statsHourlyCSVColumns = []string{"hour", "requests", "success", "input_tokens", "output_tokens"}
+)
+
+// buildStatsCSV 将 GetDetailedStats 的模型或小时统计转换为 CSV，保证与 JSON 视图数值一致
+func buildStatsCSV(detailed map[string]interface{}, table string) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	switch table {
+	case "models":
+		models, _ := detailed["models"].(map[string]interface{})
+		names := make([]string, 0, len(models))
+		for name := range models {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		w.Write(append([]string{"model"}, statsModelCSVColumns...))
+		for _, name := range names {
+			row := []string{name}
+			fields, _ := models[name].(map[string]interface{})
+			for _, col := range statsModelCSVColumns {
+				row = append(row, fmt.Sprint(fields[col]))
+			}
+			w.Write(row)
+		}
+	case "hourly":
+		hourly, _ := detailed["hourly"].([]map[string]interface{})
+		w.Write(statsHourlyCSVColumns)
+		for _, fields := range hourly {
+			row := make([]string, 0, len(statsHourlyCSVColumns))
+			for _, col := range statsHourlyCSVColumns {
+				row = append(row, fmt.Sprint(fields[col]))
+			}
+			w.Write(row)
+		}
+	default:
+		return nil, fmt.Errorf("不支持的 table: %s（可选 models/hourly）", table)
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+func handleAdminStatsExport(c *gin.Context) {
+	format := strings.ToLower(strings.TrimSpace(c.DefaultQuery("format", "csv")))
+	if format != "csv" {
+		c.JSON(400, gin.H{"error": fmt.Sprintf("不支持的导出格式: %s（仅支持 csv）", format)})
 		return
 	}
-	authType, _ := c.Get("auth_type")
-	if authType != "session" {
-		c.JSON(403, gin.H{"error": "仅允许登录会话修改密码"})
+	table := strings.ToLower(strings.TrimSpace(c.DefaultQuery("table", "models")))
+	payload, err := buildStatsCSV(apiStats.GetDetailedStats(), table)
+	if err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
 		return
 	}
 
+	filename := fmt.Sprintf("stats-%s-%s.csv", table, time.Now().Format("20060102-150405"))
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	c.Data(200, "text/csv; charset=utf-8", payload)
+}
+
+func handleRegistrarTriggerRegister(c *gin.Context) {
 	var req struct {
-		NewPassword string `json:"new_password"`
+		Count int `json:"count"`
 	}
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(400, gin.H{"error": err.Error()})
 		return
 	}
-	req.NewPassword = strings.TrimSpace(req.NewPassword)
-	if len(req.NewPassword) < adminauth.MinPasswordLength {
-		c.JSON(400, gin.H{"error": fmt.Sprintf("新密码长度至少 %d 位", adminauth.MinPasswordLength)})
-		return
+	if req.Count < 1 {
+		req.Count = 1
+	}
+	if req.Count > 20 {
+		req.Count = 20
 	}
 
-	updatedAt, err := panelAuthStore.ChangePassword(req.NewPassword)
+	baseURL := strings.TrimRight(getRegistrarBaseURL(), "/")
+	targetURL := fmt.Sprintf("%s/trigger/register?count=%d", baseURL, req.Count)
+
+	httpReq, err := http.NewRequest(http.MethodPost, targetURL, nil)
 	if err != nil {
-		c.JSON(500, gin.H{"error": err.Error()})
+		c.JSON(500, gin.H{"error": fmt.Sprintf("构建 registrar 请求失败: %v", err)})
 		return
 	}
-
-	username := panelAuthStore.Username()
-	panelSessions.DeleteByUsername(username)
-	clearSessionCookie(c)
-	c.JSON(200, gin.H{
-		"success":             true,
-		"username":            username,
-		"password_updated_at": updatedAt,
-	})
-}
-
-func handleLogsStream(c *gin.Context) {
-	if logStreamHandler == nil {
-		c.JSON(500, gin.H{"error": "log stream unavailable"})
+	httpClient := &http.Client{Timeout: 30 * time.Second}
+	resp, err := httpClient.Do(httpReq)
+	if err != nil {
+		c.JSON(502, gin.H{
+			"error":         fmt.Sprintf("调用 registrar 失败: %v", err),
+			"registrar_url": targetURL,
+			"source":        "python_registrar",
+		})
 		return
 	}
-	logStreamHandler(c)
-}
+	defer resp.Body.Close()
 
-func handleAdminPanel(c *gin.Context) {
-	panelPath := filepath.Join("web", "admin", "index.html")
-	if _, err := os.Stat(panelPath); err != nil {
-		c.JSON(404, gin.H{"error": "admin panel not found"})
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		c.JSON(resp.StatusCode, gin.H{
+			"error":            "registrar 返回错误",
+			"registrar_url":    targetURL,
+			"registrar_status": resp.StatusCode,
+			"registrar_body":   string(body),
+			"source":           "python_registrar",
+		})
 		return
 	}
-	c.File(panelPath)
-}
 
-func handleAdminPanelAsset(c *gin.Context) {
-	assetPath := strings.TrimPrefix(c.Param("filepath"), "/")
-	assetPath = filepath.Clean(assetPath)
-	if assetPath == "." || strings.HasPrefix(assetPath, "..") {
-		c.JSON(400, gin.H{"error": "invalid asset path"})
-		return
+	var passthrough interface{}
+	if len(body) > 0 {
+		_ = json.Unmarshal(body, &passthrough)
 	}
-	fullPath := filepath.Join("web", "admin", assetPath)
-	base := filepath.Clean(filepath.Join("web", "admin"))
-	cleanFullPath := filepath.Clean(fullPath)
-	if !strings.HasPrefix(cleanFullPath, base+string(os.PathSeparator)) && cleanFullPath != base {
-		c.JSON(400, gin.H{"error": "invalid asset path"})
-		return
+
+	response := gin.H{
+		"accepted":      true,
+		"count":         req.Count,
+		"source":        "python_registrar",
+		"registrar_url": targetURL,
 	}
-	if _, err := os.Stat(cleanFullPath); err != nil {
-		c.JSON(404, gin.H{"error": "asset not found"})
-		return
+	if passthrough != nil {
+		response["registrar_response"] = passthrough
 	}
-	c.File(cleanFullPath)
+	c.JSON(200, response)
 }
 
-func handleAdminAccounts(c *gin.Context) {
-	state := normalizeStateFilter(c.Query("state"))
-	statusFilter := parseStatusFilter(c.Query("status"))
-	q := strings.TrimSpace(c.Query("q"))
+// ==================== 批量浏览器刷新 ====================
 
-	accounts, err := buildAdminAccountViews(DataDir)
-	if err != nil {
-		c.JSON(500, gin.H{"error": fmt.Sprintf("读取账号列表失败: %v", err)})
-		return
-	}
-	filtered := filterAccountViews(accounts, state, statusFilter, q)
-	c.JSON(200, gin.H{
-		"items":  filtered,
-		"total":  len(filtered),
-		"state":  state,
-		"status": c.Query("status"),
-		"q":      q,
-	})
+// browserRefreshFunc 浏览器刷新实现（测试中可替换）
+var browserRefreshFunc = register.RefreshCookieWithBrowser
+
+const (
+	defaultBulkRefreshThreads = 2
+	maxBulkRefreshThreads     = 10
+)
+
+// bulkBrowserRefreshRunning 同一时间只允许一个批量浏览器刷新任务
+var bulkBrowserRefreshRunning int32
+
+// bulkRefreshResult 单个账号的批量刷新结果
+type bulkRefreshResult struct {
+	Email      string `json:"email"`
+	Success    bool   `json:"success"`
+	Error      string `json:"error,omitempty"`
+	DurationMs int64  `json:"duration_ms"`
 }
 
-func handleAdminPoolFiles(c *gin.Context) {
-	state := normalizeStateFilter(c.Query("state"))
-	statusFilter := parseStatusFilter(c.Query("status"))
-	q := strings.TrimSpace(c.Query("q"))
-	page, pageSize := parsePageParams(c)
+// applyBrowserRefreshResult 将浏览器刷新结果写回账号并保存，随后重新走 JWT 刷新流程
+func applyBrowserRefreshResult(acc *pool.Account, result *register.BrowserRefreshResult, proxyKey string) {
+	acc.Mu.Lock()
+	email := acc.Data.Email
+	// 更新完整信息
+	acc.Data.Cookies = result.SecureCookies
+	if result.Authorization != "" {
+		acc.Data.Authorization = result.Authorization
+	}
+	if result.CSESIDX != "" {
+		acc.CSESIDX = result.CSESIDX
+		acc.Data.CSESIDX = result.CSESIDX
+	}
+	if result.ConfigID != "" {
+		acc.ConfigID = result.ConfigID
+		acc.Data.ConfigID = result.ConfigID
+	}
+	if proxyKey != "" {
+		acc.Data.ProxyKey = proxyKey
+	}
+	acc.Data.Timestamp = time.Now().Format(time.RFC3339)
+	acc.FailCount = 0
+	acc.Mu.Unlock()
+	acc.RecordRefresh("browser_manual", nil)
 
-	records, err := collectPoolFileRecords(DataDir)
-	if err != nil {
-		c.JSON(500, gin.H{"error": fmt.Sprintf("读取号池文件失败: %v", err)})
-		return
+	if err := acc.SaveToFile(); err != nil {
+		logger.Error("❌ [%s] 保存刷新后的数据失败: %v", email, err)
+	} else {
+		logger.Info("✅ [%s] 刷新数据已保存到文件", email)
 	}
-	filteredRecords := filterPoolFileRecords(records, state, statusFilter, q)
-	items := make([]adminPoolFileView, 0, len(filteredRecords))
-	for _, rec := range filteredRecords {
-		items = append(items, rec.view)
+	pool.Pool.MarkNeedsRefresh(acc)
+}
+
+// browserRefreshError 浏览器刷新失败原因（结果未带错误时给出通用描述）
+func browserRefreshError(result *register.BrowserRefreshResult) error {
+	if result.Error != nil {
+		return result.Error
 	}
-	pageItems, total := paginatePoolFileViews(items, page, pageSize)
+	return errors.New("浏览器刷新失败")
+}
 
-	c.JSON(200, gin.H{
-		"items":      pageItems,
-		"total":      total,
-		"page":       page,
-		"page_size":  pageSize,
-		"state":      state,
-		"status":     c.Query("status"),
-		"q":          q,
-		"total_page": (total + pageSize - 1) / pageSize,
-	})
+// stickyProxyEnabled 是否启用账号粘性代理
+func stickyProxyEnabled() bool {
+	configMu.RLock()
+	defer configMu.RUnlock()
+	return appConfig.ProxyPool.Sticky
 }
 
-func handleAdminPoolFilesExport(c *gin.Context) {
-	state := normalizeStateFilter(c.Query("state"))
-	statusFilter := parseStatusFilter(c.Query("status"))
-	q := strings.TrimSpace(c.Query("q"))
+// nextAccountProxy 启用粘性代理时优先使用账号上次成功的节点（不健康时回退到新代理）
+func nextAccountProxy(proxyKey string) string {
+	if stickyProxyEnabled() {
+		return proxy.Manager.NextPreferred(proxyKey)
+	}
+	return proxy.Manager.Next()
+}
 
-	records, err := collectPoolFileRecords(DataDir)
-	if err != nil {
-		c.JSON(500, gin.H{"error": fmt.Sprintf("读取号池文件失败: %v", err)})
-		return
+// browserRefreshProxy 为浏览器刷新分配代理（优先使用代理池），返回节点标识与释放函数（释放时上报刷新结果）
+func browserRefreshProxy(acc *pool.Account) (string, string, func(success bool)) {
+	if proxy.Manager.HealthyCount() > 0 {
+		acc.Mu.Lock()
+		proxyKey := acc.Data.ProxyKey
+		acc.Mu.Unlock()
+		if proxyURL := nextAccountProxy(proxyKey); proxyURL != "" {
+			return proxyURL, proxy.Manager.NodeKey(proxyURL), func(success bool) {
+				proxy.Manager.ReportResult(proxyURL, success)
+				proxy.Manager.ReleaseByURL(proxyURL)
+			}
+		}
 	}
-	filtered := filterPoolFileRecords(records, state, statusFilter, q)
+	return Proxy, "", func(bool) {}
+}
 
-	buffer := bytes.NewBuffer(nil)
-	zipWriter := zip.NewWriter(buffer)
+// bulkRefreshThreads 批量刷新并发数：请求指定优先，其次配置，最多 maxBulkRefreshThreads
+func bulkRefreshThreads(requested int) int {
+	threads := requested
+	if threads <= 0 {
+		configMu.RLock()
+		threads = appConfig.Pool.BulkRefreshThreads
+		configMu.RUnlock()
+	}
+	if threads <= 0 {
+		threads = defaultBulkRefreshThreads
+	}
+	if threads > maxBulkRefreshThreads {
+		threads = maxBulkRefreshThreads
+	}
+	return threads
+}
 
-	manifestFiles := make([]adminPoolFileView, 0, len(filtered))
-	exportErrors := make([]string, 0)
-	for _, record := range filtered {
-		manifestFiles = append(manifestFiles, record.view)
-		raw, readErr := os.ReadFile(record.filePath)
-		if readErr != nil {
-			exportErrors = append(exportErrors, fmt.Sprintf("%s: %v", record.view.FileName, readErr))
-			continue
+// collectBulkRefreshTargets 未指定邮箱时选取所有待刷新账号，否则按邮箱查找（找不到的直接记为失败）
+func collectBulkRefreshTargets(emails []string) ([]*pool.Account, []bulkRefreshResult) {
+	var targets []*pool.Account
+	var missing []bulkRefreshResult
+	pool.Pool.WithLock(func(ready, pending []*pool.Account) {
+		if len(emails) == 0 {
+			for _, acc := range pending {
+				acc.Mu.Lock()
+				status := acc.Status
+				acc.Mu.Unlock()
+				if status == pool.StatusPending || status == pool.StatusPendingExternal {
+					targets = append(targets, acc)
+				}
+			}
+			return
 		}
-		entry, err := zipWriter.Create(record.view.FileName)
-		if err != nil {
-			exportErrors = append(exportErrors, fmt.Sprintf("%s: %v", record.view.FileName, err))
-			continue
+
+		byEmail := make(map[string]*pool.Account, len(ready)+len(pending))
+		for _, acc := range ready {
+			byEmail[strings.ToLower(acc.Data.Email)] = acc
 		}
-		if _, err := entry.Write(raw); err != nil {
-			exportErrors = append(exportErrors, fmt.Sprintf("%s: %v", record.view.FileName, err))
-			continue
+		for _, acc := range pending {
+			byEmail[strings.ToLower(acc.Data.Email)] = acc
 		}
-	}
+		seen := make(map[string]bool, len(emails))
+		for _, email := range emails {
+			email = strings.TrimSpace(email)
+			key := strings.ToLower(email)
+			if email == "" || seen[key] {
+				continue
+			}
+			seen[key] = true
+			if acc, ok := byEmail[key]; ok {
+				targets = append(targets, acc)
+			} else {
+				missing = append(missing, bulkRefreshResult{Email: email, Error: "账号未找到"})
+			}
+		}
+	})
+	return targets, missing
+}
 
-	manifest := map[string]interface{}{
-		"generated_at":   time.Now().UTC().Format(time.RFC3339),
-		"state":          state,
-		"status":         c.Query("status"),
-		"q":              q,
-		"total":          len(filtered),
-		"exported_count": len(filtered) - len(exportErrors),
-		"errors":         exportErrors,
-		"files":          manifestFiles,
+// runBulkBrowserRefresh 以固定并发刷新账号，每完成一个调用一次 onResult（串行调用）
+func runBulkBrowserRefresh(targets []*pool.Account, threads int, onResult func(bulkRefreshResult)) {
+	jobs := make(chan *pool.Account)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < threads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for acc := range jobs {
+				start := time.Now()
+				email := acc.Data.Email
+				proxyURL, proxyKey, release := browserRefreshProxy(acc)
+				result := browserRefreshFunc(acc, pool.BrowserRefreshHeadless, proxyURL)
+				release(result.Success)
+
+				item := bulkRefreshResult{Email: email, Success: result.Success}
+				if result.Success {
+					applyBrowserRefreshResult(acc, result, proxyKey)
+					logger.Info("✅ 批量浏览器刷新成功: %s", email)
+				} else {
+					refreshErr := browserRefreshError(result)
+					acc.RecordRefresh("browser_manual", refreshErr)
+					item.Error = refreshErr.Error()
+					logger.Error("❌ 批量浏览器刷新失败: %s - %s", email, item.Error)
+				}
+				item.DurationMs = time.Since(start).Milliseconds()
+
+				mu.Lock()
+				onResult(item)
+				mu.Unlock()
+			}
+		}()
 	}
-	manifestRaw, _ := json.MarshalIndent(manifest, "", "  ")
-	manifestEntry, err := zipWriter.Create("manifest.json")
-	if err != nil {
-		c.JSON(500, gin.H{"error": fmt.Sprintf("创建 manifest 失败: %v", err)})
+	for _, acc := range targets {
+		jobs <- acc
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+// writeSSEEvent 写出一条 SSE 事件
+func writeSSEEvent(c *gin.Context, event string, payload interface{}) {
+	data, _ := json.Marshal(payload)
+	fmt.Fprintf(c.Writer, "event: %s\ndata: %s\n\n", event, data)
+	c.Writer.Flush()
+}
+
+// handleBulkBrowserRefresh 批量浏览器刷新待刷新账号（或指定邮箱），stream=1 时以 SSE 推送进度
+// flowTestTokenModel/flowTestTokenPrompt 单 Token 测试使用的轻量图片生成请求
+const (
+	flowTestTokenModel  = "gemini-2.5-flash-image-landscape"
+	flowTestTokenPrompt = "a small red circle on a white background"
+)
+
+// handleFlowTestToken 使用指定 Flow Token 执行一次简单图片生成以验证其可用性
+func handleFlowTestToken(c *gin.Context) {
+	if flowTokenPool == nil || flowHandler == nil {
+		c.JSON(503, gin.H{"error": "Flow 服务未启用"})
 		return
 	}
-	if _, err := manifestEntry.Write(manifestRaw); err != nil {
-		c.JSON(500, gin.H{"error": fmt.Sprintf("写入 manifest 失败: %v", err)})
+	var req struct {
+		TokenID string `json:"token_id"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(400, gin.H{"error": err.Error()})
 		return
 	}
-	if err := zipWriter.Close(); err != nil {
-		c.JSON(500, gin.H{"error": fmt.Sprintf("导出 ZIP 失败: %v", err)})
+	if strings.TrimSpace(req.TokenID) == "" {
+		c.JSON(400, gin.H{"error": "需要提供 token_id"})
 		return
 	}
 
-	filename := fmt.Sprintf("pool-export-%s.zip", time.Now().Format("20060102-150405"))
-	c.Header("Content-Type", "application/zip")
-	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
-	c.Header("X-Export-Count", strconv.Itoa(len(filtered)))
-	c.Header("X-Export-Errors", strconv.Itoa(len(exportErrors)))
-	c.Data(200, "application/zip", buffer.Bytes())
-}
-
-func handleDeleteInvalidPreview(c *gin.Context) {
-	scope := strings.TrimSpace(c.DefaultQuery("scope", "invalid_files_and_invalid_accounts"))
-	if scope == "" {
-		scope = "invalid_files_and_invalid_accounts"
-	}
-
-	records, err := collectPoolFileRecords(DataDir)
+	start := time.Now()
+	result, err := flowHandler.HandleGenerationWithToken(req.TokenID, flow.GenerationRequest{
+		Model:  flowTestTokenModel,
+		Prompt: flowTestTokenPrompt,
+	}, nil)
 	if err != nil {
-		c.JSON(500, gin.H{"error": fmt.Sprintf("读取号池文件失败: %v", err)})
+		c.JSON(404, gin.H{"error": err.Error()})
 		return
 	}
-	candidates := buildDeleteInvalidCandidates(records, scope)
-
-	structureInvalid := 0
-	statusInvalid := 0
-	for _, c := range candidates {
-		if c.Reason == "status_invalid" {
-			statusInvalid++
-		} else {
-			structureInvalid++
-		}
-	}
-
+	log.Printf("🧪 Flow Token 测试 %s: success=%v %s", req.TokenID, result.Success, result.Error)
 	c.JSON(200, gin.H{
-		"scope":      scope,
-		"candidates": candidates,
-		"total":      len(candidates),
-		"summary": gin.H{
-			"structure_invalid": structureInvalid,
-			"status_invalid":    statusInvalid,
-		},
+		"token_id":    req.TokenID,
+		"success":     result.Success,
+		"url":         result.URL,
+		"error":       result.Error,
+		"duration_ms": time.Since(start).Milliseconds(),
 	})
 }
 
-func handleDeleteInvalidExecute(c *gin.Context) {
-	var req adminDeleteExecuteRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
+func handleBulkBrowserRefresh(c *gin.Context) {
+	var req struct {
+		Emails      []string `json:"emails"`
+		Concurrency int      `json:"concurrency"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
 		c.JSON(400, gin.H{"error": err.Error()})
 		return
 	}
-	if len(req.Files) == 0 {
-		c.JSON(400, gin.H{"error": "files 不能为空"})
+	if !atomic.CompareAndSwapInt32(&bulkBrowserRefreshRunning, 0, 1) {
+		c.JSON(409, gin.H{"error": "已有批量浏览器刷新任务在进行中"})
 		return
 	}
-	autoBackup := true
-	if req.AutoBackup != nil {
-		autoBackup = *req.AutoBackup
-	}
+	defer atomic.StoreInt32(&bulkBrowserRefreshRunning, 0)
 
-	records, err := collectPoolFileRecords(DataDir)
-	if err != nil {
-		c.JSON(500, gin.H{"error": fmt.Sprintf("读取号池文件失败: %v", err)})
-		return
+	targets, missing := collectBulkRefreshTargets(req.Emails)
+	threads := bulkRefreshThreads(req.Concurrency)
+	total := len(targets) + len(missing)
+	stream := c.Query("stream") == "1" || c.Query("stream") == "true" ||
+		strings.Contains(c.GetHeader("Accept"), "text/event-stream")
+	logger.Info("🔄 批量浏览器刷新: %d 个账号, 并发 %d (headless=%v)", len(targets), threads, pool.BrowserRefreshHeadless)
+
+	if stream {
+		c.Header("Content-Type", "text/event-stream")
+		c.Header("Cache-Control", "no-cache")
+		c.Header("Connection", "keep-alive")
+		c.Header("X-Accel-Buffering", "no")
+		c.Status(200)
+		writeSSEEvent(c, "start", gin.H{"total": total, "concurrency": threads})
 	}
-	allowed := make(map[string]adminPoolFileRecord)
-	for _, record := range buildDeleteInvalidCandidates(records, "invalid_files_and_invalid_accounts") {
-		allowed[record.FileName] = adminPoolFileRecord{
-			filePath: filepath.Join(DataDir, record.FileName),
+
+	results := make([]bulkRefreshResult, 0, total)
+	var success, failed int
+	record := func(item bulkRefreshResult) {
+		results = append(results, item)
+		if item.Success {
+			success++
+		} else {
+			failed++
+		}
+		if stream {
+			writeSSEEvent(c, "progress", gin.H{
+				"result":  item,
+				"done":    len(results),
+				"total":   total,
+				"success": success,
+				"failed":  failed,
+			})
 		}
 	}
+	for _, item := range missing {
+		record(item)
+	}
+	runBulkBrowserRefresh(targets, threads, record)
 
-	uniqueFiles := make([]string, 0, len(req.Files))
-	seen := make(map[string]struct{})
-	for _, file := range req.Files {
-		name := filepath.Base(strings.TrimSpace(file))
-		if name == "" || name != strings.TrimSpace(file) {
-			continue
-		}
-		if !strings.HasSuffix(strings.ToLower(name), ".json") {
-			continue
-		}
-		if _, ok := allowed[name]; !ok {
-			continue
-		}
-		if _, ok := seen[name]; ok {
-			continue
-		}
-		seen[name] = struct{}{}
-		uniqueFiles = append(uniqueFiles, name)
+	logger.Info("✅ 批量浏览器刷新完成: 成功 %d, 失败 %d", success, failed)
+	summary := gin.H{
+		"total":       total,
+		"success":     success,
+		"failed":      failed,
+		"concurrency": threads,
+		"results":     results,
 	}
-	if len(uniqueFiles) == 0 {
-		c.JSON(400, gin.H{"error": "未提供可删除文件（需来自 preview 结果）"})
+	if stream {
+		writeSSEEvent(c, "done", summary)
 		return
 	}
+	c.JSON(200, summary)
+}
 
-	pathsToDelete := make([]string, 0, len(uniqueFiles))
-	for _, name := range uniqueFiles {
-		pathsToDelete = append(pathsToDelete, filepath.Join(DataDir, name))
+// ==================== 批量健康检查 ====================
+
+// healthProbeFunc 账号健康探测实现（测试中可替换）
+var healthProbeFunc = probeAccountSession
+
+const (
+	defaultHealthCheckThreads = 3
+	maxHealthCheckThreads     = 10
+)
+
+// healthCheckRunning 同一时间只允许一个批量健康检查任务
+var healthCheckRunning int32
+
+// healthCheckResult 单个账号的健康检查结果
+type healthCheckResult struct {
+	Email      string `json:"email"`
+	Status     string `json:"status"` // healthy / invalid / skipped
+	Error      string `json:"error,omitempty"`
+	DurationMs int64  `json:"duration_ms"`
+}
+
+// probeAccountSession 轻量探测：用当前 JWT 创建一次 Session（不重试）
+func probeAccountSession(acc *pool.Account) error {
+	jwt, configID, err := acc.GetJWT()
+	if err != nil {
+		return err
 	}
+	acc.Mu.Lock()
+	auth := acc.Data.Authorization
+	acc.Mu.Unlock()
+	_, err = createSessionOnce(jwt, configID, auth)
+	return err
+}
 
-	backupFile := ""
-	if autoBackup {
-		if created, err := createBackupZip(DataDir, pathsToDelete); err != nil {
-			c.JSON(500, gin.H{"error": fmt.Sprintf("创建备份失败: %v", err)})
-			return
-		} else {
-			backupFile = created
-		}
+// healthCheckThreads 健康检查并发数：请求指定优先，其次配置，最多 maxHealthCheckThreads
+func healthCheckThreads(requested int) int {
+	threads := requested
+	if threads <= 0 {
+		configMu.RLock()
+		threads = appConfig.Pool.HealthCheckThreads
+		configMu.RUnlock()
+	}
+	if threads <= 0 {
+		threads = defaultHealthCheckThreads
 	}
+	if threads > maxHealthCheckThreads {
+		threads = maxHealthCheckThreads
+	}
+	return threads
+}
 
-	deletedFiles := make([]string, 0, len(pathsToDelete))
-	failed := make([]string, 0)
-	for i, path := range pathsToDelete {
-		if err := os.Remove(path); err != nil {
-			failed = append(failed, fmt.Sprintf("%s: %v", uniqueFiles[i], err))
-			continue
+// checkAccountHealth 探测单个账号并更新状态：失败的就绪账号移入刷新池，JWT 缺失或过期的跳过（交给刷新流程）
+func checkAccountHealth(acc *pool.Account) healthCheckResult {
+	start := time.Now()
+	acc.Mu.Lock()
+	email := acc.Data.Email
+	hasJWT := acc.JWT != "" && time.Now().Before(acc.JWTExpires)
+	acc.Mu.Unlock()
+
+	item := healthCheckResult{Email: email}
+	if !hasJWT {
+		item.Status = "skipped"
+		item.Error = "JWT 为空或已过期，等待刷新"
+		item.DurationMs = time.Since(start).Milliseconds()
+		return item
+	}
+
+	err := healthProbeFunc(acc)
+	acc.RecordRefresh("health_check", err)
+	if err == nil {
+		item.Status = "healthy"
+	} else {
+		item.Status = "invalid"
+		item.Error = err.Error()
+		logger.Warn("⚠️ [%s] 健康检查失败: %v", email, err)
+		acc.Mu.Lock()
+		wasReady := acc.Status == pool.StatusReady
+		acc.Mu.Unlock()
+		if wasReady {
+			pool.Pool.MarkNeedsRefreshReason(acc, err.Error())
 		}
-		deletedFiles = append(deletedFiles, uniqueFiles[i])
 	}
+	item.DurationMs = time.Since(start).Milliseconds()
+	return item
+}
 
-	_ = pool.Pool.Load(DataDir)
+// runAccountHealthCheck 按并发数探测全部就绪+待刷新账号，结果按邮箱排序
+func runAccountHealthCheck(threads int) []healthCheckResult {
+	var targets []*pool.Account
+	pool.Pool.WithLock(func(ready, pending []*pool.Account) {
+		targets = make([]*pool.Account, 0, len(ready)+len(pending))
+		targets = append(targets, ready...)
+		targets = append(targets, pending...)
+	})
 
-	resp := gin.H{
-		"deleted_count": len(deletedFiles),
-		"deleted_files": deletedFiles,
-		"failed":        failed,
-		"stats":         pool.Pool.Stats(),
+	jobs := make(chan *pool.Account)
+	results := make([]healthCheckResult, 0, len(targets))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < threads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for acc := range jobs {
+				item := checkAccountHealth(acc)
+				mu.Lock()
+				results = append(results, item)
+				mu.Unlock()
+			}
+		}()
 	}
-	if backupFile != "" {
-		resp["backup_file"] = backupFile
+	for _, acc := range targets {
+		jobs <- acc
 	}
-	c.JSON(200, resp)
+	close(jobs)
+	wg.Wait()
+
+	sort.Slice(results, func(i, j int) bool {
+		return strings.ToLower(results[i].Email) < strings.ToLower(results[j].Email)
+	})
+	return results
 }
 
-func handleRegistrarTriggerRegister(c *gin.Context) {
+// handleAccountsHealthCheck 批量健康检查：探测全部账号，失败的就绪账号移入刷新池
+func handleAccountsHealthCheck(c *gin.Context) {
 	var req struct {
-		Count int `json:"count"`
+		Concurrency int `json:"concurrency"`
 	}
-	if err := c.ShouldBindJSON(&req); err != nil {
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
 		c.JSON(400, gin.H{"error": err.Error()})
 		return
 	}
-	if req.Count < 1 {
-		req.Count = 1
+	if !atomic.CompareAndSwapInt32(&healthCheckRunning, 0, 1) {
+		c.JSON(409, gin.H{"error": "已有健康检查任务在进行中"})
+		return
 	}
-	if req.Count > 20 {
-		req.Count = 20
+	defer atomic.StoreInt32(&healthCheckRunning, 0)
+
+	threads := healthCheckThreads(req.Concurrency)
+	start := time.Now()
+	results := runAccountHealthCheck(threads)
+	var healthy, invalid, skipped int
+	for _, item := range results {
+		switch item.Status {
+		case "healthy":
+			healthy++
+		case "invalid":
+			invalid++
+		default:
+			skipped++
+		}
 	}
+	logger.Info("🩺 账号健康检查完成: 检查 %d, 健康 %d, 失效 %d, 跳过 %d (并发 %d, 耗时 %v)",
+		len(results), healthy, invalid, skipped, threads, time.Since(start).Round(time.Millisecond))
+	c.JSON(200, gin.H{
+		"checked":     len(results),
+		"healthy":     healthy,
+		"invalid":     invalid,
+		"skipped":     skipped,
+		"concurrency": threads,
+		"duration_ms": time.Since(start).Milliseconds(),
+		"details":     results,
+	})
+}
 
-	baseURL := strings.TrimRight(getRegistrarBaseURL(), "/")
-	targetURL := fmt.Sprintf("%s/trigger/register?count=%d", baseURL, req.Count)
+// flowStats Flow 子系统统计：Token 池状态（含每个 Token 的用量与成功率）与生成计数，未启用时仅返回 enabled=false
+func flowStats() map[string]interface{} {
+	tokenPool, handler := flowTokenPool, flowHandler
+	if tokenPool == nil {
+		return map[string]interface{}{"enabled": false}
+	}
+	stats := tokenPool.Stats()
+	stats["enabled"] = handler != nil
+	if handler != nil {
+		stats["generation"] = handler.Stats()
+	}
+	return stats
+}
 
-	httpReq, err := http.NewRequest(http.MethodPost, targetURL, nil)
-	if err != nil {
-		c.JSON(500, gin.H{"error": fmt.Sprintf("构建 registrar 请求失败: %v", err)})
+// ==================== 代理池管理 ====================
+
+// handleProxyNodes 列出代理节点（地址脱敏）
+func handleProxyNodes(c *gin.Context) {
+	nodes := proxy.Manager.Nodes()
+	healthy, blacklisted, deprioritized := 0, 0, 0
+	for _, n := range nodes {
+		if n.Healthy {
+			healthy++
+		}
+		if n.Blacklisted {
+			blacklisted++
+		}
+		if n.Deprioritized {
+			deprioritized++
+		}
+	}
+	response := gin.H{
+		"items":           nodes,
+		"total":           len(nodes),
+		"healthy":         healthy,
+		"blacklisted":     blacklisted,
+		"deprioritized":   deprioritized,
+		"active":          proxy.Manager.HealthyCount(),
+		"health_checking": proxy.Manager.IsHealthChecking(),
+		"instances":       proxy.Manager.PoolStats(),
+	}
+	if last := proxy.Manager.LastUpdate(); !last.IsZero() {
+		response["last_update"] = last
+	}
+	c.JSON(200, response)
+}
+
+// handleProxyReload 重新加载代理订阅和文件，随后在后台做健康检查
+func handleProxyReload(c *gin.Context) {
+	subscribes, files := proxy.Manager.Sources()
+	if len(subscribes) == 0 && len(files) == 0 {
+		c.JSON(400, gin.H{"error": "未配置代理订阅或代理文件"})
 		return
 	}
-	httpClient := &http.Client{Timeout: 30 * time.Second}
-	resp, err := httpClient.Do(httpReq)
-	if err != nil {
-		c.JSON(502, gin.H{
-			"error":         fmt.Sprintf("调用 registrar 失败: %v", err),
-			"registrar_url": targetURL,
-			"source":        "python_registrar",
-		})
+	if err := proxy.Manager.LoadAll(); err != nil {
+		c.JSON(500, gin.H{"error": fmt.Sprintf("加载代理失败: %v", err)})
 		return
 	}
-	defer resp.Body.Close()
+	total := proxy.Manager.TotalCount()
+	logger.Info("🔄 [%s] 手动重新加载代理池: %d 个节点", adminActor(c), total)
+	go proxy.Manager.CheckAllHealth()
+	c.JSON(200, gin.H{
+		"total":        total,
+		"subscribes":   len(subscribes),
+		"files":        len(files),
+		"health_check": "started",
+	})
+}
 
-	body, _ := io.ReadAll(resp.Body)
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		c.JSON(resp.StatusCode, gin.H{
-			"error":            "registrar 返回错误",
-			"registrar_url":    targetURL,
-			"registrar_status": resp.StatusCode,
-			"registrar_body":   string(body),
-			"source":           "python_registrar",
+// handleProxyCheckHealth 触发代理健康检查，默认后台执行，wait=1 时等待完成后返回结果
+func handleProxyCheckHealth(c *gin.Context) {
+	if proxy.Manager.IsHealthChecking() {
+		c.JSON(409, gin.H{"error": "健康检查正在进行中"})
+		return
+	}
+	logger.Info("🩺 [%s] 手动触发代理健康检查", adminActor(c))
+	if wait := c.Query("wait"); wait == "1" || wait == "true" {
+		start := time.Now()
+		proxy.Manager.CheckAllHealth()
+		c.JSON(200, gin.H{
+			"status":      "done",
+			"total":       proxy.Manager.TotalCount(),
+			"healthy":     proxy.Manager.HealthyCount(),
+			"duration_ms": time.Since(start).Milliseconds(),
 		})
 		return
 	}
+	go proxy.Manager.CheckAllHealth()
+	c.JSON(202, gin.H{"status": "started", "total": proxy.Manager.TotalCount()})
+}
 
-	var passthrough interface{}
-	if len(body) > 0 {
-		_ = json.Unmarshal(body, &passthrough)
+// requestIDHeader 请求 ID：客户端可传入，缺省时生成，并在响应头中回显
+const (
+	requestIDHeader = "X-Request-ID"
+	requestIDKey    = "request_id"
+	maxRequestIDLen = 128
+)
+
+// validRequestID 只接受长度有限的可打印标识（字母、数字与 -_.:），避免日志注入
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for _, r := range id {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_.:", r)) {
+			return false
+		}
 	}
+	return true
+}
 
-	response := gin.H{
-		"accepted":      true,
-		"count":         req.Count,
-		"source":        "python_registrar",
-		"registrar_url": targetURL,
+// requestIDMiddleware 读取或生成请求 ID，存入 gin 上下文并写入响应头
+func requestIDMiddleware(c *gin.Context) {
+	id := strings.TrimSpace(c.GetHeader(requestIDHeader))
+	if !validRequestID(id) {
+		id = uuid.New().String()
 	}
-	if passthrough != nil {
-		response["registrar_response"] = passthrough
+	c.Set(requestIDKey, id)
+	c.Header(requestIDHeader, id)
+	c.Next()
+}
+
+// requestID 当前请求的 ID；未经过中间件时现场生成
+func requestID(c *gin.Context) string {
+	if id := c.GetString(requestIDKey); id != "" {
+		return id
 	}
-	c.JSON(200, response)
+	id := uuid.New().String()
+	c.Set(requestIDKey, id)
+	return id
+}
+
+// requestLogger 以请求 ID 为前缀的日志器，同一请求的日志可按 ID 检索
+func requestLogger(c *gin.Context) *logger.Logger {
+	return logger.WithPrefix(requestID(c))
 }
 
 func setupAPIRoutes(r *gin.Engine) {
@@ -4862,6 +11134,8 @@ func setupAPIRoutes(r *gin.Engine) {
 		panic(err)
 	}
 
+	r.Use(requestIDMiddleware)
+
 	// 请求日志中间件
 	r.Use(func(c *gin.Context) {
 		start := time.Now()
@@ -4874,10 +11148,11 @@ func setupAPIRoutes(r *gin.Engine) {
 		latency := time.Since(start)
 		statusCode := c.Writer.Status()
 
+		reqLog := requestLogger(c)
 		if statusCode >= 400 {
-			logger.Error("❌ %s %s %s %d %v", clientIP, method, path, statusCode, latency)
+			reqLog.Error("❌ %s %s %s %d %v", clientIP, method, path, statusCode, latency)
 		} else {
-			logger.Info("✅ %s %s %s %d %v", clientIP, method, path, statusCode, latency)
+			reqLog.Info("✅ %s %s %s %d %v", clientIP, method, path, statusCode, latency)
 		}
 	})
 
@@ -4926,14 +11201,20 @@ func setupAPIRoutes(r *gin.Engine) {
 
 	r.GET("/health", func(c *gin.Context) {
 		c.JSON(200, gin.H{
-			"status":  "ok",
-			"time":    time.Now().UTC().Format(time.RFC3339),
-			"ready":   pool.Pool.ReadyCount(),
-			"pending": pool.Pool.PendingCount(),
-			"mode":    map[PoolMode]string{PoolModeLocal: "local", PoolModeServer: "server", PoolModeClient: "client"}[poolMode],
+			"status":          "ok",
+			"time":            time.Now().UTC().Format(time.RFC3339),
+			"ready":           pool.Pool.ReadyCount(),
+			"pending":         pool.Pool.PendingCount(),
+			"mode":            map[PoolMode]string{PoolModeLocal: "local", PoolModeServer: "server", PoolModeClient: "client"}[poolMode],
+			"circuit_breaker": circuitBreaker.State(),
 		})
 	})
 
+	r.GET("/readyz", handleReadyz)
+
+	// 生成图片下载（随机 ID 且限时有效，不鉴权以便客户端直接展示）
+	r.GET("/v1/images/files/:id", handleGeneratedImageFile)
+
 	// 管理面板静态资源（页面本身不鉴权，具体管理接口仍由 API Key 保护）
 	r.GET("/admin/panel", handleAdminPanel)
 	r.GET("/admin/panel/assets/*filepath", handleAdminPanelAsset)
@@ -4973,7 +11254,7 @@ func setupAPIRoutes(r *gin.Engine) {
 	})
 
 	apiGroup := r.Group("/")
-	apiGroup.Use(apiKeyAuth())
+	apiGroup.Use(apiKeyAuth(), ipRateLimit(), requestBodyLimit())
 
 	// Gemini 风格模型列表 /v1beta/models
 	apiGroup.GET("/v1beta/models", func(c *gin.Context) {
@@ -4985,11 +11266,12 @@ func setupAPIRoutes(r *gin.Engine) {
 				"displayName":                m,
 				"description":                "Gemini model: " + m,
 				"inputTokenLimit":            1048576,
-				"outputTokenLimit":           8192,
+				"outputTokenLimit":           listedOutputTokenLimit(m),
 				"supportedGenerationMethods": []string{"generateContent", "countTokens"},
 				"temperature":                1.0,
 				"topP":                       0.95,
 				"topK":                       64,
+				"capabilities":               geminiCapabilities(m),
 			})
 		}
 		c.JSON(200, gin.H{"models": models})
@@ -5001,11 +11283,12 @@ func setupAPIRoutes(r *gin.Engine) {
 		var models []gin.H
 		for _, m := range GetAvailableModels() {
 			models = append(models, gin.H{
-				"id":         m,
-				"object":     "model",
-				"created":    now,
-				"owned_by":   "google",
-				"permission": []interface{}{},
+				"id":           m,
+				"object":       "model",
+				"created":      now,
+				"owned_by":     "google",
+				"permission":   []interface{}{},
+				"capabilities": modelCapabilities(m),
 			})
 		}
 		c.JSON(200, gin.H{"object": "list", "data": models})
@@ -5014,16 +11297,18 @@ func setupAPIRoutes(r *gin.Engine) {
 	apiGroup.POST("/v1/chat/completions", func(c *gin.Context) {
 		var req ChatRequest
 		if err := c.ShouldBindJSON(&req); err != nil {
-			c.JSON(400, gin.H{"error": err.Error()})
+			respondAPIError(c, 400, "invalid_request_error", err.Error(), "")
 			return
 		}
 		if req.Model == "" {
-			req.Model = GetAvailableModels()[0]
+			req.Model = defaultModelFor(apiPathOpenAI)
 		}
 		streamChat(c, req)
 	})
 
 	apiGroup.POST("/v1/messages", handleClaudeMessages)
+	apiGroup.GET("/v1/ping", handlePing)
+	apiGroup.POST("/v1/images/generations", handleImagesGenerations)
 
 	// Gemini 单模型详情 GET /v1beta/models/{model}
 	apiGroup.GET("/v1beta/models/:model", func(c *gin.Context) {
@@ -5040,11 +11325,7 @@ func setupAPIRoutes(r *gin.Engine) {
 			}
 		}
 		if !found {
-			c.JSON(404, gin.H{"error": gin.H{
-				"code":    404,
-				"message": "Model not found: " + modelName,
-				"status":  "NOT_FOUND",
-			}})
+			respondAPIError(c, 404, "invalid_request_error", "Model not found: "+modelName, "model_not_found")
 			return
 		}
 
@@ -5054,11 +11335,12 @@ func setupAPIRoutes(r *gin.Engine) {
 			"displayName":                modelName,
 			"description":                "Gemini model: " + modelName,
 			"inputTokenLimit":            1048576,
-			"outputTokenLimit":           8192,
+			"outputTokenLimit":           listedOutputTokenLimit(modelName),
 			"supportedGenerationMethods": []string{"generateContent", "countTokens"},
 			"temperature":                1.0,
 			"topP":                       0.95,
 			"topK":                       64,
+			"capabilities":               geminiCapabilities(modelName),
 		})
 	})
 
@@ -5200,6 +11482,11 @@ func setupAPIRoutes(r *gin.Engine) {
 	})
 
 	admin.GET("/accounts", handleAdminAccounts)
+	admin.GET("/accounts/stats", handleAdminAccountsStats)
+	admin.POST("/accounts/health-check", handleAccountsHealthCheck)
+	admin.GET("/accounts/:email", handleAdminAccountDetail)
+	admin.PATCH("/accounts/:email", handleAdminAccountPatch)
+	admin.GET("/pool/history", handleAdminPoolHistory)
 	admin.GET("/pool-files", handleAdminPoolFiles)
 	admin.GET("/pool-files/export", handleAdminPoolFilesExport)
 	admin.POST("/pool-files/import", handlePoolFilesImport)
@@ -5207,6 +11494,9 @@ func setupAPIRoutes(r *gin.Engine) {
 	admin.POST("/pool-files/delete-invalid/execute", handleDeleteInvalidExecute)
 	admin.POST("/registrar/trigger-register", handleRegistrarTriggerRegister)
 	admin.GET("/logs/stream", handleLogsStream)
+	admin.GET("/events/stream", handleEventsStream)
+	admin.GET("/logs/search", handleLogsSearch)
+	admin.GET("/logs/ws", handleLogsWS)
 
 	admin.GET("/status", func(c *gin.Context) {
 		stats := pool.Pool.Stats()
@@ -5215,6 +11505,9 @@ func setupAPIRoutes(r *gin.Engine) {
 		stats["is_registering"] = atomic.LoadInt32(&register.IsRegistering) == 1
 		stats["register_stats"] = register.Stats.Get()
 		stats["mode"] = map[PoolMode]string{PoolModeLocal: "local", PoolModeServer: "server", PoolModeClient: "client"}[poolMode]
+		stats["generation"] = generationLimiter.Snapshot()
+		stats["circuit_breaker"] = circuitBreaker.Snapshot()
+		stats["rate_limit"] = ipRateLimiter.Snapshot()
 		c.JSON(200, stats)
 	})
 
@@ -5223,8 +11516,15 @@ func setupAPIRoutes(r *gin.Engine) {
 		detailed := apiStats.GetDetailedStats()
 		detailed["pool"] = pool.Pool.Stats()
 		detailed["proxy_pool"] = proxy.Manager.PoolStats()
+		detailed["flow"] = flowStats()
 		c.JSON(200, detailed)
 	})
+	admin.GET("/proxy/nodes", handleProxyNodes)
+	admin.POST("/proxy/reload", handleProxyReload)
+	admin.POST("/proxy/check-health", handleProxyCheckHealth)
+	admin.GET("/stats/export", handleAdminStatsExport)
+	admin.POST("/stats/reset", handleAdminStatsReset)
+	admin.POST("/ip/reset", handleAdminIPReset)
 	admin.GET("/ip", func(c *gin.Context) {
 		c.JSON(200, ipStats.GetAllIPStats())
 	})
@@ -5254,12 +11554,59 @@ func setupAPIRoutes(r *gin.Engine) {
 				"browser_refresh_headless":  appConfig.Pool.BrowserRefreshHeadless,
 				"browser_refresh_max_retry": appConfig.Pool.BrowserRefreshMaxRetry,
 				"auto_delete_401":           appConfig.Pool.AutoDelete401,
+				"auto_delete_min_failures":  appConfig.Pool.AutoDeleteMinFailures,
+				"auto_delete_grace_minutes": appConfig.Pool.AutoDeleteGraceMinutes,
 				"registrar_base_url":        appConfig.Pool.RegistrarBaseURL,
 			},
 		})
 		configMu.RUnlock()
 	})
 
+	admin.GET("/config", handleEffectiveConfig)
+	admin.POST("/config/validate", handleConfigValidate)
+	admin.GET("/config/history", func(c *gin.Context) {
+		items := configHistoryView()
+		c.JSON(200, gin.H{"items": items, "count": len(items), "limit": configHistoryLimit})
+	})
+	admin.POST("/config/rollback", func(c *gin.Context) {
+		snapshot, err := rollbackConfig()
+		if err != nil {
+			c.JSON(409, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"message": "配置已回滚", "restored": snapshot})
+	})
+	admin.GET("/config/backups", func(c *gin.Context) {
+		backups, err := listConfigBackups()
+		if err != nil {
+			c.JSON(500, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"items": backups, "count": len(backups), "limit": configBackupLimit(), "dir": configBackupDir()})
+	})
+	admin.POST("/config/restore", func(c *gin.Context) {
+		var req struct {
+			Name string `json:"name"`
+		}
+		if err := c.ShouldBindJSON(&req); err != nil || strings.TrimSpace(req.Name) == "" {
+			c.JSON(400, gin.H{"error": "需要提供备份文件名 name"})
+			return
+		}
+		name := strings.TrimSpace(req.Name)
+		if _, _, ok := parseConfigBackupName(name); !ok {
+			c.JSON(400, gin.H{"error": "无效的备份文件名"})
+			return
+		}
+		if _, err := os.Stat(filepath.Join(configBackupDir(), name)); err != nil {
+			c.JSON(404, gin.H{"error": "备份不存在"})
+			return
+		}
+		if err := restoreConfigBackup(name); err != nil {
+			c.JSON(422, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(200, gin.H{"message": "配置已从备份恢复", "restored": name})
+	})
 	admin.POST("/config/cooldown", func(c *gin.Context) {
 		var req struct {
 			RefreshCooldownSec int `json:"refresh_cooldown_sec"`
@@ -5315,34 +11662,14 @@ func setupAPIRoutes(r *gin.Engine) {
 
 		go func() {
 			logger.Info("🔄 手动触发浏览器刷新: %s", req.Email)
-			result := register.RefreshCookieWithBrowser(targetAcc, pool.BrowserRefreshHeadless, Proxy)
+			proxyURL, proxyKey, release := browserRefreshProxy(targetAcc)
+			result := browserRefreshFunc(targetAcc, pool.BrowserRefreshHeadless, proxyURL)
+			release(result.Success)
 			if result.Success {
-				targetAcc.Mu.Lock()
-				// 更新完整信息
-				targetAcc.Data.Cookies = result.SecureCookies
-				if result.Authorization != "" {
-					targetAcc.Data.Authorization = result.Authorization
-				}
-				if result.CSESIDX != "" {
-					targetAcc.CSESIDX = result.CSESIDX
-					targetAcc.Data.CSESIDX = result.CSESIDX
-				}
-				if result.ConfigID != "" {
-					targetAcc.ConfigID = result.ConfigID
-					targetAcc.Data.ConfigID = result.ConfigID
-				}
-				targetAcc.Data.Timestamp = time.Now().Format(time.RFC3339)
-				targetAcc.FailCount = 0
-				targetAcc.Mu.Unlock()
-
-				if err := targetAcc.SaveToFile(); err != nil {
-					logger.Error("❌ [%s] 保存刷新后的数据失败: %v", req.Email, err)
-				} else {
-					logger.Info("✅ [%s] 刷新数据已保存到文件", req.Email)
-				}
-				pool.Pool.MarkNeedsRefresh(targetAcc)
+				applyBrowserRefreshResult(targetAcc, result, proxyKey)
 				logger.Info("✅ 手动浏览器刷新成功: %s", req.Email)
 			} else {
+				targetAcc.RecordRefresh("browser_manual", browserRefreshError(result))
 				logger.Error("❌ 手动浏览器刷新失败: %s - %v", req.Email, result.Error)
 			}
 		}()
@@ -5353,6 +11680,8 @@ func setupAPIRoutes(r *gin.Engine) {
 		})
 	})
 
+	admin.POST("/browser-refresh/bulk", handleBulkBrowserRefresh)
+
 	// Flow Token 管理
 	admin.GET("/flow/status", func(c *gin.Context) {
 		if flowTokenPool == nil {
@@ -5417,6 +11746,8 @@ func setupAPIRoutes(r *gin.Engine) {
 		})
 	})
 
+	admin.POST("/flow/test-token", handleFlowTestToken)
+
 	admin.POST("/flow/reload", func(c *gin.Context) {
 		if flowTokenPool == nil {
 			c.JSON(503, gin.H{"error": "Flow 服务未启用"})
@@ -0,0 +1,1059 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+
+	"business2api/src/audit"
+	"business2api/src/flow"
+	"business2api/src/logger"
+	"business2api/src/utils"
+)
+
+func TestResolveImageAspectRatio(t *testing.T) {
+	cases := []struct {
+		aspectRatio string
+		size        string
+		want        string
+		wantErr     bool
+	}{
+		{"", "", "", false},
+		{"auto", "", "", false},
+		{"16:9", "1024x1024", "16:9", false},
+		{"", "1024x1024", "1:1", false},
+		{"", "1792x1024", "16:9", false},
+		{"", "1024x1792", "9:16", false},
+		{"", "1024x768", "4:3", false},
+		{"", "portrait", "9:16", false},
+		{"21:9", "", "", true},
+		{"", "1536x1024", "", true},
+		{"", "huge", "", true},
+	}
+	for _, tc := range cases {
+		got, err := resolveImageAspectRatio(tc.aspectRatio, tc.size)
+		if (err != nil) != tc.wantErr {
+			t.Fatalf("aspect=%q size=%q: unexpected err %v", tc.aspectRatio, tc.size, err)
+		}
+		if got != tc.want {
+			t.Fatalf("aspect=%q size=%q: got %q want %q", tc.aspectRatio, tc.size, got, tc.want)
+		}
+	}
+}
+
+func TestApplyImageAspectRatioOnlyForImageSpec(t *testing.T) {
+	imageSpec := buildToolsSpec(nil, true, false, false)
+	if !applyImageAspectRatio(imageSpec, "16:9") {
+		t.Fatalf("expected aspect ratio to be applied to image spec")
+	}
+	if got := imageSpec["imageGenerationSpec"].(map[string]interface{})["aspectRatio"]; got != "16:9" {
+		t.Fatalf("unexpected aspectRatio %v", got)
+	}
+
+	searchSpec := buildToolsSpec(nil, false, false, true)
+	if applyImageAspectRatio(searchSpec, "16:9") {
+		t.Fatalf("aspect ratio should be ignored without image generation")
+	}
+}
+
+func TestParseImageGenerationBody(t *testing.T) {
+	body := []byte("   " + `{"choices":[{"message":{"content":"done ![image](data:image/png;base64,aGVsbG8=) and ![Generated Image](https://example.com/a.png)"}}]}`)
+	images, err := parseImageGenerationBody(body)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(images) != 2 || images[0] != "data:image/png;base64,aGVsbG8=" || images[1] != "https://example.com/a.png" {
+		t.Fatalf("unexpected images: %v", images)
+	}
+
+	if _, err := parseImageGenerationBody([]byte(`{"error":{"message":"没有可用账号"}}`)); err == nil || err.Error() != "没有可用账号" {
+		t.Fatalf("expected object error message, got %v", err)
+	}
+	if _, err := parseImageGenerationBody([]byte(`{"error":"boom"}`)); err == nil || err.Error() != "boom" {
+		t.Fatalf("expected string error message, got %v", err)
+	}
+	if _, err := parseImageGenerationBody([]byte(`{"choices":[{"message":{"content":"only text"}}]}`)); err == nil {
+		t.Fatalf("expected error when no image returned")
+	}
+}
+
+func TestBuildImageDataItemServesStoredImage(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/v1/images/files/:id", handleGeneratedImageFile)
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodPost, "http://api.local/v1/images/generations", nil)
+
+	item, err := buildImageDataItem(c, "data:image/png;base64,aGVsbG8=", "b64_json")
+	if err != nil || item["b64_json"] != "aGVsbG8=" {
+		t.Fatalf("unexpected b64 item: %v err=%v", item, err)
+	}
+
+	item, err = buildImageDataItem(c, "data:image/png;base64,aGVsbG8=", "url")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	url, _ := item["url"].(string)
+	if !strings.HasPrefix(url, "http://api.local/v1/images/files/") {
+		t.Fatalf("unexpected url: %q", url)
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, strings.TrimPrefix(url, "http://api.local"), nil))
+	if w.Code != http.StatusOK || w.Body.String() != "hello" || w.Header().Get("Content-Type") != "image/png" {
+		t.Fatalf("unexpected served image: code=%d type=%q body=%q", w.Code, w.Header().Get("Content-Type"), w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/v1/images/files/missing", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for unknown image, got %d", w.Code)
+	}
+}
+
+func TestHandleImagesGenerationsValidation(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/v1/images/generations", handleImagesGenerations)
+
+	cases := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{"empty prompt", `{"prompt":"  "}`, 400},
+		{"text model", `{"prompt":"cat","model":"gemini-2.5-flash"}`, 400},
+		{"bad format", `{"prompt":"cat","response_format":"png"}`, 400},
+		{"bad size", `{"prompt":"cat","size":"huge"}`, 400},
+		{"flow disabled", `{"prompt":"cat","model":"imagen-4.0-generate-preview-landscape","n":2}`, 503},
+	}
+	for _, tc := range cases {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/v1/images/generations", strings.NewReader(tc.body))
+		req.Header.Set("Content-Type", "application/json")
+		r.ServeHTTP(w, req)
+		if w.Code != tc.status {
+			t.Fatalf("%s: expected %d, got %d body=%s", tc.name, tc.status, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestSSEHeartbeatWritesCommentsUntilStopped(t *testing.T) {
+	w := httptest.NewRecorder()
+	hb := startSSEHeartbeat(w, 10*time.Millisecond)
+	time.Sleep(55 * time.Millisecond)
+	hb.Stop()
+	hb.Stop()
+
+	body := w.Body.String()
+	if !strings.HasPrefix(body, sseKeepAliveComment) || strings.Count(body, sseKeepAliveComment) < 2 {
+		t.Fatalf("expected repeated keep-alive comments, got %q", body)
+	}
+	stoppedLen := w.Body.Len()
+	time.Sleep(30 * time.Millisecond)
+	if w.Body.Len() != stoppedLen {
+		t.Fatalf("heartbeat should not write after Stop")
+	}
+
+	disabled := startSSEHeartbeat(w, 0)
+	if disabled != nil {
+		t.Fatalf("zero interval should disable heartbeat")
+	}
+	disabled.Stop()
+}
+
+func TestHeartbeatIntervalConfig(t *testing.T) {
+	old := appConfig.Pool.HeartbeatIntervalSec
+	defer func() { appConfig.Pool.HeartbeatIntervalSec = old }()
+
+	for _, tc := range []struct {
+		sec  int
+		want time.Duration
+	}{
+		{0, 15 * time.Second},
+		{5, 5 * time.Second},
+		{-1, 0},
+	} {
+		appConfig.Pool.HeartbeatIntervalSec = tc.sec
+		if got := heartbeatInterval(); got != tc.want {
+			t.Fatalf("sec=%d: expected %v, got %v", tc.sec, tc.want, got)
+		}
+	}
+}
+
+func TestMediaSizeLimit(t *testing.T) {
+	old := appConfig.Pool.MaxMediaBytes
+	defer func() { appConfig.Pool.MaxMediaBytes = old }()
+	appConfig.Pool.MaxMediaBytes = 16
+
+	small := parseMediaURL("data:image/png;base64,"+strings.Repeat("A", 16), "image")
+	if small == nil || small.Err != nil {
+		t.Fatalf("small data URI should be accepted, got %+v", small)
+	}
+	big := parseMediaURL("data:video/mp4;base64,"+strings.Repeat("A", 40), "image")
+	if big == nil || !errors.Is(big.Err, errMediaTooLarge) || big.MediaType != "video" {
+		t.Fatalf("oversized data URI should be rejected, got %+v", big)
+	}
+	if err := mediaError([]MediaInfo{*small, *big}); !errors.Is(err, errMediaTooLarge) {
+		t.Fatalf("expected media error, got %v", err)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		if r.URL.Path == "/chunked" {
+			// 不设置 Content-Length，验证读取上限
+			w.(http.Flusher).Flush()
+		}
+		fmt.Fprint(w, strings.Repeat("x", 32))
+	}))
+	defer srv.Close()
+	oldClient := utils.HTTPClient
+	defer func() { utils.HTTPClient = oldClient }()
+	utils.HTTPClient = srv.Client()
+
+	for _, path := range []string{"/sized", "/chunked"} {
+		if _, _, err := downloadMedia(srv.URL+path, "image", nil); !errors.Is(err, errMediaTooLarge) {
+			t.Fatalf("%s: expected media too large, got %v", path, err)
+		}
+	}
+	appConfig.Pool.MaxMediaBytes = -1
+	if _, _, err := downloadMedia(srv.URL+"/sized", "image", nil); err != nil {
+		t.Fatalf("negative limit should disable the check: %v", err)
+	}
+}
+
+func TestParseMediaURLSniffsActualImageType(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 2, 2))
+	var pngBuf, gifBuf bytes.Buffer
+	if err := png.Encode(&pngBuf, img); err != nil {
+		t.Fatalf("encode png: %v", err)
+	}
+	if err := gif.Encode(&gifBuf, img, nil); err != nil {
+		t.Fatalf("encode gif: %v", err)
+	}
+
+	// PNG 数据被声明为 JPEG：按实际类型上传，不做转换
+	media := parseMediaURL("data:image/jpeg;base64,"+base64.StdEncoding.EncodeToString(pngBuf.Bytes()), "image")
+	if media.MimeType != "image/png" || media.Data != base64.StdEncoding.EncodeToString(pngBuf.Bytes()) {
+		t.Fatalf("mislabeled PNG should keep data with detected type, got %s", media.MimeType)
+	}
+
+	// GIF 数据被声明为 PNG：检测后转换为 PNG
+	media = parseMediaURL("data:image/png;base64,"+base64.StdEncoding.EncodeToString(gifBuf.Bytes()), "image")
+	decoded, err := base64.StdEncoding.DecodeString(media.Data)
+	if err != nil || media.MimeType != "image/png" || sniffImageMime(decoded) != "image/png" {
+		t.Fatalf("mislabeled GIF should be converted to PNG, got %s err=%v", media.MimeType, err)
+	}
+
+	if got := sniffImageMime([]byte("not an image")); got != "" {
+		t.Fatalf("unknown data should not be detected as image, got %q", got)
+	}
+}
+
+func TestSniffHEIFImages(t *testing.T) {
+	// 最小 AVIF 片段：ftyp box，主品牌 avif，兼容品牌 mif1/miaf
+	avif := []byte("\x00\x00\x00\x1cftypavif\x00\x00\x00\x00avifmif1miaf")
+	// iPhone HEIC：主品牌 mif1，兼容品牌中包含 heic
+	heic := []byte("\x00\x00\x00\x18ftypmif1\x00\x00\x00\x00mif1heic")
+
+	if got := sniffImageMime(avif); got != "image/avif" {
+		t.Fatalf("expected image/avif, got %q", got)
+	}
+	if got := sniffImageMime(heic); got != "image/heic" {
+		t.Fatalf("expected image/heic, got %q", got)
+	}
+	if got := sniffHEIFMime([]byte("\x00\x00\x00\x14ftypmp42\x00\x00\x00\x00mp42")); got != "" {
+		t.Fatalf("mp4 should not be detected as HEIF, got %q", got)
+	}
+
+	// 当前构建未注册 AVIF/HEIC 解码器：任何转换策略下都返回明确的 415，而不是当作 JPEG 或原样上传
+	oldPolicy := appConfig.Pool.ImageConvertPolicy
+	t.Cleanup(func() { appConfig.Pool.ImageConvertPolicy = oldPolicy })
+	for _, policy := range []string{"", imageConvertKeepOriginal} {
+		appConfig.Pool.ImageConvertPolicy = policy
+		for _, data := range [][]byte{avif, heic} {
+			media := parseMediaURL("data:image/jpeg;base64,"+base64.StdEncoding.EncodeToString(data), "image")
+			if media == nil || !errors.Is(media.Err, errUnsupportedImage) {
+				t.Fatalf("policy %q: expected unsupported image error, got %+v", policy, media)
+			}
+			if status, code := mediaErrorCode(media.Err); status != 415 || code != "unsupported_media_type" {
+				t.Fatalf("policy %q: expected 415 unsupported_media_type, got %d %s", policy, status, code)
+			}
+		}
+	}
+}
+
+func TestDownloadMediaForwardsHeadersAndLimitsRedirects(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 1, 1))
+	var pngBuf bytes.Buffer
+	if err := png.Encode(&pngBuf, img); err != nil {
+		t.Fatalf("encode png: %v", err)
+	}
+
+	var cdnAuth string
+	cdn := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cdnAuth = r.Header.Get("X-Api-Key")
+		w.Header().Set("Content-Type", "image/png")
+		w.Write(pngBuf.Bytes())
+	}))
+	defer cdn.Close()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/private":
+			if r.Header.Get("X-Api-Key") != "secret" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(pngBuf.Bytes())
+		case "/to-cdn":
+			http.Redirect(w, r, cdn.URL+"/img.png", http.StatusFound)
+		case "/loop":
+			http.Redirect(w, r, "/loop", http.StatusFound)
+		}
+	}))
+	defer srv.Close()
+	oldClient := utils.HTTPClient
+	defer func() { utils.HTTPClient = oldClient }()
+	utils.HTTPClient = srv.Client()
+
+	headers := map[string]string{"X-Api-Key": "secret"}
+	if _, _, err := downloadMedia(srv.URL+"/private", "image", nil); err == nil {
+		t.Fatalf("download without header should fail")
+	}
+	if _, mimeType, err := downloadMedia(srv.URL+"/private", "image", headers); err != nil || mimeType != "image/png" {
+		t.Fatalf("download with header failed: mime=%s err=%v", mimeType, err)
+	}
+	// 跨主机重定向不转发调用方请求头
+	if _, _, err := downloadMedia(srv.URL+"/to-cdn", "image", headers); err != nil || cdnAuth != "" {
+		t.Fatalf("cross-host redirect should succeed without forwarding headers: err=%v header=%q", err, cdnAuth)
+	}
+	if _, _, err := downloadMedia(srv.URL+"/loop", "image", nil); err == nil || !strings.Contains(err.Error(), "重定向") {
+		t.Fatalf("redirect loop should be capped, got %v", err)
+	}
+
+	content := []interface{}{map[string]interface{}{
+		"type":      "image_url",
+		"image_url": map[string]interface{}{"url": srv.URL + "/private", "headers": map[string]interface{}{"X-Api-Key": "secret"}},
+	}}
+	_, medias := parseMessageContent(Message{Role: "user", Content: content})
+	if len(medias) != 1 || medias[0].Headers["X-Api-Key"] != "secret" {
+		t.Fatalf("image_url headers not parsed: %+v", medias)
+	}
+}
+
+func TestRecordAuditRespectsConfig(t *testing.T) {
+	oldCfg, oldSink := appConfig.Audit, auditSink
+	dir := t.TempDir()
+	auditSink = audit.NewSink(dir)
+	defer func() {
+		auditSink.Close()
+		appConfig.Audit, auditSink = oldCfg, oldSink
+	}()
+
+	req := ChatRequest{Model: "gemini-2.5-flash", Messages: []Message{{Role: "user", Content: "hi"}}}
+	appConfig.Audit = AuditConfig{}
+	recordAudit("chatcmpl-off", "1.2.3.4", req, 200, true, time.Now())
+	if files, _ := os.ReadDir(dir); len(files) != 0 {
+		t.Fatalf("audit disabled should not write files, got %d", len(files))
+	}
+
+	appConfig.Audit = AuditConfig{Enable: true}
+	recordAudit("chatcmpl-on", "1.2.3.4", req, 200, true, time.Now())
+	files, _ := os.ReadDir(dir)
+	if len(files) != 1 {
+		t.Fatalf("expected one audit file, got %d", len(files))
+	}
+	raw, _ := os.ReadFile(filepath.Join(dir, files[0].Name()))
+	if !strings.Contains(string(raw), `"request_id":"chatcmpl-on"`) || !strings.Contains(string(raw), `"upstream_status":200`) {
+		t.Fatalf("unexpected audit content: %s", raw)
+	}
+}
+
+func TestImageConvertPolicy(t *testing.T) {
+	old := appConfig.Pool.ImageConvertPolicy
+	defer func() { appConfig.Pool.ImageConvertPolicy = old }()
+
+	cases := map[string]struct {
+		policy  string
+		quality int
+	}{
+		"":                    {imageConvertToPNG, 0},
+		"bogus":               {imageConvertToPNG, 0},
+		"keep_original":       {imageConvertKeepOriginal, 0},
+		"to_jpeg":             {imageConvertToJPEG, defaultJPEGQuality},
+		"to_jpeg_quality:60":  {imageConvertToJPEG, 60},
+		"to_jpeg_quality:999": {imageConvertToJPEG, defaultJPEGQuality},
+	}
+	for raw, want := range cases {
+		if policy, quality := parseImageConvertPolicy(raw); policy != want.policy || quality != want.quality {
+			t.Fatalf("%q: got %s/%d, want %s/%d", raw, policy, quality, want.policy, want.quality)
+		}
+	}
+
+	frame := image.NewPaletted(image.Rect(0, 0, 2, 2), []color.Color{color.White, color.Black})
+	var still, animated bytes.Buffer
+	if err := gif.Encode(&still, frame, nil); err != nil {
+		t.Fatalf("encode gif: %v", err)
+	}
+	if err := gif.EncodeAll(&animated, &gif.GIF{Image: []*image.Paletted{frame, frame}, Delay: []int{10, 10}}); err != nil {
+		t.Fatalf("encode animated gif: %v", err)
+	}
+
+	appConfig.Pool.ImageConvertPolicy = "to_jpeg_quality:80"
+	if mimeType, out, err := normalizeImageData("image/gif", still.Bytes()); err != nil || mimeType != "image/jpeg" || sniffImageMime(out) != "image/jpeg" {
+		t.Fatalf("to_jpeg should convert still GIF: mime=%s err=%v", mimeType, err)
+	}
+	// 动图保留原始字节，避免只剩第一帧
+	if mimeType, out, err := normalizeImageData("image/gif", animated.Bytes()); err != nil || mimeType != "image/gif" || !bytes.Equal(out, animated.Bytes()) {
+		t.Fatalf("animated GIF should pass through: mime=%s err=%v", mimeType, err)
+	}
+
+	appConfig.Pool.ImageConvertPolicy = "keep_original"
+	if mimeType, out, err := normalizeImageData("image/gif", still.Bytes()); err != nil || mimeType != "image/gif" || !bytes.Equal(out, still.Bytes()) {
+		t.Fatalf("keep_original should not convert: mime=%s err=%v", mimeType, err)
+	}
+}
+
+func TestUploadContextFileRejectsOversizedMedia(t *testing.T) {
+	old := appConfig.Pool.MaxMediaBytes
+	defer func() { appConfig.Pool.MaxMediaBytes = old }()
+	appConfig.Pool.MaxMediaBytes = 16
+
+	// 超限时在发起上游请求前返回
+	_, err := uploadContextFile("jwt", "config", "session", "image/png", strings.Repeat("A", 40), "")
+	if !errors.Is(err, errMediaTooLarge) {
+		t.Fatalf("expected media too large, got %v", err)
+	}
+	if status, body := mediaErrorResponse(err); status != http.StatusRequestEntityTooLarge || body == nil {
+		t.Fatalf("expected 413 media_too_large, got %d", status)
+	}
+}
+
+func TestParseInputAudio(t *testing.T) {
+	wav := base64.StdEncoding.EncodeToString([]byte("RIFF....WAVEfmt "))
+	content := []interface{}{
+		map[string]interface{}{"type": "text", "text": "transcribe"},
+		map[string]interface{}{"type": "input_audio", "input_audio": map[string]interface{}{"data": wav, "format": "wav"}},
+		map[string]interface{}{"type": "image_url", "image_url": map[string]interface{}{"url": "data:audio/mpeg;base64," + wav}},
+	}
+	_, medias := parseMessageContent(Message{Role: "user", Content: content})
+	if len(medias) != 2 {
+		t.Fatalf("expected 2 audio parts, got %d", len(medias))
+	}
+	if medias[0].MediaType != "audio" || medias[0].MimeType != "audio/wav" || medias[0].Data != wav {
+		t.Fatalf("unexpected input_audio media: %+v", medias[0])
+	}
+	if medias[1].MediaType != "audio" || medias[1].MimeType != "audio/mp3" {
+		t.Fatalf("unexpected data URI audio media: %+v", medias[1])
+	}
+
+	for format, want := range map[string]string{"mp3": "audio/mp3", "audio/x-wav": "audio/wav", "opus": "audio/ogg", "audio/x-m4a": "audio/aac"} {
+		if got := normalizeAudioMimeType(format); got != want {
+			t.Fatalf("normalizeAudioMimeType(%q) = %s, want %s", format, got, want)
+		}
+	}
+
+	if err := validateMedia("gemini-2.5-flash", medias); err != nil {
+		t.Fatalf("text model should accept audio: %v", err)
+	}
+	err := validateMedia("gemini-2.5-flash-image", medias)
+	if status, _ := mediaErrorResponse(err); !errors.Is(err, errAudioNotSupported) || status != http.StatusBadRequest {
+		t.Fatalf("image model should reject audio with 400, got %v (%d)", err, status)
+	}
+}
+
+func TestValidateUpstreamConfig(t *testing.T) {
+	cfg := UpstreamConfig{APIBaseURL: " https://mirror.example.com/ ", Origin: ""}
+	if err := validateUpstreamConfig(&cfg); err != nil {
+		t.Fatalf("valid config rejected: %v", err)
+	}
+	if cfg.APIBaseURL != "https://mirror.example.com" || cfg.Origin != defaultUpstreamOrigin {
+		t.Fatalf("unexpected normalized config: %+v", cfg)
+	}
+	for _, bad := range []string{"mirror.example.com", "ftp://mirror.example.com", "https://mirror.example.com/?a=1"} {
+		if err := validateUpstreamConfig(&UpstreamConfig{APIBaseURL: bad}); err == nil {
+			t.Fatalf("%q should be rejected", bad)
+		}
+	}
+
+	old := appConfig.Upstream
+	defer func() { appConfig.Upstream = old }()
+	appConfig.Upstream = cfg
+	if got := upstreamAPIURL("/v1alpha/locations/global/widgetStreamAssist"); got != "https://mirror.example.com/v1alpha/locations/global/widgetStreamAssist" {
+		t.Fatalf("unexpected upstream url: %s", got)
+	}
+	if headers := getCommonHeaders("jwt", ""); headers["origin"] != defaultUpstreamOrigin || headers["referer"] != defaultUpstreamOrigin+"/" {
+		t.Fatalf("unexpected origin headers: %v", headers)
+	}
+}
+
+func TestStreamChatNoAccountsReturns503(t *testing.T) {
+	_, _, restore := newAdminTestRouter(t)
+	defer restore()
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	doStreamChat(c, ChatRequest{
+		Model:    "gemini-2.5-flash",
+		Messages: []Message{{Role: "user", Content: "hi"}},
+	})
+
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %d %s", w.Code, w.Body.String())
+	}
+	body := decodeJSONBody(t, w.Body.String())
+	errBody, _ := body["error"].(map[string]interface{})
+	if errBody["type"] != "no_accounts_available" || errBody["ready"] != float64(0) || errBody["pending"] != float64(0) {
+		t.Fatalf("unexpected error body: %s", w.Body.String())
+	}
+}
+
+func TestRequestDeadline(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	newCtx := func(header string) *gin.Context {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+		if header != "" {
+			c.Request.Header.Set(requestTimeoutHeader, header)
+		}
+		return c
+	}
+
+	cases := []struct {
+		header string
+		body   float64
+		want   time.Duration
+	}{
+		{"", 0, 0},
+		{"", 60, time.Minute},
+		{"1.5", 60, 1500 * time.Millisecond},
+		{"bogus", 30, 30 * time.Second},
+		{"-1", 30, 0},
+	}
+	for _, tc := range cases {
+		if got := requestDeadline(newCtx(tc.header), tc.body); got != tc.want {
+			t.Fatalf("header=%q body=%v: got %v want %v", tc.header, tc.body, got, tc.want)
+		}
+	}
+}
+
+func TestStreamChatDeadlineReturns504(t *testing.T) {
+	_, _, restore := newAdminTestRouter(t)
+	defer restore()
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+	c.Request.Header.Set(requestTimeoutHeader, "0.000000001")
+	doStreamChat(c, ChatRequest{
+		Model:    "gemini-2.5-flash",
+		Messages: []Message{{Role: "user", Content: "hi"}},
+	})
+
+	if w.Code != http.StatusGatewayTimeout || !strings.Contains(w.Body.String(), "request_timeout") {
+		t.Fatalf("expected 504 request_timeout, got %d %s", w.Code, w.Body.String())
+	}
+}
+
+func TestGetCommonHeadersPassthroughPolicy(t *testing.T) {
+	old := appConfig.Upstream
+	defer func() { appConfig.Upstream = old }()
+
+	cases := []struct {
+		policy   string
+		origAuth string
+		want     bool
+	}{
+		{"", "Bearer real", true},
+		{origAuthPassthroughAuto, "Bearer fallback-csesidx-123", false},
+		{origAuthPassthroughAlways, "Bearer fallback-csesidx-123", true},
+		{origAuthPassthroughNever, "Bearer real", false},
+		{origAuthPassthroughAlways, "", false},
+	}
+	for _, tc := range cases {
+		appConfig.Upstream = UpstreamConfig{OrigAuthPassthrough: tc.policy}
+		_, got := getCommonHeaders("jwt", tc.origAuth)["x-original-authorization"]
+		if got != tc.want {
+			t.Fatalf("policy=%q auth=%q: passthrough=%v want %v", tc.policy, tc.origAuth, got, tc.want)
+		}
+	}
+
+	appConfig.Upstream = UpstreamConfig{Referer: "https://example.com/app", UserAgent: "test-agent"}
+	headers := getCommonHeaders("jwt", "")
+	if headers["referer"] != "https://example.com/app" || headers["user-agent"] != "test-agent" || headers["origin"] != defaultUpstreamOrigin {
+		t.Fatalf("header overrides not applied: %v", headers)
+	}
+
+	for _, bad := range []UpstreamConfig{{OrigAuthPassthrough: "sometimes"}, {Referer: "not a url"}} {
+		if err := validateUpstreamConfig(&bad); err == nil {
+			t.Fatalf("%+v should be rejected", bad)
+		}
+	}
+}
+
+func TestAccountTagForModel(t *testing.T) {
+	configMu.Lock()
+	old := appConfig.ModelTags
+	appConfig.ModelTags = map[string]string{
+		"video":                "veo",
+		"image":                " img ",
+		"gemini-2.5-pro-image": "pro-img",
+	}
+	configMu.Unlock()
+	defer func() {
+		configMu.Lock()
+		appConfig.ModelTags = old
+		configMu.Unlock()
+	}()
+
+	cases := map[string]string{
+		"gemini-2.5-flash-video": "veo",
+		"gemini-2.5-flash-image": "img",
+		"gemini-2.5-pro-image":   "pro-img",
+		"gemini-2.5-flash":       "",
+	}
+	for model, want := range cases {
+		if got := accountTagForModel(model); got != want {
+			t.Fatalf("%s: expected tag %q, got %q", model, want, got)
+		}
+	}
+}
+
+func TestWriteFlowStreamEndSendsFinishBeforeDone(t *testing.T) {
+	var buf bytes.Buffer
+	writeFlowStreamEnd(&buf, "chatcmpl-flow", 1, "gemini-2.5-flash-image-landscape", "")
+	events := strings.Split(strings.TrimSpace(buf.String()), "\n\n")
+	if len(events) != 2 || events[1] != "data: [DONE]" {
+		t.Fatalf("expected finish chunk followed by [DONE], got %q", buf.String())
+	}
+	if !strings.Contains(events[0], `"finish_reason":"stop"`) || !strings.Contains(events[0], `"id":"chatcmpl-flow"`) {
+		t.Fatalf("unexpected finish chunk: %s", events[0])
+	}
+
+	buf.Reset()
+	errMsg := flowStreamError(&flow.GenerationResult{Success: false, Error: "quota exhausted"}, nil)
+	writeFlowStreamEnd(&buf, "chatcmpl-flow", 1, "veo", errMsg)
+	events = strings.Split(strings.TrimSpace(buf.String()), "\n\n")
+	if len(events) != 3 || !strings.Contains(events[0], "[错误] quota exhausted") || !strings.Contains(events[1], `"finish_reason":"stop"`) {
+		t.Fatalf("failure should emit error content then finish chunk, got %q", buf.String())
+	}
+
+	if msg := flowStreamError(&flow.GenerationResult{Success: true}, nil); msg != "" {
+		t.Fatalf("successful result should have no error, got %q", msg)
+	}
+	if msg := flowStreamError(nil, errors.New("没有可用的 Token")); msg != "没有可用的 Token" {
+		t.Fatalf("handler error should be surfaced, got %q", msg)
+	}
+}
+
+func TestFlowVideoOutputBodyOverridesHeader(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	newCtx := func(headers map[string]string) *gin.Context {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+		for k, v := range headers {
+			c.Request.Header.Set(k, v)
+		}
+		return c
+	}
+	model := "veo_3_1_t2v_fast_landscape"
+
+	out, err := flowVideoOutput(newCtx(map[string]string{flowDurationHeader: "6s", flowQualityHeader: "720p"}), ChatRequest{Model: model})
+	if err != nil || out.DurationSeconds != 6 || out.Quality != "720p" {
+		t.Fatalf("headers should be used when body is empty, got %+v err=%v", out, err)
+	}
+	out, err = flowVideoOutput(newCtx(map[string]string{flowDurationHeader: "6"}), ChatRequest{Model: model, Duration: 8, Quality: "1080p"})
+	if err != nil || out.DurationSeconds != 8 || out.Quality != "1080p" {
+		t.Fatalf("body should take precedence, got %+v err=%v", out, err)
+	}
+	if _, err := flowVideoOutput(newCtx(map[string]string{flowDurationHeader: "long"}), ChatRequest{Model: model}); err == nil {
+		t.Fatal("invalid duration header should fail")
+	}
+	if out, err := flowVideoOutput(newCtx(nil), ChatRequest{Model: model}); err != nil || out != (flow.VideoOutput{}) {
+		t.Fatalf("no parameters should keep defaults, got %+v err=%v", out, err)
+	}
+}
+
+func TestCreateToolCallChunksStreamsArgumentDeltas(t *testing.T) {
+	args := `{"city":"北京","note":"` + strings.Repeat("天气", 40) + `"}`
+	call := ToolCall{ID: "call_1", Type: "function", Function: FunctionCall{Name: "get_weather", Arguments: args}}
+	chunks := createToolCallChunks("chatcmpl-x", 1, "gemini-2.5-flash", call)
+	if len(chunks) < 3 {
+		t.Fatalf("expected header plus several argument fragments, got %d chunks", len(chunks))
+	}
+
+	var rebuilt strings.Builder
+	for i, raw := range chunks {
+		var chunk struct {
+			Choices []struct {
+				Delta struct {
+					ToolCalls []struct {
+						Index    int     `json:"index"`
+						ID       *string `json:"id"`
+						Function struct {
+							Name      *string `json:"name"`
+							Arguments string  `json:"arguments"`
+						} `json:"function"`
+					} `json:"tool_calls"`
+				} `json:"delta"`
+				FinishReason *string `json:"finish_reason"`
+			} `json:"choices"`
+		}
+		if err := json.Unmarshal([]byte(raw), &chunk); err != nil {
+			t.Fatalf("chunk %d is not valid JSON: %v", i, err)
+		}
+		tc := chunk.Choices[0].Delta.ToolCalls[0]
+		if tc.Index != 0 || chunk.Choices[0].FinishReason != nil {
+			t.Fatalf("chunk %d: unexpected index/finish_reason: %s", i, raw)
+		}
+		if i == 0 {
+			if tc.ID == nil || *tc.ID != "call_1" || tc.Function.Name == nil || *tc.Function.Name != "get_weather" || tc.Function.Arguments != "" {
+				t.Fatalf("first chunk should carry id/name with empty arguments: %s", raw)
+			}
+			continue
+		}
+		if tc.ID != nil || tc.Function.Name != nil {
+			t.Fatalf("argument chunks should only carry arguments: %s", raw)
+		}
+		if !utf8.ValidString(tc.Function.Arguments) || len(tc.Function.Arguments) > toolCallArgsChunkSize {
+			t.Fatalf("fragment %d is not a valid bounded UTF-8 slice: %q", i, tc.Function.Arguments)
+		}
+		rebuilt.WriteString(tc.Function.Arguments)
+	}
+	if rebuilt.String() != args {
+		t.Fatalf("fragments should reassemble the arguments, got %q", rebuilt.String())
+	}
+}
+
+func TestExtractToolCallsAssignsParallelIndices(t *testing.T) {
+	var dataList []map[string]interface{}
+	raw := `[{"streamAssistResponse":{"answer":{"replies":[
+		{"groundedContent":{"content":{"functionCall":{"name":"get_weather","args":{"city":"Paris"}}}}},
+		{"groundedContent":{"content":{"text":"checking"}}},
+		{"groundedContent":{"content":{"functionCall":{"name":"get_time","args":{"tz":"CET"}}}}}
+	]}}}]`
+	if err := json.Unmarshal([]byte(raw), &dataList); err != nil {
+		t.Fatalf("unmarshal: %v", err)
+	}
+
+	calls := extractToolCalls(dataList)
+	if len(calls) != 2 {
+		t.Fatalf("expected two tool calls, got %+v", calls)
+	}
+	if calls[0].Index != 0 || calls[1].Index != 1 || calls[0].ID == calls[1].ID {
+		t.Fatalf("parallel tool calls need distinct ids and increasing indices: %+v", calls)
+	}
+	if calls[1].Function.Name != "get_time" || calls[1].Function.Arguments != `{"tz":"CET"}` {
+		t.Fatalf("unexpected second call: %+v", calls[1])
+	}
+
+	// 客户端按 index 拼装流式增量，应还原出两个独立调用
+	assembled := map[int]*strings.Builder{}
+	names := map[int]string{}
+	for _, call := range calls {
+		for _, chunk := range createToolCallChunks("chatcmpl-x", 1, "m", call) {
+			var parsed struct {
+				Choices []struct {
+					Delta struct {
+						ToolCalls []struct {
+							Index    int `json:"index"`
+							Function struct {
+								Name      string `json:"name"`
+								Arguments string `json:"arguments"`
+							} `json:"function"`
+						} `json:"tool_calls"`
+					} `json:"delta"`
+				} `json:"choices"`
+			}
+			if err := json.Unmarshal([]byte(chunk), &parsed); err != nil {
+				t.Fatalf("bad chunk: %v", err)
+			}
+			tc := parsed.Choices[0].Delta.ToolCalls[0]
+			if assembled[tc.Index] == nil {
+				assembled[tc.Index] = &strings.Builder{}
+			}
+			if tc.Function.Name != "" {
+				names[tc.Index] = tc.Function.Name
+			}
+			assembled[tc.Index].WriteString(tc.Function.Arguments)
+		}
+	}
+	if len(assembled) != 2 || names[0] != "get_weather" || names[1] != "get_time" ||
+		assembled[0].String() != `{"city":"Paris"}` || assembled[1].String() != `{"tz":"CET"}` {
+		t.Fatalf("index-keyed assembly mixed up the calls: names=%v args0=%q args1=%q", names, assembled[0], assembled[1])
+	}
+}
+
+func TestConvertMessagesToPromptPairsToolResultsByCallID(t *testing.T) {
+	call := func(id, name, args string) ToolCall {
+		return ToolCall{ID: id, Type: "function", Function: FunctionCall{Name: name, Arguments: args}}
+	}
+	prompt := convertMessagesToPrompt([]Message{
+		{Role: "user", Content: "weather and time?"},
+		{Role: "assistant", ToolCalls: []ToolCall{
+			call("call_a", "get_weather", `{"city":"Paris"}`),
+			call("call_b", "get_time", `{"tz":"CET"}`),
+		}},
+		// 结果顺序与调用相反，且不带 name，只能靠 tool_call_id 关联
+		{Role: "tool", ToolCallID: "call_b", Content: "12:00"},
+		{Role: "tool", ToolCallID: "call_a", Content: "sunny"},
+		{Role: "tool", ToolCallID: "call_x", Name: "lookup", Content: "orphan"},
+	})
+
+	for _, want := range []string{
+		`Assistant: [调用工具 call_a: get_weather({"city":"Paris"})]`,
+		`Assistant: [调用工具 call_b: get_time({"tz":"CET"})]`,
+		`Tool Result [call_b: get_time({"tz":"CET"})]: 12:00`,
+		`Tool Result [call_a: get_weather({"city":"Paris"})]: sunny`,
+		`Tool Result [call_x: lookup]: orphan`,
+	} {
+		if !strings.Contains(prompt, want) {
+			t.Fatalf("prompt missing %q:\n%s", want, prompt)
+		}
+	}
+}
+
+func TestOpenLiveUpstreamStreamsBeforeBodyCompletes(t *testing.T) {
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	resp := &http.Response{StatusCode: 200, Header: http.Header{}, Body: pr}
+	reply := func(field string) string {
+		return `{"streamAssistResponse":{"answer":{"replies":[{"groundedContent":{"content":` + field + `}}]}}}`
+	}
+
+	go func() {
+		io.WriteString(pw, "["+reply(`{"thought":true}`)+",")
+		io.WriteString(pw, reply(`{"text":"hello"}`)+",")
+	}()
+	type opened struct {
+		live *liveUpstream
+		raw  []byte
+	}
+	result := make(chan opened, 1)
+	go func() {
+		live, raw := openLiveUpstream(resp, logger.WithPrefix("test"))
+		result <- opened{live, raw}
+	}()
+
+	var got opened
+	select {
+	case got = <-result:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("openLiveUpstream should return once output arrives, without waiting for the full body")
+	}
+	if got.live == nil || !bytes.Contains(got.raw, []byte(`"hello"`)) {
+		t.Fatalf("expected live upstream with first output, got live=%v raw=%s", got.live, got.raw)
+	}
+
+	// 上游在对象中途断开，备用解析补齐剩余完整对象
+	go func() {
+		io.WriteString(pw, reply(`{"text":" world"}`)+`,{"streamAssistResponse":{"ans`)
+		pw.Close()
+	}()
+	var texts []string
+	next := upstreamObjects(nil, got.live)
+	for data, ok := next(); ok; data, ok = next() {
+		for _, content := range upstreamReplyContents(data) {
+			if text, ok := content["text"].(string); ok {
+				texts = append(texts, text)
+			}
+		}
+	}
+	if strings.Join(texts, "") != "hello world" {
+		t.Fatalf("expected replies in order without duplicates, got %q", texts)
+	}
+}
+
+func TestOpenLiveUpstreamFallsBackWithoutOutput(t *testing.T) {
+	body := `[{"error":{"code":429,"status":"RESOURCE_EXHAUSTED"}}]`
+	resp := &http.Response{StatusCode: 200, Header: http.Header{}, Body: io.NopCloser(strings.NewReader(body))}
+	live, raw := openLiveUpstream(resp, logger.WithPrefix("test"))
+	if live != nil || string(raw) != body {
+		t.Fatalf("responses without output should be returned whole for buffered checks, got live=%v raw=%s", live, raw)
+	}
+}
+
+func TestResolveThinkingBudget(t *testing.T) {
+	budget := func(n int) *int { return &n }
+	cases := []struct {
+		model, effort string
+		budget        *int
+		want          *int
+		wantErr       bool
+	}{
+		{model: "gemini-3-pro-preview", want: nil},
+		{model: "gemini-3-pro-preview", effort: "High", want: budget(24576)},
+		{model: "gemini-2.5-flash-search", effort: "low", want: budget(1024)},
+		{model: "gemini-2.5-pro", effort: "low", budget: budget(-1), want: budget(-1)},
+		{model: "gemini-2.5-pro", effort: "extreme", wantErr: true},
+		{model: "gemini-2.5-pro", budget: budget(maxThinkingBudget + 1), wantErr: true},
+		{model: "gemini-2.5-flash-image", effort: "medium", wantErr: true},
+		{model: "unknown-model", budget: budget(0), wantErr: true},
+	}
+	for _, tc := range cases {
+		got, err := resolveThinkingBudget(tc.model, tc.effort, tc.budget)
+		if (err != nil) != tc.wantErr {
+			t.Fatalf("%s effort=%q: err=%v wantErr=%v", tc.model, tc.effort, err, tc.wantErr)
+		}
+		if (got == nil) != (tc.want == nil) || (got != nil && *got != *tc.want) {
+			t.Fatalf("%s effort=%q: got %v want %v", tc.model, tc.effort, got, tc.want)
+		}
+	}
+}
+
+func TestParseToolChoice(t *testing.T) {
+	tools := []ToolDef{
+		{Type: "function", Function: FunctionDef{Name: "get_weather"}},
+		{Type: "function", Function: FunctionDef{Name: "get_time"}},
+	}
+	cases := []struct {
+		raw     interface{}
+		tools   []ToolDef
+		want    toolChoice
+		kept    int
+		wantErr bool
+	}{
+		{raw: nil, tools: tools, want: toolChoice{Mode: toolChoiceAuto}, kept: 2},
+		{raw: "none", tools: tools, want: toolChoice{Mode: toolChoiceNone}, kept: 0},
+		{raw: "required", tools: tools, want: toolChoice{Mode: toolChoiceRequired}, kept: 2},
+		{raw: functionToolChoice("get_time"), tools: tools, want: toolChoice{Mode: toolChoiceRequired, Function: "get_time"}, kept: 1},
+		{raw: "required", wantErr: true},
+		{raw: functionToolChoice("missing"), tools: tools, wantErr: true},
+		{raw: map[string]interface{}{"type": "function"}, tools: tools, wantErr: true},
+		{raw: "sometimes", tools: tools, wantErr: true},
+	}
+	for _, tc := range cases {
+		got, err := parseToolChoice(tc.raw, tc.tools)
+		if (err != nil) != tc.wantErr {
+			t.Fatalf("%v: err=%v wantErr=%v", tc.raw, err, tc.wantErr)
+		}
+		if err != nil {
+			continue
+		}
+		if got != tc.want || len(got.filterTools(tc.tools)) != tc.kept {
+			t.Fatalf("%v: got %+v keeping %d tools", tc.raw, got, len(got.filterTools(tc.tools)))
+		}
+	}
+
+	if got := geminiToolChoice(map[string]interface{}{"mode": "ANY", "allowedFunctionNames": []interface{}{"get_time"}}); !reflect.DeepEqual(got, functionToolChoice("get_time")) {
+		t.Fatalf("gemini ANY with one allowed function should pick it, got %v", got)
+	}
+	if got := geminiToolChoice(map[string]interface{}{"mode": "NONE"}); got != toolChoiceNone {
+		t.Fatalf("gemini NONE should map to none, got %v", got)
+	}
+}
+
+func TestOutputBudgetCutsAtRuneBoundary(t *testing.T) {
+	budget := &outputBudget{limit: 2}
+	if got, exceeded := budget.Take("你好"); got != "你好" || exceeded {
+		t.Fatalf("text within budget should pass through, got %q exceeded=%v", got, exceeded)
+	}
+	if got, exceeded := budget.Take("世界"); got != "" || !exceeded {
+		t.Fatalf("partial runes must not be emitted, got %q exceeded=%v", got, exceeded)
+	}
+	if got, _ := (&outputBudget{}).Take("unlimited"); got != "unlimited" {
+		t.Fatalf("zero limit should not truncate, got %q", got)
+	}
+}
+
+func TestModelCapabilities(t *testing.T) {
+	cases := map[string]ModelCapabilities{
+		"gemini-2.5-flash":                 {Vision: true, ImageGeneration: true, VideoGeneration: true, Search: true, ToolCalling: true},
+		"gemini-2.5-flash-image":           {Vision: true, ImageGeneration: true},
+		"gemini-3-pro-video":               {Vision: true, VideoGeneration: true},
+		"gemini-2.5-pro-search":            {Vision: true, Search: true, ToolCalling: true},
+		"gemini-2.5-flash-image-landscape": {Vision: true, ImageGeneration: true},
+		"veo_2_0_t2v_portrait":             {VideoGeneration: true},
+		"veo_3_1_i2v_s_fast_fl_landscape":  {Vision: true, VideoGeneration: true},
+	}
+	for model, want := range cases {
+		if got := modelCapabilities(model); got != want {
+			t.Fatalf("modelCapabilities(%q)=%+v, want %+v", model, got, want)
+		}
+	}
+
+	r, _, restore := newAdminTestRouter(t)
+	defer restore()
+	w := doAuthedJSONRequest(t, r, http.MethodGet, "/v1/models", "")
+	var list struct {
+		Data []struct {
+			ID           string            `json:"id"`
+			OwnedBy      string            `json:"owned_by"`
+			Capabilities ModelCapabilities `json:"capabilities"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || len(list.Data) == 0 {
+		t.Fatalf("unexpected model list: %v %s", err, w.Body.String())
+	}
+	for _, m := range list.Data {
+		if m.OwnedBy != "google" || m.Capabilities != modelCapabilities(m.ID) {
+			t.Fatalf("model %s should keep existing fields and report capabilities, got %+v", m.ID, m)
+		}
+	}
+
+	w = doAuthedJSONRequest(t, r, http.MethodGet, "/v1beta/models/gemini-2.5-flash-search", "")
+	body := decodeJSONBody(t, w.Body.String())
+	caps, _ := body["capabilities"].(map[string]interface{})
+	if body["outputTokenLimit"] == nil || caps["search"] != true || caps["imageGeneration"] != false || caps["toolCalling"] != true {
+		t.Fatalf("unexpected gemini model detail: %v", body)
+	}
+}
+
+func TestDefaultModelForPath(t *testing.T) {
+	oldDefault, oldModels, oldFlow := appConfig.DefaultModel, appConfig.DefaultModels, flowHandler
+	t.Cleanup(func() {
+		appConfig.DefaultModel, appConfig.DefaultModels, flowHandler = oldDefault, oldModels, oldFlow
+	})
+	flowHandler = nil
+
+	appConfig.DefaultModel, appConfig.DefaultModels = "", DefaultModelsConfig{}
+	if got := defaultModelFor(apiPathOpenAI); got != BaseModels[0] {
+		t.Fatalf("expected first base model without config, got %q", got)
+	}
+
+	appConfig.DefaultModel = "gemini-2.5-pro"
+	appConfig.DefaultModels = DefaultModelsConfig{Claude: "gemini-3-pro", Gemini: "veo_2_0_t2v_portrait"}
+	if got := defaultModelFor(apiPathOpenAI); got != "gemini-2.5-pro" {
+		t.Fatalf("openai should use default_model, got %q", got)
+	}
+	if got := defaultModelFor(apiPathClaude); got != "gemini-3-pro" {
+		t.Fatalf("claude should use its path default, got %q", got)
+	}
+	if got := defaultModelFor(apiPathGemini); got != "gemini-2.5-pro" {
+		t.Fatalf("flow model should fall back while flow is disabled, got %q", got)
+	}
+	flowHandler = &flow.GenerationHandler{}
+	if got := defaultModelFor(apiPathGemini); got != "veo_2_0_t2v_portrait" {
+		t.Fatalf("flow model should be used once flow is enabled, got %q", got)
+	}
+
+	result := validateConfigData([]byte(`{"default_model":"gpt-4","default_models":{"gemini":"veo_2_0_t2v_portrait"}}`))
+	warnings := strings.Join(result.Warnings, "\n")
+	if !strings.Contains(warnings, "default_model") || !strings.Contains(warnings, "default_models.gemini") {
+		t.Fatalf("unknown default models should warn, got %v", result.Warnings)
+	}
+	if result := validateConfigData([]byte(`{"default_models":{"gemini":"veo_2_0_t2v_portrait"},"flow":{"enable":true}}`)); strings.Contains(strings.Join(result.Warnings, "\n"), "default_models") {
+		t.Fatalf("flow models should be accepted when flow is enabled, got %v", result.Warnings)
+	}
+}
@@ -0,0 +1,496 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestGenerationLimiterQueueAndReject(t *testing.T) {
+	limiter := newGenerationLimiter(func() int { return 1 })
+
+	if err := limiter.Acquire(context.Background(), 0); err != nil {
+		t.Fatalf("first acquire should succeed: %v", err)
+	}
+	if err := limiter.Acquire(context.Background(), 0); !errors.Is(err, errGenerationBusy) {
+		t.Fatalf("expected busy error without queue, got %v", err)
+	}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		limiter.Release()
+	}()
+	if err := limiter.Acquire(context.Background(), 2*time.Second); err != nil {
+		t.Fatalf("queued acquire should succeed after release: %v", err)
+	}
+
+	snapshot := limiter.Snapshot()
+	if snapshot["in_flight"] != 1 || snapshot["waiting"] != 0 || snapshot["rejected"] != int64(1) {
+		t.Fatalf("unexpected snapshot: %#v", snapshot)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := limiter.Acquire(ctx, time.Second); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context canceled, got %v", err)
+	}
+	limiter.Release()
+	if got := limiter.Snapshot()["in_flight"]; got != 0 {
+		t.Fatalf("expected no in-flight generations, got %v", got)
+	}
+}
+
+func TestRespondGenerationBusyReturns503(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	oldLimiter := generationLimiter
+	defer func() { generationLimiter = oldLimiter }()
+	generationLimiter = newGenerationLimiter(func() int { return 1 })
+	if err := generationLimiter.Acquire(context.Background(), 0); err != nil {
+		t.Fatalf("acquire: %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	respondGenerationBusy(c)
+
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("expected 503 with Retry-After, got %d %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	body := w.Body.String()
+	if !strings.Contains(body, `"type":"server_busy"`) || !strings.Contains(body, `"in_flight":1`) {
+		t.Fatalf("unexpected body: %s", body)
+	}
+}
+
+func TestGenerationLimiterUnlimited(t *testing.T) {
+	limiter := newGenerationLimiter(func() int { return -1 })
+	for i := 0; i < 10; i++ {
+		if err := limiter.Acquire(context.Background(), 0); err != nil {
+			t.Fatalf("acquire %d should succeed when unlimited: %v", i, err)
+		}
+	}
+}
+
+func TestGenerationConcurrencyLimitAutoAndOverride(t *testing.T) {
+	configMu.Lock()
+	old := appConfig.Pool.MaxConcurrentGen
+	appConfig.Pool.MaxConcurrentGen = 0
+	configMu.Unlock()
+	defer func() {
+		configMu.Lock()
+		appConfig.Pool.MaxConcurrentGen = old
+		configMu.Unlock()
+	}()
+
+	if got := generationConcurrencyLimit(); got < 1 {
+		t.Fatalf("auto limit should be at least 1, got %d", got)
+	}
+
+	configMu.Lock()
+	appConfig.Pool.MaxConcurrentGen = 7
+	configMu.Unlock()
+	if got := generationConcurrencyLimit(); got != 7 {
+		t.Fatalf("expected configured limit 7, got %d", got)
+	}
+}
+
+func newTestCircuitBreaker(cfg CircuitBreakerConfig, now *time.Time) *CircuitBreaker {
+	b := newCircuitBreaker(func() CircuitBreakerConfig { return cfg })
+	b.now = func() time.Time { return *now }
+	return b
+}
+
+func TestCircuitBreakerTripsAndRecovers(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	b := newTestCircuitBreaker(CircuitBreakerConfig{FailureRate: 0.5, WindowSec: 60, MinRequests: 4, CooldownSec: 30}, &now)
+
+	b.Record(false)
+	b.Record(false)
+	b.Record(false)
+	if b.State() != breakerClosed {
+		t.Fatalf("breaker should stay closed below min requests, got %s", b.State())
+	}
+	b.Record(true)
+	if b.State() != breakerOpen {
+		t.Fatalf("breaker should open at 75%% failure rate, got %s", b.State())
+	}
+
+	now = now.Add(10 * time.Second)
+	allowed, remaining := b.Allow()
+	if allowed || remaining != 20*time.Second {
+		t.Fatalf("expected rejection with 20s remaining, got allowed=%v remaining=%v", allowed, remaining)
+	}
+
+	now = now.Add(25 * time.Second)
+	if allowed, _ := b.Allow(); !allowed {
+		t.Fatalf("breaker should allow a probe after cooldown")
+	}
+	b.Record(false)
+	if b.State() != breakerOpen {
+		t.Fatalf("failed probe should reopen breaker, got %s", b.State())
+	}
+
+	now = now.Add(31 * time.Second)
+	if allowed, _ := b.Allow(); !allowed {
+		t.Fatalf("breaker should allow a probe after second cooldown")
+	}
+	b.Record(true)
+	if b.State() != breakerClosed {
+		t.Fatalf("successful probe should close breaker, got %s", b.State())
+	}
+
+	snapshot := b.Snapshot()
+	if snapshot["trips"] != int64(2) || snapshot["rejected"] != int64(1) {
+		t.Fatalf("unexpected snapshot: %#v", snapshot)
+	}
+}
+
+func TestCircuitBreakerSlidingWindowAndDisable(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	b := newTestCircuitBreaker(CircuitBreakerConfig{FailureRate: 0.5, WindowSec: 10, MinRequests: 3, CooldownSec: 30}, &now)
+
+	b.Record(false)
+	b.Record(false)
+	now = now.Add(11 * time.Second)
+	b.Record(false)
+	b.Record(true)
+	if b.State() != breakerClosed {
+		t.Fatalf("expired failures should not count toward the window, got %s", b.State())
+	}
+
+	disabled := newTestCircuitBreaker(CircuitBreakerConfig{FailureRate: -1, WindowSec: 10, MinRequests: 1, CooldownSec: 30}, &now)
+	disabled.Record(false)
+	if allowed, _ := disabled.Allow(); !allowed || disabled.State() != "disabled" {
+		t.Fatalf("disabled breaker should always allow requests")
+	}
+}
+
+func TestIPRateLimiterWindowAndWhitelist(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	cfg := RateLimitConfig{PerIPRPM: 2, Whitelist: []string{"10.0.0.0/8", "192.168.1.5"}}
+	l := newIPRateLimiter(func() RateLimitConfig { return cfg })
+	l.now = func() time.Time { return now }
+
+	if ok, _ := l.Allow("1.2.3.4"); !ok {
+		t.Fatalf("first request should pass")
+	}
+	now = now.Add(20 * time.Second)
+	if ok, _ := l.Allow("1.2.3.4"); !ok {
+		t.Fatalf("second request should pass")
+	}
+	ok, wait := l.Allow("1.2.3.4")
+	if ok || wait != 40*time.Second {
+		t.Fatalf("expected rejection with 40s wait, got ok=%v wait=%v", ok, wait)
+	}
+	if ok, _ := l.Allow("5.6.7.8"); !ok {
+		t.Fatalf("other IPs should have their own window")
+	}
+	for i := 0; i < 5; i++ {
+		if ok, _ := l.Allow("10.1.2.3"); !ok {
+			t.Fatalf("CIDR whitelisted IP should never be limited")
+		}
+		if ok, _ := l.Allow("192.168.1.5"); !ok {
+			t.Fatalf("whitelisted IP should never be limited")
+		}
+	}
+
+	now = now.Add(41 * time.Second)
+	if ok, _ := l.Allow("1.2.3.4"); !ok {
+		t.Fatalf("request should pass after oldest hit leaves the window")
+	}
+	if l.Snapshot()["rejected"] != int64(1) {
+		t.Fatalf("unexpected snapshot: %#v", l.Snapshot())
+	}
+
+	cfg.PerIPRPM = 0
+	for i := 0; i < 5; i++ {
+		if ok, _ := l.Allow("1.2.3.4"); !ok {
+			t.Fatalf("limiter should be disabled when per_ip_rpm is 0")
+		}
+	}
+}
+
+func TestIPRateLimitMiddlewareIgnoresUntrustedForwardedFor(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	oldLimiter := ipRateLimiter
+	defer func() { ipRateLimiter = oldLimiter }()
+	cfg := RateLimitConfig{PerIPRPM: 1, Whitelist: []string{"203.0.113.1"}}
+	ipRateLimiter = newIPRateLimiter(func() RateLimitConfig { return cfg })
+
+	r := gin.New()
+	if err := configureClientIP(r, nil, ""); err != nil {
+		t.Fatalf("configure client ip: %v", err)
+	}
+	r.Use(ipRateLimit())
+	r.GET("/", func(c *gin.Context) { c.Status(http.StatusOK) })
+	do := func(xff string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = "192.0.2.10:1234"
+		req.Header.Set("X-Forwarded-For", xff)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := do("203.0.113.1"); w.Code != http.StatusOK {
+		t.Fatalf("first request should pass, got %d", w.Code)
+	}
+	// 伪造的转发地址既不能换取新的限流桶，也不能冒充白名单
+	w := do("203.0.113.2")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("expected 429 with Retry-After, got %d %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	if w := do("203.0.113.1"); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("spoofed whitelist IP should not bypass limiting, got %d", w.Code)
+	}
+}
+
+func TestRequestBodyLimit(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	old := appConfig.Pool.MaxRequestBytes
+	defer func() { appConfig.Pool.MaxRequestBytes = old }()
+	appConfig.Pool.MaxRequestBytes = 16
+
+	r := gin.New()
+	r.Use(requestBodyLimit())
+	r.POST("/", func(c *gin.Context) {
+		body, _ := io.ReadAll(c.Request.Body)
+		c.String(http.StatusOK, string(body))
+	})
+	do := func(body string, chunked bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		if chunked {
+			req.ContentLength = -1 // 未声明长度，验证读取上限
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	if w := do(`{"a":1}`, false); w.Code != http.StatusOK || w.Body.String() != `{"a":1}` {
+		t.Fatalf("small body should pass through intact, got %d %q", w.Code, w.Body.String())
+	}
+	for _, chunked := range []bool{false, true} {
+		if w := do(strings.Repeat("x", 32), chunked); w.Code != http.StatusRequestEntityTooLarge || !strings.Contains(w.Body.String(), "request_too_large") {
+			t.Fatalf("chunked=%v: expected 413, got %d %s", chunked, w.Code, w.Body.String())
+		}
+	}
+
+	appConfig.Pool.MaxRequestBytes = -1
+	if w := do(strings.Repeat("x", 32), true); w.Code != http.StatusOK {
+		t.Fatalf("negative limit should disable the check, got %d", w.Code)
+	}
+}
+
+func TestConfigureClientIPUsesHeaderFromTrustedProxy(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	if err := configureClientIP(r, []string{"10.0.0.0/8"}, "CF-Connecting-IP"); err != nil {
+		t.Fatalf("configure client ip: %v", err)
+	}
+	r.GET("/", func(c *gin.Context) { c.String(http.StatusOK, c.ClientIP()) })
+	do := func(remote string) string {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = remote
+		req.Header.Set("CF-Connecting-IP", "198.51.100.7")
+		req.Header.Set("X-Forwarded-For", "203.0.113.9")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Body.String()
+	}
+
+	if got := do("10.1.2.3:443"); got != "198.51.100.7" {
+		t.Fatalf("expected header IP from trusted proxy, got %s", got)
+	}
+	if got := do("192.0.2.1:443"); got != "192.0.2.1" {
+		t.Fatalf("expected remote address from untrusted peer, got %s", got)
+	}
+	if err := configureClientIP(gin.New(), []string{"not-an-ip"}, ""); err == nil {
+		t.Fatalf("expected invalid trusted proxy to fail")
+	}
+}
+
+func TestConfigureClientIPIgnoresHeaderWithoutTrustedProxies(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	if err := configureClientIP(r, nil, "CF-Connecting-IP"); err != nil {
+		t.Fatalf("configure client ip: %v", err)
+	}
+	r.GET("/", func(c *gin.Context) { c.String(http.StatusOK, c.ClientIP()) })
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = "192.0.2.1:443"
+	req.Header.Set("CF-Connecting-IP", "198.51.100.7")
+	req.Header.Set("X-Forwarded-For", "203.0.113.9")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if got := w.Body.String(); got != "192.0.2.1" {
+		t.Fatalf("expected remote address when no proxy is trusted, got %s", got)
+	}
+}
+
+func TestSingleFlightSharesConcurrentIdenticalRequests(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	group := &singleFlightGroup{calls: make(map[string]*singleFlightCall)}
+	var runs int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	r := gin.New()
+	r.Use(requestIDMiddleware)
+	r.POST("/gen", func(c *gin.Context) {
+		group.Do(c, "same-key", func(c *gin.Context) {
+			n := atomic.AddInt32(&runs, 1)
+			if n == 1 {
+				close(started)
+			}
+			<-release
+			c.JSON(200, gin.H{"run": n})
+		})
+	})
+
+	const total = 3
+	results := make([]*httptest.ResponseRecorder, total)
+	var wg sync.WaitGroup
+	doRequest := func(i int) {
+		defer wg.Done()
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/gen", nil)
+		req.Header.Set(requestIDHeader, fmt.Sprintf("req-%d", i))
+		r.ServeHTTP(w, req)
+		results[i] = w
+	}
+
+	wg.Add(1)
+	go doRequest(0)
+	<-started
+	for i := 1; i < total; i++ {
+		wg.Add(1)
+		go doRequest(i)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		group.mu.Lock()
+		followers := group.calls["same-key"].followers
+		group.mu.Unlock()
+		if followers == total-1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(release)
+	wg.Wait()
+
+	if atomic.LoadInt32(&runs) != 1 {
+		t.Fatalf("expected a single upstream run, got %d", runs)
+	}
+	shared := 0
+	for i, w := range results {
+		if w.Code != 200 || w.Body.String() != `{"run":1}` {
+			t.Fatalf("request %d got status=%d body=%s", i, w.Code, w.Body.String())
+		}
+		if w.Header().Get(singleFlightHeader) == "shared" {
+			shared++
+		}
+		if ids := w.Header().Values(requestIDHeader); len(ids) != 1 || ids[0] != fmt.Sprintf("req-%d", i) {
+			t.Fatalf("request %d should keep its own request id, got %v", i, ids)
+		}
+	}
+	if shared != total-1 {
+		t.Fatalf("expected %d shared responses, got %d", total-1, shared)
+	}
+	if len(group.calls) != 0 {
+		t.Fatalf("completed calls should be removed from the group")
+	}
+}
+
+func TestSingleFlightKey(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	keyOf := func(req ChatRequest, headers map[string]string) string {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodPost, "/v1/chat/completions", nil)
+		for k, v := range headers {
+			c.Request.Header.Set(k, v)
+		}
+		return singleFlightKey(c, req)
+	}
+
+	base := ChatRequest{Model: "gemini-2.5-flash", Messages: []Message{{Role: "user", Content: "draw a cat"}}}
+	same := ChatRequest{Model: "gemini-2.5-flash", Messages: []Message{{Role: "user", Content: "draw a cat"}}}
+	if keyOf(base, nil) != keyOf(same, nil) {
+		t.Fatalf("identical requests should share a key")
+	}
+	other := base
+	other.Messages = []Message{{Role: "user", Content: "draw a dog"}}
+	if keyOf(base, nil) == keyOf(other, nil) {
+		t.Fatalf("different prompts should not share a key")
+	}
+	streamed := base
+	streamed.Stream = true
+	if keyOf(base, nil) == keyOf(streamed, nil) {
+		t.Fatalf("stream and non-stream requests should not share a key")
+	}
+
+	// 只有生成参数不同的请求会发出不同的上游请求，不能合并
+	limited := base
+	limited.MaxTokens = 100
+	if keyOf(base, nil) == keyOf(limited, nil) {
+		t.Fatalf("requests differing in max_tokens should not share a key")
+	}
+	// max_tokens 与 max_completion_tokens 解析为同一上限时可以合并
+	completion := base
+	completion.MaxCompletionTokens = 100
+	if keyOf(limited, nil) != keyOf(completion, nil) {
+		t.Fatalf("equivalent max_tokens fields should share a key")
+	}
+	image := ChatRequest{Model: "gemini-2.5-flash-image", Messages: base.Messages, AspectRatio: "16:9"}
+	portrait := image
+	portrait.AspectRatio = "9:16"
+	if keyOf(image, nil) == keyOf(portrait, nil) {
+		t.Fatalf("requests differing in aspect_ratio should not share a key")
+	}
+	thinking := base
+	thinking.ReasoningEffort = "high"
+	if keyOf(base, nil) == keyOf(thinking, nil) {
+		t.Fatalf("requests differing in reasoning effort should not share a key")
+	}
+	if keyOf(base, nil) == keyOf(base, map[string]string{configIDHeader: "cfg-a"}) {
+		t.Fatalf("requests differing in X-Config-Id should not share a key")
+	}
+	video := ChatRequest{Model: "veo_3_1_t2v_fast_landscape", Messages: base.Messages}
+	if keyOf(video, map[string]string{flowQualityHeader: "720p"}) == keyOf(video, map[string]string{flowQualityHeader: "1080p"}) {
+		t.Fatalf("flow requests differing in quality should not share a key")
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	cases := []struct {
+		value string
+		want  time.Duration
+		ok    bool
+	}{
+		{"120", 2 * time.Minute, true},
+		{" 0 ", 0, true},
+		{now.Add(90 * time.Second).Format(http.TimeFormat), 90 * time.Second, true},
+		{now.Add(-time.Minute).Format(http.TimeFormat), 0, true},
+		{"", 0, false},
+		{"-5", 0, false},
+		{"soon", 0, false},
+	}
+	for _, tc := range cases {
+		got, ok := parseRetryAfter(tc.value, now)
+		if got != tc.want || ok != tc.ok {
+			t.Fatalf("parseRetryAfter(%q) = %v,%v want %v,%v", tc.value, got, ok, tc.want, tc.ok)
+		}
+	}
+}
@@ -48,104 +48,190 @@ func NewStreamHandler(cfg StreamHandlerConfig) *StreamHandler {
 	}
 }
 
+// streamOptions SSE 与 WebSocket 共用的查询参数
+type streamOptions struct {
+	source         string
+	level          string
+	bootstrapLimit int
+	pollMS         int
+	lastEventID    string // SSE 重连时浏览器带回的 Last-Event-ID，非空时从该位置续传而不发送启动快照
+}
+
+// logSink 日志推送目标（SSE / WebSocket），返回错误时结束推送；
+// cursor 为推送后的续传位置（见 formatCursor），SSE 作为事件 id 发送
+type logSink interface {
+	Logs(items []logger.LogEntry, cursor string) error
+	System(message string) error
+	Ping() error
+}
+
+func parseStreamOptions(c *gin.Context) streamOptions {
+	return streamOptions{
+		source:         normalizeSource(c.DefaultQuery("source", "all")),
+		level:          normalizeLevel(c.DefaultQuery("level", "all")),
+		bootstrapLimit: clampInt(c.DefaultQuery("bootstrap_limit", "200"), 1, 1000, 200),
+		pollMS:         clampInt(c.DefaultQuery("poll_ms", "1000"), 500, 10000, 1000),
+	}
+}
+
 func (h *StreamHandler) Handler() gin.HandlerFunc {
 	return func(c *gin.Context) {
-		source := normalizeSource(c.DefaultQuery("source", "all"))
-		level := normalizeLevel(c.DefaultQuery("level", "all"))
-		bootstrapLimit := clampInt(c.DefaultQuery("bootstrap_limit", "200"), 1, 1000, 200)
-		pollMS := clampInt(c.DefaultQuery("poll_ms", "1000"), 500, 10000, 1000)
-
-		writer := c.Writer
-		flusher, ok := writer.(http.Flusher)
+		opts := parseStreamOptions(c)
+		opts.lastEventID = c.GetHeader("Last-Event-ID")
+		sse, ok := StartSSE(c)
 		if !ok {
-			c.JSON(http.StatusInternalServerError, gin.H{"error": "stream unsupported"})
 			return
 		}
+		h.stream(c.Request.Context(), opts, &sseSink{sse: sse}, 15*time.Second)
+	}
+}
 
-		writer.Header().Set("Content-Type", "text/event-stream")
-		writer.Header().Set("Cache-Control", "no-cache")
-		writer.Header().Set("Connection", "keep-alive")
-		writer.Header().Set("X-Accel-Buffering", "no")
-		writer.WriteHeader(http.StatusOK)
-		flusher.Flush()
-
-		ctx := c.Request.Context()
-		localAfterID := int64(0)
-		registrarAfterID := int64(0)
-
-		bootstrap := make([]logger.LogEntry, 0, bootstrapLimit*2)
-		if source == "all" || source == "business2api" {
-			local := logger.Recent(bootstrapLimit, "business2api", level)
-			if len(local) > 0 {
-				localAfterID = local[len(local)-1].ID
-				bootstrap = append(bootstrap, local...)
-			}
+// formatCursor 续传位置：单一来源时为该来源最后一条日志的 ID，source=all 时两个来源各自编号，
+// 格式为 "<business2api ID>,<registrar ID>"
+func formatCursor(source string, localAfterID, registrarAfterID int64) string {
+	switch source {
+	case "business2api":
+		return strconv.FormatInt(localAfterID, 10)
+	case "registrar":
+		return strconv.FormatInt(registrarAfterID, 10)
+	default:
+		return strconv.FormatInt(localAfterID, 10) + "," + strconv.FormatInt(registrarAfterID, 10)
+	}
+}
+
+// parseCursor 解析 formatCursor 生成的续传位置，格式不符时返回 false
+func parseCursor(source, raw string) (localAfterID, registrarAfterID int64, ok bool) {
+	parts := strings.Split(strings.TrimSpace(raw), ",")
+	ids := make([]int64, len(parts))
+	for i, part := range parts {
+		id, err := strconv.ParseInt(strings.TrimSpace(part), 10, 64)
+		if err != nil || id < 0 {
+			return 0, 0, false
+		}
+		ids[i] = id
+	}
+	switch {
+	case source == "business2api" && len(ids) == 1:
+		return ids[0], 0, true
+	case source == "registrar" && len(ids) == 1:
+		return 0, ids[0], true
+	case source == "all" && len(ids) == 2:
+		return ids[0], ids[1], true
+	}
+	return 0, 0, false
+}
+
+// resumeCursor 解析 Last-Event-ID；本地日志 ID 超过当前最新 ID（服务已重启、编号重置）时视为无效
+func resumeCursor(source, lastEventID string) (localAfterID, registrarAfterID int64, ok bool) {
+	if strings.TrimSpace(lastEventID) == "" {
+		return 0, 0, false
+	}
+	localAfterID, registrarAfterID, ok = parseCursor(source, lastEventID)
+	if !ok || localAfterID == 0 {
+		return localAfterID, registrarAfterID, ok
+	}
+	latest := logger.Recent(1, "business2api", "all")
+	if len(latest) == 0 || latest[0].ID < localAfterID {
+		return 0, 0, false
+	}
+	return localAfterID, registrarAfterID, true
+}
+
+// stream 先推送启动快照（带 Last-Event-ID 重连时改为从该位置续传），再按 pollMS 轮询增量日志，
+// 直到 ctx 结束或 sink 写入失败
+func (h *StreamHandler) stream(ctx context.Context, opts streamOptions, sink logSink, pingInterval time.Duration) {
+	source, level, bootstrapLimit := opts.source, opts.level, opts.bootstrapLimit
+	localAfterID, registrarAfterID, resumed := resumeCursor(source, opts.lastEventID)
+	// registrar 子进程的 stdout 也会进入 business2api 日志，合并两个来源时按指纹去重
+	var dedup *recentFingerprints
+	if source == "all" {
+		dedup = newRecentFingerprints(fingerprintCapacity)
+	}
+
+	// 重连续传时跳过启动快照，断线期间的日志由下方轮询补齐
+	bootstrap := make([]logger.LogEntry, 0, bootstrapLimit*2)
+	if !resumed && (source == "all" || source == "business2api") {
+		local := logger.Recent(bootstrapLimit, "business2api", level)
+		if len(local) > 0 {
+			localAfterID = local[len(local)-1].ID
+			bootstrap = append(bootstrap, local...)
 		}
-		if source == "all" || source == "registrar" {
-			items, nextID, err := h.fetchRegistrarLogs(ctx, 0, bootstrapLimit, level)
-			if err != nil {
-				h.writeSystemEvent(writer, flusher, "registrar bootstrap error: "+err.Error())
-			} else {
-				registrarAfterID = nextID
-				bootstrap = append(bootstrap, items...)
+	}
+	if !resumed && (source == "all" || source == "registrar") {
+		items, nextID, err := h.fetchRegistrarLogs(ctx, 0, bootstrapLimit, level)
+		if err != nil {
+			if sink.System("registrar bootstrap error: "+err.Error()) != nil {
+				return
 			}
+		} else {
+			registrarAfterID = nextID
+			bootstrap = append(bootstrap, items...)
 		}
-		if len(bootstrap) > 0 {
-			sort.Slice(bootstrap, func(i, j int) bool {
-				if bootstrap[i].TS == bootstrap[j].TS {
-					return bootstrap[i].ID < bootstrap[j].ID
-				}
-				return bootstrap[i].TS < bootstrap[j].TS
-			})
-			h.writeLogsEvent(writer, flusher, bootstrap)
+	}
+	if len(bootstrap) > 0 {
+		sortEntries(bootstrap)
+		bootstrap = dedup.filter(bootstrap)
+		if sink.Logs(bootstrap, formatCursor(source, localAfterID, registrarAfterID)) != nil {
+			return
 		}
+	}
 
-		ticker := time.NewTicker(time.Duration(pollMS) * time.Millisecond)
-		pingTicker := time.NewTicker(15 * time.Second)
-		defer ticker.Stop()
-		defer pingTicker.Stop()
+	ticker := time.NewTicker(time.Duration(opts.pollMS) * time.Millisecond)
+	pingTicker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+	defer pingTicker.Stop()
 
-		for {
-			select {
-			case <-ctx.Done():
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-pingTicker.C:
+			if sink.Ping() != nil {
 				return
-			case <-pingTicker.C:
-				h.writePingEvent(writer, flusher)
-			case <-ticker.C:
-				batch := make([]logger.LogEntry, 0, 200)
-				if source == "all" || source == "business2api" {
-					local, nextID := logger.After(localAfterID, 200, "business2api", level)
-					if nextID > localAfterID {
-						localAfterID = nextID
-					}
-					batch = append(batch, local...)
+			}
+		case <-ticker.C:
+			batch := make([]logger.LogEntry, 0, 200)
+			if source == "all" || source == "business2api" {
+				local, nextID := logger.After(localAfterID, 200, "business2api", level)
+				if nextID > localAfterID {
+					localAfterID = nextID
 				}
-				if source == "all" || source == "registrar" {
-					items, nextID, err := h.fetchRegistrarLogs(ctx, registrarAfterID, 200, level)
-					if err != nil {
-						h.writeSystemEvent(writer, flusher, "registrar pull error: "+err.Error())
-					} else {
-						if nextID > registrarAfterID {
-							registrarAfterID = nextID
-						}
-						batch = append(batch, items...)
+				batch = append(batch, local...)
+			}
+			if source == "all" || source == "registrar" {
+				items, nextID, err := h.fetchRegistrarLogs(ctx, registrarAfterID, 200, level)
+				if err != nil {
+					if sink.System("registrar pull error: "+err.Error()) != nil {
+						return
 					}
-				}
-				if len(batch) == 0 {
-					continue
-				}
-				sort.Slice(batch, func(i, j int) bool {
-					if batch[i].TS == batch[j].TS {
-						return batch[i].ID < batch[j].ID
+				} else {
+					if nextID > registrarAfterID {
+						registrarAfterID = nextID
 					}
-					return batch[i].TS < batch[j].TS
-				})
-				h.writeLogsEvent(writer, flusher, batch)
+					batch = append(batch, items...)
+				}
+			}
+			if len(batch) == 0 {
+				continue
+			}
+			sortEntries(batch)
+			batch = dedup.filter(batch)
+			if sink.Logs(batch, formatCursor(source, localAfterID, registrarAfterID)) != nil {
+				return
 			}
 		}
 	}
 }
 
+func sortEntries(items []logger.LogEntry) {
+	sort.Slice(items, func(i, j int) bool {
+		if items[i].TS == items[j].TS {
+			return items[i].ID < items[j].ID
+		}
+		return items[i].TS < items[j].TS
+	})
+}
+
 func (h *StreamHandler) fetchRegistrarLogs(ctx context.Context, afterID int64, limit int, level string) ([]logger.LogEntry, int64, error) {
 	baseURL := ""
 	if h.getRegistrarBaseURL != nil {
@@ -184,31 +270,157 @@ func (h *StreamHandler) fetchRegistrarLogs(ctx context.Context, afterID int64, l
 	if out.NextAfterID < afterID {
 		out.NextAfterID = afterID
 	}
-	for i := range out.Items {
-		out.Items[i].Source = "registrar"
+	// registrar 可能忽略 level 参数，本地再按级别过滤一次；next_after_id 仍按原始结果推进
+	items := out.Items[:0]
+	for _, item := range out.Items {
+		if !matchLevel(level, item.Level) {
+			continue
+		}
+		item.Source = "registrar"
+		items = append(items, item)
+	}
+	return items, out.NextAfterID, nil
+}
+
+// fingerprintCapacity 去重时保留的近期指纹数量上限
+const fingerprintCapacity = 4096
+
+// recentFingerprints 有界的近期日志指纹集合（消息内容 + 秒级时间戳），超出容量后按 FIFO 淘汰
+type recentFingerprints struct {
+	seen  map[string]struct{}
+	order []string
+	next  int
+}
+
+func newRecentFingerprints(capacity int) *recentFingerprints {
+	return &recentFingerprints{
+		seen:  make(map[string]struct{}, capacity),
+		order: make([]string, 0, capacity),
 	}
-	return out.Items, out.NextAfterID, nil
 }
 
-func (h *StreamHandler) writeLogsEvent(w io.Writer, flusher http.Flusher, items []logger.LogEntry) {
-	if len(items) == 0 {
+func fingerprint(message string, sec int64) string {
+	return strconv.FormatInt(sec, 10) + "|" + message
+}
+
+// filter 去掉已出现过的日志；两个来源的时间戳来自不同进程，相邻一秒内的同内容视为重复。
+// nil 接收者表示不去重
+func (f *recentFingerprints) filter(items []logger.LogEntry) []logger.LogEntry {
+	if f == nil || len(items) == 0 {
+		return items
+	}
+	out := items[:0]
+	for _, item := range items {
+		ts, err := time.Parse(time.RFC3339Nano, item.TS)
+		if err != nil {
+			out = append(out, item)
+			continue
+		}
+		sec := ts.Unix()
+		message := strings.TrimSpace(item.Message)
+		duplicate := false
+		for _, s := range []int64{sec - 1, sec, sec + 1} {
+			if _, ok := f.seen[fingerprint(message, s)]; ok {
+				duplicate = true
+				break
+			}
+		}
+		if duplicate {
+			continue
+		}
+		f.add(fingerprint(message, sec))
+		out = append(out, item)
+	}
+	return out
+}
+
+func (f *recentFingerprints) add(key string) {
+	if _, ok := f.seen[key]; ok {
 		return
 	}
-	payload, _ := json.Marshal(streamPayload{Items: items})
-	_, _ = fmt.Fprintf(w, "event: logs\ndata: %s\n\n", payload)
-	flusher.Flush()
+	if len(f.order) < cap(f.order) {
+		f.order = append(f.order, key)
+	} else {
+		delete(f.seen, f.order[f.next])
+		f.order[f.next] = key
+		f.next = (f.next + 1) % len(f.order)
+	}
+	f.seen[key] = struct{}{}
 }
 
-func (h *StreamHandler) writeSystemEvent(w io.Writer, flusher http.Flusher, message string) {
-	payload, _ := json.Marshal(map[string]string{"message": message})
-	_, _ = fmt.Fprintf(w, "event: system\ndata: %s\n\n", payload)
-	flusher.Flush()
+// SSEWriter 通用 SSE 事件写入，日志流与管理端事件流共用
+type SSEWriter struct {
+	w       io.Writer
+	flusher http.Flusher
 }
 
-func (h *StreamHandler) writePingEvent(w io.Writer, flusher http.Flusher) {
-	payload, _ := json.Marshal(map[string]string{"ts": time.Now().UTC().Format(time.RFC3339Nano)})
-	_, _ = fmt.Fprintf(w, "event: ping\ndata: %s\n\n", payload)
+// StartSSE 写入 SSE 响应头；响应不支持 flush 时返回 500 与 false
+func StartSSE(c *gin.Context) (*SSEWriter, bool) {
+	writer := c.Writer
+	flusher, ok := writer.(http.Flusher)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "stream unsupported"})
+		return nil, false
+	}
+
+	writer.Header().Set("Content-Type", "text/event-stream")
+	writer.Header().Set("Cache-Control", "no-cache")
+	writer.Header().Set("Connection", "keep-alive")
+	writer.Header().Set("X-Accel-Buffering", "no")
+	writer.WriteHeader(http.StatusOK)
 	flusher.Flush()
+	return &SSEWriter{w: writer, flusher: flusher}, true
+}
+
+// Event 推送一条 JSON 事件
+func (s *SSEWriter) Event(name string, payload interface{}) error {
+	return s.EventWithID("", name, payload)
+}
+
+// EventWithID 推送一条带 id 的 JSON 事件，浏览器重连时以 Last-Event-ID 请求头带回；id 为空时同 Event
+func (s *SSEWriter) EventWithID(id, name string, payload interface{}) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	if id != "" {
+		if _, err := fmt.Fprintf(s.w, "id: %s\n", id); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", name, data); err != nil {
+		return err
+	}
+	s.flusher.Flush()
+	return nil
+}
+
+// Ping 推送心跳事件
+func (s *SSEWriter) Ping() error {
+	return s.Event("ping", map[string]string{"ts": time.Now().UTC().Format(time.RFC3339Nano)})
+}
+
+// sseSink 以 SSE 事件推送日志
+type sseSink struct {
+	sse *SSEWriter
+}
+
+func (s *sseSink) Logs(items []logger.LogEntry, cursor string) error {
+	if len(items) == 0 {
+		return nil
+	}
+	_ = s.sse.EventWithID(cursor, "logs", streamPayload{Items: items})
+	return nil
+}
+
+func (s *sseSink) System(message string) error {
+	_ = s.sse.Event("system", map[string]string{"message": message})
+	return nil
+}
+
+func (s *sseSink) Ping() error {
+	_ = s.sse.Ping()
+	return nil
 }
 
 func normalizeSource(source string) string {
@@ -231,6 +443,24 @@ func normalizeLevel(level string) string {
 	}
 }
 
+// matchLevel 与 registrar 的 normalize_level 保持一致：critical/fatal 归为 error，warning 归为 warn，未知级别视为 info
+func matchLevel(filter, level string) bool {
+	if filter == "all" {
+		return true
+	}
+	switch strings.ToLower(strings.TrimSpace(level)) {
+	case "critical", "fatal", "error":
+		level = "error"
+	case "warning", "warn":
+		level = "warn"
+	case "debug":
+		level = "debug"
+	default:
+		level = "info"
+	}
+	return level == filter
+}
+
 func clampInt(raw string, min, max, fallback int) int {
 	v, err := strconv.Atoi(strings.TrimSpace(raw))
 	if err != nil {
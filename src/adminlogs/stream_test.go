@@ -0,0 +1,151 @@
+package adminlogs
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"business2api/src/logger"
+)
+
+func TestFetchRegistrarLogsFiltersLevelLocally(t *testing.T) {
+	// 模拟忽略 level 参数的 registrar：始终返回全部级别
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(registrarLogResponse{
+			Items: []logger.LogEntry{
+				{ID: 1, Level: "info", Message: "started"},
+				{ID: 2, Level: "error", Message: "register failed"},
+				{ID: 3, Level: "warning", Message: "slow proxy"},
+				{ID: 4, Level: "CRITICAL", Message: "browser crashed"},
+			},
+			NextAfterID: 4,
+		})
+	}))
+	defer srv.Close()
+
+	h := NewStreamHandler(StreamHandlerConfig{GetRegistrarBaseURL: func() string { return srv.URL }})
+	items, nextID, err := h.fetchRegistrarLogs(context.Background(), 0, 10, "error")
+	if err != nil {
+		t.Fatalf("fetch registrar logs: %v", err)
+	}
+	if nextID != 4 {
+		t.Fatalf("next_after_id should advance past filtered items, got %d", nextID)
+	}
+	if len(items) != 2 || items[0].ID != 2 || items[1].ID != 4 {
+		t.Fatalf("expected only error-level items, got %+v", items)
+	}
+	for _, item := range items {
+		if item.Source != "registrar" {
+			t.Fatalf("registrar items should be tagged with source, got %q", item.Source)
+		}
+	}
+
+	items, _, _ = h.fetchRegistrarLogs(context.Background(), 0, 10, "warn")
+	if len(items) != 1 || items[0].ID != 3 {
+		t.Fatalf("warning should match the warn filter, got %+v", items)
+	}
+	items, _, _ = h.fetchRegistrarLogs(context.Background(), 0, 10, "all")
+	if len(items) != 4 {
+		t.Fatalf("level=all should keep every item, got %+v", items)
+	}
+}
+
+func TestRecentFingerprintsDropsCrossSourceDuplicates(t *testing.T) {
+	f := newRecentFingerprints(2)
+	items := f.filter([]logger.LogEntry{
+		{ID: 1, Source: "registrar", TS: "2026-01-01T00:00:00.900+00:00", Message: "registered a@example.com"},
+		{ID: 7, Source: "business2api", TS: "2026-01-01T00:00:01.050Z", Message: "registered a@example.com"},
+		{ID: 8, Source: "business2api", TS: "2026-01-01T00:00:01.100Z", Message: "other line"},
+	})
+	if len(items) != 2 || items[0].ID != 1 || items[1].ID != 8 {
+		t.Fatalf("duplicate line from another source should be dropped, got %+v", items)
+	}
+
+	// 不同时间重复出现的相同内容不是重复
+	items = f.filter([]logger.LogEntry{{ID: 9, TS: "2026-01-01T00:01:00Z", Message: "other line"}})
+	if len(items) != 1 {
+		t.Fatalf("same message at a later time should be kept, got %+v", items)
+	}
+
+	// 超出容量后最早的指纹被淘汰
+	items = f.filter([]logger.LogEntry{{ID: 10, TS: "2026-01-01T00:00:01Z", Message: "registered a@example.com"}})
+	if len(items) != 1 {
+		t.Fatalf("evicted fingerprint should no longer dedupe, got %+v", items)
+	}
+
+	var disabled *recentFingerprints
+	if got := disabled.filter([]logger.LogEntry{{ID: 1}, {ID: 1}}); len(got) != 2 {
+		t.Fatalf("nil set should not dedupe, got %+v", got)
+	}
+}
+
+// recordingSink 记录推送的日志批次与续传位置
+type recordingSink struct {
+	batches [][]logger.LogEntry
+	cursors []string
+}
+
+func (s *recordingSink) Logs(items []logger.LogEntry, cursor string) error {
+	s.batches = append(s.batches, items)
+	s.cursors = append(s.cursors, cursor)
+	return nil
+}
+
+func (s *recordingSink) System(string) error { return nil }
+func (s *recordingSink) Ping() error         { return nil }
+
+func TestStreamResumesFromLastEventID(t *testing.T) {
+	first := logger.AppendRaw("business2api", "resume test first")
+	second := logger.AppendRaw("business2api", "resume test second")
+	h := NewStreamHandler(StreamHandlerConfig{})
+	run := func(lastEventID string) *recordingSink {
+		ctx, cancel := context.WithTimeout(context.Background(), 700*time.Millisecond)
+		defer cancel()
+		sink := &recordingSink{}
+		h.stream(ctx, streamOptions{source: "business2api", level: "all", bootstrapLimit: 1000, pollMS: 500, lastEventID: lastEventID}, sink, time.Minute)
+		return sink
+	}
+
+	// 首次连接发送启动快照，事件 id 为最后一条日志的 ID
+	sink := run("")
+	if len(sink.batches) == 0 || sink.cursors[0] != strconv.FormatInt(second.ID, 10) {
+		t.Fatalf("first connect should send bootstrap with cursor %d, got %v", second.ID, sink.cursors)
+	}
+
+	// 重连时跳过快照，只补发 Last-Event-ID 之后的日志
+	sink = run(strconv.FormatInt(first.ID, 10))
+	if len(sink.batches) != 1 || len(sink.batches[0]) != 1 || sink.batches[0][0].ID != second.ID {
+		t.Fatalf("resume should only send entries after %d, got %+v", first.ID, sink.batches)
+	}
+
+	// 超过当前最新 ID（服务重启）或格式不符时回退到启动快照
+	for _, stale := range []string{strconv.FormatInt(second.ID+1000, 10), "1,2", "abc"} {
+		sink = run(stale)
+		if len(sink.batches) == 0 || len(sink.batches[0]) < 2 {
+			t.Fatalf("invalid Last-Event-ID %q should fall back to bootstrap, got %+v", stale, sink.batches)
+		}
+	}
+}
+
+func TestCursorRoundTripPerSource(t *testing.T) {
+	for _, source := range []string{"all", "business2api", "registrar"} {
+		local, registrar, ok := parseCursor(source, formatCursor(source, 7, 3))
+		wantLocal, wantRegistrar := int64(7), int64(3)
+		switch source {
+		case "business2api":
+			wantRegistrar = 0
+		case "registrar":
+			wantLocal = 0
+		}
+		if !ok || local != wantLocal || registrar != wantRegistrar {
+			t.Fatalf("%s cursor round trip = %d,%d,%v", source, local, registrar, ok)
+		}
+	}
+	if _, _, ok := parseCursor("all", "7"); ok {
+		t.Fatal("source=all cursor requires both ids")
+	}
+}
@@ -0,0 +1,109 @@
+package adminlogs
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+
+	"business2api/src/logger"
+)
+
+const (
+	wsPingInterval = 20 * time.Second
+	wsPongWait     = 60 * time.Second
+	wsWriteWait    = 10 * time.Second
+)
+
+// wsFrame WebSocket 推送帧：type 为 logs/system
+type wsFrame struct {
+	Type    string            `json:"type"`
+	Items   []logger.LogEntry `json:"items,omitempty"`
+	Message string            `json:"message,omitempty"`
+}
+
+var wsUpgrader = websocket.Upgrader{
+	CheckOrigin:     sameOriginOrAbsent,
+	ReadBufferSize:  1024,
+	WriteBufferSize: 4096,
+}
+
+// sameOriginOrAbsent 管理面板依赖 Cookie 会话，拒绝跨站页面发起的握手；非浏览器客户端不带 Origin 时放行
+func sameOriginOrAbsent(r *http.Request) bool {
+	origin := strings.TrimSpace(r.Header.Get("Origin"))
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+// wsSink 以 JSON 文本帧推送日志，心跳使用 WebSocket ping 控制帧
+type wsSink struct {
+	conn *websocket.Conn
+}
+
+func (s *wsSink) writeJSON(frame wsFrame) error {
+	_ = s.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	return s.conn.WriteJSON(frame)
+}
+
+func (s *wsSink) Logs(items []logger.LogEntry, _ string) error {
+	if len(items) == 0 {
+		return nil
+	}
+	return s.writeJSON(wsFrame{Type: "logs", Items: items})
+}
+
+func (s *wsSink) System(message string) error {
+	return s.writeJSON(wsFrame{Type: "system", Message: message})
+}
+
+func (s *wsSink) Ping() error {
+	return s.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait))
+}
+
+// WSHandler WebSocket 版日志流，参数与 SSE 一致（source/level/bootstrap_limit/poll_ms），
+// 适用于会缓冲或截断 SSE 的代理环境
+func (h *StreamHandler) WSHandler() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		opts := parseStreamOptions(c)
+
+		conn, err := wsUpgrader.Upgrade(c.Writer, c.Request, nil)
+		if err != nil {
+			logger.Debug("[LogsWS] 握手失败: %v", err)
+			return
+		}
+		defer conn.Close()
+
+		ctx, cancel := context.WithCancel(c.Request.Context())
+		defer cancel()
+
+		// 读循环：处理 pong/close，连接断开或心跳超时后结束推送
+		conn.SetReadLimit(4096)
+		_ = conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		})
+		go func() {
+			defer cancel()
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+				_ = conn.SetReadDeadline(time.Now().Add(wsPongWait))
+			}
+		}()
+
+		h.stream(ctx, opts, &wsSink{conn: conn}, wsPingInterval)
+		_ = conn.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(wsWriteWait))
+	}
+}
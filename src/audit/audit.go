@@ -0,0 +1,143 @@
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Entry 单条请求审计记录
+type Entry struct {
+	Time           time.Time   `json:"time"`
+	RequestID      string      `json:"request_id"` // 与响应中的 id (chatcmpl-...) 一致
+	Model          string      `json:"model"`
+	ClientIP       string      `json:"client_ip,omitempty"`
+	Messages       interface{} `json:"messages_redacted"`
+	UpstreamStatus int         `json:"upstream_status"` // 最后一次上游 HTTP 状态码，0 表示未请求上游
+	Success        bool        `json:"success"`
+	LatencyMS      int64       `json:"latency_ms"`
+}
+
+// Sink 按天滚动写入 JSON Lines 审计文件 (audit-YYYYMMDD.jsonl)
+type Sink struct {
+	mu   sync.Mutex
+	dir  string
+	day  string
+	file *os.File
+}
+
+func NewSink(dir string) *Sink {
+	return &Sink{dir: dir}
+}
+
+// Write 追加一条审计记录
+func (s *Sink) Write(entry Entry) error {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("序列化审计记录失败: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	day := entry.Time.Format("20060102")
+	if s.file == nil || s.day != day {
+		if s.file != nil {
+			s.file.Close()
+			s.file = nil
+		}
+		if err := os.MkdirAll(s.dir, 0755); err != nil {
+			return fmt.Errorf("创建审计目录失败: %w", err)
+		}
+		f, err := os.OpenFile(filepath.Join(s.dir, "audit-"+day+".jsonl"), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			return fmt.Errorf("打开审计文件失败: %w", err)
+		}
+		s.file = f
+		s.day = day
+	}
+	_, err = s.file.Write(append(line, '\n'))
+	return err
+}
+
+// Close 关闭当前审计文件
+func (s *Sink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// Sampled 按采样率决定是否记录 (rate>=1 全部记录，rate<=0 不记录)
+func Sampled(rate float64) bool {
+	if rate >= 1 {
+		return true
+	}
+	if rate <= 0 {
+		return false
+	}
+	return rand.Float64() < rate
+}
+
+// sensitiveKeys 需要脱敏的字段名（小写，去掉 -/_）
+var sensitiveKeys = map[string]bool{
+	"apikey":        true,
+	"xapikey":       true,
+	"key":           true,
+	"authorization": true,
+	"token":         true,
+	"accesstoken":   true,
+	"password":      true,
+	"secret":        true,
+	"cookie":        true,
+}
+
+// Redact 递归脱敏：敏感字段替换为 [redacted]，base64 data URI 只保留类型和长度
+func Redact(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(val))
+		for k, item := range val {
+			normalized := strings.NewReplacer("-", "", "_", "").Replace(strings.ToLower(k))
+			if sensitiveKeys[normalized] {
+				out[k] = "[redacted]"
+				continue
+			}
+			out[k] = Redact(item)
+		}
+		return out
+	case []interface{}:
+		out := make([]interface{}, len(val))
+		for i, item := range val {
+			out[i] = Redact(item)
+		}
+		return out
+	case string:
+		return redactString(val)
+	default:
+		return v
+	}
+}
+
+func redactString(s string) string {
+	if strings.HasPrefix(s, "data:") {
+		if idx := strings.Index(s, ";base64,"); idx > 0 {
+			return fmt.Sprintf("%s;base64,[%d bytes redacted]", s[:idx], len(s)-idx-len(";base64,"))
+		}
+	}
+	if strings.HasPrefix(s, "Bearer ") {
+		return "Bearer [redacted]"
+	}
+	return s
+}
@@ -0,0 +1,72 @@
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRedactMasksSecretsAndMedia(t *testing.T) {
+	in := []interface{}{map[string]interface{}{
+		"role": "user",
+		"content": []interface{}{
+			map[string]interface{}{"type": "text", "text": "hello"},
+			map[string]interface{}{"type": "image_url", "image_url": map[string]interface{}{
+				"url":     "data:image/png;base64,AAAABBBB",
+				"headers": map[string]interface{}{"Authorization": "Bearer sk-abc", "X-Api-Key": "sk-def"},
+			}},
+		},
+	}}
+
+	raw, _ := json.Marshal(Redact(in))
+	got := string(raw)
+	for _, secret := range []string{"sk-abc", "sk-def", "AAAABBBB"} {
+		if strings.Contains(got, secret) {
+			t.Fatalf("redacted output still contains %q: %s", secret, got)
+		}
+	}
+	if !strings.Contains(got, "hello") || !strings.Contains(got, "data:image/png;base64,[8 bytes redacted]") {
+		t.Fatalf("unexpected redacted output: %s", got)
+	}
+}
+
+func TestSinkWritesDailyJSONLines(t *testing.T) {
+	dir := t.TempDir()
+	sink := NewSink(dir)
+	defer sink.Close()
+
+	day := time.Date(2026, 3, 1, 12, 0, 0, 0, time.Local)
+	for _, id := range []string{"chatcmpl-1", "chatcmpl-2"} {
+		if err := sink.Write(Entry{Time: day, RequestID: id, Model: "gemini-2.5-flash", UpstreamStatus: 200, Success: true}); err != nil {
+			t.Fatalf("write: %v", err)
+		}
+	}
+
+	f, err := os.Open(filepath.Join(dir, "audit-20260301.jsonl"))
+	if err != nil {
+		t.Fatalf("open audit file: %v", err)
+	}
+	defer f.Close()
+	var ids []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var entry Entry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("invalid json line: %v", err)
+		}
+		ids = append(ids, entry.RequestID)
+	}
+	if strings.Join(ids, ",") != "chatcmpl-1,chatcmpl-2" {
+		t.Fatalf("unexpected entries: %v", ids)
+	}
+}
+
+func TestSampled(t *testing.T) {
+	if !Sampled(1) || Sampled(0) {
+		t.Fatalf("rate 1 should always sample and rate 0 never")
+	}
+}
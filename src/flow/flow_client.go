@@ -9,6 +9,7 @@ import (
 	"io"
 	"math/rand"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -22,6 +23,7 @@ const (
 	DefaultTimeout         = 120
 	DefaultPollInterval    = 3
 	DefaultMaxPollAttempts = 500
+	DefaultAuthRetry       = 2
 )
 
 // FlowConfig Flow 服务配置
@@ -32,6 +34,7 @@ type FlowConfig struct {
 	PollInterval    int    `json:"poll_interval"`
 	MaxPollAttempts int    `json:"max_poll_attempts"`
 	Proxy           string `json:"proxy"`
+	AuthRetry       int    `json:"auth_retry"` // 认证失败时切换 Token 重试次数 (0=默认, <0=不重试)
 }
 
 // FlowToken Flow Token (ST/AT)
@@ -47,9 +50,38 @@ type FlowToken struct {
 	Disabled        bool      `json:"disabled"`
 	LastUsed        time.Time `json:"last_used"`
 	ErrorCount      int       `json:"error_count"`
+	GenerationCount int       `json:"generation_count"` // 生成请求次数
+	SuccessCount    int       `json:"success_count"`    // 生成成功次数
+	FailCount       int       `json:"fail_count"`       // 生成失败次数
+	LastError       string    `json:"last_error"`       // 最近一次生成失败原因
+	LastErrorAt     time.Time `json:"last_error_at"`    // 最近一次生成失败时间
+	DisabledReason  string    `json:"disabled_reason"`  // 被移出轮换的原因
+	lastSelected    time.Time // 最近一次被选中的时间，用于轮换
 	mu              sync.RWMutex
 }
 
+// ShortID 返回用于日志和状态展示的 Token ID 前缀
+func (t *FlowToken) ShortID() string {
+	if len(t.ID) <= 16 {
+		return t.ID
+	}
+	return t.ID[:16] + "..."
+}
+
+// RecordGeneration 记录一次生成结果
+func (t *FlowToken) RecordGeneration(success bool, errMsg string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.GenerationCount++
+	if success {
+		t.SuccessCount++
+		return
+	}
+	t.FailCount++
+	t.LastError = errMsg
+	t.LastErrorAt = time.Now()
+}
+
 // FlowClient VideoFX API 客户端
 type FlowClient struct {
 	config     FlowConfig
@@ -75,6 +107,9 @@ func NewFlowClient(config FlowConfig) *FlowClient {
 	if config.MaxPollAttempts == 0 {
 		config.MaxPollAttempts = DefaultMaxPollAttempts
 	}
+	if config.AuthRetry == 0 {
+		config.AuthRetry = DefaultAuthRetry
+	}
 
 	return &FlowClient{
 		config: config,
@@ -99,20 +134,54 @@ func (fc *FlowClient) GetToken(id string) *FlowToken {
 	return fc.tokens[id]
 }
 
-// SelectToken 选择可用 Token
+// FindToken 按完整 ID 或唯一前缀（如状态接口展示的 16 位前缀）查找 Token
+func (fc *FlowClient) FindToken(id string) *FlowToken {
+	id = strings.TrimSuffix(strings.TrimSpace(id), "...")
+	if id == "" {
+		return nil
+	}
+
+	fc.tokensMu.RLock()
+	defer fc.tokensMu.RUnlock()
+	if t, ok := fc.tokens[id]; ok {
+		return t
+	}
+	var match *FlowToken
+	for tokenID, t := range fc.tokens {
+		if strings.HasPrefix(tokenID, id) {
+			if match != nil {
+				return nil // 前缀不唯一
+			}
+			match = t
+		}
+	}
+	return match
+}
+
+// SelectToken 选择可用 Token（按最近被选中时间轮换，避免单个 Token 被过度使用）
 func (fc *FlowClient) SelectToken() *FlowToken {
 	fc.tokensMu.RLock()
 	defer fc.tokensMu.RUnlock()
 
 	var best *FlowToken
+	var bestSelected time.Time
 	for _, t := range fc.tokens {
-		if t.Disabled || t.ErrorCount >= 3 {
+		t.mu.RLock()
+		healthy := !t.Disabled && t.ErrorCount < 3
+		selected := t.lastSelected
+		t.mu.RUnlock()
+		if !healthy {
 			continue
 		}
-		if best == nil || t.LastUsed.Before(best.LastUsed) {
-			best = t
+		if best == nil || selected.Before(bestSelected) {
+			best, bestSelected = t, selected
 		}
 	}
+	if best != nil {
+		best.mu.Lock()
+		best.lastSelected = time.Now()
+		best.mu.Unlock()
+	}
 	return best
 }
 
@@ -379,13 +448,26 @@ type GenerateImageResponse struct {
 // ==================== 视频生成 (使用AT) ====================
 
 // GenerateVideoText 文生视频
-func (fc *FlowClient) GenerateVideoText(at, projectID, prompt, modelKey, aspectRatio, userPaygateTier string) (*GenerateVideoResponse, error) {
+func (fc *FlowClient) GenerateVideoText(at, projectID, prompt, modelKey, aspectRatio, userPaygateTier string, output VideoOutput) (*GenerateVideoResponse, error) {
 	url := fmt.Sprintf("%s/video:batchAsyncGenerateVideoText", fc.config.APIBaseURL)
 	headers := map[string]string{
 		"authorization": "Bearer " + at,
 	}
 
 	sceneID := uuid.New().String()
+	request := map[string]interface{}{
+		"aspectRatio": aspectRatio,
+		"seed":        rand.Intn(99999) + 1,
+		"textInput": map[string]interface{}{
+			"prompt": prompt,
+		},
+		"videoModelKey": modelKey,
+		"metadata": map[string]interface{}{
+			"sceneId": sceneID,
+		},
+	}
+	output.apply(request)
+
 	body := map[string]interface{}{
 		"clientContext": map[string]interface{}{
 			"sessionId":       fc.generateSessionID(),
@@ -393,24 +475,14 @@ func (fc *FlowClient) GenerateVideoText(at, projectID, prompt, modelKey, aspectR
 			"tool":            "PINHOLE",
 			"userPaygateTier": userPaygateTier,
 		},
-		"requests": []map[string]interface{}{{
-			"aspectRatio": aspectRatio,
-			"seed":        rand.Intn(99999) + 1,
-			"textInput": map[string]interface{}{
-				"prompt": prompt,
-			},
-			"videoModelKey": modelKey,
-			"metadata": map[string]interface{}{
-				"sceneId": sceneID,
-			},
-		}},
+		"requests": []map[string]interface{}{request},
 	}
 
 	return fc.parseVideoResponse(fc.makeRequest("POST", url, headers, body))
 }
 
 // GenerateVideoStartEnd 首尾帧生成视频
-func (fc *FlowClient) GenerateVideoStartEnd(at, projectID, prompt, modelKey, aspectRatio, startMediaID, endMediaID, userPaygateTier string) (*GenerateVideoResponse, error) {
+func (fc *FlowClient) GenerateVideoStartEnd(at, projectID, prompt, modelKey, aspectRatio, startMediaID, endMediaID, userPaygateTier string, output VideoOutput) (*GenerateVideoResponse, error) {
 	url := fmt.Sprintf("%s/video:batchAsyncGenerateVideoStartAndEndImage", fc.config.APIBaseURL)
 	headers := map[string]string{
 		"authorization": "Bearer " + at,
@@ -438,6 +510,7 @@ func (fc *FlowClient) GenerateVideoStartEnd(at, projectID, prompt, modelKey, asp
 			"mediaId": endMediaID,
 		}
 	}
+	output.apply(request)
 
 	body := map[string]interface{}{
 		"clientContext": map[string]interface{}{
@@ -453,13 +526,27 @@ func (fc *FlowClient) GenerateVideoStartEnd(at, projectID, prompt, modelKey, asp
 }
 
 // GenerateVideoReferenceImages 多图生成视频
-func (fc *FlowClient) GenerateVideoReferenceImages(at, projectID, prompt, modelKey, aspectRatio string, referenceImages []map[string]interface{}, userPaygateTier string) (*GenerateVideoResponse, error) {
+func (fc *FlowClient) GenerateVideoReferenceImages(at, projectID, prompt, modelKey, aspectRatio string, referenceImages []map[string]interface{}, userPaygateTier string, output VideoOutput) (*GenerateVideoResponse, error) {
 	url := fmt.Sprintf("%s/video:batchAsyncGenerateVideoReferenceImages", fc.config.APIBaseURL)
 	headers := map[string]string{
 		"authorization": "Bearer " + at,
 	}
 
 	sceneID := uuid.New().String()
+	request := map[string]interface{}{
+		"aspectRatio": aspectRatio,
+		"seed":        rand.Intn(99999) + 1,
+		"textInput": map[string]interface{}{
+			"prompt": prompt,
+		},
+		"videoModelKey":   modelKey,
+		"referenceImages": referenceImages,
+		"metadata": map[string]interface{}{
+			"sceneId": sceneID,
+		},
+	}
+	output.apply(request)
+
 	body := map[string]interface{}{
 		"clientContext": map[string]interface{}{
 			"sessionId":       fc.generateSessionID(),
@@ -467,18 +554,7 @@ func (fc *FlowClient) GenerateVideoReferenceImages(at, projectID, prompt, modelK
 			"tool":            "PINHOLE",
 			"userPaygateTier": userPaygateTier,
 		},
-		"requests": []map[string]interface{}{{
-			"aspectRatio": aspectRatio,
-			"seed":        rand.Intn(99999) + 1,
-			"textInput": map[string]interface{}{
-				"prompt": prompt,
-			},
-			"videoModelKey":   modelKey,
-			"referenceImages": referenceImages,
-			"metadata": map[string]interface{}{
-				"sceneId": sceneID,
-			},
-		}},
+		"requests": []map[string]interface{}{request},
 	}
 
 	return fc.parseVideoResponse(fc.makeRequest("POST", url, headers, body))
@@ -542,6 +618,7 @@ func (fc *FlowClient) CheckVideoStatus(at string, operations []map[string]interf
 			if status, ok := op["status"].(string); ok {
 				resp.Status = status
 			}
+			resp.Progress, resp.HasProgress = parseVideoProgress(op)
 			if operation, ok := op["operation"].(map[string]interface{}); ok {
 				if name, ok := operation["name"].(string); ok {
 					resp.TaskID = name
@@ -561,9 +638,55 @@ func (fc *FlowClient) CheckVideoStatus(at string, operations []map[string]interf
 }
 
 type VideoStatusResponse struct {
-	TaskID   string `json:"task_id"`
-	Status   string `json:"status"`
-	VideoURL string `json:"video_url"`
+	TaskID      string `json:"task_id"`
+	Status      string `json:"status"`
+	VideoURL    string `json:"video_url"`
+	Progress    int    `json:"progress"`     // 渲染进度 (0-100)，仅 HasProgress 为 true 时有效
+	HasProgress bool   `json:"has_progress"` // 上游是否返回了进度
+}
+
+// videoProgressKeys 轮询响应中可能携带进度的字段
+var videoProgressKeys = []string{"progress", "progressPercent", "progressPercentage", "percentComplete", "percentage"}
+
+// parseVideoProgress 从轮询响应的 operation 及其 metadata 中解析渲染进度
+func parseVideoProgress(op map[string]interface{}) (int, bool) {
+	candidates := []map[string]interface{}{op}
+	if operation, ok := op["operation"].(map[string]interface{}); ok {
+		candidates = append(candidates, operation)
+		if metadata, ok := operation["metadata"].(map[string]interface{}); ok {
+			candidates = append(candidates, metadata)
+		}
+	}
+	for _, m := range candidates {
+		for _, key := range videoProgressKeys {
+			raw, ok := m[key]
+			if !ok {
+				continue
+			}
+			var value float64
+			switch v := raw.(type) {
+			case float64:
+				value = v
+			case string:
+				parsed, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(v), "%"), 64)
+				if err != nil {
+					continue
+				}
+				value = parsed
+			default:
+				continue
+			}
+			// 0-1 的小数视为比例
+			if value > 0 && value < 1 {
+				value *= 100
+			}
+			if value < 0 || value > 100 {
+				continue
+			}
+			return int(value), true
+		}
+	}
+	return 0, false
 }
 
 // PollVideoResult 轮询视频生成结果
@@ -1,15 +1,116 @@
 package flow
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
+	"strings"
+	"sync"
 	"time"
 )
 
 // GenerationHandler Flow 生成处理器
 type GenerationHandler struct {
 	client *FlowClient
+	// OnTokenDisabled Token 因认证失败被移出轮换时回调（异步执行）
+	OnTokenDisabled func(token *FlowToken, reason string)
+
+	stats generationStats
+}
+
+// generationStats Flow 生成请求统计（按最终结果计数，切换 Token 的重试不重复计入）
+type generationStats struct {
+	mu             sync.Mutex
+	requests       int64
+	success        int64
+	failed         int64
+	images         int64            // 成功生成的图片数
+	videos         int64            // 成功生成的视频数
+	polledVideos   int64            // 发生过轮询的视频请求数
+	pollAttempts   int64            // 视频结果轮询次数累计
+	failureReasons map[string]int64 // 失败分类 → 次数
+}
+
+// record 记录一次生成请求的最终结果
+func (s *generationStats) record(modelType ModelType, result *GenerationResult, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+	if result != nil && result.PollAttempts > 0 {
+		s.polledVideos++
+		s.pollAttempts += int64(result.PollAttempts)
+	}
+	if err == nil && result != nil && result.Success {
+		s.success++
+		if modelType == ModelTypeImage {
+			s.images++
+		} else {
+			s.videos++
+		}
+		return
+	}
+	s.failed++
+	msg := ""
+	if err != nil {
+		msg = err.Error()
+	} else if result != nil {
+		msg = result.Error
+	}
+	if s.failureReasons == nil {
+		s.failureReasons = make(map[string]int64)
+	}
+	s.failureReasons[failureReason(msg)]++
+}
+
+// failureReason 将生成失败信息归类，避免原始错误文本（含 ID 等）使统计无限增长
+func failureReason(msg string) string {
+	switch {
+	case isAuthFailure(msg):
+		return "auth"
+	case strings.Contains(msg, "没有可用的 Flow Token"):
+		return "no_token"
+	case strings.Contains(msg, "已取消"):
+		return "cancelled"
+	case strings.Contains(msg, "超时"):
+		return "timeout"
+	case strings.Contains(msg, "不支持的模型"):
+		return "unsupported_model"
+	case strings.Contains(msg, "上传"):
+		return "upload"
+	case strings.Contains(msg, "创建项目失败"):
+		return "project"
+	case strings.Contains(msg, "提交任务失败"), strings.Contains(msg, "任务创建失败"):
+		return "submit"
+	case strings.Contains(msg, "生成"):
+		return "generation"
+	}
+	return "other"
+}
+
+// Stats 返回生成统计：请求数、成功率、图片/视频数、平均轮询次数与失败分类
+func (h *GenerationHandler) Stats() map[string]interface{} {
+	s := &h.stats
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	avgPoll := float64(0)
+	if s.polledVideos > 0 {
+		avgPoll = float64(s.pollAttempts) / float64(s.polledVideos)
+	}
+	reasons := make(map[string]int64, len(s.failureReasons))
+	for reason, n := range s.failureReasons {
+		reasons[reason] = n
+	}
+	return map[string]interface{}{
+		"requests":          s.requests,
+		"success":           s.success,
+		"failed":            s.failed,
+		"success_rate":      fmt.Sprintf("%.2f%%", float64(s.success)/float64(max(s.requests, 1))*100),
+		"images":            s.images,
+		"videos":            s.videos,
+		"avg_poll_attempts": fmt.Sprintf("%.1f", avgPoll),
+		"failure_reasons":   reasons,
+	}
 }
 
 // NewGenerationHandler 创建生成处理器
@@ -19,27 +120,55 @@ func NewGenerationHandler(client *FlowClient) *GenerationHandler {
 
 // GenerationRequest 生成请求
 type GenerationRequest struct {
-	Model  string   `json:"model"`
-	Prompt string   `json:"prompt"`
-	Images [][]byte `json:"images,omitempty"` // 图片字节数据
-	Stream bool     `json:"stream"`
+	Model      string   `json:"model"`
+	Prompt     string   `json:"prompt"`
+	Images     [][]byte `json:"images,omitempty"` // 图片字节数据
+	Stream     bool     `json:"stream"`
+	NoProgress bool     `json:"no_progress"` // 关闭视频轮询期间的进度推送
+	// 视频模型按角色划分的图片；均为空时按模型类型从 Images 自动划分
+	StartImage      []byte   `json:"start_image,omitempty"`      // 首帧 (I2V)
+	EndImage        []byte   `json:"end_image,omitempty"`        // 尾帧 (I2V)
+	ReferenceImages [][]byte `json:"reference_images,omitempty"` // 参考图 (R2V)
+	// Output 视频时长/清晰度，零值使用 Flow 默认值
+	Output VideoOutput `json:"output,omitempty"`
+	// Ctx 请求截止时间，到期后停止轮询；为空表示不限
+	Ctx context.Context `json:"-"`
+}
+
+// requestContext 返回请求的 Context，未设置时为 Background
+func (r GenerationRequest) requestContext() context.Context {
+	if r.Ctx != nil {
+		return r.Ctx
+	}
+	return context.Background()
 }
 
 // GenerationResult 生成结果
 type GenerationResult struct {
-	Success  bool   `json:"success"`
-	Type     string `json:"type"` // "image" 或 "video"
-	URL      string `json:"url"`
-	Error    string `json:"error,omitempty"`
-	Progress int    `json:"progress,omitempty"`
-	Message  string `json:"message,omitempty"`
+	Success      bool   `json:"success"`
+	Type         string `json:"type"` // "image" 或 "video"
+	URL          string `json:"url"`
+	Error        string `json:"error,omitempty"`
+	Progress     int    `json:"progress,omitempty"`
+	Message      string `json:"message,omitempty"`
+	PollAttempts int    `json:"poll_attempts,omitempty"` // 视频结果轮询次数
 }
 
+// progressEstimateEvery 上游未返回进度时，每隔多少次轮询推送一次估算进度
+const progressEstimateEvery = 5
+
 // StreamCallback 流式回调函数
 type StreamCallback func(chunk string)
 
-// HandleGeneration 处理生成请求
+// HandleGeneration 处理生成请求，并计入生成统计
 func (h *GenerationHandler) HandleGeneration(req GenerationRequest, streamCb StreamCallback) (*GenerationResult, error) {
+	result, err := h.handleGeneration(req, streamCb)
+	modelConfig, _ := GetFlowModelConfig(req.Model)
+	h.stats.record(modelConfig.Type, result, err)
+	return result, err
+}
+
+func (h *GenerationHandler) handleGeneration(req GenerationRequest, streamCb StreamCallback) (*GenerationResult, error) {
 	// 验证模型
 	modelConfig, ok := GetFlowModelConfig(req.Model)
 	if !ok {
@@ -49,15 +178,97 @@ func (h *GenerationHandler) HandleGeneration(req GenerationRequest, streamCb Str
 		}, nil
 	}
 
-	// 选择 Token
-	token := h.client.SelectToken()
-	if token == nil {
+	// 选择 Token，认证失败时禁用该 Token 并切换下一个重试
+	maxRetry := max(h.client.config.AuthRetry, 0)
+	var result *GenerationResult
+	var err error
+	for attempt := 0; attempt <= maxRetry; attempt++ {
+		if ctxErr := req.requestContext().Err(); ctxErr != nil {
+			return &GenerationResult{Success: false, Error: fmt.Sprintf("请求已取消: %v", ctxErr)}, nil
+		}
+		token := h.client.SelectToken()
+		if token == nil {
+			if result != nil {
+				return result, err
+			}
+			return &GenerationResult{
+				Success: false,
+				Error:   "没有可用的 Flow Token",
+			}, nil
+		}
+
+		result, err = h.generateWithToken(token, modelConfig, req, streamCb)
+		if err != nil || result == nil || result.Success || !isAuthFailure(result.Error) {
+			return result, err
+		}
+		if attempt < maxRetry {
+			log.Printf("[Flow] Token %s 认证失败，切换 Token 重试 (%d/%d)", token.ShortID(), attempt+1, maxRetry)
+			if streamCb != nil {
+				streamCb(h.createStreamChunk("⚠️ Token 认证失效，切换 Token 重试...\n", false))
+			}
+		}
+	}
+	return result, err
+}
+
+// isAuthFailure 判断生成失败是否由 Token 认证失效引起（cookie 过期、401 等）
+func isAuthFailure(msg string) bool {
+	return strings.HasPrefix(msg, "Token 认证失败") ||
+		strings.Contains(msg, "HTTP 401") ||
+		strings.Contains(msg, "UNAUTHENTICATED")
+}
+
+// disableToken 将认证失效的 Token 移出轮换，并触发回调
+func (h *GenerationHandler) disableToken(token *FlowToken, reason string) {
+	token.mu.Lock()
+	alreadyDisabled := token.Disabled
+	token.Disabled = true
+	token.DisabledReason = reason
+	token.mu.Unlock()
+	if alreadyDisabled {
+		return
+	}
+
+	log.Printf("[Flow] ⛔ Token %s 认证失效，已移出轮换: %s", token.ShortID(), reason)
+	if h.OnTokenDisabled != nil {
+		go h.OnTokenDisabled(token, reason)
+	}
+}
+
+// HandleGenerationWithToken 使用指定 Token 处理生成请求（用于单个 Token 可用性测试）
+func (h *GenerationHandler) HandleGenerationWithToken(tokenID string, req GenerationRequest, streamCb StreamCallback) (*GenerationResult, error) {
+	modelConfig, ok := GetFlowModelConfig(req.Model)
+	if !ok {
 		return &GenerationResult{
 			Success: false,
-			Error:   "没有可用的 Flow Token",
+			Error:   fmt.Sprintf("不支持的模型: %s", req.Model),
 		}, nil
 	}
 
+	token := h.client.FindToken(tokenID)
+	if token == nil {
+		return nil, fmt.Errorf("Token 不存在: %s", tokenID)
+	}
+
+	return h.generateWithToken(token, modelConfig, req, streamCb)
+}
+
+// generateWithToken 使用给定 Token 生成，并记录该 Token 的成功/失败统计
+func (h *GenerationHandler) generateWithToken(token *FlowToken, modelConfig ModelConfig, req GenerationRequest, streamCb StreamCallback) (*GenerationResult, error) {
+	result, err := h.runWithToken(token, modelConfig, req, streamCb)
+	switch {
+	case err != nil:
+		token.RecordGeneration(false, err.Error())
+	case result != nil:
+		token.RecordGeneration(result.Success, result.Error)
+		if !result.Success && isAuthFailure(result.Error) {
+			h.disableToken(token, result.Error)
+		}
+	}
+	return result, err
+}
+
+func (h *GenerationHandler) runWithToken(token *FlowToken, modelConfig ModelConfig, req GenerationRequest, streamCb StreamCallback) (*GenerationResult, error) {
 	// 确保 AT 有效
 	if err := h.ensureATValid(token); err != nil {
 		return &GenerationResult{
@@ -152,6 +363,24 @@ func (h *GenerationHandler) ensureProjectExists(token *FlowToken) error {
 	return nil
 }
 
+// requestVideoImageRoles 优先使用请求中显式指定的图片角色，否则按模型类型从 Images 划分
+func requestVideoImageRoles(req GenerationRequest) (VideoImageRoles, error) {
+	if req.StartImage != nil || req.EndImage != nil || len(req.ReferenceImages) > 0 {
+		if req.StartImage == nil && req.EndImage != nil {
+			return VideoImageRoles{}, fmt.Errorf("指定尾帧时必须同时提供首帧")
+		}
+		images := req.ReferenceImages
+		if req.StartImage != nil {
+			images = [][]byte{req.StartImage}
+			if req.EndImage != nil {
+				images = append(images, req.EndImage)
+			}
+		}
+		return AssignVideoImageRoles(req.Model, images)
+	}
+	return AssignVideoImageRoles(req.Model, req.Images)
+}
+
 // handleImageGeneration 处理图片生成
 func (h *GenerationHandler) handleImageGeneration(token *FlowToken, modelConfig ModelConfig, req GenerationRequest, streamCb StreamCallback) (*GenerationResult, error) {
 	if streamCb != nil {
@@ -236,54 +465,47 @@ func (h *GenerationHandler) handleVideoGeneration(token *FlowToken, modelConfig
 		streamCb(h.createStreamChunk("✨ 视频生成任务已启动\n", false))
 	}
 
-	imageCount := len(req.Images)
-
-	// 验证图片数量
-	if modelConfig.VideoType == VideoTypeT2V {
-		if imageCount > 0 {
-			if streamCb != nil {
-				streamCb(h.createStreamChunk("⚠️ 文生视频模型不支持图片，将忽略图片仅使用文本提示词\n", false))
-			}
-			req.Images = nil
-			imageCount = 0
-		}
-	} else if modelConfig.VideoType == VideoTypeI2V {
-		if imageCount < modelConfig.MinImages || imageCount > modelConfig.MaxImages {
-			return &GenerationResult{
-				Success: false,
-				Error:   fmt.Sprintf("首尾帧模型需要 %d-%d 张图片，当前提供了 %d 张", modelConfig.MinImages, modelConfig.MaxImages, imageCount),
-			}, nil
+	// 文生视频模型忽略图片
+	if modelConfig.VideoType == VideoTypeT2V && (len(req.Images) > 0 || len(req.ReferenceImages) > 0 || req.StartImage != nil) {
+		if streamCb != nil {
+			streamCb(h.createStreamChunk("⚠️ 文生视频模型不支持图片，将忽略图片仅使用文本提示词\n", false))
 		}
 	}
 
+	// 划分图片角色并验证数量
+	roles, roleErr := requestVideoImageRoles(req)
+	if roleErr != nil {
+		return &GenerationResult{Success: false, Error: roleErr.Error()}, nil
+	}
+
 	// 上传图片
 	var startMediaID, endMediaID string
 	var referenceImages []map[string]interface{}
 
-	if modelConfig.VideoType == VideoTypeI2V && len(req.Images) > 0 {
+	if modelConfig.VideoType == VideoTypeI2V && roles.StartFrame != nil {
 		if streamCb != nil {
 			streamCb(h.createStreamChunk("上传首帧图片...\n", false))
 		}
 		var err error
-		startMediaID, err = h.client.UploadImage(token.AT, req.Images[0], modelConfig.AspectRatio)
+		startMediaID, err = h.client.UploadImage(token.AT, roles.StartFrame, modelConfig.AspectRatio)
 		if err != nil {
 			return &GenerationResult{Success: false, Error: fmt.Sprintf("上传首帧失败: %v", err)}, nil
 		}
 
-		if len(req.Images) == 2 {
+		if roles.EndFrame != nil {
 			if streamCb != nil {
 				streamCb(h.createStreamChunk("上传尾帧图片...\n", false))
 			}
-			endMediaID, err = h.client.UploadImage(token.AT, req.Images[1], modelConfig.AspectRatio)
+			endMediaID, err = h.client.UploadImage(token.AT, roles.EndFrame, modelConfig.AspectRatio)
 			if err != nil {
 				return &GenerationResult{Success: false, Error: fmt.Sprintf("上传尾帧失败: %v", err)}, nil
 			}
 		}
-	} else if modelConfig.VideoType == VideoTypeR2V && len(req.Images) > 0 {
+	} else if modelConfig.VideoType == VideoTypeR2V && len(roles.References) > 0 {
 		if streamCb != nil {
-			streamCb(h.createStreamChunk(fmt.Sprintf("上传 %d 张参考图片...\n", len(req.Images)), false))
+			streamCb(h.createStreamChunk(fmt.Sprintf("上传 %d 张参考图片...\n", len(roles.References)), false))
 		}
-		for _, imgBytes := range req.Images {
+		for _, imgBytes := range roles.References {
 			mediaID, err := h.client.UploadImage(token.AT, imgBytes, modelConfig.AspectRatio)
 			if err != nil {
 				return &GenerationResult{Success: false, Error: fmt.Sprintf("上传图片失败: %v", err)}, nil
@@ -313,18 +535,18 @@ func (h *GenerationHandler) handleVideoGeneration(token *FlowToken, modelConfig
 		videoResp, err = h.client.GenerateVideoStartEnd(
 			token.AT, token.ProjectID, req.Prompt,
 			modelConfig.ModelKey, modelConfig.AspectRatio,
-			startMediaID, endMediaID, userTier,
+			startMediaID, endMediaID, userTier, req.Output,
 		)
 	case VideoTypeR2V:
 		videoResp, err = h.client.GenerateVideoReferenceImages(
 			token.AT, token.ProjectID, req.Prompt,
 			modelConfig.ModelKey, modelConfig.AspectRatio,
-			referenceImages, userTier,
+			referenceImages, userTier, req.Output,
 		)
 	default: // T2V
 		videoResp, err = h.client.GenerateVideoText(
 			token.AT, token.ProjectID, req.Prompt,
-			modelConfig.ModelKey, modelConfig.AspectRatio, userTier,
+			modelConfig.ModelKey, modelConfig.AspectRatio, userTier, req.Output,
 		)
 	}
 
@@ -344,9 +566,13 @@ func (h *GenerationHandler) handleVideoGeneration(token *FlowToken, modelConfig
 	}
 
 	// 轮询结果
-	videoURL, err := h.pollVideoResult(token, videoResp.TaskID, videoResp.SceneID, streamCb)
+	progressCb := streamCb
+	if req.NoProgress {
+		progressCb = nil
+	}
+	videoURL, attempts, err := h.pollVideoResult(req.requestContext(), token, videoResp.TaskID, videoResp.SceneID, progressCb)
 	if err != nil {
-		return &GenerationResult{Success: false, Error: err.Error()}, nil
+		return &GenerationResult{Success: false, Error: err.Error(), PollAttempts: attempts}, nil
 	}
 
 	// 更新 Token 使用
@@ -360,14 +586,17 @@ func (h *GenerationHandler) handleVideoGeneration(token *FlowToken, modelConfig
 	}
 
 	return &GenerationResult{
-		Success: true,
-		Type:    "video",
-		URL:     videoURL,
+		Success:      true,
+		Type:         "video",
+		URL:          videoURL,
+		PollAttempts: attempts,
 	}, nil
 }
 
-// pollVideoResult 轮询视频生成结果
-func (h *GenerationHandler) pollVideoResult(token *FlowToken, taskID, sceneID string, streamCb StreamCallback) (string, error) {
+// pollVideoResult 轮询视频生成结果，返回视频地址与轮询次数
+// streamCb 不为空时推送进度：上游返回进度则在变化时推送，否则按轮询次数定期推送估算值
+// ctx 到期或取消时立即停止轮询
+func (h *GenerationHandler) pollVideoResult(ctx context.Context, token *FlowToken, taskID, sceneID string, streamCb StreamCallback) (string, int, error) {
 	operations := []map[string]interface{}{{
 		"operation": map[string]interface{}{
 			"name": taskID,
@@ -378,37 +607,64 @@ func (h *GenerationHandler) pollVideoResult(token *FlowToken, taskID, sceneID st
 	maxAttempts := h.client.config.MaxPollAttempts
 	pollInterval := h.client.config.PollInterval
 
+	lastProgress := -1
 	for i := 0; i < maxAttempts; i++ {
-		time.Sleep(time.Duration(pollInterval) * time.Second)
+		timer := time.NewTimer(time.Duration(pollInterval) * time.Second)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+		case <-timer.C:
+		}
+		if err := ctx.Err(); err != nil {
+			return "", i, fmt.Errorf("视频生成已取消 (已轮询 %d 次): %w", i, err)
+		}
+		attempt := i + 1
 
 		resp, err := h.client.CheckVideoStatus(token.AT, operations)
 		if err != nil {
 			continue
 		}
 
-		// 进度更新
-		if streamCb != nil && i%7 == 0 {
-			progress := min(i*100/maxAttempts, 95)
-			streamCb(h.createStreamChunk(fmt.Sprintf("生成进度: %d%%\n", progress), false))
-		}
-
 		switch resp.Status {
 		case "MEDIA_GENERATION_STATUS_SUCCESSFUL":
 			if resp.VideoURL != "" {
-				return resp.VideoURL, nil
+				return resp.VideoURL, attempt, nil
 			}
 		case "MEDIA_GENERATION_STATUS_ERROR_UNKNOWN",
 			"MEDIA_GENERATION_STATUS_ERROR_NSFW",
 			"MEDIA_GENERATION_STATUS_ERROR_PERSON",
 			"MEDIA_GENERATION_STATUS_ERROR_SAFETY":
-			return "", fmt.Errorf("视频生成失败: %s", resp.Status)
+			return "", attempt, fmt.Errorf("视频生成失败: %s", resp.Status)
+		}
+
+		// 进度更新
+		if streamCb == nil {
+			continue
+		}
+		if resp.HasProgress {
+			if resp.Progress != lastProgress {
+				lastProgress = resp.Progress
+				streamCb(h.createStreamChunk(formatVideoProgress(resp.Progress, false, attempt, maxAttempts), false))
+			}
+		} else if i%progressEstimateEvery == 0 {
+			progress := min(i*100/maxAttempts, 95)
+			streamCb(h.createStreamChunk(formatVideoProgress(progress, true, attempt, maxAttempts), false))
 		}
 	}
 
-	return "", fmt.Errorf("视频生成超时 (已轮询 %d 次)", maxAttempts)
+	return "", maxAttempts, fmt.Errorf("视频生成超时 (已轮询 %d 次)", maxAttempts)
+}
+
+// formatVideoProgress 生成进度文本，estimated 表示进度为按轮询次数估算
+func formatVideoProgress(progress int, estimated bool, attempt, maxAttempts int) string {
+	if estimated {
+		return fmt.Sprintf("渲染中 约%d%% (轮询 %d/%d)\n", progress, attempt, maxAttempts)
+	}
+	return fmt.Sprintf("渲染中 %d%% (轮询 %d/%d)\n", progress, attempt, maxAttempts)
 }
 
-// createStreamChunk 创建流式响应块
+// createStreamChunk 创建流式响应块：isFinish 为最终结果（content），其余为进度（reasoning_content）。
+// finish_reason 由调用方在 [DONE] 前单独发送
 func (h *GenerationHandler) createStreamChunk(content string, isFinish bool) string {
 	chunk := map[string]interface{}{
 		"id":      fmt.Sprintf("chatcmpl-%d", time.Now().Unix()),
@@ -424,7 +680,6 @@ func (h *GenerationHandler) createStreamChunk(content string, isFinish bool) str
 
 	if isFinish {
 		chunk["choices"].([]map[string]interface{})[0]["delta"].(map[string]interface{})["content"] = content
-		chunk["choices"].([]map[string]interface{})[0]["finish_reason"] = "stop"
 	} else {
 		chunk["choices"].([]map[string]interface{})[0]["delta"].(map[string]interface{})["reasoning_content"] = content
 	}
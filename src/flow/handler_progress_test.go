@@ -0,0 +1,112 @@
+package flow
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseVideoProgress(t *testing.T) {
+	cases := []struct {
+		op   string
+		want int
+		ok   bool
+	}{
+		{`{"status":"MEDIA_GENERATION_STATUS_ACTIVE"}`, 0, false},
+		{`{"progress":40}`, 40, true},
+		{`{"operation":{"metadata":{"progressPercent":"65%"}}}`, 65, true},
+		{`{"operation":{"percentComplete":0.25}}`, 25, true},
+		{`{"progress":"n/a"}`, 0, false},
+		{`{"progress":140}`, 0, false},
+	}
+	for _, tc := range cases {
+		var op map[string]interface{}
+		if err := json.Unmarshal([]byte(tc.op), &op); err != nil {
+			t.Fatalf("unmarshal %s: %v", tc.op, err)
+		}
+		got, ok := parseVideoProgress(op)
+		if got != tc.want || ok != tc.ok {
+			t.Fatalf("%s: expected (%d,%v), got (%d,%v)", tc.op, tc.want, tc.ok, got, ok)
+		}
+	}
+}
+
+func newPollTestHandler(t *testing.T, responses []string) *GenerationHandler {
+	t.Helper()
+	call := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := responses[len(responses)-1]
+		if call < len(responses) {
+			body = responses[call]
+		}
+		call++
+		fmt.Fprint(w, body)
+	}))
+	t.Cleanup(srv.Close)
+	return NewGenerationHandler(&FlowClient{
+		config:     FlowConfig{APIBaseURL: srv.URL, MaxPollAttempts: 10},
+		httpClient: srv.Client(),
+	})
+}
+
+func TestPollVideoResultStreamsUpstreamProgress(t *testing.T) {
+	h := newPollTestHandler(t, []string{
+		`{"operations":[{"status":"MEDIA_GENERATION_STATUS_ACTIVE","progress":10}]}`,
+		`{"operations":[{"status":"MEDIA_GENERATION_STATUS_ACTIVE","progress":10}]}`,
+		`{"operations":[{"status":"MEDIA_GENERATION_STATUS_ACTIVE","progress":40}]}`,
+		`{"operations":[{"status":"MEDIA_GENERATION_STATUS_SUCCESSFUL","operation":{"metadata":{"video":{"fifeUrl":"https://example.com/v.mp4"}}}}]}`,
+	})
+
+	var chunks []string
+	url, attempts, err := h.pollVideoResult(context.Background(), &FlowToken{AT: "at"}, "task", "scene", func(chunk string) {
+		chunks = append(chunks, chunk)
+	})
+	if err != nil || url != "https://example.com/v.mp4" {
+		t.Fatalf("unexpected result url=%q err=%v", url, err)
+	}
+	if attempts != 4 {
+		t.Fatalf("expected 4 poll attempts, got %d", attempts)
+	}
+	if len(chunks) != 2 {
+		t.Fatalf("expected progress only when it changes, got %d chunks", len(chunks))
+	}
+	if !strings.Contains(chunks[0], "渲染中 10% (轮询 1/10)") || !strings.Contains(chunks[1], "渲染中 40% (轮询 3/10)") {
+		t.Fatalf("unexpected progress chunks: %v", chunks)
+	}
+}
+
+func TestPollVideoResultWithoutCallbackReportsAttempts(t *testing.T) {
+	h := newPollTestHandler(t, []string{
+		`{"operations":[{"status":"MEDIA_GENERATION_STATUS_ACTIVE"}]}`,
+		`{"operations":[{"status":"MEDIA_GENERATION_STATUS_ERROR_SAFETY"}]}`,
+	})
+
+	_, attempts, err := h.pollVideoResult(context.Background(), &FlowToken{AT: "at"}, "task", "scene", nil)
+	if err == nil || !strings.Contains(err.Error(), "ERROR_SAFETY") {
+		t.Fatalf("expected safety error, got %v", err)
+	}
+	if attempts != 2 {
+		t.Fatalf("expected 2 poll attempts, got %d", attempts)
+	}
+}
+
+func TestPollVideoResultStopsAtDeadline(t *testing.T) {
+	h := newPollTestHandler(t, []string{
+		`{"operations":[{"status":"MEDIA_GENERATION_STATUS_ACTIVE"}]}`,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, attempts, err := h.pollVideoResult(ctx, &FlowToken{AT: "at"}, "task", "scene", nil)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected cancellation error, got %v", err)
+	}
+	if attempts != 0 {
+		t.Fatalf("expected no poll attempts after cancellation, got %d", attempts)
+	}
+}
@@ -0,0 +1,134 @@
+package flow
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newRotationTestClient(t *testing.T, authRetry int) *FlowClient {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.Contains(r.URL.Path, "batchGenerateImages") {
+			fmt.Fprint(w, `{}`)
+			return
+		}
+		if r.Header.Get("Authorization") == "Bearer expired" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"error":{"status":"UNAUTHENTICATED"}}`)
+			return
+		}
+		fmt.Fprint(w, `{"media":[{"image":{"generatedImage":{"fifeUrl":"https://example.com/i.png"}}}]}`)
+	}))
+	t.Cleanup(srv.Close)
+	return &FlowClient{
+		config:     FlowConfig{APIBaseURL: srv.URL, AuthRetry: authRetry},
+		httpClient: srv.Client(),
+		tokens:     make(map[string]*FlowToken),
+	}
+}
+
+func newRotationTestToken(id, at string, lastSelected time.Time) *FlowToken {
+	return &FlowToken{
+		ID:           id,
+		AT:           at,
+		ATExpires:    time.Now().Add(time.Hour),
+		ProjectID:    "project",
+		lastSelected: lastSelected,
+	}
+}
+
+func TestHandleGenerationRotatesOnAuthFailure(t *testing.T) {
+	fc := newRotationTestClient(t, 2)
+	now := time.Now()
+	expired := newRotationTestToken("expired-token-0000000000", "expired", now.Add(-2*time.Minute))
+	good := newRotationTestToken("good-token-000000000000", "good", now.Add(-time.Minute))
+	fc.AddToken(expired)
+	fc.AddToken(good)
+
+	disabled := make(chan string, 1)
+	h := NewGenerationHandler(fc)
+	h.OnTokenDisabled = func(token *FlowToken, reason string) { disabled <- token.ID }
+
+	result, err := h.HandleGeneration(GenerationRequest{Model: "gemini-2.5-flash-image-landscape", Prompt: "x"}, nil)
+	if err != nil || !result.Success || result.URL != "https://example.com/i.png" {
+		t.Fatalf("expected retry with next token to succeed, got %+v err=%v", result, err)
+	}
+	if !expired.Disabled || !strings.Contains(expired.DisabledReason, "HTTP 401") {
+		t.Fatalf("expired token should be disabled with reason, got disabled=%v reason=%q", expired.Disabled, expired.DisabledReason)
+	}
+	if good.Disabled || good.SuccessCount != 1 {
+		t.Fatalf("good token should stay healthy with one success")
+	}
+	select {
+	case id := <-disabled:
+		if id != expired.ID {
+			t.Fatalf("unexpected disabled token %s", id)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected disable callback")
+	}
+	if next := fc.SelectToken(); next != good {
+		t.Fatalf("disabled token should be out of rotation")
+	}
+}
+
+func TestHandleGenerationNoRetryWhenDisabled(t *testing.T) {
+	fc := newRotationTestClient(t, -1)
+	now := time.Now()
+	fc.AddToken(newRotationTestToken("expired-token-0000000000", "expired", now.Add(-2*time.Minute)))
+	fc.AddToken(newRotationTestToken("good-token-000000000000", "good", now.Add(-time.Minute)))
+
+	result, err := NewGenerationHandler(fc).HandleGeneration(GenerationRequest{Model: "gemini-2.5-flash-image-landscape", Prompt: "x"}, nil)
+	if err != nil || result.Success {
+		t.Fatalf("expected failure without retry, got %+v err=%v", result, err)
+	}
+}
+
+func TestSelectTokenRoundRobin(t *testing.T) {
+	fc := NewFlowClient(FlowConfig{})
+	a := &FlowToken{ID: "token-a"}
+	b := &FlowToken{ID: "token-b"}
+	fc.AddToken(a)
+	fc.AddToken(b)
+
+	first := fc.SelectToken()
+	second := fc.SelectToken()
+	if first == second {
+		t.Fatalf("consecutive selections should rotate between healthy tokens")
+	}
+	if third := fc.SelectToken(); third != first {
+		t.Fatalf("third selection should wrap back to the first token")
+	}
+}
+
+func TestGenerationStatsCountResultsAndFailureReasons(t *testing.T) {
+	fc := newRotationTestClient(t, 2)
+	now := time.Now()
+	fc.AddToken(newRotationTestToken("expired-token-0000000000", "expired", now.Add(-2*time.Minute)))
+	fc.AddToken(newRotationTestToken("good-token-000000000000", "good", now.Add(-time.Minute)))
+	h := NewGenerationHandler(fc)
+
+	// 认证失败后切换 Token 成功，只计为一次成功请求
+	if result, err := h.HandleGeneration(GenerationRequest{Model: "gemini-2.5-flash-image-landscape", Prompt: "x"}, nil); err != nil || !result.Success {
+		t.Fatalf("expected success, got %+v err=%v", result, err)
+	}
+	h.HandleGeneration(GenerationRequest{Model: "no-such-model", Prompt: "x"}, nil)
+	h.stats.record(ModelTypeVideo, &GenerationResult{Success: true, PollAttempts: 4}, nil)
+	h.stats.record(ModelTypeVideo, &GenerationResult{Error: "视频生成超时 (已轮询 6 次)", PollAttempts: 6}, nil)
+
+	stats := h.Stats()
+	if stats["requests"] != int64(4) || stats["success"] != int64(2) || stats["failed"] != int64(2) {
+		t.Fatalf("unexpected counts: %v", stats)
+	}
+	if stats["images"] != int64(1) || stats["videos"] != int64(1) || stats["avg_poll_attempts"] != "5.0" {
+		t.Fatalf("unexpected media/poll stats: %v", stats)
+	}
+	reasons := stats["failure_reasons"].(map[string]int64)
+	if reasons["unsupported_model"] != 1 || reasons["timeout"] != 1 || reasons["auth"] != 0 {
+		t.Fatalf("unexpected failure reasons: %v", reasons)
+	}
+}
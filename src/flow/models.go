@@ -1,5 +1,10 @@
 package flow
 
+import (
+	"fmt"
+	"strings"
+)
+
 // ModelType 模型类型
 type ModelType string
 
@@ -187,6 +192,123 @@ var FlowModelConfig = map[string]ModelConfig{
 	},
 }
 
+// VideoImageRoles 视频模型输入图片的角色划分
+type VideoImageRoles struct {
+	StartFrame []byte   // 首帧 (I2V)
+	EndFrame   []byte   // 尾帧 (I2V，可选)
+	References [][]byte // 参考图 (R2V)
+}
+
+// AssignVideoImageRoles 按模型类型划分图片角色并校验数量：
+// I2V 第一张为首帧、第二张为尾帧；R2V 全部作为参考图；T2V 不使用图片
+func AssignVideoImageRoles(model string, images [][]byte) (VideoImageRoles, error) {
+	cfg, ok := GetFlowModelConfig(model)
+	if !ok || cfg.Type != ModelTypeVideo {
+		return VideoImageRoles{}, nil
+	}
+
+	count := len(images)
+	switch cfg.VideoType {
+	case VideoTypeI2V:
+		if count < cfg.MinImages || count > cfg.MaxImages {
+			return VideoImageRoles{}, fmt.Errorf("模型 %s 为首尾帧模型，需要 %d-%d 张图片（第 1 张为首帧，第 2 张为尾帧），当前提供了 %d 张",
+				model, cfg.MinImages, cfg.MaxImages, count)
+		}
+		roles := VideoImageRoles{StartFrame: images[0]}
+		if count > 1 {
+			roles.EndFrame = images[1]
+		}
+		return roles, nil
+	case VideoTypeR2V:
+		if count < cfg.MinImages || (cfg.MaxImages > 0 && count > cfg.MaxImages) {
+			limit := fmt.Sprintf("至少 %d 张", cfg.MinImages)
+			if cfg.MaxImages > 0 {
+				limit = fmt.Sprintf("%d-%d 张", cfg.MinImages, cfg.MaxImages)
+			}
+			return VideoImageRoles{}, fmt.Errorf("模型 %s 为参考图模型，需要%s参考图片，当前提供了 %d 张", model, limit, count)
+		}
+		return VideoImageRoles{References: images}, nil
+	}
+	return VideoImageRoles{}, nil
+}
+
+// VideoOutputRange 视频模型可调的输出参数范围
+type VideoOutputRange struct {
+	MinDuration int      // 最短时长（秒）
+	MaxDuration int      // 最长时长（秒）
+	Qualities   []string // 可选清晰度
+}
+
+// videoOutputRanges 按模型系列（videoModelKey 前缀）划分的时长/清晰度范围
+var videoOutputRanges = map[string]VideoOutputRange{
+	"veo_3": {MinDuration: 4, MaxDuration: 8, Qualities: []string{"720p", "1080p"}},
+	"veo_2": {MinDuration: 5, MaxDuration: 8, Qualities: []string{"720p"}},
+}
+
+// videoQualityResolutions 清晰度到 Flow 分辨率枚举的映射
+var videoQualityResolutions = map[string]string{
+	"720p":  "VIDEO_RESOLUTION_720P",
+	"1080p": "VIDEO_RESOLUTION_1080P",
+}
+
+// VideoOutput 视频输出参数，零值表示使用 Flow 默认值
+type VideoOutput struct {
+	DurationSeconds int    `json:"duration_seconds,omitempty"`
+	Quality         string `json:"quality,omitempty"` // 720p / 1080p
+}
+
+// apply 将已设置的输出参数写入生成请求
+func (o VideoOutput) apply(request map[string]interface{}) {
+	if o.DurationSeconds > 0 {
+		request["videoDurationSeconds"] = o.DurationSeconds
+	}
+	if resolution, ok := videoQualityResolutions[o.Quality]; ok {
+		request["videoResolution"] = resolution
+	}
+}
+
+// GetVideoOutputRange 返回视频模型支持的时长/清晰度范围
+func GetVideoOutputRange(model string) (VideoOutputRange, bool) {
+	cfg, ok := GetFlowModelConfig(model)
+	if !ok || cfg.Type != ModelTypeVideo {
+		return VideoOutputRange{}, false
+	}
+	for prefix, r := range videoOutputRanges {
+		if strings.HasPrefix(cfg.ModelKey, prefix) {
+			return r, true
+		}
+	}
+	return VideoOutputRange{}, false
+}
+
+// ValidateVideoOutput 校验并规范化时长/清晰度；均未指定时返回零值（保持默认行为）
+func ValidateVideoOutput(model string, duration int, quality string) (VideoOutput, error) {
+	quality = strings.ToLower(strings.TrimSpace(quality))
+	if duration == 0 && quality == "" {
+		return VideoOutput{}, nil
+	}
+	r, ok := GetVideoOutputRange(model)
+	if !ok {
+		return VideoOutput{}, fmt.Errorf("模型 %s 不支持 duration/quality 参数（仅视频模型可用）", model)
+	}
+	if duration != 0 && (duration < r.MinDuration || duration > r.MaxDuration) {
+		return VideoOutput{}, fmt.Errorf("模型 %s 的 duration 需在 %d-%d 秒之间，当前为 %d", model, r.MinDuration, r.MaxDuration, duration)
+	}
+	if quality != "" {
+		supported := false
+		for _, q := range r.Qualities {
+			if q == quality {
+				supported = true
+				break
+			}
+		}
+		if !supported {
+			return VideoOutput{}, fmt.Errorf("模型 %s 不支持 quality=%s，可选值: %s", model, quality, strings.Join(r.Qualities, ", "))
+		}
+	}
+	return VideoOutput{DurationSeconds: duration, Quality: quality}, nil
+}
+
 // IsFlowModel 检查是否是 Flow 模型
 func IsFlowModel(model string) bool {
 	_, ok := FlowModelConfig[model]
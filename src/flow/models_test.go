@@ -0,0 +1,81 @@
+package flow
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAssignVideoImageRoles(t *testing.T) {
+	a, b, c := []byte("a"), []byte("b"), []byte("c")
+
+	roles, err := AssignVideoImageRoles("veo_3_1_i2v_s_fast_fl_landscape", [][]byte{a, b})
+	if err != nil || string(roles.StartFrame) != "a" || string(roles.EndFrame) != "b" || roles.References != nil {
+		t.Fatalf("i2v should map first/second image to start/end frame, got %+v err=%v", roles, err)
+	}
+	roles, err = AssignVideoImageRoles("veo_3_1_i2v_s_fast_fl_landscape", [][]byte{a})
+	if err != nil || string(roles.StartFrame) != "a" || roles.EndFrame != nil {
+		t.Fatalf("i2v with one image should only set start frame, got %+v err=%v", roles, err)
+	}
+	if _, err := AssignVideoImageRoles("veo_3_1_i2v_s_fast_fl_landscape", [][]byte{a, b, c}); err == nil || !strings.Contains(err.Error(), "当前提供了 3 张") {
+		t.Fatalf("expected i2v count error, got %v", err)
+	}
+	if _, err := AssignVideoImageRoles("veo_3_1_i2v_s_fast_fl_landscape", nil); err == nil {
+		t.Fatalf("expected i2v without images to fail")
+	}
+
+	roles, err = AssignVideoImageRoles("veo_3_0_r2v_fast_landscape", [][]byte{a, b, c})
+	if err != nil || len(roles.References) != 3 || roles.StartFrame != nil {
+		t.Fatalf("r2v should use all images as references, got %+v err=%v", roles, err)
+	}
+
+	roles, err = AssignVideoImageRoles("veo_3_1_t2v_fast_landscape", [][]byte{a})
+	if err != nil || roles.StartFrame != nil || roles.References != nil {
+		t.Fatalf("t2v should ignore images, got %+v err=%v", roles, err)
+	}
+	if _, err := AssignVideoImageRoles("gemini-2.5-flash-image-landscape", [][]byte{a, b, c}); err != nil {
+		t.Fatalf("image models should not be validated as video: %v", err)
+	}
+}
+
+func TestRequestVideoImageRolesPrefersExplicitRoles(t *testing.T) {
+	roles, err := requestVideoImageRoles(GenerationRequest{
+		Model:      "veo_3_1_i2v_s_fast_fl_landscape",
+		Images:     [][]byte{[]byte("x"), []byte("y"), []byte("z")},
+		StartImage: []byte("start"),
+	})
+	if err != nil || string(roles.StartFrame) != "start" || roles.EndFrame != nil {
+		t.Fatalf("explicit start frame should take precedence, got %+v err=%v", roles, err)
+	}
+	if _, err := requestVideoImageRoles(GenerationRequest{
+		Model:    "veo_3_1_i2v_s_fast_fl_landscape",
+		EndImage: []byte("end"),
+	}); err == nil {
+		t.Fatalf("end frame without start frame should fail")
+	}
+}
+
+func TestValidateVideoOutput(t *testing.T) {
+	out, err := ValidateVideoOutput("veo_3_1_t2v_fast_landscape", 0, "")
+	if err != nil || out != (VideoOutput{}) {
+		t.Fatalf("unset parameters should keep defaults, got %+v err=%v", out, err)
+	}
+	out, err = ValidateVideoOutput("veo_3_1_t2v_fast_landscape", 8, " 1080P ")
+	if err != nil || out.DurationSeconds != 8 || out.Quality != "1080p" {
+		t.Fatalf("expected normalized 8s/1080p, got %+v err=%v", out, err)
+	}
+	request := map[string]interface{}{}
+	out.apply(request)
+	if request["videoDurationSeconds"] != 8 || request["videoResolution"] != "VIDEO_RESOLUTION_1080P" {
+		t.Fatalf("output should be forwarded to the request, got %v", request)
+	}
+
+	if _, err := ValidateVideoOutput("veo_3_1_t2v_fast_landscape", 12, ""); err == nil {
+		t.Fatal("duration above the model range should fail")
+	}
+	if _, err := ValidateVideoOutput("veo_2_0_t2v_landscape", 0, "1080p"); err == nil {
+		t.Fatal("veo 2 should reject 1080p")
+	}
+	if _, err := ValidateVideoOutput("gemini-2.5-flash-image-landscape", 8, ""); err == nil {
+		t.Fatal("image models should reject duration")
+	}
+}
@@ -25,6 +25,8 @@ type TokenPool struct {
 	stopChan  chan struct{}
 	watcher   *fsnotify.Watcher
 	fileIndex map[string]string // fileName -> tokenID
+
+	lastRefresh time.Time // 最近一次定期刷新 AT 的完成时间
 }
 
 // NewTokenPool 创建新的 Token 池
@@ -200,12 +202,21 @@ func (p *TokenPool) Stats() map[string]interface{} {
 	for _, t := range p.tokens {
 		t.mu.RLock()
 		info := map[string]interface{}{
-			"id":          t.ID[:16] + "...",
-			"email":       t.Email,
-			"credits":     t.Credits,
-			"disabled":    t.Disabled,
-			"error_count": t.ErrorCount,
-			"last_used":   t.LastUsed.Format(time.RFC3339),
+			"id":               t.ShortID(),
+			"email":            t.Email,
+			"credits":          t.Credits,
+			"disabled":         t.Disabled,
+			"error_count":      t.ErrorCount,
+			"last_used":        t.LastUsed.Format(time.RFC3339),
+			"generation_count": t.GenerationCount,
+			"success_count":    t.SuccessCount,
+			"fail_count":       t.FailCount,
+			"success_rate":     fmt.Sprintf("%.2f%%", float64(t.SuccessCount)/float64(max(t.GenerationCount, 1))*100),
+			"last_error":       t.LastError,
+			"disabled_reason":  t.DisabledReason,
+		}
+		if !t.LastErrorAt.IsZero() {
+			info["last_error_at"] = t.LastErrorAt.Format(time.RFC3339)
 		}
 		t.mu.RUnlock()
 
@@ -220,13 +231,17 @@ func (p *TokenPool) Stats() map[string]interface{} {
 		}
 	}
 
-	return map[string]interface{}{
+	stats := map[string]interface{}{
 		"total":    len(p.tokens),
 		"ready":    ready,
 		"disabled": disabled,
 		"errored":  errored,
 		"tokens":   tokenInfos,
 	}
+	if !p.lastRefresh.IsZero() {
+		stats["last_refresh"] = p.lastRefresh.Format(time.RFC3339)
+	}
+	return stats
 }
 
 // StartRefreshWorker 启动定期刷新 AT 的 worker
@@ -419,6 +434,7 @@ func (p *TokenPool) refreshSingleToken(token *FlowToken) {
 	token.Email = resp.Email
 	token.ErrorCount = 0
 	token.Disabled = false
+	token.DisabledReason = ""
 	token.mu.Unlock()
 
 	log.Printf("[FlowPool] Token %s AT 已刷新, Email: %s", token.ID[:16]+"...", resp.Email)
@@ -453,6 +469,7 @@ func (p *TokenPool) refreshAllAT() {
 			token.ErrorCount++
 			if token.ErrorCount >= 3 {
 				token.Disabled = true
+				token.DisabledReason = fmt.Sprintf("AT 刷新失败: %v", err)
 				log.Printf("[FlowPool] Token %s 刷新失败次数过多，已禁用: %v", token.ID[:16]+"...", err)
 			}
 			token.mu.Unlock()
@@ -469,10 +486,15 @@ func (p *TokenPool) refreshAllAT() {
 		token.Email = resp.Email
 		token.ErrorCount = 0
 		token.Disabled = false
+		token.DisabledReason = ""
 		token.mu.Unlock()
 
 		log.Printf("[FlowPool] Token %s AT 已刷新, Email: %s", token.ID[:16]+"...", resp.Email)
 	}
+
+	p.mu.Lock()
+	p.lastRefresh = time.Now()
+	p.mu.Unlock()
 }
 
 // extractSessionToken 从 cookie 字符串提取 __Secure-next-auth.session-token
@@ -0,0 +1,53 @@
+package flow
+
+import "testing"
+
+func TestFindTokenByPrefix(t *testing.T) {
+	fc := NewFlowClient(FlowConfig{})
+	a := &FlowToken{ID: "abcdef0123456789-token-a"}
+	b := &FlowToken{ID: "abcdef0123456789-token-b"}
+	c := &FlowToken{ID: "zzzzzz0123456789-token-c"}
+	fc.AddToken(a)
+	fc.AddToken(b)
+	fc.AddToken(c)
+
+	if got := fc.FindToken(a.ID); got != a {
+		t.Fatalf("expected exact id match")
+	}
+	if got := fc.FindToken("zzzzzz0123456789..."); got != c {
+		t.Fatalf("expected unique prefix match from status id")
+	}
+	if got := fc.FindToken("abcdef0123456789..."); got != nil {
+		t.Fatalf("expected ambiguous prefix to return nil")
+	}
+	if got := fc.FindToken("  "); got != nil {
+		t.Fatalf("expected empty id to return nil")
+	}
+}
+
+func TestTokenStatsIncludeGenerationCounts(t *testing.T) {
+	fc := NewFlowClient(FlowConfig{})
+	pool := NewTokenPool(t.TempDir(), fc)
+	token := &FlowToken{ID: "abcdef0123456789-token"}
+	pool.tokens[token.ID] = token
+
+	token.RecordGeneration(true, "")
+	token.RecordGeneration(false, "生成失败")
+	token.RecordGeneration(true, "")
+
+	stats := pool.Stats()
+	infos := stats["tokens"].([]map[string]interface{})
+	if len(infos) != 1 {
+		t.Fatalf("expected 1 token info, got %d", len(infos))
+	}
+	info := infos[0]
+	if info["generation_count"] != 3 || info["success_count"] != 2 || info["fail_count"] != 1 {
+		t.Fatalf("unexpected counts: %v", info)
+	}
+	if info["success_rate"] != "66.67%" || info["last_error"] != "生成失败" {
+		t.Fatalf("unexpected rate/error: %v", info)
+	}
+	if _, ok := info["last_error_at"]; !ok {
+		t.Fatalf("expected last_error_at to be set")
+	}
+}
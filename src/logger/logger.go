@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -25,40 +27,69 @@ var levelNames = map[Level]string{
 	LevelDebug: "DEBUG",
 }
 
-// Logger 日志记录器
+// Logger 日志记录器（级别全局共享，热重载后对带前缀的日志器同样生效）
 type Logger struct {
-	level  Level
 	prefix string
 	mu     sync.Mutex
 }
 
 var (
-	defaultLogger = &Logger{level: LevelInfo}
-	debugMode     = false
+	defaultLogger = &Logger{}
+	debugMode     atomic.Bool
+	minLevel      atomic.Int32 // 最低输出级别，低于该级别的日志在写入前丢弃
 )
 
-// SetDebugMode 设置调试模式
+// SetDebugMode 设置调试模式（同时把日志级别切换为 DEBUG / INFO）
 func SetDebugMode(debug bool) {
-	debugMode = debug
+	debugMode.Store(debug)
 	if debug {
-		defaultLogger.level = LevelDebug
+		SetLevel(LevelDebug)
 	} else {
-		defaultLogger.level = LevelInfo
+		SetLevel(LevelInfo)
 	}
 }
 
 // IsDebug 是否为调试模式
 func IsDebug() bool {
-	return debugMode
+	return debugMode.Load()
 }
 
 // SetLevel 设置日志级别
 func SetLevel(level Level) {
-	defaultLogger.level = level
+	minLevel.Store(int32(level))
+}
+
+// GetLevel 当前日志级别
+func GetLevel() Level {
+	return Level(minLevel.Load())
+}
+
+// Enabled 指定级别的日志是否会输出
+func Enabled(level Level) bool {
+	return level <= GetLevel()
+}
+
+// ParseLevel 解析级别名称（error/warn/info/debug，不区分大小写）
+func ParseLevel(name string) (Level, bool) {
+	upper := strings.ToUpper(strings.TrimSpace(name))
+	if upper == "WARNING" {
+		upper = "WARN"
+	}
+	for level, levelName := range levelNames {
+		if levelName == upper {
+			return level, true
+		}
+	}
+	return LevelInfo, false
+}
+
+// String 级别名称
+func (l Level) String() string {
+	return levelNames[l]
 }
 
 func (l *Logger) log(level Level, format string, args ...interface{}) {
-	if level > l.level {
+	if !Enabled(level) {
 		return
 	}
 	l.mu.Lock()
@@ -97,10 +128,7 @@ func Debug(format string, args ...interface{}) {
 
 // WithPrefix 创建带前缀的子日志器
 func WithPrefix(prefix string) *Logger {
-	return &Logger{
-		level:  defaultLogger.level,
-		prefix: prefix,
-	}
+	return &Logger{prefix: prefix}
 }
 
 func (l *Logger) Error(format string, args ...interface{}) { l.log(LevelError, format, args...) }
@@ -109,6 +137,7 @@ func (l *Logger) Info(format string, args ...interface{})  { l.log(LevelInfo, fo
 func (l *Logger) Debug(format string, args ...interface{}) { l.log(LevelDebug, format, args...) }
 
 func init() {
+	minLevel.Store(int32(LevelInfo))
 	log.SetFlags(0)
 	log.SetOutput(os.Stdout)
 }
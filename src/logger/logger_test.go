@@ -0,0 +1,78 @@
+package logger
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+)
+
+func TestParseLevel(t *testing.T) {
+	cases := map[string]Level{"error": LevelError, " WARN ": LevelWarn, "warning": LevelWarn, "Info": LevelInfo, "debug": LevelDebug}
+	for name, want := range cases {
+		if got, ok := ParseLevel(name); !ok || got != want {
+			t.Fatalf("%q: expected %v, got %v (ok=%v)", name, want, got, ok)
+		}
+	}
+	if _, ok := ParseLevel("verbose"); ok {
+		t.Fatal("unknown level should not parse")
+	}
+}
+
+func TestMinLevelDropsBeforeWrite(t *testing.T) {
+	var buf bytes.Buffer
+	oldOutput := log.Writer()
+	log.SetOutput(&buf)
+	old := GetLevel()
+	defer func() {
+		SetLevel(old)
+		log.SetOutput(oldOutput)
+	}()
+
+	prefixed := WithPrefix("worker")
+	SetLevel(LevelWarn)
+	Info("info dropped")
+	Debug("debug dropped")
+	prefixed.Info("prefixed info dropped")
+	Warn("warn kept")
+	prefixed.Error("prefixed error kept")
+
+	out := buf.String()
+	if strings.Contains(out, "dropped") {
+		t.Fatalf("messages below WARN should be dropped, got %q", out)
+	}
+	if !strings.Contains(out, "warn kept") || !strings.Contains(out, "[worker] prefixed error kept") {
+		t.Fatalf("messages at or above WARN should be written, got %q", out)
+	}
+
+	// 级别变更对已创建的带前缀日志器同样生效
+	SetLevel(LevelDebug)
+	prefixed.Debug("prefixed debug kept")
+	if !strings.Contains(buf.String(), "prefixed debug kept") {
+		t.Fatalf("prefixed logger should follow new level, got %q", buf.String())
+	}
+}
+
+func TestRingStoreSearch(t *testing.T) {
+	s := NewRingStore(10)
+	s.AppendRaw("business2api", "[INFO] account a@example.com ready")
+	s.AppendRaw("business2api", "[ERROR] account a@example.com failed")
+	s.AppendRaw("registrar", "[INFO] account b@example.com ready")
+	s.AppendRaw("business2api", "[INFO] account c@example.com ready")
+
+	match := func(msg string) bool { return strings.Contains(msg, "a@example.com") }
+	items := s.Search(match, 0, "", "")
+	if len(items) != 2 || items[0].ID > items[1].ID {
+		t.Fatalf("expected 2 chronological matches, got %+v", items)
+	}
+	if items := s.Search(match, 0, "", "error"); len(items) != 1 || !strings.Contains(items[0].Message, "failed") {
+		t.Fatalf("level filter should keep only the error entry, got %+v", items)
+	}
+	if items := s.Search(func(string) bool { return true }, 0, "registrar", ""); len(items) != 1 {
+		t.Fatalf("source filter should keep only registrar entries, got %+v", items)
+	}
+	// limit 保留最新的匹配项
+	if items := s.Search(func(string) bool { return true }, 1, "", ""); len(items) != 1 || !strings.Contains(items[0].Message, "c@example.com") {
+		t.Fatalf("limit should keep the newest match, got %+v", items)
+	}
+}
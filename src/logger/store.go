@@ -42,6 +42,11 @@ func After(afterID int64, limit int, source, level string) ([]LogEntry, int64) {
 	return store.After(afterID, limit, source, level)
 }
 
+// Search 返回最近 limit 条消息满足 match 的日志（按时间正序）
+func Search(match func(message string) bool, limit int, source, level string) []LogEntry {
+	return store.Search(match, limit, source, level)
+}
+
 func (s *RingStore) AppendRaw(source, line string) LogEntry {
 	cleanLine := strings.TrimSpace(strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"))
 	if cleanLine == "" {
@@ -101,6 +106,40 @@ func (s *RingStore) Recent(limit int, source, level string) []LogEntry {
 	return items
 }
 
+func (s *RingStore) Search(match func(message string) bool, limit int, source, level string) []LogEntry {
+	source = normalizeSource(source)
+	level = normalizeLevel(level)
+	if limit <= 0 {
+		limit = 200
+	}
+	if limit > 1000 {
+		limit = 1000
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	items := make([]LogEntry, 0)
+	for i := len(s.entries) - 1; i >= 0; i-- {
+		entry := s.entries[i]
+		if !matchSource(source, entry.Source) || !matchLevel(level, entry.Level) {
+			continue
+		}
+		if match != nil && !match(entry.Message) {
+			continue
+		}
+		items = append(items, entry)
+		if len(items) >= limit {
+			break
+		}
+	}
+
+	for i, j := 0, len(items)-1; i < j; i, j = i+1, j-1 {
+		items[i], items[j] = items[j], items[i]
+	}
+	return items
+}
+
 func (s *RingStore) After(afterID int64, limit int, source, level string) ([]LogEntry, int64) {
 	source = normalizeSource(source)
 	level = normalizeLevel(level)
@@ -5,11 +5,13 @@ import (
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -39,7 +41,10 @@ type AccountData struct {
 	ResponseHeaders map[string]string `json:"response_headers,omitempty"`
 	Timestamp       string            `json:"timestamp"`
 	ConfigID        string            `json:"configId,omitempty"`
+	ConfigIDs       []string          `json:"configIds,omitempty"` // 账号可用的其他 configId（与 configId 一起按策略轮换）
 	CSESIDX         string            `json:"csesidx,omitempty"`
+	ProxyKey        string            `json:"proxy_key,omitempty"` // 最近一次成功使用的代理节点标识（粘性代理）
+	Tags            []string          `json:"tags,omitempty"`      // 账号标签（按模型路由到子号池，未打标签的账号可用于所有模型）
 }
 
 func ParseCookieString(cookieStr string) []Cookie {
@@ -173,13 +178,94 @@ type Account struct {
 	TotalCount          int    // 总使用次数
 	DailyCount          int    // 每日调用次数
 	DailyCountDate      string // 每日计数日期 (YYYY-MM-DD)
+	RateLimitStreak     int    // 连续 429 次数（成功请求后清零）
 	ExternalTaskID      string
 	ExternalLeaseOwner  string
 	ExternalLeaseUntil  time.Time
 	ExternalFailCount   int
 	ExternalRetryAt     time.Time
+	LastError           string    // 最近一次失败原因
+	LastErrorAt         time.Time // 最近一次失败时间
+	AuthFailSince       time.Time // 本轮连续 401 的首次时间，用于自动删除宽限
+	UpstreamFailure     string    // 最近一次请求上游失败原因（HTTP 401/403/配额耗尽等）
+	UpstreamFailureKind string    // 最近一次上游失败类型，见 ClassifyUpstreamFailure
+	UpstreamFailureAt   time.Time // 最近一次上游失败时间
 	Status              AccountStatus
 	Mu                  sync.Mutex
+
+	proactiveRefreshing bool           // 是否正在主动刷新JWT
+	configCursor        uint64         // round_robin 策略下的 configId 轮换位置
+	proactiveRetryAt    time.Time      // 主动刷新失败后的下次重试时间
+	recentUsage         []AccountEvent // 最近的请求结果（最多 accountHistoryLimit 条）
+	refreshHistory      []AccountEvent // 最近的刷新记录（最多 accountHistoryLimit 条）
+}
+
+// AccountEvent 账号的一次请求或刷新结果
+type AccountEvent struct {
+	Time    time.Time `json:"time"`
+	Kind    string    `json:"kind,omitempty"`
+	Success bool      `json:"success"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// accountHistoryLimit 每个账号保留的请求/刷新记录条数
+const accountHistoryLimit = 20
+
+func appendAccountEvent(events []AccountEvent, ev AccountEvent) []AccountEvent {
+	events = append(events, ev)
+	if len(events) > accountHistoryLimit {
+		events = events[len(events)-accountHistoryLimit:]
+	}
+	return events
+}
+
+// 上游失败类型，用于区分账号失效原因
+const (
+	FailureUnauthorized = "unauthorized"    // 401 / UNAUTHENTICATED：Cookie 或 JWT 失效
+	FailureForbidden    = "forbidden"       // 403：账号无权限或被封禁
+	FailureQuota        = "quota_exhausted" // 配额耗尽
+	FailureRateLimited  = "rate_limited"    // 429 限流
+	FailureEmptyReply   = "empty_reply"     // 上游空返回
+	FailureUpstream     = "upstream_error"  // 其他上游错误
+)
+
+// ClassifyUpstreamFailure 根据失败原因文本归类上游失败类型
+func ClassifyUpstreamFailure(reason string) string {
+	lower := strings.ToLower(reason)
+	switch {
+	case strings.Contains(lower, "401") || strings.Contains(lower, "unauthenticated") || strings.Contains(reason, "认证"):
+		return FailureUnauthorized
+	case strings.Contains(lower, "403") || strings.Contains(lower, "permission_denied"):
+		return FailureForbidden
+	case strings.Contains(reason, "配额") || strings.Contains(lower, "resource_exhausted") || strings.Contains(lower, "quota"):
+		return FailureQuota
+	case strings.Contains(lower, "429"):
+		return FailureRateLimited
+	case strings.Contains(reason, "空返回"):
+		return FailureEmptyReply
+	default:
+		return FailureUpstream
+	}
+}
+
+// recordUpstreamFailureLocked 记录最近一次上游失败原因，调用方需持有 acc.Mu
+func (acc *Account) recordUpstreamFailureLocked(reason string, now time.Time) {
+	acc.UpstreamFailure = reason
+	acc.UpstreamFailureKind = ClassifyUpstreamFailure(reason)
+	acc.UpstreamFailureAt = now
+}
+
+// RecordRefresh 记录一次刷新结果（jwt/proactive/browser 等）
+func (acc *Account) RecordRefresh(kind string, err error) {
+	ev := AccountEvent{Time: time.Now(), Kind: kind, Success: err == nil}
+	acc.Mu.Lock()
+	defer acc.Mu.Unlock()
+	if err != nil {
+		ev.Error = err.Error()
+		acc.LastError = ev.Error
+		acc.LastErrorAt = ev.Time
+	}
+	acc.refreshHistory = appendAccountEvent(acc.refreshHistory, ev)
 }
 
 // SetCooldownMultiplier 设置冷却时间倍数（用于429限流）
@@ -189,23 +275,53 @@ func (acc *Account) SetCooldownMultiplier(multiplier int) {
 	acc.Mu.Unlock()
 }
 
+// RateLimitMaxMultiplier 连续 429 退避的最大冷却倍数
+var RateLimitMaxMultiplier = 48
+
+// RateLimitMultiplier 连续 streak 次 429 对应的冷却倍数：首次 3 倍，之后逐次翻倍，不超过上限（streak<=0 为 1）
+func RateLimitMultiplier(streak int) int {
+	if streak <= 0 {
+		return 1
+	}
+	multiplier := 3
+	for i := 1; i < streak && multiplier < RateLimitMaxMultiplier; i++ {
+		multiplier *= 2
+	}
+	if multiplier > RateLimitMaxMultiplier {
+		multiplier = RateLimitMaxMultiplier
+	}
+	return multiplier
+}
+
+// MarkRateLimited 记录一次 429，返回按连续次数退避后的冷却时间
+func (acc *Account) MarkRateLimited() time.Duration {
+	acc.Mu.Lock()
+	defer acc.Mu.Unlock()
+	acc.RateLimitStreak++
+	return UseCooldown * time.Duration(RateLimitMultiplier(acc.RateLimitStreak))
+}
+
 // 默认冷却时间（可通过配置覆盖）
 var (
 	RefreshCooldown        = 4 * time.Minute  // 刷新冷却
 	UseCooldown            = 15 * time.Second // 使用冷却
 	JWTRefreshThreshold    = 60 * time.Second // JWT刷新阈值
+	JWTRefreshMargin       = 30 * time.Second // JWT到期前主动刷新余量（0=禁用）
 	MaxFailCount           = 3                // 最大连续失败次数
 	EnableBrowserRefresh   = true             // 是否启用浏览器刷新
 	BrowserRefreshHeadless = true             // 浏览器刷新是否无头模式
 	BrowserRefreshMaxRetry = 1                // 浏览器刷新最大重试次数
 	AutoDelete401          = false            // 401时是否自动删除账号
+	AutoDeleteMinFailures  = 3                // 401 自动删除前需连续失败的次数
+	AutoDeleteGracePeriod  = 10 * time.Minute // 401 自动删除前需持续失败的时长（从本轮首次 401 起）
 	ExternalRefreshMode    = false            // 是否启用外部续期模式
 	DailyLimit             = 3000             // 每账号每日最大调用次数
 	DataDir                string
 	DefaultConfig          string
 	Proxy                  string
-	JwtTTL                 = 270 * time.Second
+	JwtTTL                 = defaultJwtTTL // JWT有效期（可通过配置覆盖）
 	HTTPClient             *http.Client
+	UpstreamOrigin         = "https://business.gemini.google" // 业务站点 Origin（getoxsrf 请求使用）
 )
 
 const (
@@ -215,6 +331,11 @@ const (
 	externalRefreshThrottleRatio          = 0.5
 	defaultExternalTaskLeaseSec           = 180
 	maxExternalTaskLeaseSec               = 1800
+
+	proactiveRefreshInterval   = time.Second      // 主动刷新扫描间隔
+	proactiveRefreshPerTick    = 2                // 每次扫描最多发起的主动刷新数（错峰）
+	proactiveRefreshMaxRunning = 3                // 同时进行的主动刷新上限
+	proactiveRefreshRetryDelay = 15 * time.Second // 主动刷新失败后的重试间隔
 )
 
 type RefreshCookieFunc func(acc *Account, headless bool, proxy string) *BrowserRefreshResult
@@ -230,6 +351,37 @@ type BrowserRefreshResult struct {
 
 var RefreshCookieWithBrowser RefreshCookieFunc
 
+// ReportProxyResult 上报经代理池代理发出的真实请求结果（用于自动拉黑失败率过高的节点）
+var ReportProxyResult func(proxyURL string, success bool)
+
+// finishProxy 上报请求结果并释放代理池代理（静态代理不处理）
+func finishProxy(proxyURL string, success bool) {
+	if proxyURL == "" || proxyURL == Proxy || proxyURL == ClientProxy {
+		return
+	}
+	if ReportProxyResult != nil {
+		ReportProxyResult(proxyURL, success)
+	}
+	if ReleaseProxy != nil {
+		ReleaseProxy(proxyURL)
+	}
+}
+
+// accountRefreshProxy 为账号浏览器刷新选择代理（优先粘性节点），返回代理地址与节点标识
+func accountRefreshProxy(acc *Account) (string, string) {
+	if GetAccountProxy == nil {
+		return Proxy, ""
+	}
+	acc.Mu.Lock()
+	proxyKey := acc.Data.ProxyKey
+	acc.Mu.Unlock()
+	proxyURL := GetAccountProxy(proxyKey)
+	if ProxyKeyOf == nil {
+		return proxyURL, ""
+	}
+	return proxyURL, ProxyKeyOf(proxyURL)
+}
+
 func readResponseBody(resp *http.Response) ([]byte, error) {
 	body := make([]byte, 0)
 	buf := make([]byte, 4096)
@@ -265,6 +417,14 @@ type AccountPool struct {
 	externalRefreshThrottleActive bool
 	externalRefreshFailAlert      bool
 	externalRefreshFallbackAlert  bool
+	proactiveRefreshRunning       int32
+	proactiveRefreshSuccess       int64
+	proactiveRefreshFailed        int64
+	invalidTotal                  int64        // 启动以来因失效被移除的账号数
+	historyMu                     sync.Mutex   // 保护 history / historyLastRequests
+	history                       []PoolSample // 号池数量时间序列（环形，最多 poolHistoryLimit 条）
+	historyLastRequests           int64        // 上次采样时的累计请求数
+	historyOnce                   sync.Once
 }
 
 func (p *AccountPool) GetReadyAccounts() []*Account {
@@ -304,6 +464,75 @@ func SetCooldowns(refreshSec, useSec int) {
 	logger.Info("⚙️ 冷却配置: 刷新=%v, 使用=%v", RefreshCooldown, UseCooldown)
 }
 
+// SetAutoDeleteGrace 设置 401 自动删除宽限：连续失败次数（<=0 使用默认 3）与持续时长（分钟，0 使用默认 10，<0 不要求持续时长）
+func SetAutoDeleteGrace(minFailures, graceMinutes int) {
+	AutoDeleteMinFailures = 3
+	if minFailures > 0 {
+		AutoDeleteMinFailures = minFailures
+	}
+	switch {
+	case graceMinutes < 0:
+		AutoDeleteGracePeriod = 0
+	case graceMinutes > 0:
+		AutoDeleteGracePeriod = time.Duration(graceMinutes) * time.Minute
+	default:
+		AutoDeleteGracePeriod = 10 * time.Minute
+	}
+	logger.Info("⚙️ 401自动删除宽限: 连续 %d 次且持续 %v", AutoDeleteMinFailures, AutoDeleteGracePeriod)
+}
+
+// autoDeleteDueLocked 判断 401 账号是否已超出自动删除宽限：连续 failures 次失败且自本轮首次 401 起已持续 AutoDeleteGracePeriod，
+// 返回已持续时长；首次调用时记录本轮起始时间。调用方需持有 acc.Mu
+func (acc *Account) autoDeleteDueLocked(failures int, now time.Time) (time.Duration, bool) {
+	if acc.AuthFailSince.IsZero() {
+		acc.AuthFailSince = now
+	}
+	elapsed := now.Sub(acc.AuthFailSince)
+	return elapsed, failures >= AutoDeleteMinFailures && elapsed >= AutoDeleteGracePeriod
+}
+
+// defaultJwtTTL JWT 默认有效期
+const defaultJwtTTL = 270 * time.Second
+
+// SetJWTTTL 设置JWT有效期（秒），<=0 使用默认值；只影响之后刷新的 JWT
+func SetJWTTTL(sec int) {
+	if sec > 0 {
+		JwtTTL = time.Duration(sec) * time.Second
+	} else {
+		JwtTTL = defaultJwtTTL
+	}
+	logger.Info("⚙️ JWT有效期: %v", JwtTTL)
+}
+
+// JWTRefreshLead 返回JWT到期前开始刷新的提前量：启用主动刷新时为主动刷新余量，否则为扫描刷新阈值
+func JWTRefreshLead() time.Duration {
+	if JWTRefreshMargin > 0 {
+		return JWTRefreshMargin
+	}
+	return JWTRefreshThreshold
+}
+
+// InJWTRefreshWindow 判断JWT是否已进入刷新窗口（到期前 JWTRefreshLead 内或已过期）
+func InJWTRefreshWindow(expires, now time.Time) bool {
+	if expires.IsZero() {
+		return false
+	}
+	return now.Add(JWTRefreshLead()).After(expires)
+}
+
+// SetJWTRefreshMargin 设置JWT主动刷新余量（秒），<0 表示禁用
+func SetJWTRefreshMargin(sec int) {
+	if sec < 0 {
+		JWTRefreshMargin = 0
+		logger.Info("⚙️ JWT主动刷新: 已禁用")
+		return
+	}
+	if sec > 0 {
+		JWTRefreshMargin = time.Duration(sec) * time.Second
+	}
+	logger.Info("⚙️ JWT主动刷新: 到期前 %v", JWTRefreshMargin)
+}
+
 // SetDailyLimit 设置每账号每日最大调用次数
 func SetDailyLimit(limit int) {
 	if limit >= 0 {
@@ -320,6 +549,7 @@ func (p *AccountPool) Load(dir string) error {
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
+	rescueAccountTempFiles(dir)
 	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
 	if err != nil {
 		return err
@@ -365,7 +595,7 @@ func (p *AccountPool) Load(dir string) error {
 
 		csesidx := acc.CSESIDX
 		if csesidx == "" {
-			csesidx = extractCSESIDX(acc.Authorization)
+			csesidx = ExtractCSESIDX(acc.Authorization)
 		}
 		if csesidx == "" {
 			log.Printf("⚠️ %s 无法获取 csesidx", f)
@@ -579,13 +809,23 @@ func (p *AccountPool) externalTaskByIDLocked(taskID string) *Account {
 	return nil
 }
 
+// OnAccountInvalid 账号失效被移除时的回调（管理端实时事件推送）
+var OnAccountInvalid func(email string)
+
 // RemoveAccount 删除失效账号
 func (p *AccountPool) RemoveAccount(acc *Account) {
+	atomic.AddInt64(&p.invalidTotal, 1)
 	if err := os.Remove(acc.FilePath); err != nil {
 		log.Printf("⚠️ 删除文件失败 %s: %v", acc.FilePath, err)
 	} else {
 		log.Printf("🗑️ 已删除失效账号: %s", filepath.Base(acc.FilePath))
 	}
+	if OnAccountInvalid != nil {
+		acc.Mu.Lock()
+		email := acc.Data.Email
+		acc.Mu.Unlock()
+		OnAccountInvalid(email)
+	}
 }
 
 // SaveToFile 保存账号到文件
@@ -605,10 +845,7 @@ func (acc *Account) SaveToFile() error {
 		return fmt.Errorf("序列化账号数据失败: %w", err)
 	}
 
-	if err := os.WriteFile(acc.FilePath, data, 0644); err != nil {
-		return fmt.Errorf("写入文件失败: %w", err)
-	}
-	return nil
+	return WriteAccountFile(acc.FilePath, data)
 }
 
 // StartPoolManager 启动号池管理器
@@ -617,6 +854,7 @@ func (p *AccountPool) StartPoolManager() {
 		go p.refreshWorker(i)
 	}
 	go p.scanWorker()
+	go p.proactiveRefreshWorker()
 }
 
 func (p *AccountPool) refreshWorker(id int) {
@@ -646,6 +884,9 @@ func (p *AccountPool) refreshWorker(id int) {
 		acc.JWTExpires = time.Time{}
 		if err := acc.RefreshJWT(); err != nil {
 			errMsg := err.Error()
+			if !strings.Contains(errMsg, "刷新冷却中") {
+				acc.RecordRefresh("jwt", err)
+			}
 
 			// 认证失败：根据配置决定是否删除或尝试刷新
 			if strings.Contains(errMsg, "账号失效") ||
@@ -659,14 +900,24 @@ func (p *AccountPool) refreshWorker(id int) {
 					continue
 				}
 
-				// 如果配置了401自动删除，直接删除账号
+				// 配置了401自动删除：连续失败达到次数且超过宽限时长才删除，否则继续尝试浏览器刷新恢复
 				if AutoDelete401 {
-					log.Printf("🗑️ [worker-%d] [%s] 401自动删除已启用，移除账号", id, acc.Data.Email)
 					acc.Mu.Lock()
-					acc.Status = StatusInvalid
+					if acc.FailCount == 0 {
+						acc.AuthFailSince = time.Time{} // 新一轮连续失败
+					}
+					failures := acc.FailCount + 1
+					elapsed, due := acc.autoDeleteDueLocked(failures, time.Now())
+					if due {
+						acc.Status = StatusInvalid
+					}
 					acc.Mu.Unlock()
-					p.RemoveAccount(acc)
-					continue
+					if due {
+						log.Printf("🗑️ [worker-%d] [%s] 401 连续 %d 次、持续 %v，超出宽限，自动删除账号", id, acc.Data.Email, failures, elapsed.Round(time.Second))
+						p.RemoveAccount(acc)
+						continue
+					}
+					log.Printf("⏳ [worker-%d] [%s] 401 第 %d/%d 次、已持续 %v（宽限 %v），暂不删除，尝试恢复", id, acc.Data.Email, failures, AutoDeleteMinFailures, elapsed.Round(time.Second), AutoDeleteGracePeriod)
 				}
 
 				// 检查是否可以进行浏览器刷新
@@ -677,7 +928,16 @@ func (p *AccountPool) refreshWorker(id int) {
 					acc.Mu.Lock()
 					acc.BrowserRefreshCount++
 					acc.Mu.Unlock()
-					refreshResult := RefreshCookieWithBrowser(acc, BrowserRefreshHeadless, Proxy)
+					refreshProxy, proxyKey := accountRefreshProxy(acc)
+					refreshResult := RefreshCookieWithBrowser(acc, BrowserRefreshHeadless, refreshProxy)
+					finishProxy(refreshProxy, refreshResult.Success)
+					if refreshResult.Success {
+						acc.RecordRefresh("browser", nil)
+					} else if refreshResult.Error != nil {
+						acc.RecordRefresh("browser", refreshResult.Error)
+					} else {
+						acc.RecordRefresh("browser", fmt.Errorf("浏览器刷新失败"))
+					}
 
 					if refreshResult.Success {
 						acc.Mu.Lock()
@@ -696,7 +956,11 @@ func (p *AccountPool) refreshWorker(id int) {
 						if len(refreshResult.ResponseHeaders) > 0 {
 							acc.Data.ResponseHeaders = refreshResult.ResponseHeaders
 						}
+						if proxyKey != "" {
+							acc.Data.ProxyKey = proxyKey
+						}
 						acc.FailCount = 0
+						acc.AuthFailSince = time.Time{}
 						acc.BrowserRefreshCount = 0  // 成功后重置计数
 						acc.JWTExpires = time.Time{} // 重置JWT过期时间
 						acc.Status = StatusPending
@@ -778,8 +1042,10 @@ func (p *AccountPool) refreshWorker(id int) {
 			}
 		} else {
 			// 刷新成功：重置失败计数
+			acc.RecordRefresh("jwt", nil)
 			acc.Mu.Lock()
 			acc.FailCount = 0
+			acc.AuthFailSince = time.Time{}
 			acc.Status = StatusReady
 			acc.Mu.Unlock()
 
@@ -818,16 +1084,23 @@ func (p *AccountPool) RefreshExpiredAccounts() {
 	refreshed := 0
 	now := time.Now()
 
+	// 启用主动刷新时，JWT 由主动刷新原地续期，这里仅兜底处理已过期的账号
+	threshold := JWTRefreshThreshold
+	if JWTRefreshMargin > 0 {
+		threshold = 0
+	}
+
 	for _, acc := range p.readyAccounts {
 		acc.Mu.Lock()
 		jwtExpires := acc.JWTExpires
 		lastRefresh := acc.LastRefresh
+		refreshing := acc.proactiveRefreshing
 		acc.Mu.Unlock()
 
-		needsRefresh := jwtExpires.IsZero() || now.Add(JWTRefreshThreshold).After(jwtExpires)
+		needsRefresh := jwtExpires.IsZero() || now.Add(threshold).After(jwtExpires)
 		inCooldown := now.Sub(lastRefresh) < RefreshCooldown
 
-		if needsRefresh && !inCooldown {
+		if needsRefresh && !inCooldown && !refreshing {
 			acc.Mu.Lock()
 			acc.Refreshed = false
 			acc.Status = StatusPending
@@ -845,6 +1118,105 @@ func (p *AccountPool) RefreshExpiredAccounts() {
 	}
 }
 
+// proactiveRefreshWorker 在JWT到期前主动刷新就绪账号，避免请求时才发现过期
+func (p *AccountPool) proactiveRefreshWorker() {
+	ticker := time.NewTicker(proactiveRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.stopChan:
+			return
+		case <-ticker.C:
+			p.scheduleProactiveRefresh(time.Now())
+		}
+	}
+}
+
+// scheduleProactiveRefresh 选出即将到期的账号并发起刷新，每轮数量受限以错开刷新时间
+func (p *AccountPool) scheduleProactiveRefresh(now time.Time) int {
+	slots := proactiveRefreshMaxRunning - int(atomic.LoadInt32(&p.proactiveRefreshRunning))
+	if slots > proactiveRefreshPerTick {
+		slots = proactiveRefreshPerTick
+	}
+	due := p.claimProactiveRefresh(now, slots)
+	for _, acc := range due {
+		atomic.AddInt32(&p.proactiveRefreshRunning, 1)
+		go func(acc *Account) {
+			defer atomic.AddInt32(&p.proactiveRefreshRunning, -1)
+			p.proactiveRefresh(acc)
+		}(acc)
+	}
+	return len(due)
+}
+
+// claimProactiveRefresh 按到期先后认领最多 limit 个需要主动刷新的就绪账号
+func (p *AccountPool) claimProactiveRefresh(now time.Time, limit int) []*Account {
+	margin := JWTRefreshMargin
+	if margin <= 0 || limit <= 0 {
+		return nil
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	type candidate struct {
+		acc     *Account
+		expires time.Time
+	}
+	var candidates []candidate
+	for _, acc := range p.readyAccounts {
+		acc.Mu.Lock()
+		due := acc.JWT != "" && !acc.JWTExpires.IsZero() &&
+			!acc.proactiveRefreshing &&
+			now.Add(margin).After(acc.JWTExpires) &&
+			now.Sub(acc.LastRefresh) >= RefreshCooldown &&
+			!now.Before(acc.proactiveRetryAt)
+		expires := acc.JWTExpires
+		acc.Mu.Unlock()
+		if due {
+			candidates = append(candidates, candidate{acc: acc, expires: expires})
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].expires.Before(candidates[j].expires)
+	})
+	if len(candidates) > limit {
+		candidates = candidates[:limit]
+	}
+
+	claimed := make([]*Account, 0, len(candidates))
+	for _, c := range candidates {
+		c.acc.Mu.Lock()
+		c.acc.proactiveRefreshing = true
+		c.acc.Mu.Unlock()
+		claimed = append(claimed, c.acc)
+	}
+	return claimed
+}
+
+// proactiveRefresh 原地刷新账号JWT，失败时延后重试，过期后由扫描兜底移入刷新池
+func (p *AccountPool) proactiveRefresh(acc *Account) {
+	err := acc.refreshJWTInPlace()
+	acc.RecordRefresh("proactive", err)
+
+	acc.Mu.Lock()
+	acc.proactiveRefreshing = false
+	if err != nil {
+		acc.proactiveRetryAt = time.Now().Add(proactiveRefreshRetryDelay)
+	}
+	email := acc.Data.Email
+	acc.Mu.Unlock()
+
+	if err != nil {
+		atomic.AddInt64(&p.proactiveRefreshFailed, 1)
+		logger.Warn("⚠️ [%s] JWT主动刷新失败: %v", email, err)
+		return
+	}
+	atomic.AddInt64(&p.proactiveRefreshSuccess, 1)
+	logger.Debug("🔄 [%s] JWT主动刷新成功", email)
+}
+
 func (p *AccountPool) RefreshAllAccounts() {
 	p.mu.Lock()
 	defer p.mu.Unlock()
@@ -900,7 +1272,31 @@ func (acc *Account) GetDailyUsage() (count int, limit int, date string) {
 	return acc.DailyCount, DailyLimit, acc.DailyCountDate
 }
 
-func (p *AccountPool) Next() *Account {
+// HasTag 判断账号是否带有指定标签（不区分大小写）
+func (d *AccountData) HasTag(tag string) bool {
+	for _, t := range d.Tags {
+		if strings.EqualFold(strings.TrimSpace(t), tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesTag 账号能否服务指定标签：未打标签的账号可服务所有请求，打了标签的账号只服务对应标签
+func (acc *Account) matchesTag(tag string) bool {
+	if len(acc.Data.Tags) == 0 {
+		return true
+	}
+	return tag != "" && acc.Data.HasTag(tag)
+}
+
+// Next 选择一个可服务 tag 的就绪账号（tag 为空时只从未打标签的账号中选择）
+func (p *AccountPool) Next(tag string) *Account {
+	return p.NextWithConfigID(tag, "")
+}
+
+// NextWithConfigID 同 Next，configID 非空时只选择可使用该 configId 的账号
+func (p *AccountPool) NextWithConfigID(tag, configID string) *Account {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
 
@@ -915,11 +1311,17 @@ func (p *AccountPool) Next() *Account {
 	var bestAccount *Account
 	var oldestUsed time.Time
 	var allExceededDaily bool = true
+	matched := 0
 
 	// 第一轮：找不在使用冷却中且未超日限的账号
 	for i := 0; i < n; i++ {
 		acc := p.readyAccounts[(startIdx+uint64(i))%uint64(n)]
 		acc.Mu.Lock()
+		if !acc.matchesTag(tag) || (configID != "" && !acc.allowsConfigIDLocked(configID)) {
+			acc.Mu.Unlock()
+			continue
+		}
+		matched++
 		inUseCooldown := now.Sub(acc.LastUsed) < UseCooldown
 		lastUsed := acc.LastUsed
 
@@ -955,6 +1357,15 @@ func (p *AccountPool) Next() *Account {
 		}
 	}
 
+	if matched == 0 {
+		if configID != "" {
+			log.Printf("⚠️ 没有可服务标签 %q 且可使用 configId %s 的就绪账号", tag, configID)
+		} else {
+			log.Printf("⚠️ 没有可服务标签 %q 的就绪账号", tag)
+		}
+		return nil
+	}
+
 	// 所有账号都超过每日限制
 	if allExceededDaily {
 		log.Printf("⚠️ 所有账号已达每日调用上限 (%d次/天)", DailyLimit)
@@ -976,15 +1387,32 @@ func (p *AccountPool) Next() *Account {
 
 // MarkUsed 标记账号已使用（成功）
 func (p *AccountPool) MarkUsed(acc *Account, success bool) {
+	p.markUsed(acc, success, "")
+}
+
+// MarkFailed 标记账号使用失败并记录原因
+func (p *AccountPool) MarkFailed(acc *Account, reason string) {
+	p.markUsed(acc, false, reason)
+}
+
+func (p *AccountPool) markUsed(acc *Account, success bool, reason string) {
 	if acc == nil {
 		return
 	}
 	acc.Mu.Lock()
 	defer acc.Mu.Unlock()
 
+	ev := AccountEvent{Time: time.Now(), Success: success, Error: reason}
+	acc.recentUsage = appendAccountEvent(acc.recentUsage, ev)
+	if !success && reason != "" {
+		acc.LastError = reason
+		acc.LastErrorAt = ev.Time
+		acc.recordUpstreamFailureLocked(reason, ev.Time)
+	}
 	if success {
 		acc.SuccessCount++
-		acc.FailCount = 0 // 重置连续失败
+		acc.FailCount = 0       // 重置连续失败
+		acc.RateLimitStreak = 0 // 重置 429 退避
 		atomic.AddInt64(&p.totalSuccess, 1)
 	} else {
 		acc.FailCount++
@@ -994,9 +1422,19 @@ func (p *AccountPool) MarkUsed(acc *Account, success bool) {
 
 // MarkNeedsRefresh 标记账号需要刷新（遇到401/403等）
 func (p *AccountPool) MarkNeedsRefresh(acc *Account) {
+	p.MarkNeedsRefreshReason(acc, "")
+}
+
+// MarkNeedsRefreshReason 标记账号需要刷新并记录触发的上游失败原因
+func (p *AccountPool) MarkNeedsRefreshReason(acc *Account, reason string) {
 	if acc == nil {
 		return
 	}
+	if reason != "" {
+		acc.Mu.Lock()
+		acc.recordUpstreamFailureLocked(reason, time.Now())
+		acc.Mu.Unlock()
+	}
 	if ExternalRefreshMode {
 		p.MarkExternalRefreshPending(acc)
 		return
@@ -1226,6 +1664,27 @@ func (p *AccountPool) ReadyCount() int {
 	defer p.mu.RUnlock()
 	return len(p.readyAccounts)
 }
+
+// ServableCount 返回可服务 tag 且未达每日上限的就绪账号数（规则同 Next，但不占用账号）
+func (p *AccountPool) ServableCount(tag string) int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	today := time.Now().Format("2006-01-02")
+	count := 0
+	for _, acc := range p.readyAccounts {
+		acc.Mu.Lock()
+		dailyCount := acc.DailyCount
+		if acc.DailyCountDate != today {
+			dailyCount = 0
+		}
+		servable := acc.matchesTag(tag) && !(DailyLimit > 0 && dailyCount >= DailyLimit)
+		acc.Mu.Unlock()
+		if servable {
+			count++
+		}
+	}
+	return count
+}
 func (p *AccountPool) TotalCount() int {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
@@ -1233,6 +1692,44 @@ func (p *AccountPool) TotalCount() int {
 }
 
 // Stats 返回号池统计信息
+// tagStatsLocked 统计各标签（以及未打标签）的就绪/总账号数，调用方需持有 p.mu
+func (p *AccountPool) tagStatsLocked() (map[string]map[string]int, map[string]int) {
+	tags := make(map[string]map[string]int)
+	untagged := map[string]int{"ready": 0, "total": 0}
+	count := func(list []*Account, ready bool) {
+		for _, acc := range list {
+			acc.Mu.Lock()
+			accTags := acc.Data.Tags
+			acc.Mu.Unlock()
+			if len(accTags) == 0 {
+				untagged["total"]++
+				if ready {
+					untagged["ready"]++
+				}
+				continue
+			}
+			seen := make(map[string]bool, len(accTags))
+			for _, t := range accTags {
+				t = strings.ToLower(strings.TrimSpace(t))
+				if t == "" || seen[t] {
+					continue
+				}
+				seen[t] = true
+				if tags[t] == nil {
+					tags[t] = map[string]int{"ready": 0, "total": 0}
+				}
+				tags[t]["total"]++
+				if ready {
+					tags[t]["ready"]++
+				}
+			}
+		}
+	}
+	count(p.readyAccounts, true)
+	count(p.pendingAccounts, false)
+	return tags, untagged
+}
+
 func (p *AccountPool) Stats() map[string]interface{} {
 	p.mu.RLock()
 	defer p.mu.RUnlock()
@@ -1271,6 +1768,7 @@ func (p *AccountPool) Stats() map[string]interface{} {
 		}
 		acc.Mu.Unlock()
 	}
+	tags, untagged := p.tagStatsLocked()
 
 	claimTotal, refreshSuccessTotal, refreshFailedTotal, leaseExpiredTotal, fallbackTotal, refreshSuccessRate, fallbackRatio, throttled := p.externalMetricsLocked()
 	refreshSampleSize := refreshSuccessTotal + refreshFailedTotal
@@ -1287,10 +1785,19 @@ func (p *AccountPool) Stats() map[string]interface{} {
 		"total_failed":     totalFailed,
 		"success_rate":     fmt.Sprintf("%.1f%%", successRate),
 		"daily_limit":      DailyLimit,
+		"tags":             tags,
+		"untagged":         untagged,
 		"cooldowns": map[string]interface{}{
 			"refresh_sec": int(RefreshCooldown.Seconds()),
 			"use_sec":     int(UseCooldown.Seconds()),
 		},
+		"jwt_proactive_refresh": map[string]interface{}{
+			"margin_sec": int(JWTRefreshMargin.Seconds()),
+			"ttl_sec":    int(JwtTTL.Seconds()),
+			"running":    atomic.LoadInt32(&p.proactiveRefreshRunning),
+			"success":    atomic.LoadInt64(&p.proactiveRefreshSuccess),
+			"failed":     atomic.LoadInt64(&p.proactiveRefreshFailed),
+		},
 		"registrar_metrics": map[string]interface{}{
 			"refresh_claim_total":         claimTotal,
 			"refresh_success_total":       refreshSuccessTotal,
@@ -1305,6 +1812,82 @@ func (p *AccountPool) Stats() map[string]interface{} {
 	}
 }
 
+// PoolSample 号池数量的单次采样
+type PoolSample struct {
+	Time            time.Time `json:"time"`
+	Ready           int       `json:"ready"`
+	Pending         int       `json:"pending"` // 含待外部续期
+	PendingExternal int       `json:"pending_external"`
+	Invalid         int       `json:"invalid"`  // 启动以来因失效被移除的累计账号数
+	Requests        int64     `json:"requests"` // 距上次采样的请求数
+}
+
+const (
+	HistoryInterval  = time.Minute // 采样间隔
+	poolHistoryLimit = 24 * 60     // 保留 24 小时
+)
+
+// StartHistorySampler 启动号池数量采样（每分钟一次，重复调用无效）
+func (p *AccountPool) StartHistorySampler() {
+	p.historyOnce.Do(func() {
+		p.recordSample(time.Now())
+		go func() {
+			ticker := time.NewTicker(HistoryInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-p.stopChan:
+					return
+				case now := <-ticker.C:
+					p.recordSample(now)
+				}
+			}
+		}()
+	})
+}
+
+// recordSample 记录一次号池数量采样，超出 poolHistoryLimit 时丢弃最旧的记录
+func (p *AccountPool) recordSample(now time.Time) {
+	p.mu.RLock()
+	sample := PoolSample{
+		Time:    now,
+		Ready:   len(p.readyAccounts),
+		Pending: len(p.pendingAccounts),
+	}
+	for _, acc := range p.pendingAccounts {
+		acc.Mu.Lock()
+		if acc.Status == StatusPendingExternal {
+			sample.PendingExternal++
+		}
+		acc.Mu.Unlock()
+	}
+	p.mu.RUnlock()
+	sample.Invalid = int(atomic.LoadInt64(&p.invalidTotal))
+
+	totalRequests := atomic.LoadInt64(&p.totalRequests)
+	p.historyMu.Lock()
+	defer p.historyMu.Unlock()
+	sample.Requests = totalRequests - p.historyLastRequests
+	if sample.Requests < 0 { // 统计被重置
+		sample.Requests = totalRequests
+	}
+	p.historyLastRequests = totalRequests
+	p.history = append(p.history, sample)
+	if len(p.history) > poolHistoryLimit {
+		p.history = append([]PoolSample(nil), p.history[len(p.history)-poolHistoryLimit:]...)
+	}
+}
+
+// History 返回 since 之后（含）的采样副本，since 为零值时返回全部
+func (p *AccountPool) History(since time.Time) []PoolSample {
+	p.historyMu.Lock()
+	defer p.historyMu.Unlock()
+	start := sort.Search(len(p.history), func(i int) bool {
+		return !p.history[i].Time.Before(since)
+	})
+	return append([]PoolSample(nil), p.history[start:]...)
+}
+
 // AccountInfo 账号信息（用于API返回）
 type AccountInfo struct {
 	Email          string    `json:"email"`
@@ -1318,6 +1901,11 @@ type AccountInfo struct {
 	DailyLimit     int       `json:"daily_limit"`
 	DailyRemaining int       `json:"daily_remaining"`
 	JWTExpires     time.Time `json:"jwt_expires"`
+	CooldownMult   int       `json:"cooldown_multiplier"` // 当前 429 退避冷却倍数（1=未限流）
+
+	UpstreamFailure     string    `json:"upstream_failure,omitempty"`
+	UpstreamFailureKind string    `json:"upstream_failure_kind,omitempty"`
+	UpstreamFailureAt   time.Time `json:"upstream_failure_at,omitempty"`
 }
 
 // ListAccounts 列出所有账号信息
@@ -1360,6 +1948,11 @@ func (p *AccountPool) ListAccounts() []AccountInfo {
 				DailyLimit:     DailyLimit,
 				DailyRemaining: dailyRemaining,
 				JWTExpires:     acc.JWTExpires,
+				CooldownMult:   RateLimitMultiplier(acc.RateLimitStreak),
+
+				UpstreamFailure:     acc.UpstreamFailure,
+				UpstreamFailureKind: acc.UpstreamFailureKind,
+				UpstreamFailureAt:   acc.UpstreamFailureAt,
 			}
 			acc.Mu.Unlock()
 			accounts = append(accounts, info)
@@ -1372,6 +1965,46 @@ func (p *AccountPool) ListAccounts() []AccountInfo {
 	return accounts
 }
 
+// AccountDetail 单个账号的详细信息（用于管理接口）
+type AccountDetail struct {
+	Data                AccountData
+	HasJWT              bool
+	BrowserRefreshCount int
+	LastError           string
+	LastErrorAt         time.Time
+	RecentUsage         []AccountEvent
+	RefreshHistory      []AccountEvent
+}
+
+// GetAccountDetail 按邮箱（不区分大小写）获取账号详情副本
+func (p *AccountPool) GetAccountDetail(email string) (AccountDetail, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	for _, list := range [][]*Account{p.readyAccounts, p.pendingAccounts} {
+		for _, acc := range list {
+			acc.Mu.Lock()
+			if !strings.EqualFold(acc.Data.Email, email) {
+				acc.Mu.Unlock()
+				continue
+			}
+			detail := AccountDetail{
+				Data:                acc.Data,
+				HasJWT:              acc.JWT != "",
+				BrowserRefreshCount: acc.BrowserRefreshCount,
+				LastError:           acc.LastError,
+				LastErrorAt:         acc.LastErrorAt,
+				RecentUsage:         append([]AccountEvent(nil), acc.recentUsage...),
+				RefreshHistory:      append([]AccountEvent(nil), acc.refreshHistory...),
+			}
+			detail.Data.Cookies = append([]Cookie(nil), acc.Data.Cookies...)
+			acc.Mu.Unlock()
+			return detail, true
+		}
+	}
+	return AccountDetail{}, false
+}
+
 // ForceRefreshAll 强制刷新所有账号
 func (p *AccountPool) ForceRefreshAll() int {
 	p.mu.Lock()
@@ -1414,6 +2047,7 @@ func kqEncode(s string) string {
 func createJWT(keyBytes []byte, keyID, csesidx string) string {
 	now := time.Now().Unix()
 	header := map[string]interface{}{"alg": "HS256", "typ": "JWT", "kid": keyID}
+	// iss/aud 是 Google 校验的身份标识，不随 UpstreamOrigin（镜像/区域地址）变化
 	payload := map[string]interface{}{
 		"iss": "https://business.gemini.google",
 		"aud": "https://biz-discoveryengine.googleapis.com",
@@ -1430,7 +2064,8 @@ func createJWT(keyBytes []byte, keyID, csesidx string) string {
 	return message + "." + urlsafeB64Encode(h.Sum(nil))
 }
 
-func extractCSESIDX(auth string) string {
+// ExtractCSESIDX 从 Authorization JWT 的 sub 中解析 csesidx
+func ExtractCSESIDX(auth string) string {
 	parts := strings.Split(auth, " ")
 	if len(parts) != 2 {
 		return ""
@@ -1508,14 +2143,14 @@ func (acc *Account) RefreshJWT() error {
 		}
 	}
 
-	req, _ := http.NewRequest("GET", "https://business.gemini.google/auth/getoxsrf", nil)
+	req, _ := http.NewRequest("GET", UpstreamOrigin+"/auth/getoxsrf", nil)
 	q := req.URL.Query()
 	q.Add("csesidx", acc.CSESIDX)
 	req.URL.RawQuery = q.Encode()
 
 	req.Header.Set("Cookie", cookie)
 	req.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36")
-	req.Header.Set("Referer", "https://business.gemini.google/")
+	req.Header.Set("Referer", UpstreamOrigin+"/")
 
 	resp, err := HTTPClient.Do(req)
 	if err != nil {
@@ -1584,6 +2219,29 @@ func (acc *Account) RefreshJWT() error {
 	return nil
 }
 
+// refreshJWTInPlace 刷新JWT但不持有账号锁进行网络请求，刷新期间旧JWT仍可继续使用
+func (acc *Account) refreshJWTInPlace() error {
+	acc.Mu.Lock()
+	tmp := &Account{
+		Data:     acc.Data,
+		ConfigID: acc.ConfigID,
+		CSESIDX:  acc.CSESIDX,
+	}
+	acc.Mu.Unlock()
+
+	if err := tmp.RefreshJWT(); err != nil {
+		return err
+	}
+
+	acc.Mu.Lock()
+	acc.JWT = tmp.JWT
+	acc.JWTExpires = tmp.JWTExpires
+	acc.LastRefresh = tmp.LastRefresh
+	acc.ConfigID = tmp.ConfigID
+	acc.Mu.Unlock()
+	return nil
+}
+
 // GetJWT 获取JWT
 func (acc *Account) GetJWT() (string, string, error) {
 	acc.Mu.Lock()
@@ -1594,6 +2252,114 @@ func (acc *Account) GetJWT() (string, string, error) {
 	return acc.JWT, acc.ConfigID, nil
 }
 
+// configId 选择策略
+const (
+	ConfigIDPolicyBound      = "bound"       // 固定使用账号当前的 configId（默认）
+	ConfigIDPolicyRoundRobin = "round_robin" // 每次请求在账号可用的 configId 之间轮换
+)
+
+var (
+	configIDMu       sync.RWMutex
+	configIDPolicy   = ConfigIDPolicyBound
+	defaultConfigIDs []string // 账号未配置 configId 时，与 DefaultConfig 一起可用的 configId
+)
+
+// ErrConfigIDNotAllowed 请求指定的 configId 不属于该账号
+var ErrConfigIDNotAllowed = errors.New("configId 不属于该账号")
+
+// SetConfigIDPolicy 设置 configId 选择策略（未知值按 bound 处理）与全局额外 configId
+func SetConfigIDPolicy(policy string, extra []string) {
+	policy = strings.ToLower(strings.TrimSpace(policy))
+	if policy != ConfigIDPolicyRoundRobin {
+		policy = ConfigIDPolicyBound
+	}
+	configIDMu.Lock()
+	defer configIDMu.Unlock()
+	configIDPolicy = policy
+	defaultConfigIDs = append([]string(nil), extra...)
+}
+
+// configIDsLocked 账号可用的 configId（去重，首个为当前 configId）：账号自身的 configId/configIds，
+// 账号未配置时为 default_config 与 config_ids。调用方需持有 acc.Mu
+func (acc *Account) configIDsLocked() []string {
+	candidates := append([]string{acc.ConfigID}, acc.Data.ConfigIDs...)
+	if acc.Data.ConfigID == "" && len(acc.Data.ConfigIDs) == 0 {
+		configIDMu.RLock()
+		candidates = append(candidates, defaultConfigIDs...)
+		configIDMu.RUnlock()
+	}
+	seen := make(map[string]bool, len(candidates))
+	ids := make([]string, 0, len(candidates))
+	for _, id := range candidates {
+		id = strings.TrimSpace(id)
+		if id == "" || seen[id] {
+			continue
+		}
+		seen[id] = true
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// allowsConfigIDLocked 账号能否使用指定 configId，调用方需持有 acc.Mu
+func (acc *Account) allowsConfigIDLocked(id string) bool {
+	for _, candidate := range acc.configIDsLocked() {
+		if candidate == id {
+			return true
+		}
+	}
+	return false
+}
+
+// ConfigIDs 返回账号可用的 configId
+func (acc *Account) ConfigIDs() []string {
+	acc.Mu.Lock()
+	defer acc.Mu.Unlock()
+	return acc.configIDsLocked()
+}
+
+// SelectConfigID 选择本次请求使用的 configId：override 非空时须属于该账号，否则按 config_id_policy 选择
+func (acc *Account) SelectConfigID(override string) (string, error) {
+	acc.Mu.Lock()
+	defer acc.Mu.Unlock()
+	if override != "" {
+		if !acc.allowsConfigIDLocked(override) {
+			return "", fmt.Errorf("%w: %s (%s)", ErrConfigIDNotAllowed, override, acc.Data.Email)
+		}
+		return override, nil
+	}
+	ids := acc.configIDsLocked()
+	if len(ids) == 0 {
+		return acc.ConfigID, nil
+	}
+	configIDMu.RLock()
+	policy := configIDPolicy
+	configIDMu.RUnlock()
+	if policy != ConfigIDPolicyRoundRobin || len(ids) == 1 {
+		return ids[0], nil
+	}
+	id := ids[acc.configCursor%uint64(len(ids))]
+	acc.configCursor++
+	return id, nil
+}
+
+// HasConfigID 是否有账号（就绪或待刷新）可使用指定 configId
+func (p *AccountPool) HasConfigID(id string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for _, list := range [][]*Account{p.readyAccounts, p.pendingAccounts} {
+		for _, acc := range list {
+			acc.Mu.Lock()
+			ok := acc.allowsConfigIDLocked(id)
+			acc.Mu.Unlock()
+			if ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func (acc *Account) fetchConfigID() (string, error) {
 	if acc.Data.ConfigID != "" {
 		return acc.Data.ConfigID, nil
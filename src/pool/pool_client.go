@@ -25,6 +25,7 @@ type BrowserRegisterResult struct {
 	Authorization string
 	ConfigID      string
 	CSESIDX       string
+	ProxyKey      string // 注册所用代理节点标识
 	Error         error
 }
 
@@ -40,13 +41,28 @@ var (
 	ClientProxy        string
 	GetClientProxy     func() string                    // 获取代理的函数
 	ReleaseProxy       func(proxyURL string)            // 释放代理的函数
+	GetAccountProxy    func(proxyKey string) string     // 按账号粘性节点获取代理（不可用时回退到新代理）
+	ProxyKeyOf         func(proxyURL string) string     // 代理实例对应的节点标识
 	DefaultProxyCount  = 3                              // 客户端模式默认启动的代理实例数
 	IsProxyReady       func() bool                      // 检查代理是否就绪
 	WaitProxyReady     func(timeout time.Duration) bool // 等待代理就绪
 	GetHealthyCount    func() int                       // 获取健康代理数量
 	proxyReadyTimeout  = 30 * time.Second               // 代理就绪超时时间（减少等待）
+	minHealthyProxies  = 1                              // 开始注册/续期前需要的最少健康代理数
 )
 
+// SetProxyReadyGate 设置注册/续期前的代理就绪门槛：最少健康代理数（<=0 为 1）与等待超时（秒，<=0 为 30）
+func SetProxyReadyGate(minHealthy, timeoutSec int) {
+	minHealthyProxies = 1
+	if minHealthy > 0 {
+		minHealthyProxies = minHealthy
+	}
+	proxyReadyTimeout = 30 * time.Second
+	if timeoutSec > 0 {
+		proxyReadyTimeout = time.Duration(timeoutSec) * time.Second
+	}
+}
+
 // PoolClient 号池客户端
 type PoolClient struct {
 	config    PoolServerConfig
@@ -298,7 +314,7 @@ func (pc *PoolClient) handleRegisterTask(data map[string]interface{}) {
 	}()
 
 	logger.Info("收到注册任务 [%d]", taskID)
-	if GetHealthyCount != nil && GetHealthyCount() >= 1 {
+	if GetHealthyCount != nil && GetHealthyCount() >= minHealthyProxies {
 		// 已有健康代理，直接开始
 	} else if WaitProxyReady != nil {
 		if !WaitProxyReady(proxyReadyTimeout) {
@@ -312,13 +328,18 @@ func (pc *PoolClient) handleRegisterTask(data map[string]interface{}) {
 		currentProxy = GetClientProxy()
 	}
 	logger.Info("[注册 %d] 使用代理: %s", taskID, currentProxy)
+	proxyKey := ""
+	if ProxyKeyOf != nil {
+		proxyKey = ProxyKeyOf(currentProxy)
+	}
 	result := RunBrowserRegister(ClientHeadless, currentProxy, int(taskID))
-
-	// 任务完成后释放代理
-	if ReleaseProxy != nil && currentProxy != "" && currentProxy != ClientProxy {
-		ReleaseProxy(currentProxy)
+	if result.Success {
+		result.ProxyKey = proxyKey
 	}
 
+	// 任务完成后上报结果并释放代理
+	finishProxy(currentProxy, result.Success)
+
 	if result.Success {
 		// 上传账号到服务器
 		if err := pc.uploadAccount(result, true); err != nil {
@@ -392,7 +413,7 @@ func (pc *PoolClient) handleRefreshTask(data map[string]interface{}) {
 	logger.Info("收到续期任务: %s", email)
 
 	// 检查代理：如果已有健康代理则不等待
-	if GetHealthyCount != nil && GetHealthyCount() >= 1 {
+	if GetHealthyCount != nil && GetHealthyCount() >= minHealthyProxies {
 		// 已有健康代理，直接开始
 	} else if WaitProxyReady != nil {
 		if !WaitProxyReady(proxyReadyTimeout) {
@@ -435,20 +456,27 @@ func (pc *PoolClient) handleRefreshTask(data map[string]interface{}) {
 	if csesidx, ok := data["csesidx"].(string); ok {
 		acc.CSESIDX = csesidx
 	}
+	if proxyKey, ok := data["proxy_key"].(string); ok {
+		acc.Data.ProxyKey = proxyKey
+	}
 
-	// 获取代理（优先使用代理池）
+	// 获取代理（优先使用账号粘性节点，其次代理池）
 	currentProxy := Proxy
-	if GetClientProxy != nil {
+	if GetAccountProxy != nil {
+		currentProxy = GetAccountProxy(acc.Data.ProxyKey)
+	} else if GetClientProxy != nil {
 		currentProxy = GetClientProxy()
 	}
+	proxyKey := ""
+	if ProxyKeyOf != nil {
+		proxyKey = ProxyKeyOf(currentProxy)
+	}
 
 	// 执行浏览器刷新
 	result := RefreshCookieWithBrowser(acc, BrowserRefreshHeadless, currentProxy)
 
-	// 任务完成后释放代理
-	if ReleaseProxy != nil && currentProxy != "" && currentProxy != Proxy {
-		ReleaseProxy(currentProxy)
-	}
+	// 任务完成后上报结果并释放代理
+	finishProxy(currentProxy, result.Success)
 
 	if result.Success {
 		logger.Info("✅ 账号续期成功: %s", email)
@@ -476,6 +504,7 @@ func (pc *PoolClient) handleRefreshTask(data map[string]interface{}) {
 			Authorization: authorization,
 			ConfigID:      configID,
 			CSESIDX:       csesidx,
+			ProxyKey:      proxyKey,
 			IsNew:         false,
 		}
 		logger.Info("[%s] 上传续期数据: configID=%s, csesidx=%s, auth长度=%d",
@@ -528,6 +557,7 @@ func (pc *PoolClient) uploadAccount(result *BrowserRegisterResult, isNew bool) e
 		Authorization: result.Authorization,
 		ConfigID:      result.ConfigID,
 		CSESIDX:       result.CSESIDX,
+		ProxyKey:      result.ProxyKey,
 		IsNew:         isNew,
 	}
 	return pc.uploadAccountData(req)
@@ -0,0 +1,82 @@
+package pool
+
+import (
+	"errors"
+	"testing"
+)
+
+func newConfigIDReadyAccount(email, configID string, extra ...string) *Account {
+	acc := newTaggedReadyAccount(email)
+	acc.Data.ConfigID = configID
+	acc.Data.ConfigIDs = extra
+	acc.ConfigID = configID
+	return acc
+}
+
+func TestSelectConfigIDFollowsPolicyAndValidatesOverride(t *testing.T) {
+	defer SetConfigIDPolicy(ConfigIDPolicyBound, nil)
+	acc := newConfigIDReadyAccount("multi@example.com", "cfg-a", "cfg-b", "cfg-a", " ")
+
+	if got := acc.ConfigIDs(); len(got) != 2 || got[0] != "cfg-a" || got[1] != "cfg-b" {
+		t.Fatalf("ConfigIDs = %v, want [cfg-a cfg-b]", got)
+	}
+
+	SetConfigIDPolicy("", nil)
+	for i := 0; i < 3; i++ {
+		if id, err := acc.SelectConfigID(""); err != nil || id != "cfg-a" {
+			t.Fatalf("bound policy should keep cfg-a, got %q, %v", id, err)
+		}
+	}
+
+	SetConfigIDPolicy("Round_Robin", nil)
+	var got []string
+	for i := 0; i < 4; i++ {
+		id, err := acc.SelectConfigID("")
+		if err != nil {
+			t.Fatalf("SelectConfigID: %v", err)
+		}
+		got = append(got, id)
+	}
+	if got[0] != "cfg-a" || got[1] != "cfg-b" || got[2] != "cfg-a" || got[3] != "cfg-b" {
+		t.Fatalf("round_robin should alternate, got %v", got)
+	}
+
+	if id, err := acc.SelectConfigID("cfg-b"); err != nil || id != "cfg-b" {
+		t.Fatalf("allowed override should be used, got %q, %v", id, err)
+	}
+	if _, err := acc.SelectConfigID("cfg-other"); !errors.Is(err, ErrConfigIDNotAllowed) {
+		t.Fatalf("foreign override should be rejected, got %v", err)
+	}
+}
+
+func TestGlobalConfigIDsOnlyApplyToAccountsWithoutOwnConfigID(t *testing.T) {
+	defer SetConfigIDPolicy(ConfigIDPolicyBound, nil)
+	SetConfigIDPolicy(ConfigIDPolicyRoundRobin, []string{"cfg-global"})
+
+	bound := newConfigIDReadyAccount("bound@example.com", "cfg-own")
+	shared := newConfigIDReadyAccount("shared@example.com", "")
+	shared.ConfigID = "cfg-default" // Load 时以 DefaultConfig 填充
+
+	if got := bound.ConfigIDs(); len(got) != 1 || got[0] != "cfg-own" {
+		t.Fatalf("account with own configId should not use config_ids, got %v", got)
+	}
+	if got := shared.ConfigIDs(); len(got) != 2 || got[0] != "cfg-default" || got[1] != "cfg-global" {
+		t.Fatalf("account without configId should use default + config_ids, got %v", got)
+	}
+
+	p := newTestPool()
+	p.readyAccounts = []*Account{bound, shared}
+	if !p.HasConfigID("cfg-global") || !p.HasConfigID("cfg-own") || p.HasConfigID("cfg-missing") {
+		t.Fatal("HasConfigID should reflect configIds of pool accounts")
+	}
+	for i := 0; i < 3; i++ {
+		acc := p.NextWithConfigID("", "cfg-global")
+		if acc != shared {
+			t.Fatalf("NextWithConfigID should only pick accounts allowing cfg-global, got %v", acc)
+		}
+		acc.LastUsed = acc.LastUsed.Add(-UseCooldown)
+	}
+	if acc := p.NextWithConfigID("", "cfg-missing"); acc != nil {
+		t.Fatalf("no account allows cfg-missing, got %s", acc.Data.Email)
+	}
+}
@@ -0,0 +1,130 @@
+package pool
+
+import (
+	"errors"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAccountHistoryIsCappedAndCopied(t *testing.T) {
+	acc := newExternalPendingAccount("history@example.com")
+	acc.Status = StatusReady
+	p := newTestPool()
+	p.readyAccounts = []*Account{acc}
+
+	for i := 0; i < accountHistoryLimit+5; i++ {
+		p.MarkUsed(acc, true)
+	}
+	p.MarkFailed(acc, "HTTP 500")
+	acc.RecordRefresh("jwt", errors.New("token expired"))
+	acc.RecordRefresh("jwt", nil)
+
+	detail, ok := p.GetAccountDetail("HISTORY@example.com")
+	if !ok {
+		t.Fatalf("expected account detail to be found case-insensitively")
+	}
+	if len(detail.RecentUsage) != accountHistoryLimit {
+		t.Fatalf("expected usage history capped at %d, got %d", accountHistoryLimit, len(detail.RecentUsage))
+	}
+	last := detail.RecentUsage[len(detail.RecentUsage)-1]
+	if last.Success || last.Error != "HTTP 500" {
+		t.Fatalf("expected last usage to be the failure, got %+v", last)
+	}
+	if len(detail.RefreshHistory) != 2 || detail.RefreshHistory[0].Success || !detail.RefreshHistory[1].Success {
+		t.Fatalf("unexpected refresh history: %+v", detail.RefreshHistory)
+	}
+	if detail.LastError != "token expired" {
+		t.Fatalf("expected last error from latest failure, got %q", detail.LastError)
+	}
+
+	detail.RecentUsage[0].Error = "mutated"
+	if again, _ := p.GetAccountDetail("history@example.com"); again.RecentUsage[0].Error == "mutated" {
+		t.Fatalf("detail should return a copy of the history")
+	}
+	if _, ok := p.GetAccountDetail("missing@example.com"); ok {
+		t.Fatalf("unexpected detail for missing account")
+	}
+}
+
+func TestPoolHistorySamplesAreCappedAndFiltered(t *testing.T) {
+	p := newTestPool()
+	ready := newExternalPendingAccount("ready@example.com")
+	ready.Status = StatusReady
+	external := newExternalPendingAccount("external@example.com")
+	pending := newExternalPendingAccount("pending@example.com")
+	pending.Status = StatusPending
+	p.readyAccounts = []*Account{ready}
+	p.pendingAccounts = []*Account{external, pending}
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	atomic.StoreInt64(&p.totalRequests, 5)
+	p.recordSample(start)
+	atomic.StoreInt64(&p.totalRequests, 12)
+	invalid := newExternalPendingAccount("gone@example.com")
+	invalid.FilePath = filepath.Join(t.TempDir(), "gone.json")
+	p.RemoveAccount(invalid)
+	p.recordSample(start.Add(HistoryInterval))
+
+	all := p.History(time.Time{})
+	if len(all) != 2 {
+		t.Fatalf("expected 2 samples, got %d", len(all))
+	}
+	first, second := all[0], all[1]
+	if first.Ready != 1 || first.Pending != 2 || first.PendingExternal != 1 || first.Invalid != 0 || first.Requests != 5 {
+		t.Fatalf("unexpected first sample: %+v", first)
+	}
+	if second.Invalid != 1 || second.Requests != 7 {
+		t.Fatalf("expected invalid total and per-interval requests, got %+v", second)
+	}
+	if recent := p.History(start.Add(HistoryInterval)); len(recent) != 1 || !recent[0].Time.Equal(second.Time) {
+		t.Fatalf("since filter should keep only newer samples, got %+v", recent)
+	}
+
+	all[0].Ready = 99
+	if p.History(time.Time{})[0].Ready == 99 {
+		t.Fatalf("history should return a copy")
+	}
+
+	for i := 0; i < poolHistoryLimit+10; i++ {
+		p.recordSample(start.Add(time.Duration(i+2) * HistoryInterval))
+	}
+	capped := p.History(time.Time{})
+	if len(capped) != poolHistoryLimit {
+		t.Fatalf("expected history capped at %d, got %d", poolHistoryLimit, len(capped))
+	}
+	if want := start.Add(time.Duration(poolHistoryLimit+11) * HistoryInterval); !capped[len(capped)-1].Time.Equal(want) {
+		t.Fatalf("expected newest sample kept, got %v", capped[len(capped)-1].Time)
+	}
+}
+
+func TestUpstreamFailureReasonIsClassified(t *testing.T) {
+	cases := map[string]string{
+		"HTTP 401":                FailureUnauthorized,
+		"创建 Session 失败: HTTP 401": FailureUnauthorized,
+		"认证失败（上游返回 uToken 响应）": FailureUnauthorized,
+		"HTTP 403":    FailureForbidden,
+		"配额耗尽":        FailureQuota,
+		"HTTP 429 限流": FailureRateLimited,
+		"空返回，无有效内容":   FailureEmptyReply,
+		"HTTP 500":    FailureUpstream,
+	}
+	for reason, want := range cases {
+		if got := ClassifyUpstreamFailure(reason); got != want {
+			t.Fatalf("ClassifyUpstreamFailure(%q)=%q, want %q", reason, got, want)
+		}
+	}
+
+	acc := newExternalPendingAccount("failure@example.com")
+	acc.Status = StatusReady
+	p := newTestPool()
+	p.readyAccounts = []*Account{acc}
+	p.MarkFailed(acc, "配额耗尽")
+	p.MarkNeedsRefreshReason(acc, "HTTP 401")
+
+	infos := p.ListAccounts()
+	if len(infos) != 1 || infos[0].UpstreamFailure != "HTTP 401" || infos[0].UpstreamFailureKind != FailureUnauthorized || infos[0].UpstreamFailureAt.IsZero() {
+		t.Fatalf("expected latest upstream failure in account info, got %+v", infos)
+	}
+}
@@ -0,0 +1,166 @@
+package pool
+
+import (
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newReadyJWTAccount(email string, expires, lastRefresh time.Time) *Account {
+	acc := newExternalPendingAccount(email)
+	acc.Status = StatusReady
+	acc.JWT = "old-jwt"
+	acc.JWTExpires = expires
+	acc.LastRefresh = lastRefresh
+	return acc
+}
+
+func TestClaimProactiveRefreshRespectsMarginCooldownAndLimit(t *testing.T) {
+	oldMargin, oldCooldown := JWTRefreshMargin, RefreshCooldown
+	defer func() {
+		JWTRefreshMargin, RefreshCooldown = oldMargin, oldCooldown
+	}()
+	JWTRefreshMargin = 30 * time.Second
+	RefreshCooldown = 4 * time.Minute
+
+	now := time.Now()
+	longAgo := now.Add(-10 * time.Minute)
+	soonest := newReadyJWTAccount("soonest@example.com", now.Add(5*time.Second), longAgo)
+	soon := newReadyJWTAccount("soon@example.com", now.Add(20*time.Second), longAgo)
+	later := newReadyJWTAccount("later@example.com", now.Add(25*time.Second), longAgo)
+	fresh := newReadyJWTAccount("fresh@example.com", now.Add(3*time.Minute), longAgo)
+	cooling := newReadyJWTAccount("cooling@example.com", now.Add(10*time.Second), now.Add(-time.Minute))
+
+	p := newTestPool()
+	p.readyAccounts = []*Account{later, fresh, cooling, soon, soonest}
+
+	claimed := p.claimProactiveRefresh(now, 2)
+	if len(claimed) != 2 {
+		t.Fatalf("expected 2 claimed accounts, got %d", len(claimed))
+	}
+	if claimed[0] != soonest || claimed[1] != soon {
+		t.Fatalf("expected accounts claimed by expiry order, got %s, %s", claimed[0].Data.Email, claimed[1].Data.Email)
+	}
+	for _, acc := range claimed {
+		if !acc.proactiveRefreshing {
+			t.Fatalf("claimed account %s should be marked refreshing", acc.Data.Email)
+		}
+	}
+
+	next := p.claimProactiveRefresh(now, 5)
+	if len(next) != 1 || next[0] != later {
+		t.Fatalf("expected only later account on next claim, got %d", len(next))
+	}
+
+	JWTRefreshMargin = 0
+	later.proactiveRefreshing = false
+	if got := p.claimProactiveRefresh(now, 5); len(got) != 0 {
+		t.Fatalf("expected no claims when proactive refresh disabled, got %d", len(got))
+	}
+}
+
+func TestProactiveRefreshKeepsAccountReady(t *testing.T) {
+	oldMargin, oldCooldown, oldHTTPClient := JWTRefreshMargin, RefreshCooldown, HTTPClient
+	defer func() {
+		JWTRefreshMargin, RefreshCooldown, HTTPClient = oldMargin, oldCooldown, oldHTTPClient
+	}()
+	JWTRefreshMargin = 30 * time.Second
+	RefreshCooldown = 4 * time.Minute
+
+	xsrfToken := base64.URLEncoding.EncodeToString([]byte("0123456789abcdef"))
+	HTTPClient = &http.Client{
+		Transport: roundTripFunc(func(req *http.Request) (*http.Response, error) {
+			if req.URL == nil || !strings.Contains(req.URL.String(), "getoxsrf") {
+				return nil, errors.New("unexpected request url")
+			}
+			body := ")]}'\n" + `{"xsrfToken":"` + xsrfToken + `","keyId":"kid-test"}`
+			return &http.Response{
+				StatusCode: http.StatusOK,
+				Body:       io.NopCloser(strings.NewReader(body)),
+				Header:     make(http.Header),
+			}, nil
+		}),
+	}
+
+	now := time.Now()
+	acc := newReadyJWTAccount("proactive@example.com", now.Add(10*time.Second), now.Add(-10*time.Minute))
+	p := newTestPool()
+	p.readyAccounts = []*Account{acc}
+
+	claimed := p.claimProactiveRefresh(now, 1)
+	if len(claimed) != 1 {
+		t.Fatalf("expected account to be claimed, got %d", len(claimed))
+	}
+	p.proactiveRefresh(claimed[0])
+
+	if p.ReadyCount() != 1 || p.PendingCount() != 0 {
+		t.Fatalf("account should stay ready during proactive refresh, ready=%d pending=%d", p.ReadyCount(), p.PendingCount())
+	}
+	acc.Mu.Lock()
+	defer acc.Mu.Unlock()
+	if acc.JWT == "old-jwt" || acc.JWT == "" {
+		t.Fatalf("expected jwt to be replaced, got %q", acc.JWT)
+	}
+	if !acc.JWTExpires.After(now.Add(JWTRefreshMargin)) {
+		t.Fatalf("expected jwt expiry to be extended, got %v", acc.JWTExpires)
+	}
+	if acc.proactiveRefreshing {
+		t.Fatalf("refreshing flag should be cleared")
+	}
+}
+
+func TestRefreshExpiredAccountsSkipsUnexpiredWhenProactiveEnabled(t *testing.T) {
+	oldMargin, oldCooldown := JWTRefreshMargin, RefreshCooldown
+	defer func() {
+		JWTRefreshMargin, RefreshCooldown = oldMargin, oldCooldown
+	}()
+	JWTRefreshMargin = 30 * time.Second
+	RefreshCooldown = 4 * time.Minute
+
+	now := time.Now()
+	longAgo := now.Add(-10 * time.Minute)
+	nearExpiry := newReadyJWTAccount("near@example.com", now.Add(20*time.Second), longAgo)
+	expired := newReadyJWTAccount("expired@example.com", now.Add(-time.Second), longAgo)
+
+	p := newTestPool()
+	p.readyAccounts = []*Account{nearExpiry, expired}
+	p.RefreshExpiredAccounts()
+
+	if p.ReadyCount() != 1 || p.readyAccounts[0] != nearExpiry {
+		t.Fatalf("expected near-expiry account to remain ready for proactive refresh")
+	}
+	if p.PendingCount() != 1 || p.pendingAccounts[0] != expired {
+		t.Fatalf("expected expired account to fall back to pending")
+	}
+}
+
+func TestJWTTTLAndRefreshWindow(t *testing.T) {
+	oldTTL, oldMargin := JwtTTL, JWTRefreshMargin
+	defer func() { JwtTTL, JWTRefreshMargin = oldTTL, oldMargin }()
+
+	SetJWTTTL(600)
+	if JwtTTL != 10*time.Minute {
+		t.Fatalf("expected ttl 10m, got %v", JwtTTL)
+	}
+	SetJWTTTL(0)
+	if JwtTTL != defaultJwtTTL {
+		t.Fatalf("expected default ttl, got %v", JwtTTL)
+	}
+
+	now := time.Now()
+	JWTRefreshMargin = 45 * time.Second
+	if !InJWTRefreshWindow(now.Add(30*time.Second), now) || InJWTRefreshWindow(now.Add(time.Minute), now) {
+		t.Fatalf("refresh window should follow the proactive margin")
+	}
+	JWTRefreshMargin = 0
+	if !InJWTRefreshWindow(now.Add(50*time.Second), now) || InJWTRefreshWindow(now.Add(2*time.Minute), now) {
+		t.Fatalf("refresh window should fall back to the scan threshold")
+	}
+	if InJWTRefreshWindow(time.Time{}, now) {
+		t.Fatalf("accounts without a JWT are not in the refresh window")
+	}
+}
@@ -0,0 +1,43 @@
+package pool
+
+import (
+	"testing"
+)
+
+func TestRateLimitMultiplierBacksOffToCap(t *testing.T) {
+	cases := map[int]int{0: 1, 1: 3, 2: 6, 3: 12, 4: 24, 5: 48, 6: 48, 20: 48}
+	for streak, want := range cases {
+		if got := RateLimitMultiplier(streak); got != want {
+			t.Fatalf("streak %d: expected multiplier %d, got %d", streak, want, got)
+		}
+	}
+}
+
+func TestMarkRateLimitedResetsAfterSuccess(t *testing.T) {
+	acc := newExternalPendingAccount("ratelimit@example.com")
+	acc.Status = StatusReady
+	p := newTestPool()
+	p.readyAccounts = []*Account{acc}
+
+	if got := acc.MarkRateLimited(); got != UseCooldown*3 {
+		t.Fatalf("expected first 429 cooldown %v, got %v", UseCooldown*3, got)
+	}
+	if got := acc.MarkRateLimited(); got != UseCooldown*6 {
+		t.Fatalf("expected second 429 cooldown %v, got %v", UseCooldown*6, got)
+	}
+	if infos := p.ListAccounts(); len(infos) != 1 || infos[0].CooldownMult != 6 {
+		t.Fatalf("expected listed multiplier 6, got %+v", infos)
+	}
+
+	p.MarkFailed(acc, "HTTP 500")
+	if acc.RateLimitStreak != 2 {
+		t.Fatalf("non-429 failure should not reset streak, got %d", acc.RateLimitStreak)
+	}
+	p.MarkUsed(acc, true)
+	if acc.RateLimitStreak != 0 {
+		t.Fatalf("success should reset streak, got %d", acc.RateLimitStreak)
+	}
+	if got := acc.MarkRateLimited(); got != UseCooldown*3 {
+		t.Fatalf("expected backoff to restart at %v, got %v", UseCooldown*3, got)
+	}
+}
@@ -370,6 +370,7 @@ func (ps *PoolServer) taskDispatcher() {
 				"mail_password": acc.Data.MailPassword,
 				"config_id":     acc.ConfigID,
 				"csesidx":       acc.CSESIDX,
+				"proxy_key":     acc.Data.ProxyKey,
 			})
 		}
 	}
@@ -439,13 +440,20 @@ func (ps *PoolServer) assignTask(client *WSClient) {
 		ps.pool.mu.Lock()
 		var toDelete []*Account
 		var remaining []*Account
+		now := time.Now()
 		for _, acc := range ps.pool.pendingAccounts {
 			if !acc.Refreshed && acc.FailCount > 0 {
-				// 401账号，标记删除
-				toDelete = append(toDelete, acc)
-			} else {
-				remaining = append(remaining, acc)
+				// 401账号：超出宽限（连续失败次数与持续时长）才删除
+				acc.Mu.Lock()
+				elapsed, due := acc.autoDeleteDueLocked(acc.FailCount, now)
+				acc.Mu.Unlock()
+				if due {
+					toDelete = append(toDelete, acc)
+					continue
+				}
+				logger.Debug("⏳ [服务端] 401账号 %s 失败 %d/%d 次、已持续 %v，宽限中暂不删除", acc.Data.Email, acc.FailCount, AutoDeleteMinFailures, elapsed.Round(time.Second))
 			}
+			remaining = append(remaining, acc)
 		}
 		ps.pool.pendingAccounts = remaining
 		ps.pool.mu.Unlock()
@@ -455,52 +463,52 @@ func (ps *PoolServer) assignTask(client *WSClient) {
 			logger.Info("🗑️ [服务端] 401自动删除账号: %s", acc.Data.Email)
 			ps.pool.RemoveAccount(acc)
 		}
-	} else {
-		// 未配置自动删除，分配续期任务给节点
-		// 计算401最大重试次数
-		maxRetry := MaxFailCount * 3
-		if maxRetry < 10 {
-			maxRetry = 10
-		}
+	}
+	// 分配续期任务给节点（自动删除宽限中的账号同样续期，给其恢复机会）
+	// 计算401最大重试次数
+	maxRetry := MaxFailCount * 3
+	if maxRetry < 10 {
+		maxRetry = 10
+	}
 
-		ps.pool.mu.RLock()
-		var refreshAccounts []*Account
-		for _, acc := range ps.pool.pendingAccounts {
-			if !acc.Refreshed && acc.FailCount > 0 {
-				// 跳过已达上限的账号（浏览器刷新已达上限且401失败次数超过阈值）
-				if acc.BrowserRefreshCount >= BrowserRefreshMaxRetry && acc.FailCount >= maxRetry {
-					continue
-				}
-				refreshAccounts = append(refreshAccounts, acc)
-				if len(refreshAccounts) >= maxThreads {
-					break
-				}
-			}
-		}
-		ps.pool.mu.RUnlock()
-		for _, acc := range refreshAccounts {
-			logger.Info("[WS] 分配续期任务给 %s: %s", client.ID, acc.Data.Email)
-			msg := WSMessage{
-				Type:      WSMsgTaskRefresh,
-				Timestamp: time.Now().Unix(),
-				Data: map[string]interface{}{
-					"email":         acc.Data.Email,
-					"cookies":       acc.Data.Cookies,
-					"authorization": acc.Data.Authorization,
-					"mail_provider": acc.Data.MailProvider,
-					"mail_password": acc.Data.MailPassword,
-					"config_id":     acc.ConfigID,
-					"csesidx":       acc.CSESIDX,
-				},
+	ps.pool.mu.RLock()
+	var refreshAccounts []*Account
+	for _, acc := range ps.pool.pendingAccounts {
+		if !acc.Refreshed && acc.FailCount > 0 {
+			// 跳过已达上限的账号（浏览器刷新已达上限且401失败次数超过阈值）
+			if acc.BrowserRefreshCount >= BrowserRefreshMaxRetry && acc.FailCount >= maxRetry {
+				continue
 			}
-			msgBytes, _ := json.Marshal(msg)
-			select {
-			case client.Send <- msgBytes:
-				assignedCount++
-			default:
+			refreshAccounts = append(refreshAccounts, acc)
+			if len(refreshAccounts) >= maxThreads {
+				break
 			}
 		}
 	}
+	ps.pool.mu.RUnlock()
+	for _, acc := range refreshAccounts {
+		logger.Info("[WS] 分配续期任务给 %s: %s", client.ID, acc.Data.Email)
+		msg := WSMessage{
+			Type:      WSMsgTaskRefresh,
+			Timestamp: time.Now().Unix(),
+			Data: map[string]interface{}{
+				"email":         acc.Data.Email,
+				"cookies":       acc.Data.Cookies,
+				"authorization": acc.Data.Authorization,
+				"mail_provider": acc.Data.MailProvider,
+				"mail_password": acc.Data.MailPassword,
+				"config_id":     acc.ConfigID,
+				"csesidx":       acc.CSESIDX,
+				"proxy_key":     acc.Data.ProxyKey,
+			},
+		}
+		msgBytes, _ := json.Marshal(msg)
+		select {
+		case client.Send <- msgBytes:
+			assignedCount++
+		default:
+		}
+	}
 	remainingSlots := maxThreads - assignedCount
 	if remainingSlots > 0 {
 		currentCount := ps.pool.TotalCount()
@@ -884,6 +892,7 @@ func (ps *PoolServer) updateAccountCookies(email string, cookiesData interface{}
 				acc.Data.Cookies = newCookies
 				acc.Refreshed = true
 				acc.FailCount = 0
+				acc.AuthFailSince = time.Time{}
 				acc.SaveToFile()
 			}
 			return
@@ -968,7 +977,7 @@ type AccountResponse struct {
 }
 
 func (ps *PoolServer) handleNext(w http.ResponseWriter, r *http.Request) {
-	acc := ps.pool.Next()
+	acc := ps.pool.Next(strings.TrimSpace(r.URL.Query().Get("tag")))
 	if acc == nil {
 		json.NewEncoder(w).Encode(AccountResponse{
 			Success: false,
@@ -1270,6 +1279,7 @@ type AccountUploadRequest struct {
 	CookieString        string   `json:"cookie_string"`
 	Authorization       string   `json:"authorization"`
 	ConfigID            string   `json:"config_id"`
+	ConfigIDs           []string `json:"config_ids,omitempty"` // 额外 configId，未提供时保留已有值，空数组表示清除
 	CSESIDX             string   `json:"csesidx"`
 	IsNew               bool     `json:"is_new"`
 	TaskID              string   `json:"task_id,omitempty"`
@@ -1277,6 +1287,7 @@ type AccountUploadRequest struct {
 	LeaseUntil          string   `json:"lease_until,omitempty"`
 	FallbackUsed        bool     `json:"fallback_used,omitempty"`
 	AuthorizationSource string   `json:"authorization_source,omitempty"`
+	ProxyKey            string   `json:"proxy_key,omitempty"`
 }
 
 var ErrInvalidAccountUpload = errors.New("invalid account upload request")
@@ -1292,12 +1303,22 @@ func normalizeAndValidateUploadRequest(req *AccountUploadRequest) error {
 	req.MailPassword = strings.TrimSpace(req.MailPassword)
 	req.Authorization = strings.TrimSpace(req.Authorization)
 	req.ConfigID = strings.TrimSpace(req.ConfigID)
+	if req.ConfigIDs != nil {
+		configIDs := make([]string, 0, len(req.ConfigIDs))
+		for _, id := range req.ConfigIDs {
+			if id = strings.TrimSpace(id); id != "" {
+				configIDs = append(configIDs, id)
+			}
+		}
+		req.ConfigIDs = configIDs
+	}
 	req.CSESIDX = strings.TrimSpace(req.CSESIDX)
 	req.CookieString = strings.TrimSpace(req.CookieString)
 	req.TaskID = strings.TrimSpace(req.TaskID)
 	req.WorkerID = strings.TrimSpace(req.WorkerID)
 	req.LeaseUntil = strings.TrimSpace(req.LeaseUntil)
 	req.AuthorizationSource = strings.TrimSpace(req.AuthorizationSource)
+	req.ProxyKey = strings.TrimSpace(req.ProxyKey)
 
 	if req.Email == "" {
 		return fmt.Errorf("%w: email 不能为空", ErrInvalidAccountUpload)
@@ -1335,11 +1356,12 @@ func ProcessAccountUpload(accountPool *AccountPool, dataDir string, req *Account
 		return fmt.Errorf("创建数据目录失败: %w", err)
 	}
 
-	filename := fmt.Sprintf("%s.json", req.Email)
-	filePath := filepath.Join(dataDir, filename)
+	filePath := filepath.Join(dataDir, AccountFileName(req.Email))
 
-	// 续期场景允许空字段：保留旧值
-	if existingRaw, err := os.ReadFile(filePath); err == nil {
+	// 续期场景允许空字段：保留旧值（标签只能在本地维护，始终保留）
+	var tags []string
+	existingPath, _ := FindAccountFile(dataDir, req.Email)
+	if existingRaw, err := os.ReadFile(existingPath); err == nil {
 		var existing AccountData
 		if json.Unmarshal(existingRaw, &existing) == nil {
 			if req.FullName == "" {
@@ -1351,6 +1373,13 @@ func ProcessAccountUpload(accountPool *AccountPool, dataDir string, req *Account
 			if req.MailPassword == "" {
 				req.MailPassword = existing.MailPassword
 			}
+			if req.ProxyKey == "" {
+				req.ProxyKey = existing.ProxyKey
+			}
+			if req.ConfigIDs == nil {
+				req.ConfigIDs = existing.ConfigIDs
+			}
+			tags = existing.Tags
 		}
 	}
 
@@ -1367,7 +1396,10 @@ func ProcessAccountUpload(accountPool *AccountPool, dataDir string, req *Account
 		CookieString:  req.CookieString,
 		Authorization: req.Authorization,
 		ConfigID:      req.ConfigID,
+		ConfigIDs:     req.ConfigIDs,
 		CSESIDX:       req.CSESIDX,
+		ProxyKey:      req.ProxyKey,
+		Tags:          tags,
 		Timestamp:     time.Now().Format(time.RFC3339),
 	}
 
@@ -1375,9 +1407,10 @@ func ProcessAccountUpload(accountPool *AccountPool, dataDir string, req *Account
 	if err != nil {
 		return fmt.Errorf("序列化账号数据失败: %w", err)
 	}
-	if err := os.WriteFile(filePath, data, 0644); err != nil {
+	if err := WriteAccountFile(filePath, data); err != nil {
 		return fmt.Errorf("保存账号文件失败: %w", err)
 	}
+	removeLegacyAccountFile(dataDir, req.Email)
 
 	if accountPool == nil {
 		return nil
@@ -1428,7 +1461,7 @@ func ProcessAccountUpload(accountPool *AccountPool, dataDir string, req *Account
 
 	foundInPending := -1
 	for i, acc := range accountPool.pendingAccounts {
-		if acc.Data.Email == req.Email {
+		if strings.EqualFold(acc.Data.Email, req.Email) {
 			foundInPending = i
 			break
 		}
@@ -1445,6 +1478,7 @@ func ProcessAccountUpload(accountPool *AccountPool, dataDir string, req *Account
 		acc.ConfigID = req.ConfigID
 		acc.CSESIDX = req.CSESIDX
 		acc.FailCount = 0
+		acc.AuthFailSince = time.Time{}
 		acc.BrowserRefreshCount = 0
 		acc.JWTExpires = time.Time{}
 		acc.Refreshed = false
@@ -1458,7 +1492,7 @@ func ProcessAccountUpload(accountPool *AccountPool, dataDir string, req *Account
 
 	foundInReady := -1
 	for i, acc := range accountPool.readyAccounts {
-		if acc.Data.Email == req.Email {
+		if strings.EqualFold(acc.Data.Email, req.Email) {
 			foundInReady = i
 			break
 		}
@@ -1475,6 +1509,7 @@ func ProcessAccountUpload(accountPool *AccountPool, dataDir string, req *Account
 		acc.ConfigID = req.ConfigID
 		acc.CSESIDX = req.CSESIDX
 		acc.FailCount = 0
+		acc.AuthFailSince = time.Time{}
 		acc.BrowserRefreshCount = 0
 		acc.JWTExpires = time.Time{}
 		acc.Refreshed = false
@@ -0,0 +1,89 @@
+package pool
+
+import (
+	"testing"
+)
+
+func newTaggedReadyAccount(email string, tags ...string) *Account {
+	acc := newExternalPendingAccount(email)
+	acc.Status = StatusReady
+	acc.Data.Tags = tags
+	return acc
+}
+
+func TestNextRoutesByTag(t *testing.T) {
+	plain := newTaggedReadyAccount("plain@example.com")
+	video := newTaggedReadyAccount("video@example.com", "Video")
+	p := newTestPool()
+	p.readyAccounts = []*Account{plain, video}
+
+	for i := 0; i < 4; i++ {
+		acc := p.Next("")
+		if acc != plain {
+			t.Fatalf("untagged request should only use untagged accounts, got %v", acc)
+		}
+		acc.LastUsed = acc.LastUsed.Add(-UseCooldown)
+	}
+
+	seen := map[*Account]bool{}
+	for i := 0; i < 4; i++ {
+		acc := p.Next("video")
+		if acc == nil {
+			t.Fatal("expected an account for tag video")
+		}
+		seen[acc] = true
+		acc.LastUsed = acc.LastUsed.Add(-UseCooldown)
+	}
+	if !seen[plain] || !seen[video] {
+		t.Fatalf("tagged request should use tagged and untagged accounts, got %v", seen)
+	}
+
+	p.readyAccounts = []*Account{video}
+	if acc := p.Next("text"); acc != nil {
+		t.Fatalf("video-only account should not serve text, got %s", acc.Data.Email)
+	}
+}
+
+func TestStatsReportsTagDistribution(t *testing.T) {
+	p := newTestPool()
+	p.readyAccounts = []*Account{
+		newTaggedReadyAccount("a@example.com", "video", "image"),
+		newTaggedReadyAccount("b@example.com"),
+	}
+	pending := newTaggedReadyAccount("c@example.com", "VIDEO")
+	pending.Status = StatusPending
+	p.pendingAccounts = []*Account{pending}
+
+	stats := p.Stats()
+	tags := stats["tags"].(map[string]map[string]int)
+	if tags["video"]["ready"] != 1 || tags["video"]["total"] != 2 {
+		t.Fatalf("unexpected video stats: %v", tags["video"])
+	}
+	if tags["image"]["total"] != 1 {
+		t.Fatalf("unexpected image stats: %v", tags["image"])
+	}
+	untagged := stats["untagged"].(map[string]int)
+	if untagged["ready"] != 1 || untagged["total"] != 1 {
+		t.Fatalf("unexpected untagged stats: %v", untagged)
+	}
+}
+
+func TestServableCountMatchesNextWithoutClaiming(t *testing.T) {
+	plain := newTaggedReadyAccount("plain@example.com")
+	video := newTaggedReadyAccount("video@example.com", "video")
+	p := newTestPool()
+	p.readyAccounts = []*Account{plain, video}
+
+	if got := p.ServableCount(""); got != 1 {
+		t.Fatalf("untagged requests can use 1 account, got %d", got)
+	}
+	if got := p.ServableCount("video"); got != 2 {
+		t.Fatalf("video requests can use 2 accounts, got %d", got)
+	}
+	if got := p.ServableCount("text"); got != 1 {
+		t.Fatalf("text requests can only use the untagged account, got %d", got)
+	}
+	if !plain.LastUsed.IsZero() || plain.TotalCount != 0 {
+		t.Fatalf("ServableCount must not claim accounts")
+	}
+}
@@ -75,7 +75,9 @@ func TestProcessAccountUploadPreserveFieldsForRefresh(t *testing.T) {
 			{Name: "__Secure-C_SES", Value: "old", Domain: ".gemini.google"},
 		},
 		ConfigID:  "cfg-old",
+		ConfigIDs: []string{"cfg-extra"},
 		CSESIDX:   "111",
+		ProxyKey:  "http://10.0.0.1:8080",
 		Timestamp: time.Now().Format(time.RFC3339),
 	}
 	raw, _ := json.Marshal(initial)
@@ -125,6 +127,12 @@ func TestProcessAccountUploadPreserveFieldsForRefresh(t *testing.T) {
 	if got.MailPassword != "old-password" {
 		t.Fatalf("mail password should be preserved, got %q", got.MailPassword)
 	}
+	if got.ProxyKey != "http://10.0.0.1:8080" {
+		t.Fatalf("proxy key should be preserved, got %q", got.ProxyKey)
+	}
+	if len(got.ConfigIDs) != 1 || got.ConfigIDs[0] != "cfg-extra" {
+		t.Fatalf("config ids should be preserved, got %v", got.ConfigIDs)
+	}
 	if got.Authorization != "Bearer new-auth" {
 		t.Fatalf("authorization should be updated, got %q", got.Authorization)
 	}
@@ -510,3 +518,116 @@ func TestMarkNeedsRefreshExternalMode(t *testing.T) {
 		t.Fatalf("expected pending external status, got %v", p.pendingAccounts[0].Status)
 	}
 }
+
+func TestAccountFileName(t *testing.T) {
+	cases := map[string]string{
+		"user@example.com":       "user@example.com.json",
+		"Mixed.Case@Example.com": "mixed.case@example.com.json",
+	}
+	for email, want := range cases {
+		if got := AccountFileName(email); got != want {
+			t.Fatalf("AccountFileName(%q) = %q, want %q", email, got, want)
+		}
+	}
+	alias := AccountFileName("User+tag@gmail.com")
+	if !strings.HasPrefix(alias, "user_tag@gmail.com-") || !strings.HasSuffix(alias, ".json") {
+		t.Fatalf("alias should be sanitized with a hash suffix, got %q", alias)
+	}
+	if alias == AccountFileName("user_tag@gmail.com") || alias == AccountFileName("User+other@gmail.com") {
+		t.Fatalf("aliases must not collide with other addresses: %q", alias)
+	}
+	if alias != AccountFileName("user+TAG@Gmail.com") {
+		t.Fatalf("case variants of the same alias should share a file name")
+	}
+}
+
+func TestProcessAccountUploadMigratesLegacyFileName(t *testing.T) {
+	dir := t.TempDir()
+	email := "User+tag@gmail.com"
+	legacy := AccountData{
+		Email:         email,
+		FullName:      "Legacy Name",
+		Authorization: "Bearer old-auth",
+		Cookies:       []Cookie{{Name: "__Secure-C_SES", Value: "old", Domain: ".gemini.google"}},
+		ConfigID:      "cfg-old",
+		CSESIDX:       "111",
+		Tags:          []string{"vip"},
+	}
+	raw, _ := json.Marshal(legacy)
+	if err := os.WriteFile(filepath.Join(dir, email+".json"), raw, 0644); err != nil {
+		t.Fatalf("write legacy file: %v", err)
+	}
+
+	p := newTestPool()
+	if err := p.Load(dir); err != nil {
+		t.Fatalf("load legacy: %v", err)
+	}
+	req := &AccountUploadRequest{
+		Email:         email,
+		Cookies:       []Cookie{{Name: "__Secure-C_SES", Value: "new", Domain: ".gemini.google"}},
+		Authorization: "Bearer new-auth",
+		ConfigID:      "cfg-new",
+		CSESIDX:       "222",
+	}
+	if err := ProcessAccountUpload(p, dir, req); err != nil {
+		t.Fatalf("process upload failed: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, email+".json")); !os.IsNotExist(err) {
+		t.Fatalf("legacy file should be removed after migration, stat err=%v", err)
+	}
+	fileRaw, err := os.ReadFile(filepath.Join(dir, AccountFileName(email)))
+	if err != nil {
+		t.Fatalf("read normalized file: %v", err)
+	}
+	var got AccountData
+	if err := json.Unmarshal(fileRaw, &got); err != nil {
+		t.Fatalf("unmarshal output: %v", err)
+	}
+	if got.Email != email || got.FullName != "Legacy Name" || len(got.Tags) != 1 || got.ConfigID != "cfg-new" {
+		t.Fatalf("migrated file should keep the real email and preserved fields, got %+v", got)
+	}
+	if total := len(p.readyAccounts) + len(p.pendingAccounts); total != 1 {
+		t.Fatalf("expected a single account after migration, got %d", total)
+	}
+}
+
+func TestAutoDeleteGraceRequiresFailuresAndDuration(t *testing.T) {
+	oldMin, oldGrace := AutoDeleteMinFailures, AutoDeleteGracePeriod
+	t.Cleanup(func() {
+		AutoDeleteMinFailures, AutoDeleteGracePeriod = oldMin, oldGrace
+	})
+
+	SetAutoDeleteGrace(0, 0)
+	if AutoDeleteMinFailures != 3 || AutoDeleteGracePeriod != 10*time.Minute {
+		t.Fatalf("unexpected defaults: %d %v", AutoDeleteMinFailures, AutoDeleteGracePeriod)
+	}
+
+	acc := newExternalPendingAccount("grace@example.com")
+	start := time.Now()
+	if _, due := acc.autoDeleteDueLocked(1, start); due {
+		t.Fatalf("first 401 should not be due")
+	}
+	if !acc.AuthFailSince.Equal(start) {
+		t.Fatalf("first 401 should record streak start")
+	}
+	if _, due := acc.autoDeleteDueLocked(5, start.Add(5*time.Minute)); due {
+		t.Fatalf("401 inside grace period should not be due")
+	}
+	if _, due := acc.autoDeleteDueLocked(2, start.Add(11*time.Minute)); due {
+		t.Fatalf("401 below min failures should not be due")
+	}
+	elapsed, due := acc.autoDeleteDueLocked(3, start.Add(11*time.Minute))
+	if !due || elapsed != 11*time.Minute {
+		t.Fatalf("expected due after grace, got due=%v elapsed=%v", due, elapsed)
+	}
+
+	SetAutoDeleteGrace(2, -1)
+	if AutoDeleteGracePeriod != 0 {
+		t.Fatalf("negative grace should disable duration requirement, got %v", AutoDeleteGracePeriod)
+	}
+	fresh := newExternalPendingAccount("fresh@example.com")
+	if _, due := fresh.autoDeleteDueLocked(2, time.Now()); !due {
+		t.Fatalf("expected due once min failures reached without duration requirement")
+	}
+}
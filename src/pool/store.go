@@ -0,0 +1,335 @@
+package pool
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StoreBackendFile 账号存储后端：每个账号一个 JSON 文件（默认，也是目前唯一的后端）
+const StoreBackendFile = "file"
+
+// StoredAccount 存储层中的一条账号记录
+type StoredAccount struct {
+	Name       string       // 记录名（文件名，如 user@example.com.json）
+	Path       string       // 文件路径
+	Size       int64        // 原始数据大小
+	ModifiedAt time.Time    // 最后修改时间
+	Data       *AccountData // 解析后的账号数据，读取或解析失败时为 nil（只读，调用方不要修改）
+	ErrReason  string       // 失败原因: stat_failed / read_failed / json_parse_error
+	Err        error        // 读取或解析错误
+}
+
+// Store 账号存储接口
+type Store interface {
+	List() ([]StoredAccount, error)
+	Get(name string) (StoredAccount, error)
+	Put(name string, data *AccountData) error
+	Delete(name string) error
+}
+
+// NewStore 按后端名称创建账号存储，未知后端回退到文件存储
+func NewStore(backend, dir string) (Store, error) {
+	switch strings.ToLower(strings.TrimSpace(backend)) {
+	case "", StoreBackendFile:
+		return NewFileStore(dir), nil
+	default:
+		return NewFileStore(dir), fmt.Errorf("未知存储后端 %q，已回退到文件存储", backend)
+	}
+}
+
+// AccountFileName 返回账号的规范文件名：邮箱转小写，别名（+）等 [a-z0-9@._-] 以外的字符替换为 _ 并追加邮箱哈希，
+// 避免大小写不敏感文件系统上的冲突与非法字符；真实邮箱以文件内容中的 email 为准
+func AccountFileName(email string) string {
+	normalized := strings.ToLower(strings.TrimSpace(email))
+	var b strings.Builder
+	replaced := false
+	for _, r := range normalized {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '@', r == '.', r == '_', r == '-':
+			b.WriteRune(r)
+		default:
+			b.WriteByte('_')
+			replaced = true
+		}
+	}
+	name := b.String()
+	if replaced {
+		sum := sha256.Sum256([]byte(normalized))
+		name += "-" + hex.EncodeToString(sum[:4])
+	}
+	return name + ".json"
+}
+
+// accountTempSuffix 账号文件原子写入时的临时文件后缀
+const accountTempSuffix = ".tmp"
+
+// staleAccountTempAge 超过该时长的临时文件视为写入中断的残留，避免与进行中的写入冲突
+const staleAccountTempAge = time.Minute
+
+// WriteAccountFile 原子写入账号文件：先写入唯一的临时文件并落盘，再重命名替换，
+// 并发写同一账号互不干扰，写入中断或崩溃都不会留下截断的账号文件
+func WriteAccountFile(path string, data []byte) error {
+	dir := filepath.Dir(path)
+	f, err := os.CreateTemp(dir, filepath.Base(path)+".*"+accountTempSuffix)
+	if err != nil {
+		return fmt.Errorf("创建账号临时文件失败: %w", err)
+	}
+	tmpPath := f.Name()
+	err = f.Chmod(0644)
+	if err == nil {
+		_, err = f.Write(data)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("写入账号临时文件失败: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("替换账号文件失败: %w", err)
+	}
+	syncDir(dir)
+	return nil
+}
+
+// syncDir 将目录项落盘，使重命名在崩溃后仍然生效；不支持目录同步的平台忽略错误
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
+
+// accountFileFromTemp 由临时文件路径还原账号文件路径：<name>.json.<随机>.tmp（兼容旧版 <name>.json.tmp）
+func accountFileFromTemp(tmpPath string) string {
+	path := strings.TrimSuffix(tmpPath, accountTempSuffix)
+	if !strings.HasSuffix(path, ".json") {
+		path = path[:strings.LastIndex(path, ".")]
+	}
+	return path
+}
+
+// accountFileValid 判断账号文件能否读取并解析为完整的账号数据
+func accountFileValid(path string) bool {
+	raw, err := os.ReadFile(path)
+	var data AccountData
+	return err == nil && json.Unmarshal(raw, &data) == nil
+}
+
+// rescueAccountTempFiles 处理写入中断残留的临时文件：内容完整且比账号文件新（或账号文件缺失、无法解析）时
+// 替换账号文件（重命名前中断），否则删除（写入中中断或已被后续写入取代，原账号文件仍是最新的完整数据）
+func rescueAccountTempFiles(dir string) {
+	tmpFiles, err := filepath.Glob(filepath.Join(dir, "*.json*"+accountTempSuffix))
+	if err != nil {
+		return
+	}
+	for _, tmpPath := range tmpFiles {
+		info, err := os.Stat(tmpPath)
+		if err != nil || time.Since(info.ModTime()) < staleAccountTempAge {
+			continue
+		}
+		path := accountFileFromTemp(tmpPath)
+		if accountFileValid(tmpPath) {
+			mainInfo, statErr := os.Stat(path)
+			if statErr != nil || info.ModTime().After(mainInfo.ModTime()) || !accountFileValid(path) {
+				if err := os.Rename(tmpPath, path); err == nil {
+					log.Printf("🩹 已从临时文件恢复账号文件: %s", filepath.Base(path))
+				}
+				continue
+			}
+		}
+		if err := os.Remove(tmpPath); err == nil {
+			log.Printf("🧹 已删除过期或不完整的账号临时文件: %s", filepath.Base(tmpPath))
+		}
+	}
+}
+
+// FindAccountFile 查找账号的现有文件：优先规范文件名，其次旧版 <email>.json
+func FindAccountFile(dir, email string) (string, bool) {
+	for _, name := range []string{AccountFileName(email), strings.TrimSpace(email) + ".json"} {
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(path); err == nil {
+			return path, true
+		}
+	}
+	return filepath.Join(dir, AccountFileName(email)), false
+}
+
+// removeLegacyAccountFile 规范文件写入后删除旧版 <email>.json（大小写不敏感文件系统上二者可能是同一文件）
+func removeLegacyAccountFile(dir, email string) {
+	path := filepath.Join(dir, AccountFileName(email))
+	legacy := filepath.Join(dir, strings.TrimSpace(email)+".json")
+	if legacy == path || filepath.Base(legacy) != strings.TrimSpace(email)+".json" {
+		return
+	}
+	legacyInfo, err := os.Stat(legacy)
+	if err != nil {
+		return
+	}
+	if info, err := os.Stat(path); err != nil || os.SameFile(info, legacyInfo) {
+		return
+	}
+	if err := os.Remove(legacy); err == nil {
+		log.Printf("📁 账号文件已迁移: %s -> %s", filepath.Base(legacy), filepath.Base(path))
+	}
+}
+
+// fileStoreEntry 文件解析缓存，大小和修改时间不变时复用解析结果
+type fileStoreEntry struct {
+	size    int64
+	modTime time.Time
+	record  StoredAccount
+}
+
+// FileStore 基于目录下 *.json 文件的账号存储
+// 按文件大小和修改时间缓存解析结果，账号数量很多时 List 只需重新解析变化的文件
+type FileStore struct {
+	dir   string
+	mu    sync.Mutex
+	cache map[string]fileStoreEntry
+}
+
+func NewFileStore(dir string) *FileStore {
+	return &FileStore{dir: dir, cache: make(map[string]fileStoreEntry)}
+}
+
+// Dir 返回存储目录
+func (s *FileStore) Dir() string {
+	return s.dir
+}
+
+// List 列出全部账号记录（按文件名排序）
+func (s *FileStore) List() ([]StoredAccount, error) {
+	rescueAccountTempFiles(s.dir)
+	files, err := filepath.Glob(filepath.Join(s.dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seen := make(map[string]struct{}, len(files))
+	records := make([]StoredAccount, 0, len(files))
+	for _, path := range files {
+		if shouldSkipAccountFile(path) {
+			continue
+		}
+		seen[path] = struct{}{}
+		records = append(records, s.loadLocked(path))
+	}
+	for path := range s.cache {
+		if _, ok := seen[path]; !ok {
+			delete(s.cache, path)
+		}
+	}
+	return records, nil
+}
+
+// Get 读取单个账号记录
+func (s *FileStore) Get(name string) (StoredAccount, error) {
+	path, err := s.path(name)
+	if err != nil {
+		return StoredAccount{}, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record := s.loadLocked(path)
+	if record.ErrReason == "stat_failed" {
+		return record, record.Err
+	}
+	return record, nil
+}
+
+// Put 写入账号数据
+func (s *FileStore) Put(name string, data *AccountData) error {
+	path, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	raw, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		return fmt.Errorf("序列化账号数据失败: %w", err)
+	}
+	if err := WriteAccountFile(path, raw); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	delete(s.cache, path)
+	s.mu.Unlock()
+	return nil
+}
+
+// Delete 删除账号记录
+func (s *FileStore) Delete(name string) error {
+	path, err := s.path(name)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	delete(s.cache, path)
+	s.mu.Unlock()
+	return nil
+}
+
+// path 校验记录名并返回文件路径，拒绝目录穿越
+func (s *FileStore) path(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || name != filepath.Base(name) || !strings.HasSuffix(strings.ToLower(name), ".json") {
+		return "", fmt.Errorf("无效的账号文件名: %q", name)
+	}
+	if shouldSkipAccountFile(name) {
+		return "", fmt.Errorf("不允许访问的文件: %s", name)
+	}
+	return filepath.Join(s.dir, name), nil
+}
+
+// loadLocked 读取并解析单个文件，文件未变化时直接返回缓存
+func (s *FileStore) loadLocked(path string) StoredAccount {
+	record := StoredAccount{Name: filepath.Base(path), Path: path}
+	stat, err := os.Stat(path)
+	if err != nil {
+		delete(s.cache, path)
+		record.Err = fmt.Errorf("读取文件元数据失败: %w", err)
+		record.ErrReason = "stat_failed"
+		return record
+	}
+	record.Size = stat.Size()
+	record.ModifiedAt = stat.ModTime()
+	if cached, ok := s.cache[path]; ok && cached.size == stat.Size() && cached.modTime.Equal(stat.ModTime()) {
+		return cached.record
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		record.Err = fmt.Errorf("读取文件失败: %w", err)
+		record.ErrReason = "read_failed"
+		return record
+	}
+	var data AccountData
+	if err := json.Unmarshal(raw, &data); err != nil {
+		record.Err = fmt.Errorf("JSON 解析失败: %w", err)
+		record.ErrReason = "json_parse_error"
+	} else {
+		record.Data = &data
+	}
+	s.cache[path] = fileStoreEntry{size: stat.Size(), modTime: stat.ModTime(), record: record}
+	return record
+}
@@ -0,0 +1,163 @@
+package pool
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFileStoreCRUDAndCache(t *testing.T) {
+	dir := t.TempDir()
+	store := NewFileStore(dir)
+
+	if err := store.Put("a@example.com.json", &AccountData{Email: "a@example.com", CSESIDX: "1"}); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "broken.json"), []byte("{not json"), 0644); err != nil {
+		t.Fatalf("write broken: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, adminPanelAuthFileName), []byte("{}"), 0644); err != nil {
+		t.Fatalf("write admin auth: %v", err)
+	}
+
+	records, err := store.List()
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	if len(records) != 2 || records[0].Name != "a@example.com.json" || records[1].Name != "broken.json" {
+		t.Fatalf("unexpected records: %+v", records)
+	}
+	if records[0].Data == nil || records[0].Data.Email != "a@example.com" {
+		t.Fatalf("expected parsed account, got %+v", records[0])
+	}
+	if records[1].Data != nil || records[1].ErrReason != "json_parse_error" {
+		t.Fatalf("expected parse error, got %+v", records[1])
+	}
+
+	// 大小和修改时间不变时复用缓存，不重新解析
+	path := filepath.Join(dir, "a@example.com.json")
+	stat, _ := os.Stat(path)
+	raw, _ := os.ReadFile(path)
+	garbage := make([]byte, len(raw))
+	for i := range garbage {
+		garbage[i] = 'x'
+	}
+	os.WriteFile(path, garbage, 0644)
+	os.Chtimes(path, stat.ModTime(), stat.ModTime())
+	if record, err := store.Get("a@example.com.json"); err != nil || record.Data == nil {
+		t.Fatalf("unchanged file should be served from cache: %+v err=%v", record, err)
+	}
+	// 修改时间变化后重新解析
+	os.Chtimes(path, stat.ModTime().Add(time.Second), stat.ModTime().Add(time.Second))
+	if record, _ := store.Get("a@example.com.json"); record.Data != nil || record.ErrReason != "json_parse_error" {
+		t.Fatalf("changed file should be re-parsed, got %+v", record)
+	}
+
+	if err := store.Delete("broken.json"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "broken.json")); !os.IsNotExist(err) {
+		t.Fatalf("file should be deleted, stat err=%v", err)
+	}
+	for _, name := range []string{"../escape.json", "a.txt", adminPanelAuthFileName} {
+		if err := store.Delete(name); err == nil {
+			t.Fatalf("%q should be rejected", name)
+		}
+	}
+}
+
+func TestNewStoreFallsBackToFile(t *testing.T) {
+	for _, backend := range []string{"", "file", "sqlite", "bogus"} {
+		store, err := NewStore(backend, t.TempDir())
+		if _, ok := store.(*FileStore); !ok {
+			t.Fatalf("%q: expected file store, got %T", backend, store)
+		}
+		if wantErr := backend == "sqlite" || backend == "bogus"; (err != nil) != wantErr {
+			t.Fatalf("%q: unexpected err %v", backend, err)
+		}
+	}
+}
+
+func TestLoadRescuesInterruptedAccountWrites(t *testing.T) {
+	dir := t.TempDir()
+	good := &AccountData{Email: "good@example.com", CSESIDX: "1", Authorization: "Bearer good"}
+	if err := NewFileStore(dir).Put("good@example.com.json", good); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*"+accountTempSuffix)); len(files) != 0 {
+		t.Fatalf("atomic write should not leave a temp file, got %v", files)
+	}
+
+	stale := time.Now().Add(-2 * staleAccountTempAge)
+	writeStale := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("write %s: %v", name, err)
+		}
+		os.Chtimes(path, stale, stale)
+		return path
+	}
+	// 写入中中断：临时文件被截断，原文件是最后一次完整数据
+	truncatedTmp := writeStale("good@example.com.json"+accountTempSuffix, `{"email":"good@example.com","csesidx":"2","auth`)
+	// 重命名前中断：临时文件完整，原文件是旧版非原子写入留下的截断内容
+	writeStale("renamed@example.com.json", `{"email":"renamed@`)
+	writeStale("renamed@example.com.json.123"+accountTempSuffix, `{"email":"renamed@example.com","csesidx":"3","authorization":"Bearer renamed"}`)
+	// 完整但比账号文件旧的临时文件：已被后续写入取代，不能回滚账号
+	newer := &AccountData{Email: "newer@example.com", CSESIDX: "5", Authorization: "Bearer newer"}
+	if err := NewFileStore(dir).Put("newer@example.com.json", newer); err != nil {
+		t.Fatalf("put: %v", err)
+	}
+	writeStale("newer@example.com.json.456"+accountTempSuffix, `{"email":"newer@example.com","csesidx":"4","authorization":"Bearer older"}`)
+
+	p := newTestPool()
+	if err := p.Load(dir); err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if _, err := os.Stat(truncatedTmp); !os.IsNotExist(err) {
+		t.Fatalf("truncated temp file should be discarded, stat err=%v", err)
+	}
+	loaded := make(map[string]string)
+	for _, acc := range p.pendingAccounts {
+		loaded[acc.Data.Email] = acc.CSESIDX
+	}
+	if len(loaded) != 3 || loaded["good@example.com"] != "1" || loaded["renamed@example.com"] != "3" || loaded["newer@example.com"] != "5" {
+		t.Fatalf("expected last-good and rescued accounts, got %v", loaded)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "*"+accountTempSuffix)); len(files) != 0 {
+		t.Fatalf("temp files should be cleaned up, got %v", files)
+	}
+}
+
+func TestWriteAccountFileConcurrentWriters(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "race@example.com.json")
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			raw, _ := json.Marshal(AccountData{Email: "race@example.com", CSESIDX: strings.Repeat("x", 1000*(i+1))})
+			errs <- WriteAccountFile(path, raw)
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("concurrent write failed: %v", err)
+		}
+	}
+	if !accountFileValid(path) {
+		t.Fatalf("account file should hold one complete write")
+	}
+	if files, _ := filepath.Glob(path + ".*" + accountTempSuffix); len(files) != 0 {
+		t.Fatalf("temp files should not be left behind, got %v", files)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0644 {
+		t.Fatalf("account file should keep 0644 permissions, got %v %v", info, err)
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"io"
 	"log"
 	"math/big"
+	"net"
 	"net/http"
 	"net/url"
 	"os"
@@ -61,6 +62,15 @@ type ProxyNode struct {
 	LastUsed    time.Time     // 最后使用时间
 	FailCount   int           // 连续失败次数
 	UseCooldown time.Duration // 使用冷却时间（失败后动态调整）
+
+	// 真实请求统计（下次全量健康检查时清零）
+	ReqSuccess  int  // 真实请求成功次数
+	ReqFailure  int  // 真实请求失败次数
+	Blacklisted bool // 失败率过高被拉黑，不参与 Next 选择
+
+	// 近期失败（真实请求成功后清零），窗口内的节点在 Next 中降权
+	RecentFailures int       // 近期真实请求失败次数
+	LastFailure    time.Time // 最近一次真实请求失败时间
 }
 
 // InstanceStatus 实例状态
@@ -100,6 +110,13 @@ type ProxyManager struct {
 	ready          bool       // 代理池是否就绪
 	readyCond      *sync.Cond // 就绪条件变量
 	healthChecking bool       // 是否正在健康检查
+	autoUpdating   bool       // 是否已启动自动更新
+
+	blacklistRate float64 // 真实请求失败率达到该值时拉黑节点（<=0 禁用）
+	blacklistMin  int     // 判定失败率所需的最少请求数
+	minHealthy    int     // 就绪所需的最少健康节点数（0=MinHealthyForReady）
+
+	failureWindow time.Duration // 近期失败节点的降权时长（<=0 禁用）
 }
 
 // 默认代理使用冷却时间
@@ -109,6 +126,7 @@ var (
 	DefaultProxyCount       = 5                // 默认代理池大小
 	MinHealthyForReady      = 1                // 最少健康节点数才提示就绪（改为1，更快就绪）
 	HealthCheckTimeout      = 10 * time.Second // 健康检查超时（增加到10秒，给慢速代理更多时间）
+	DefaultFailureWindow    = 5 * time.Minute  // 真实请求失败后节点在 Next 中降权的时长
 )
 
 var Manager = &ProxyManager{
@@ -118,6 +136,7 @@ var Manager = &ProxyManager{
 	checkInterval:  5 * time.Minute,
 	healthCheckURL: "https://www.google.com/generate_204",
 	stopChan:       make(chan struct{}),
+	failureWindow:  DefaultFailureWindow,
 }
 
 func init() {
@@ -130,23 +149,45 @@ func (pm *ProxyManager) IsReady() bool {
 	defer pm.mu.RUnlock()
 	return pm.ready
 }
+
+// WaitReady 等待代理池就绪或健康节点数达到最低要求，超时返回 false
 func (pm *ProxyManager) WaitReady(timeout time.Duration) bool {
 	deadline := time.Now().Add(timeout)
 
 	for time.Now().Before(deadline) {
-		pm.mu.RLock()
-		ready := pm.ready
-		healthyCount := len(pm.healthyNodes)
-		pm.mu.RUnlock()
-
-		if ready || healthyCount > 0 {
+		if pm.readyOrEnoughHealthy() {
 			return true
 		}
 		time.Sleep(100 * time.Millisecond)
 	}
+	return pm.readyOrEnoughHealthy()
+}
+
+func (pm *ProxyManager) readyOrEnoughHealthy() bool {
 	pm.mu.RLock()
 	defer pm.mu.RUnlock()
-	return pm.ready || len(pm.healthyNodes) > 0
+	return pm.ready || len(pm.healthyNodes) >= pm.requiredHealthyLocked()
+}
+
+// SetMinHealthy 设置就绪所需的最少健康节点数（<=0 使用 MinHealthyForReady），下次健康检查起按新值判定就绪
+func (pm *ProxyManager) SetMinHealthy(n int) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	pm.minHealthy = n
+}
+
+// RequiredHealthy 返回就绪所需的最少健康节点数
+func (pm *ProxyManager) RequiredHealthy() int {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+	return pm.requiredHealthyLocked()
+}
+
+func (pm *ProxyManager) requiredHealthyLocked() int {
+	if pm.minHealthy > 0 {
+		return pm.minHealthy
+	}
+	return MinHealthyForReady
 }
 
 // SetReady 设置就绪状态
@@ -228,12 +269,136 @@ func (pm *ProxyManager) AddProxyFile(path string) {
 	pm.proxyFiles = append(pm.proxyFiles, path)
 }
 
+// RemoveSubscribeURL 移除订阅链接
+func (pm *ProxyManager) RemoveSubscribeURL(url string) {
+	url = strings.TrimSpace(url)
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	pm.subscribeURLs = removeSource(pm.subscribeURLs, url)
+}
+
+// RemoveProxyFile 移除代理文件
+func (pm *ProxyManager) RemoveProxyFile(path string) {
+	path = strings.TrimSpace(path)
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	pm.proxyFiles = removeSource(pm.proxyFiles, path)
+}
+
+// Sources 返回当前的代理源（订阅链接、代理文件）
+func (pm *ProxyManager) Sources() ([]string, []string) {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+	subscribes := make([]string, len(pm.subscribeURLs))
+	copy(subscribes, pm.subscribeURLs)
+	files := make([]string, len(pm.proxyFiles))
+	copy(files, pm.proxyFiles)
+	return subscribes, files
+}
+
+// UpdateSources 与当前代理源对比，增删变化的订阅/文件后重新加载
+// 列表未变化时直接返回 false，避免无谓的重新加载和健康检查
+func (pm *ProxyManager) UpdateSources(subscribes, files []string) bool {
+	oldSubscribes, oldFiles := pm.Sources()
+	addSubs, removeSubs := diffSources(oldSubscribes, subscribes)
+	addFiles, removeFiles := diffSources(oldFiles, files)
+	if len(addSubs)+len(removeSubs)+len(addFiles)+len(removeFiles) == 0 {
+		return false
+	}
+
+	for _, url := range removeSubs {
+		pm.RemoveSubscribeURL(url)
+	}
+	for _, path := range removeFiles {
+		pm.RemoveProxyFile(path)
+	}
+	for _, url := range addSubs {
+		pm.AddSubscribeURL(url)
+	}
+	for _, path := range addFiles {
+		pm.AddProxyFile(path)
+	}
+	log.Printf("🔄 代理源变更: 订阅 +%d/-%d, 文件 +%d/-%d",
+		len(addSubs), len(removeSubs), len(addFiles), len(removeFiles))
+
+	if err := pm.LoadAll(); err != nil {
+		log.Printf("⚠️ 重新加载代理失败: %v", err)
+	}
+
+	// 剔除已移除代理源的健康节点，避免继续使用
+	if len(removeSubs)+len(removeFiles) > 0 {
+		pm.pruneHealthyNodes()
+	}
+	// 新增代理源的节点需要健康检查后才能使用
+	if len(addSubs)+len(addFiles) > 0 {
+		go pm.CheckAllHealth()
+	}
+	return true
+}
+
+// pruneHealthyNodes 只保留仍存在于当前节点列表中的健康节点
+func (pm *ProxyManager) pruneHealthyNodes() {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	current := make(map[string]bool, len(pm.nodes))
+	for _, n := range pm.nodes {
+		current[n.Raw] = true
+	}
+	kept := make([]*ProxyNode, 0, len(pm.healthyNodes))
+	for _, n := range pm.healthyNodes {
+		if current[n.Raw] {
+			kept = append(kept, n)
+		}
+	}
+	if removed := len(pm.healthyNodes) - len(kept); removed > 0 {
+		log.Printf("🗑️ 已移除 %d 个失效代理源的健康节点", removed)
+	}
+	pm.healthyNodes = kept
+}
+
+// diffSources 计算代理源列表的新增与移除项（忽略空白和重复）
+func diffSources(oldList, newList []string) (added, removed []string) {
+	oldSet := make(map[string]bool, len(oldList))
+	for _, v := range oldList {
+		oldSet[strings.TrimSpace(v)] = true
+	}
+	newSet := make(map[string]bool, len(newList))
+	for _, v := range newList {
+		v = strings.TrimSpace(v)
+		if v == "" || newSet[v] {
+			continue
+		}
+		newSet[v] = true
+		if !oldSet[v] {
+			added = append(added, v)
+		}
+	}
+	for _, v := range oldList {
+		v = strings.TrimSpace(v)
+		if !newSet[v] {
+			removed = append(removed, v)
+		}
+	}
+	return added, removed
+}
+
+func removeSource(list []string, value string) []string {
+	kept := list[:0]
+	for _, v := range list {
+		if v != value {
+			kept = append(kept, v)
+		}
+	}
+	return kept
+}
+
 // LoadAll 加载所有代理源
 func (pm *ProxyManager) LoadAll() error {
 	var allNodes []*ProxyNode
+	subscribeURLs, proxyFiles := pm.Sources()
 
 	// 从订阅加载
-	for _, url := range pm.subscribeURLs {
+	for _, url := range subscribeURLs {
 		log.Printf("🔄 正在加载订阅: %s", url)
 		nodes, err := pm.loadFromURL(url)
 		if err != nil {
@@ -245,7 +410,7 @@ func (pm *ProxyManager) LoadAll() error {
 	}
 
 	// 从文件加载
-	for _, file := range pm.proxyFiles {
+	for _, file := range proxyFiles {
 		log.Printf("🔄 正在加载代理文件: %s", file)
 		nodes, err := pm.loadFromFile(file)
 		if err != nil {
@@ -261,7 +426,7 @@ func (pm *ProxyManager) LoadAll() error {
 	pm.lastUpdate = time.Now()
 	pm.mu.Unlock()
 
-	log.Printf("✅ 共加载 %d 个代理节点 (订阅: %d, 文件: %d)", len(allNodes), len(pm.subscribeURLs), len(pm.proxyFiles))
+	log.Printf("✅ 共加载 %d 个代理节点 (订阅: %d, 文件: %d)", len(allNodes), len(subscribeURLs), len(proxyFiles))
 	return nil
 }
 
@@ -392,6 +557,19 @@ func tryBase64Decode(s string) []byte {
 	return nil
 }
 
+// ValidateProxyLine 校验单个代理链接能否被解析（用于配置校验，不启动实例）
+func ValidateProxyLine(line string) error {
+	line = strings.TrimSpace(line)
+	node := (&ProxyManager{}).parseLine(line)
+	if node == nil {
+		return fmt.Errorf("不支持的代理格式: %s", line)
+	}
+	if node.Server == "" || node.Port <= 0 || node.Port > 65535 {
+		return fmt.Errorf("代理地址缺少有效的主机或端口: %s", line)
+	}
+	return nil
+}
+
 // parseLine 解析单行
 func (pm *ProxyManager) parseLine(line string) *ProxyNode {
 	if strings.HasPrefix(line, "vmess://") {
@@ -1142,6 +1320,7 @@ func (pm *ProxyManager) CheckAllHealth() {
 	pm.mu.Lock()
 	nodes := make([]*ProxyNode, len(pm.nodes))
 	copy(nodes, pm.nodes)
+	required := pm.requiredHealthyLocked()
 	pm.mu.Unlock()
 
 	if len(nodes) == 0 {
@@ -1195,7 +1374,7 @@ func (pm *ProxyManager) CheckAllHealth() {
 			} else {
 				healthy = append(healthy, n)
 			}
-			if len(healthy) >= MinHealthyForReady {
+			if len(healthy) >= required {
 				pm.mu.Lock()
 				if !pm.ready {
 					pm.ready = true
@@ -1265,8 +1444,12 @@ func (pm *ProxyManager) CheckAllHealth() {
 	pm.mu.Lock()
 	pm.healthyNodes = healthy
 	pm.healthChecking = false
+	// 全量检查后解除拉黑，重新统计真实请求
+	for _, n := range pm.nodes {
+		n.ReqSuccess, n.ReqFailure, n.Blacklisted = 0, 0, false
+	}
 	// 只有达到最少健康节点数才提示就绪
-	pm.ready = len(healthy) >= MinHealthyForReady
+	pm.ready = len(healthy) >= required
 	pm.readyCond.Broadcast()
 	pm.mu.Unlock()
 
@@ -1292,9 +1475,9 @@ func (pm *ProxyManager) CheckAllHealth() {
 
 	// 就绪状态提示
 	if pm.ready {
-		log.Printf("🟢 代理池就绪 (健康节点: %d >= 最低要求: %d)", len(healthy), MinHealthyForReady)
+		log.Printf("🟢 代理池就绪 (健康节点: %d >= 最低要求: %d)", len(healthy), required)
 	} else {
-		log.Printf("🔴 代理池未就绪 (健康节点: %d < 最低要求: %d)", len(healthy), MinHealthyForReady)
+		log.Printf("🔴 代理池未就绪 (健康节点: %d < 最低要求: %d)", len(healthy), required)
 	}
 }
 
@@ -1362,50 +1545,63 @@ func (pm *ProxyManager) Next() string {
 	now := time.Now()
 	var selectedNode *ProxyNode
 	var selectedIdx int = -1
-
-	// 从健康节点列表中找第一个可用的
-	for i, node := range pm.healthyNodes {
+	// 近期真实请求失败过的可用节点，仅在没有其他可用节点时使用（取失败次数最少的）
+	var degraded *ProxyNode
+	available := func(node *ProxyNode) bool {
 		// 检查冷却时间
 		cooldown := node.UseCooldown
 		if cooldown == 0 {
 			cooldown = DefaultProxyUseCooldown
 		}
 		if now.Sub(node.LastUsed) < cooldown {
-			continue
+			return false
 		}
-		// 跳过失败次数过多的节点
-		if node.FailCount >= MaxProxyFailCount {
-			continue
+		// 跳过失败次数过多或已拉黑的节点
+		if node.FailCount >= MaxProxyFailCount || node.Blacklisted {
+			return false
+		}
+		if pm.recentlyFailedLocked(node, now) {
+			if degraded == nil || node.RecentFailures < degraded.RecentFailures {
+				degraded = node
+			}
+			return false
+		}
+		return true
+	}
+
+	// 从健康节点列表中找第一个可用的
+	for i, node := range pm.healthyNodes {
+		if available(node) {
+			selectedNode = node
+			selectedIdx = i
+			break
 		}
-		selectedNode = node
-		selectedIdx = i
-		break
 	}
 
 	// 如果健康节点都不可用，尝试普通节点
 	if selectedNode == nil {
 		for i, node := range pm.nodes {
-			cooldown := node.UseCooldown
-			if cooldown == 0 {
-				cooldown = DefaultProxyUseCooldown
-			}
-			if now.Sub(node.LastUsed) < cooldown {
-				continue
-			}
-			if node.FailCount >= MaxProxyFailCount {
-				continue
+			if available(node) {
+				selectedNode = node
+				selectedIdx = i
+				break
 			}
-			selectedNode = node
-			selectedIdx = i
-			break
 		}
 	}
 
+	// 可用节点都在近期失败过，选失败次数最少的
+	if selectedNode == nil && degraded != nil {
+		selectedNode = degraded
+	}
+
 	// 如果所有节点都在冷却中，选择最久未用的健康节点
 	if selectedNode == nil {
 		var oldest *ProxyNode
 		var oldestIdx int
 		for i, node := range pm.healthyNodes {
+			if node.Blacklisted {
+				continue
+			}
 			if oldest == nil || node.LastUsed.Before(oldest.LastUsed) {
 				oldest = node
 				oldestIdx = i
@@ -1413,6 +1609,9 @@ func (pm *ProxyManager) Next() string {
 		}
 		if oldest == nil {
 			for i, node := range pm.nodes {
+				if node.Blacklisted {
+					continue
+				}
 				if oldest == nil || node.LastUsed.Before(oldest.LastUsed) {
 					oldest = node
 					oldestIdx = i
@@ -1502,6 +1701,131 @@ func (pm *ProxyManager) MarkProxySuccess(proxyURL string) {
 	}
 }
 
+// nodeKey 节点标识（协议://host:port，不含凭据），用于账号粘性代理
+func nodeKey(node *ProxyNode) string {
+	if node == nil || node.Server == "" {
+		return ""
+	}
+	return node.Protocol + "://" + net.JoinHostPort(node.Server, strconv.Itoa(node.Port))
+}
+
+// NodeKey 返回代理实例对应的节点标识，非代理池实例返回空
+func (pm *ProxyManager) NodeKey(proxyURL string) string {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+	for _, inst := range pm.instancePool {
+		if inst.proxyURL == proxyURL {
+			return nodeKey(inst.node)
+		}
+	}
+	return ""
+}
+
+// NextPreferred 优先使用指定节点（需仍在健康列表且未超过失败上限），否则回退到 Next
+func (pm *ProxyManager) NextPreferred(key string) string {
+	if key != "" {
+		if proxyURL := pm.startPreferred(key); proxyURL != "" {
+			return proxyURL
+		}
+	}
+	return pm.Next()
+}
+
+func (pm *ProxyManager) startPreferred(key string) string {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	for _, node := range pm.healthyNodes {
+		if nodeKey(node) != key || node.FailCount >= MaxProxyFailCount || node.Blacklisted {
+			continue
+		}
+		// 粘性节点近期失败过时改由 Next 选择其他节点
+		if pm.recentlyFailedLocked(node, time.Now()) {
+			return ""
+		}
+		instance, err := pm.startInstanceLocked(node)
+		if err != nil {
+			log.Printf("⚠️ 启动粘性代理失败: %v", err)
+			node.FailCount++
+			return ""
+		}
+		node.LastUsed = time.Now()
+		instance.status = InstanceStatusInUse
+		pm.instancePool = append(pm.instancePool, instance)
+		return instance.proxyURL
+	}
+	return ""
+}
+
+// SetBlacklistPolicy 设置自动拉黑策略：至少 minRequests 次真实请求且失败率 >= rate 时拉黑（rate<=0 禁用）
+func (pm *ProxyManager) SetBlacklistPolicy(rate float64, minRequests int) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	pm.blacklistRate = rate
+	pm.blacklistMin = minRequests
+}
+
+// SetFailureWindow 设置真实请求失败后节点在 Next 中降权的时长（<=0 禁用降权）
+func (pm *ProxyManager) SetFailureWindow(window time.Duration) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+	pm.failureWindow = window
+}
+
+// recentlyFailedLocked 节点是否在降权窗口内有真实请求失败（调用方需持有锁）
+func (pm *ProxyManager) recentlyFailedLocked(node *ProxyNode, now time.Time) bool {
+	return pm.failureWindow > 0 && node.RecentFailures > 0 && now.Sub(node.LastFailure) < pm.failureWindow
+}
+
+// ReportResult 记录经该代理发出的真实请求结果：失败的节点在降权窗口内被 Next 避开（成功后清零），
+// 失败率过高的节点被拉黑直到下次全量健康检查
+func (pm *ProxyManager) ReportResult(proxyURL string, success bool) {
+	pm.mu.Lock()
+	defer pm.mu.Unlock()
+
+	var node *ProxyNode
+	for _, inst := range pm.instancePool {
+		if inst.proxyURL == proxyURL {
+			node = inst.node
+			break
+		}
+	}
+	if node == nil || node.Blacklisted {
+		return
+	}
+	if success {
+		node.ReqSuccess++
+		node.RecentFailures = 0
+	} else {
+		node.ReqFailure++
+		now := time.Now()
+		// 窗口已过期的旧失败不再累计
+		if !pm.recentlyFailedLocked(node, now) {
+			node.RecentFailures = 0
+		}
+		node.RecentFailures++
+		node.LastFailure = now
+	}
+	if pm.blacklistRate <= 0 {
+		return
+	}
+	total := node.ReqSuccess + node.ReqFailure
+	if total < pm.blacklistMin || float64(node.ReqFailure)/float64(total) < pm.blacklistRate {
+		return
+	}
+
+	node.Blacklisted = true
+	kept := make([]*ProxyNode, 0, len(pm.healthyNodes))
+	for _, n := range pm.healthyNodes {
+		if n != node {
+			kept = append(kept, n)
+		}
+	}
+	pm.healthyNodes = kept
+	log.Printf("🚫 代理节点已拉黑: %s (成功=%d, 失败=%d)，下次全量健康检查后恢复",
+		node.Name, node.ReqSuccess, node.ReqFailure)
+}
+
 // PoolStats 返回实例池统计
 func (pm *ProxyManager) PoolStats() map[string]int {
 	pm.mu.RLock()
@@ -1549,13 +1873,110 @@ func (pm *ProxyManager) TotalCount() int {
 	return len(pm.nodes)
 }
 
+// NodeStatus 代理节点状态快照（服务器地址已脱敏，不含凭据）
+type NodeStatus struct {
+	Name      string    `json:"name"`
+	Protocol  string    `json:"protocol"`
+	Server    string    `json:"server"` // 脱敏后的 host:port
+	Healthy   bool      `json:"healthy"`
+	InUse     bool      `json:"in_use"` // 是否在当前健康节点轮换中
+	LatencyMs int64     `json:"latency_ms"`
+	LastCheck time.Time `json:"last_check,omitempty"`
+	FailCount int       `json:"fail_count"`
+
+	// 真实请求统计与拉黑状态
+	ReqSuccess  int  `json:"req_success"`
+	ReqFailure  int  `json:"req_failure"`
+	Blacklisted bool `json:"blacklisted"`
+
+	// 近期失败与降权状态
+	RecentFailures int       `json:"recent_failures"`
+	LastFailure    time.Time `json:"last_failure,omitempty"`
+	Deprioritized  bool      `json:"deprioritized"` // 降权窗口内，Next 优先选择其他节点
+}
+
+// Nodes 返回全部节点的状态快照
+func (pm *ProxyManager) Nodes() []NodeStatus {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+	active := make(map[*ProxyNode]bool, len(pm.healthyNodes))
+	for _, n := range pm.healthyNodes {
+		active[n] = true
+	}
+	now := time.Now()
+	out := make([]NodeStatus, 0, len(pm.nodes))
+	for _, n := range pm.nodes {
+		out = append(out, NodeStatus{
+			Name:      n.Name,
+			Protocol:  n.Protocol,
+			Server:    MaskServer(n.Server, n.Port),
+			Healthy:   n.Healthy,
+			InUse:     active[n],
+			LatencyMs: n.Latency.Milliseconds(),
+			LastCheck: n.LastCheck,
+			FailCount: n.FailCount,
+
+			ReqSuccess:  n.ReqSuccess,
+			ReqFailure:  n.ReqFailure,
+			Blacklisted: n.Blacklisted,
+
+			RecentFailures: n.RecentFailures,
+			LastFailure:    n.LastFailure,
+			Deprioritized:  pm.recentlyFailedLocked(n, now),
+		})
+	}
+	return out
+}
+
+// LastUpdate 返回节点列表最后加载时间
+func (pm *ProxyManager) LastUpdate() time.Time {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+	return pm.lastUpdate
+}
+
+// IsHealthChecking 是否正在进行健康检查
+func (pm *ProxyManager) IsHealthChecking() bool {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+	return pm.healthChecking
+}
+
+// MaskServer 脱敏服务器地址：IPv4 保留前两段，域名只保留首字符和上级域名
+func MaskServer(server string, port int) string {
+	host := server
+	if ip := net.ParseIP(server); ip != nil {
+		if v4 := ip.To4(); v4 != nil {
+			host = fmt.Sprintf("%d.%d.*.*", v4[0], v4[1])
+		} else {
+			host = "***"
+		}
+	} else if idx := strings.Index(server, "."); idx > 0 {
+		host = server[:1] + "***" + server[idx:]
+	} else if server != "" {
+		host = server[:1] + "***"
+	}
+	if port > 0 {
+		return net.JoinHostPort(host, strconv.Itoa(port))
+	}
+	return host
+}
+
 // StartAutoUpdate 启动自动更新和健康检查
 func (pm *ProxyManager) StartAutoUpdate() {
+	pm.mu.Lock()
+	if pm.autoUpdating {
+		pm.mu.Unlock()
+		return
+	}
+	pm.autoUpdating = true
+	pm.mu.Unlock()
+
 	// 自动更新订阅
 	go func() {
 		for {
 			time.Sleep(pm.updateInterval)
-			if len(pm.subscribeURLs) > 0 || len(pm.proxyFiles) > 0 {
+			if subscribes, files := pm.Sources(); len(subscribes) > 0 || len(files) > 0 {
 				if err := pm.LoadAll(); err != nil {
 					log.Printf("⚠️ 自动更新代理失败: %v", err)
 				}
@@ -1588,6 +2009,8 @@ func (pm *ProxyManager) SetProxies(proxies []string) {
 	pm.mu.Lock()
 	pm.nodes = nodes
 	pm.healthyNodes = nodes // 假设都健康
+	pm.ready = len(nodes) >= pm.requiredHealthyLocked()
+	pm.readyCond.Broadcast()
 	pm.mu.Unlock()
 	log.Printf("✅ 代理池已设置 %d 个代理", len(nodes))
 }
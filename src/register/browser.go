@@ -43,6 +43,12 @@ var (
 	}
 )
 
+// ProxyKeyOf 返回代理实例对应的节点标识，注册成功后写入账号文件用于粘性代理
+var ProxyKeyOf func(proxyURL string) string
+
+// ReportProxyResult 上报经代理池代理发出的注册请求结果（用于自动拉黑失败率过高的节点）
+var ReportProxyResult func(proxyURL string, success bool)
+
 // SetHTTPClient 设置HTTP客户端
 func SetHTTPClient(c *http.Client) {
 	httpClient = c
@@ -97,6 +103,7 @@ type BrowserRegisterResult struct {
 	Cookies       []pool.Cookie
 	ConfigID      string
 	CSESIDX       string
+	ProxyKey      string // 注册所用代理节点标识
 	Error         error
 }
 
@@ -3208,6 +3215,7 @@ func SaveBrowserRegisterResult(result *BrowserRegisterResult, dataDir string) er
 		Cookies:       result.Cookies,
 		ConfigID:      result.ConfigID,
 		CSESIDX:       result.CSESIDX,
+		ProxyKey:      result.ProxyKey,
 		Timestamp:     time.Now().Format(time.RFC3339),
 	}
 
@@ -3216,9 +3224,9 @@ func SaveBrowserRegisterResult(result *BrowserRegisterResult, dataDir string) er
 		return fmt.Errorf("序列化失败: %w", err)
 	}
 
-	filename := filepath.Join(dataDir, fmt.Sprintf("%s.json", result.Email))
-	if err := os.WriteFile(filename, jsonData, 0644); err != nil {
-		return fmt.Errorf("写入文件失败: %w", err)
+	filename := filepath.Join(dataDir, pool.AccountFileName(result.Email))
+	if err := pool.WriteAccountFile(filename, jsonData); err != nil {
+		return err
 	}
 
 	return nil
@@ -3731,12 +3739,24 @@ func NativeRegisterWorker(id int, dataDirAbs string) {
 			currentProxy = GetProxy()
 		}
 		logger.Debug("[注册线程 %d] 启动注册任务, 代理: %s", id, currentProxy)
+		proxyKey := ""
+		if ProxyKeyOf != nil {
+			proxyKey = ProxyKeyOf(currentProxy)
+		}
 
 		result := RunBrowserRegister(Headless, currentProxy, id)
+		if result.Success {
+			result.ProxyKey = proxyKey
+		}
 
-		// 释放代理
-		if ReleaseProxy != nil && currentProxy != "" && currentProxy != Proxy {
-			ReleaseProxy(currentProxy)
+		// 上报结果并释放代理
+		if currentProxy != "" && currentProxy != Proxy {
+			if ReportProxyResult != nil {
+				ReportProxyResult(currentProxy, result.Success)
+			}
+			if ReleaseProxy != nil {
+				ReleaseProxy(currentProxy)
+			}
 		}
 
 		if result.Success {
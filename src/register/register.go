@@ -156,18 +156,21 @@ func StartRegister(count int) error {
 	return nil
 }
 
-// PoolMaintainer 号池维护器
-func PoolMaintainer() {
+// maintainInterval 号池检查间隔，每轮重新读取以支持热重载
+func maintainInterval() time.Duration {
 	interval := CheckInterval
 	if interval < time.Minute {
 		interval = 30 * time.Minute
 	}
+	return interval
+}
 
-	ticker := time.NewTicker(interval)
-	defer ticker.Stop()
+// PoolMaintainer 号池维护器
+func PoolMaintainer() {
 	CheckAndMaintainPool()
 
-	for range ticker.C {
+	for {
+		time.Sleep(maintainInterval())
 		CheckAndMaintainPool()
 	}
 }
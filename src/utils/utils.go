@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"bufio"
 	"bytes"
 	"compress/gzip"
 	"crypto/tls"
@@ -54,16 +55,94 @@ func InitHTTPClient(proxy string) {
 
 // ReadResponseBody 读取 HTTP 响应体（支持 gzip）
 func ReadResponseBody(resp *http.Response) ([]byte, error) {
-	var reader io.Reader = resp.Body
+	reader, err := ResponseBodyReader(resp)
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(reader)
+}
+
+// ResponseBodyReader 返回响应体读取器，gzip 编码时自动解压（关闭仍由 resp.Body 负责）
+func ResponseBodyReader(resp *http.Response) (io.Reader, error) {
 	if resp.Header.Get("Content-Encoding") == "gzip" {
-		gzReader, err := gzip.NewReader(resp.Body)
+		return gzip.NewReader(resp.Body)
+	}
+	return resp.Body, nil
+}
+
+// JSONStreamDecoder 增量解析 JSON 数组或 NDJSON 流，每读到一个完整对象即返回
+// 已读取的原始字节会保留，解析失败时可交给 ParseIncompleteJSONArray/ParseNDJSON 兜底
+type JSONStreamDecoder struct {
+	raw     bytes.Buffer
+	src     *bufio.Reader
+	dec     *json.Decoder
+	started bool
+	inArray bool
+}
+
+// NewJSONStreamDecoder 创建增量解析器
+func NewJSONStreamDecoder(r io.Reader) *JSONStreamDecoder {
+	d := &JSONStreamDecoder{}
+	d.src = bufio.NewReader(io.TeeReader(r, &d.raw))
+	d.dec = json.NewDecoder(d.src)
+	return d
+}
+
+// Next 返回下一个完整对象；流正常结束返回 io.EOF，数组未闭合返回 io.ErrUnexpectedEOF
+func (d *JSONStreamDecoder) Next() (map[string]interface{}, error) {
+	if !d.started {
+		d.started = true
+		first, err := d.peekNonSpace()
 		if err != nil {
 			return nil, err
 		}
-		defer gzReader.Close()
-		reader = gzReader
+		if first == '[' {
+			if _, err := d.dec.Token(); err != nil {
+				return nil, err
+			}
+			d.inArray = true
+		}
+	}
+	if d.inArray && !d.dec.More() {
+		if _, err := d.dec.Token(); err != nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, io.EOF
+	}
+	var obj map[string]interface{}
+	if err := d.dec.Decode(&obj); err != nil {
+		if d.inArray && err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return obj, nil
+}
+
+// Raw 返回目前已读取的原始字节
+func (d *JSONStreamDecoder) Raw() []byte {
+	return d.raw.Bytes()
+}
+
+// Drain 读完剩余数据并返回完整的原始字节
+func (d *JSONStreamDecoder) Drain() []byte {
+	io.Copy(io.Discard, d.src)
+	return d.raw.Bytes()
+}
+
+func (d *JSONStreamDecoder) peekNonSpace() (byte, error) {
+	for {
+		b, err := d.src.Peek(1)
+		if err != nil {
+			return 0, err
+		}
+		switch b[0] {
+		case ' ', '\t', '\r', '\n':
+			d.src.ReadByte()
+		default:
+			return b[0], nil
+		}
 	}
-	return io.ReadAll(reader)
 }
 
 // ParseNDJSON 解析 NDJSON 格式数据
@@ -0,0 +1,66 @@
+package utils
+
+import (
+	"io"
+	"testing"
+)
+
+// chunkedReader 每次 Read 只返回一段，模拟上游分块到达
+type chunkedReader struct {
+	chunks []string
+	reads  int
+}
+
+func (r *chunkedReader) Read(p []byte) (int, error) {
+	if r.reads >= len(r.chunks) {
+		return 0, io.EOF
+	}
+	n := copy(p, r.chunks[r.reads])
+	r.reads++
+	return n, nil
+}
+
+func TestJSONStreamDecoderYieldsObjectsAsTheyArrive(t *testing.T) {
+	src := &chunkedReader{chunks: []string{` [{"a":1}`, `,{"a":`, `2}`, `]`}}
+	d := NewJSONStreamDecoder(src)
+
+	obj, err := d.Next()
+	if err != nil || obj["a"] != float64(1) {
+		t.Fatalf("first object: %v %v", obj, err)
+	}
+	if src.reads != 1 {
+		t.Fatalf("first object should be returned after one chunk, read %d", src.reads)
+	}
+	if obj, err = d.Next(); err != nil || obj["a"] != float64(2) {
+		t.Fatalf("second object: %v %v", obj, err)
+	}
+	if _, err = d.Next(); err != io.EOF {
+		t.Fatalf("expected io.EOF at array end, got %v", err)
+	}
+	if string(d.Raw()) != ` [{"a":1},{"a":2}]` {
+		t.Fatalf("raw bytes not kept: %q", d.Raw())
+	}
+}
+
+func TestJSONStreamDecoderNDJSONAndTruncatedArray(t *testing.T) {
+	d := NewJSONStreamDecoder(&chunkedReader{chunks: []string{"{\"a\":1}\n", "{\"a\":2}\n"}})
+	for i := 1; i <= 2; i++ {
+		if obj, err := d.Next(); err != nil || obj["a"] != float64(i) {
+			t.Fatalf("ndjson object %d: %v %v", i, obj, err)
+		}
+	}
+	if _, err := d.Next(); err != io.EOF {
+		t.Fatalf("expected io.EOF after ndjson, got %v", err)
+	}
+
+	d = NewJSONStreamDecoder(&chunkedReader{chunks: []string{`[{"a":1},{"a":`}})
+	if _, err := d.Next(); err != nil {
+		t.Fatalf("first object: %v", err)
+	}
+	if _, err := d.Next(); err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected io.ErrUnexpectedEOF for truncated array, got %v", err)
+	}
+	if got := ParseIncompleteJSONArray(d.Drain()); len(got) != 1 {
+		t.Fatalf("fallback should recover the complete object, got %v", got)
+	}
+}
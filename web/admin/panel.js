@@ -7,6 +7,7 @@
     accounts: [],
     accountsPage: 1,
     accountsPageSize: 10,
+    accountsTotalPage: 1,
     filePage: 1,
     filePageSize: 20,
     fileTotalPage: 1,
@@ -62,6 +63,7 @@
     reloadPoolBtn: document.getElementById("reloadPoolBtn"),
     triggerRegisterBtn: document.getElementById("triggerRegisterBtn"),
     registerCountInput: document.getElementById("registerCountInput"),
+    bulkBrowserRefreshBtn: document.getElementById("bulkBrowserRefreshBtn"),
     refreshAllBtn: document.getElementById("refreshAllBtn"),
 
     accountStateFilter: document.getElementById("accountStateFilter"),
@@ -364,20 +366,13 @@
       state: els.accountStateFilter.value,
       status: els.accountStatusFilter.value,
       q: els.accountQFilter.value,
+      page: String(state.accountsPage),
+      page_size: String(state.accountsPageSize),
     });
     const data = await panelFetch(`/admin/accounts?${params.toString()}`);
-    state.accounts = Array.isArray(data.items) ? data.items : [];
-    state.accountsPage = 1;
-    renderAccounts();
-  }
-
-  function renderAccounts() {
-    const total = state.accounts.length;
-    const totalPage = Math.max(1, Math.ceil(total / state.accountsPageSize));
-    state.accountsPage = Math.min(Math.max(1, state.accountsPage), totalPage);
+    const rows = Array.isArray(data.items) ? data.items : [];
+    state.accountsTotalPage = Math.max(1, data.total_page || 1);
 
-    const start = (state.accountsPage - 1) * state.accountsPageSize;
-    const rows = state.accounts.slice(start, start + state.accountsPageSize);
     els.accountsBody.innerHTML = rows
       .map((item) => {
         const validTag = item.is_valid
@@ -398,7 +393,7 @@
     if (!rows.length) {
       els.accountsBody.innerHTML = '<tr><td colspan="7">暂无数据</td></tr>';
     }
-    els.accountsPageInfo.textContent = `第 ${state.accountsPage} / ${totalPage} 页，共 ${total} 条`;
+    els.accountsPageInfo.textContent = `第 ${data.page || state.accountsPage} / ${state.accountsTotalPage} 页，共 ${data.total || 0} 条`;
   }
 
   async function loadFiles() {
@@ -679,6 +674,55 @@
     }
   }
 
+  async function bulkBrowserRefresh() {
+    const headers = { "Content-Type": "application/json" };
+    if (state.apiKey) {
+      headers.Authorization = `Bearer ${state.apiKey}`;
+    }
+
+    const resp = await fetch("/admin/browser-refresh/bulk?stream=1", {
+      method: "POST",
+      headers,
+      body: "{}",
+      credentials: "same-origin",
+    });
+    if (!resp.ok) {
+      const text = await resp.text();
+      throw new Error(formatError(resp.status, parseResponsePayload(text)));
+    }
+
+    els.bulkBrowserRefreshBtn.disabled = true;
+    try {
+      const reader = resp.body.getReader();
+      const decoder = new TextDecoder();
+      let buffer = "";
+      for (;;) {
+        const { value, done } = await reader.read();
+        if (done) {
+          break;
+        }
+        buffer += decoder.decode(value, { stream: true });
+        let idx;
+        while ((idx = buffer.indexOf("\n\n")) >= 0) {
+          const block = buffer.slice(0, idx);
+          buffer = buffer.slice(idx + 2);
+          const event = (block.match(/^event: (.*)$/m) || [])[1];
+          const data = parseResponsePayload((block.match(/^data: (.*)$/m) || [])[1] || "");
+          if (event === "start") {
+            els.bulkBrowserRefreshBtn.textContent = `批量浏览器刷新 0/${data.total}`;
+          } else if (event === "progress") {
+            els.bulkBrowserRefreshBtn.textContent = `批量浏览器刷新 ${data.done}/${data.total}`;
+          } else if (event === "done") {
+            appendLog(els.actionLog, `批量浏览器刷新完成：成功 ${data.success}，失败 ${data.failed}`, data.results || []);
+          }
+        }
+      }
+    } finally {
+      els.bulkBrowserRefreshBtn.disabled = false;
+      els.bulkBrowserRefreshBtn.textContent = "批量浏览器刷新";
+    }
+  }
+
   async function reloadPool() {
     const data = await panelFetch("/admin/refresh", { method: "POST", body: "{}" });
     appendLog(els.actionLog, "号池已刷新", data);
@@ -882,6 +926,14 @@
       }
     });
 
+    els.bulkBrowserRefreshBtn.addEventListener("click", async () => {
+      try {
+        await bulkBrowserRefresh();
+      } catch (err) {
+        appendLog(els.actionLog, "批量浏览器刷新失败", err.message);
+      }
+    });
+
     els.refreshAllBtn.addEventListener("click", async () => {
       try {
         await refreshAll();
@@ -891,6 +943,7 @@
     });
 
     els.applyAccountFilterBtn.addEventListener("click", async () => {
+      state.accountsPage = 1;
       try {
         await loadAccounts();
       } catch (err) {
@@ -898,14 +951,24 @@
       }
     });
 
-    els.accountsPrevBtn.addEventListener("click", () => {
+    els.accountsPrevBtn.addEventListener("click", async () => {
+      if (state.accountsPage <= 1) return;
       state.accountsPage -= 1;
-      renderAccounts();
+      try {
+        await loadAccounts();
+      } catch (err) {
+        appendLog(els.actionLog, "翻页失败", err.message);
+      }
     });
 
-    els.accountsNextBtn.addEventListener("click", () => {
+    els.accountsNextBtn.addEventListener("click", async () => {
+      if (state.accountsPage >= state.accountsTotalPage) return;
       state.accountsPage += 1;
-      renderAccounts();
+      try {
+        await loadAccounts();
+      } catch (err) {
+        appendLog(els.actionLog, "翻页失败", err.message);
+      }
     });
 
     els.applyFileFilterBtn.addEventListener("click", async () => {